@@ -37,7 +37,7 @@ type Review struct {
 func CreateBorrow(userID, bookLocationID int, deliveryType string) (int, error) {
 	result, err := db.Exec(`
 		INSERT INTO borrow (user_id, book_location_id, borrow_date, status, delivery_type)
-		VALUES (?, ?, NOW(), 'pending', ?)
+		VALUES (?, ?, NOW(), 'requested', ?)
 	`, userID, bookLocationID, deliveryType)
 	if err != nil {
 		return 0, err
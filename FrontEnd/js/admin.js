@@ -2,6 +2,12 @@
 
 const API_BASE = "http://localhost:8080/api"
 
+// staffHeaders identifies the logged-in admin to the borrow endpoints
+function staffHeaders() {
+  const user = JSON.parse(localStorage.getItem("user") || "{}")
+  return { "X-User-ID": user.user_id }
+}
+
 document.addEventListener("DOMContentLoaded", () => {
   loadDashboardStats()
   loadPendingBorrows()
@@ -20,8 +26,8 @@ async function loadDashboardStats() {
     // Load pending borrows
     const borrowsRes = await fetch(`${API_BASE}/borrows`)
     const borrows = await borrowsRes.json()
-    const pending = borrows.filter((b) => b.status === "pending").length
-    const active = borrows.filter((b) => b.status === "approved" || b.status === "borrowed").length
+    const pending = borrows.filter((b) => b.status === "requested").length
+    const active = borrows.filter((b) => b.status === "on_loan").length
 
     document.getElementById("pendingBorrows").textContent = pending
     document.getElementById("activeBorrows").textContent = active
@@ -34,7 +40,7 @@ async function loadPendingBorrows() {
   try {
     const res = await fetch(`${API_BASE}/borrows`)
     const borrows = await res.json()
-    const pending = borrows.filter((b) => b.status === "pending")
+    const pending = borrows.filter((b) => b.status === "requested")
 
     const tbody = document.getElementById("borrowsTable")
     tbody.innerHTML = ""
@@ -72,6 +78,7 @@ async function approveBorrow(borrowId) {
   try {
     const res = await fetch(`${API_BASE}/borrows/${borrowId}/approve`, {
       method: "PUT",
+      headers: staffHeaders(),
     })
     const data = await res.json()
     if (data.success) {
@@ -88,6 +95,7 @@ async function rejectBorrow(borrowId) {
   try {
     const res = await fetch(`${API_BASE}/borrows/${borrowId}/reject`, {
       method: "PUT",
+      headers: staffHeaders(),
     })
     const data = await res.json()
     if (data.success) {
@@ -103,4 +111,4 @@ async function rejectBorrow(borrowId) {
 document.querySelector(".logout-btn").addEventListener("click", () => {
   localStorage.removeItem("user")
   window.location.href = "login.html"
-})
+})
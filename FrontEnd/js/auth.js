@@ -18,6 +18,7 @@ if (loginForm) {
       const data = await response.json()
       // Store user data in localStorage
       localStorage.setItem("user", JSON.stringify(data.user))
+      await mergeLocalCart(data.user.user_id)
       showNotification("Login successful! Redirecting...", "success")
       setTimeout(() => {
         if (data.user.role === "admin") {
@@ -32,6 +33,27 @@ if (loginForm) {
   })
 }
 
+// Move any cart kept in the browser before carts were stored server-side
+async function mergeLocalCart(userId) {
+  const cartKey = `libmatch_cart_${userId}`
+  const savedCart = localStorage.getItem(cartKey)
+  if (!savedCart) return
+
+  try {
+    const items = JSON.parse(savedCart).map((item) => ({ book_id: item.book_id }))
+    const response = await fetch(`${API_URL}/cart/merge`, {
+      method: "POST",
+      headers: { "Content-Type": "application/json", "X-User-ID": userId },
+      body: JSON.stringify({ items }),
+    })
+    if (response.ok) {
+      localStorage.removeItem(cartKey)
+    }
+  } catch (error) {
+    console.error("Error merging cart:", error)
+  }
+}
+
 // Register Form Handler
 const registerForm = document.getElementById("registerForm")
 if (registerForm) {
@@ -239,3 +261,42 @@ if (document.readyState === "loading") {
 } else {
   loadUserProfileImage()
 }
+
+// Show the unread notification count on pages with a notification badge
+async function loadNotificationBadge() {
+  const badge = document.getElementById("notificationCount")
+  const user = getCurrentUser()
+  if (!badge || !user) return
+
+  try {
+    const response = await fetch(`${API_URL}/notifications/unread-count`, {
+      headers: { "X-User-ID": user.user_id },
+    })
+    if (!response.ok) return
+    const data = await response.json()
+    badge.textContent = data.unread_count
+    badge.style.display = data.unread_count > 0 ? "inline-block" : "none"
+  } catch (error) {
+    console.error("Error loading notifications:", error)
+  }
+}
+
+// Subscribe to the live event stream; handlers maps event types to callbacks.
+// EventSource reconnects on its own and resumes from the last event it saw.
+function subscribeToEvents(handlers) {
+  const user = getCurrentUser()
+  if (!user || !window.EventSource) return null
+
+  const source = new EventSource(`${API_URL}/events/stream?user_id=${user.user_id}`)
+  source.addEventListener("notification", loadNotificationBadge)
+  Object.entries(handlers || {}).forEach(([type, handler]) => {
+    source.addEventListener(type, (event) => handler(JSON.parse(event.data)))
+  })
+  return source
+}
+
+if (document.readyState === "loading") {
+  document.addEventListener("DOMContentLoaded", loadNotificationBadge)
+} else {
+  loadNotificationBadge()
+}
@@ -1,10 +1,16 @@
 // Borrow Management JavaScript
 
 const API_BASE = "http://localhost:8080/api"
-let currentTab = "pending"
+
+// staffHeaders identifies the logged-in admin to the borrow endpoints
+function staffHeaders() {
+  const user = JSON.parse(localStorage.getItem("user") || "{}")
+  return { "X-User-ID": user.user_id }
+}
+let currentTab = "requested"
 
 document.addEventListener("DOMContentLoaded", () => {
-  loadBorrowsByStatus("pending")
+  loadBorrowsByStatus("requested")
 })
 
 function switchTab(tab) {
@@ -29,7 +35,7 @@ async function loadBorrowsByStatus(status) {
     tbody.innerHTML = ""
 
     if (filtered.length === 0) {
-      const cols = status === "pending" || status === "approved" ? 6 : status === "borrowed" ? 5 : 5
+      const cols = status === "requested" || status === "approved" ? 6 : status === "on_loan" ? 5 : 5
       tbody.innerHTML = `<tr><td colspan="${cols}" style="text-align: center; color: #999;">Tidak ada data</td></tr>`
       return
     }
@@ -42,14 +48,14 @@ async function loadBorrowsByStatus(status) {
                 <td>${borrow.book_title}</td>
             `
 
-      if (status === "pending" || status === "approved") {
+      if (status === "requested" || status === "approved") {
         html += `
                     <td>${borrow.delivery_type}</td>
                     <td>${new Date(borrow.borrow_date).toLocaleDateString("id-ID")}</td>
                     <td>
                         <div class="action-buttons">
                             ${
-                              status === "pending"
+                              status === "requested"
                                 ? `
                                 <button class="btn-small btn-approve" onclick="approveBorrow(${borrow.borrow_id})">Setujui</button>
                                 <button class="btn-small btn-reject" onclick="rejectBorrow(${borrow.borrow_id})">Tolak</button>
@@ -61,7 +67,7 @@ async function loadBorrowsByStatus(status) {
                         </div>
                     </td>
                 `
-      } else if (status === "borrowed") {
+      } else if (status === "on_loan") {
         html += `
                     <td>${new Date(borrow.borrow_date).toLocaleDateString("id-ID")}</td>
                     <td>
@@ -87,6 +93,7 @@ async function approveBorrow(borrowId) {
   try {
     const res = await fetch(`${API_BASE}/borrows/${borrowId}/approve`, {
       method: "PUT",
+      headers: staffHeaders(),
     })
     const data = await res.json()
     if (data.success) {
@@ -103,6 +110,7 @@ async function rejectBorrow(borrowId) {
   try {
     const res = await fetch(`${API_BASE}/borrows/${borrowId}/reject`, {
       method: "PUT",
+      headers: staffHeaders(),
     })
     const data = await res.json()
     if (data.success) {
@@ -119,6 +127,7 @@ async function returnBook(borrowId) {
   try {
     const res = await fetch(`${API_BASE}/borrows/${borrowId}/return`, {
       method: "PUT",
+      headers: staffHeaders(),
     })
     const data = await res.json()
     if (data.success) {
@@ -134,4 +143,4 @@ async function returnBook(borrowId) {
 document.querySelector(".logout-btn").addEventListener("click", () => {
   localStorage.removeItem("user")
   window.location.href = "login.html"
-})
+})
@@ -39,7 +39,7 @@ function displayTransactions(transactions) {
             <td><span class="status-badge ${statusClass}">${trans.status}</span></td>
             <td>${trans.delivery_type}</td>
             <td>
-                ${trans.status === "borrowed" ? `<button class="btn btn-success" onclick="returnTransaction(${trans.transaction_id})">Kembalikan</button>` : "-"}
+                ${trans.status === "on_loan" ? `<button class="btn btn-success" onclick="returnTransaction(${trans.transaction_id})">Kembalikan</button>` : "-"}
             </td>
         `
     tbody.appendChild(row)
@@ -21,7 +21,7 @@ document.addEventListener("DOMContentLoaded", async () => {
     const borrows = await borrowResponse.json()
 
     // Calculate stats
-    const borrowed = borrows.filter((t) => t.status === "borrowed").length
+    const borrowed = borrows.filter((t) => t.status === "on_loan").length
     const returned = borrows.filter((t) => t.status === "returned").length
     const total = borrows.length
 
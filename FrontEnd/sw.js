@@ -0,0 +1,15 @@
+// Service worker for web push. Pushes carry no payload, so show a generic alert that
+// opens the notification list.
+self.addEventListener("push", (event) => {
+  event.waitUntil(
+    self.registration.showNotification("LibMatch", {
+      body: "You have a new notification",
+      data: { url: "/FrontEnd/notifications.html" },
+    })
+  )
+})
+
+self.addEventListener("notificationclick", (event) => {
+  event.notification.close()
+  event.waitUntil(clients.openWindow(event.notification.data.url))
+})
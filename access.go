@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// ============ ACCESS HELPERS ============
+
+// actingUserID identifies the caller from the X-User-ID header, falling back to the user_id query parameter.
+// The frontend keeps the logged-in user in localStorage, so this is the same trust level as the rest of the API.
+func actingUserID(r *http.Request) int {
+	raw := r.Header.Get("X-User-ID")
+	if raw == "" {
+		raw = r.URL.Query().Get("user_id")
+	}
+	id, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0
+	}
+	return id
+}
+
+// requireAdmin writes an error response and returns false unless the caller is an admin.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	userID := actingUserID(r)
+	if userID == 0 {
+		http.Error(w, "Missing user identity", http.StatusUnauthorized)
+		return false
+	}
+
+	user, err := GetUserByID(userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return false
+	}
+	if user == nil || user.Role != "admin" {
+		http.Error(w, "Admin access required", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// requireOwnerOrAdmin writes an error response and returns false unless the caller is the member
+// ownerID or an admin.
+func requireOwnerOrAdmin(w http.ResponseWriter, r *http.Request, ownerID int) bool {
+	userID := actingUserID(r)
+	if userID == 0 {
+		http.Error(w, "Missing user identity", http.StatusUnauthorized)
+		return false
+	}
+	if userID == ownerID {
+		return true
+	}
+
+	user, err := GetUserByID(userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return false
+	}
+	if user == nil || user.Role != "admin" {
+		http.Error(w, "Only the member or an admin can access this", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// requireBorrowerOrAdmin writes an error response and returns false unless the caller made the
+// borrow or is an admin.
+func requireBorrowerOrAdmin(w http.ResponseWriter, r *http.Request, borrowID int) bool {
+	if actingUserID(r) == 0 {
+		http.Error(w, "Missing user identity", http.StatusUnauthorized)
+		return false
+	}
+
+	borrow, err := GetBorrowByID(borrowID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return false
+	}
+	if borrow == nil {
+		http.Error(w, "Borrow not found", http.StatusNotFound)
+		return false
+	}
+	return requireOwnerOrAdmin(w, r, borrow.UserID)
+}
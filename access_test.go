@@ -0,0 +1,57 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// userRows answers user lookups with the given roles, keyed by user ID.
+func userRows(query string, args []driver.Value, roles map[int64]string) (*fakeRows, bool) {
+	if !strings.Contains(query, "FROM user WHERE user_id = ?") {
+		return nil, false
+	}
+	id, _ := args[0].(int64)
+	role, ok := roles[id]
+	if !ok {
+		return nil, true
+	}
+	return fakeRow(id, "Member", "member@example.com", "", "", "", role, "", "standard"), true
+}
+
+func rolesResponder(roles map[int64]string) fakeResponder {
+	return func(query string, args []driver.Value) (*fakeRows, error) {
+		rows, _ := userRows(query, args, roles)
+		return rows, nil
+	}
+}
+
+func TestRequireOwnerOrAdmin(t *testing.T) {
+	useFakeDB(t, rolesResponder(map[int64]string{5: "member", 6: "member", 1: "admin"}))
+
+	tests := []struct {
+		caller string
+		want   int
+	}{
+		{"", http.StatusUnauthorized},
+		{"5", http.StatusOK},
+		{"1", http.StatusOK},
+		{"6", http.StatusForbidden},
+		{"99", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tt.caller != "" {
+			req.Header.Set("X-User-ID", tt.caller)
+		}
+		rec := httptest.NewRecorder()
+		if requireOwnerOrAdmin(rec, req, 5) {
+			rec.WriteHeader(http.StatusOK)
+		}
+		if rec.Code != tt.want {
+			t.Errorf("caller %q: status %d, want %d", tt.caller, rec.Code, tt.want)
+		}
+	}
+}
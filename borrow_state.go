@@ -0,0 +1,376 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============ BORROW LIFECYCLE ============
+
+const (
+	BorrowStatusRequested      = "requested"
+	BorrowStatusApproved       = "approved"
+	BorrowStatusDispatched     = "dispatched"
+	BorrowStatusReadyForPickup = "ready_for_pickup"
+	BorrowStatusOnLoan         = "on_loan"
+	BorrowStatusReturned       = "returned"
+	BorrowStatusRejected       = "rejected"
+	BorrowStatusCancelled      = "cancelled"
+	BorrowStatusLost           = "lost"
+)
+
+var (
+	ErrBorrowNotFound    = errors.New("borrow not found")
+	ErrInvalidTransition = errors.New("invalid borrow status transition")
+)
+
+// borrowTransitions lists, for every status, the statuses a borrow may move to next.
+// A dispatched parcel returned to sender goes back to approved to be shipped again or cancelled.
+var borrowTransitions = map[string][]string{
+	BorrowStatusRequested:      {BorrowStatusApproved, BorrowStatusRejected, BorrowStatusCancelled},
+	BorrowStatusApproved:       {BorrowStatusDispatched, BorrowStatusReadyForPickup, BorrowStatusCancelled},
+	BorrowStatusDispatched:     {BorrowStatusOnLoan, BorrowStatusApproved, BorrowStatusLost},
+	BorrowStatusReadyForPickup: {BorrowStatusOnLoan, BorrowStatusCancelled},
+	BorrowStatusOnLoan:         {BorrowStatusReturned, BorrowStatusLost},
+	BorrowStatusLost:           {BorrowStatusReturned},
+}
+
+// borrowStatusTimestamps maps a status to the borrow column stamped when it is entered.
+var borrowStatusTimestamps = map[string]string{
+	BorrowStatusApproved:       "approved_at",
+	BorrowStatusDispatched:     "dispatched_at",
+	BorrowStatusReadyForPickup: "ready_for_pickup_at",
+	BorrowStatusOnLoan:         "on_loan_at",
+	BorrowStatusReturned:       "return_date",
+	BorrowStatusRejected:       "rejected_at",
+	BorrowStatusCancelled:      "cancelled_at",
+	BorrowStatusLost:           "lost_at",
+}
+
+type BorrowStatusChange struct {
+	HistoryID  int       `json:"history_id"`
+	BorrowID   int       `json:"borrow_id"`
+	FromStatus *string   `json:"from_status"`
+	ToStatus   string    `json:"to_status"`
+	ChangedBy  *int      `json:"changed_by"`
+	Note       string    `json:"note"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// canTransitionBorrow reports whether a borrow with the given delivery type may move from one status to another.
+// Delivery borrows are dispatched, everything else is collected from a location.
+func canTransitionBorrow(from, to, deliveryType string) bool {
+	if to == BorrowStatusDispatched && deliveryType != "delivery" {
+		return false
+	}
+	if to == BorrowStatusReadyForPickup && deliveryType == "delivery" {
+		return false
+	}
+	for _, next := range borrowTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// nullableID turns a zero ID into SQL NULL.
+func nullableID(id int) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// sqlInList builds the "?, ?, ?" placeholder list and arguments for an IN clause.
+func sqlInList(values []string) (string, []interface{}) {
+	placeholders := make([]string, len(values))
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		placeholders[i] = "?"
+		args[i] = v
+	}
+	return strings.Join(placeholders, ", "), args
+}
+
+// recordBorrowStatusTx appends a row to the borrow's transition history.
+func recordBorrowStatusTx(tx *sql.Tx, borrowID int, from, to string, changedBy int, note string) error {
+	var fromValue interface{}
+	if from != "" {
+		fromValue = from
+	}
+	_, err := tx.Exec(`
+		INSERT INTO borrow_status_history (borrow_id, from_status, to_status, changed_by, note, created_at)
+		VALUES (?, ?, ?, ?, ?, NOW())
+	`, borrowID, fromValue, to, nullableID(changedBy), note)
+	return err
+}
+
+// transitionBorrowTx moves a borrow to a new status inside tx and returns the status it had before.
+func transitionBorrowTx(tx *sql.Tx, borrowID int, to string, changedBy int, note string) (string, error) {
+	// TransitionOrder locks the order before its borrows, so a single borrow must do the same
+	if err := lockBorrowOrderTx(tx, borrowID); err != nil {
+		return "", err
+	}
+
+	var from, deliveryType string
+	err := tx.QueryRow("SELECT status, COALESCE(delivery_type, '') FROM borrow WHERE borrow_id = ? FOR UPDATE", borrowID).
+		Scan(&from, &deliveryType)
+	if err == sql.ErrNoRows {
+		return "", ErrBorrowNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if !canTransitionBorrow(from, to, deliveryType) {
+		return from, fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, from, to)
+	}
+
+	if to == BorrowStatusApproved {
+		if err := checkBorrowPaidTx(tx, borrowID); err != nil {
+			return from, err
+		}
+	}
+	if to == BorrowStatusReadyForPickup {
+		if err := checkBorrowTransferTx(tx, borrowID); err != nil {
+			return from, err
+		}
+	}
+
+	column := borrowStatusTimestamps[to]
+	_, err = tx.Exec(fmt.Sprintf("UPDATE borrow SET status = ?, %s = NOW() WHERE borrow_id = ?", column), to, borrowID)
+	if err != nil {
+		return from, err
+	}
+	if err := emitBorrowStatusTx(tx, borrowID, from, to); err != nil {
+		return from, err
+	}
+
+	if to == BorrowStatusReturned || to == BorrowStatusLost {
+		if err := flagLateReturnTx(tx, borrowID); err != nil {
+			return from, err
+		}
+	}
+
+	if to == BorrowStatusReturned || to == BorrowStatusRejected || to == BorrowStatusCancelled {
+		if err := assignReturnedCopyTx(tx, borrowID); err != nil {
+			return from, err
+		}
+	}
+
+	switch to {
+	case BorrowStatusApproved:
+		if from != BorrowStatusRequested {
+			break
+		}
+		if err := notifyBorrowTx(tx, borrowID, EventBorrowApproved); err != nil {
+			return from, err
+		}
+	case BorrowStatusOnLoan:
+		if err := completePickupAppointmentTx(tx, borrowID); err != nil {
+			return from, err
+		}
+	case BorrowStatusReturned:
+		if err := releaseDepositTx(tx, borrowID); err != nil {
+			return from, err
+		}
+		if err := queueBorrowWebhookTx(tx, borrowID, WebhookBorrowReturned); err != nil {
+			return from, err
+		}
+	case BorrowStatusRejected, BorrowStatusCancelled:
+		if err := reverseBorrowChargeTx(tx, borrowID); err != nil {
+			return from, err
+		}
+		if err := releaseVoucherRedemptionTx(tx, "borrow_id", borrowID); err != nil {
+			return from, err
+		}
+		if err := cancelRequestedTransfersTx(tx, "borrow_id", borrowID); err != nil {
+			return from, err
+		}
+	}
+
+	if err := recordBorrowStatusTx(tx, borrowID, from, to, changedBy, note); err != nil {
+		return from, err
+	}
+	return from, syncOrderStatusTx(tx, borrowID, changedBy, note)
+}
+
+// TransitionBorrow moves a borrow to a new status, enforcing the lifecycle rules.
+func TransitionBorrow(borrowID int, to string, changedBy int, note string) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	from, err := transitionBorrowTx(tx, borrowID, to, changedBy, note)
+	if err != nil {
+		return from, err
+	}
+	return from, tx.Commit()
+}
+
+// GetBorrowHistory returns every status change of a borrow, oldest first.
+func GetBorrowHistory(borrowID int) ([]BorrowStatusChange, error) {
+	rows, err := db.Query(`
+		SELECT history_id, borrow_id, from_status, to_status, changed_by, COALESCE(note, ''), created_at
+		FROM borrow_status_history
+		WHERE borrow_id = ?
+		ORDER BY created_at, history_id
+	`, borrowID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []BorrowStatusChange{}
+	for rows.Next() {
+		var change BorrowStatusChange
+		var fromStatus sql.NullString
+		var changedBy sql.NullInt64
+		err := rows.Scan(&change.HistoryID, &change.BorrowID, &fromStatus, &change.ToStatus, &changedBy, &change.Note, &change.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if fromStatus.Valid {
+			change.FromStatus = &fromStatus.String
+		}
+		if changedBy.Valid {
+			id := int(changedBy.Int64)
+			change.ChangedBy = &id
+		}
+		history = append(history, change)
+	}
+	return history, nil
+}
+
+// writeBorrowTransitionError maps lifecycle errors onto HTTP status codes.
+func writeBorrowTransitionError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, ErrBorrowNotFound):
+		http.Error(w, "Borrow not found", http.StatusNotFound)
+	case errors.Is(err, ErrInvalidTransition), errors.Is(err, ErrTransferPending):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrPaymentRequired):
+		http.Error(w, err.Error(), http.StatusPaymentRequired)
+	default:
+		http.Error(w, fallback, http.StatusInternalServerError)
+	}
+}
+
+// handleBorrowTransition reads the optional {note} body and applies a fixed transition on behalf
+// of the caller. Callers check that the caller may make the transition.
+func handleBorrowTransition(w http.ResponseWriter, r *http.Request, to, failure, success string) {
+	vars := mux.Vars(r)
+	borrowID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid borrow ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Note string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	from, err := TransitionBorrow(borrowID, to, actingUserID(r), req.Note)
+	if err != nil {
+		writeBorrowTransitionError(w, err, failure)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"message":     success,
+		"borrow_id":   borrowID,
+		"from_status": from,
+		"status":      to,
+	})
+}
+
+// updateBorrowStatus lets an admin move a borrow to any status allowed by the lifecycle.
+func updateBorrowStatus(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	vars := mux.Vars(r)
+	borrowID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid borrow ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Status string `json:"status"`
+		Note   string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := borrowStatusTimestamps[req.Status]; !ok {
+		http.Error(w, "Unknown borrow status", http.StatusBadRequest)
+		return
+	}
+
+	from, err := TransitionBorrow(borrowID, req.Status, actingUserID(r), req.Note)
+	if err != nil {
+		writeBorrowTransitionError(w, err, "Failed to update borrow status")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"message":     "Borrow status updated successfully",
+		"borrow_id":   borrowID,
+		"from_status": from,
+		"status":      req.Status,
+	})
+}
+
+// cancelBorrow lets the borrower or an admin withdraw a borrow.
+func cancelBorrow(w http.ResponseWriter, r *http.Request) {
+	borrowID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid borrow ID", http.StatusBadRequest)
+		return
+	}
+	if !requireBorrowerOrAdmin(w, r, borrowID) {
+		return
+	}
+	handleBorrowTransition(w, r, BorrowStatusCancelled, "Failed to cancel borrow", "Borrow cancelled successfully")
+}
+
+func getBorrowHistory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	borrowID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid borrow ID", http.StatusBadRequest)
+		return
+	}
+
+	history, err := GetBorrowHistory(borrowID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestCanTransitionBorrow(t *testing.T) {
+	tests := []struct {
+		from, to, deliveryType string
+		want                   bool
+	}{
+		{BorrowStatusRequested, BorrowStatusApproved, "pickup", true},
+		{BorrowStatusRequested, BorrowStatusRejected, "pickup", true},
+		{BorrowStatusRequested, BorrowStatusOnLoan, "pickup", false},
+		{BorrowStatusApproved, BorrowStatusDispatched, "delivery", true},
+		{BorrowStatusApproved, BorrowStatusDispatched, "pickup", false},
+		{BorrowStatusApproved, BorrowStatusReadyForPickup, "pickup", true},
+		{BorrowStatusApproved, BorrowStatusReadyForPickup, "delivery", false},
+		{BorrowStatusDispatched, BorrowStatusApproved, "delivery", true},
+		{BorrowStatusDispatched, BorrowStatusOnLoan, "delivery", true},
+		{BorrowStatusOnLoan, BorrowStatusReturned, "pickup", true},
+		{BorrowStatusLost, BorrowStatusReturned, "delivery", true},
+		{BorrowStatusReturned, BorrowStatusOnLoan, "pickup", false},
+		{BorrowStatusRejected, BorrowStatusApproved, "pickup", false},
+		{BorrowStatusCancelled, BorrowStatusApproved, "pickup", false},
+	}
+	for _, tt := range tests {
+		if got := canTransitionBorrow(tt.from, tt.to, tt.deliveryType); got != tt.want {
+			t.Errorf("canTransitionBorrow(%q, %q, %q) = %v, want %v", tt.from, tt.to, tt.deliveryType, got, tt.want)
+		}
+	}
+}
+
+func TestBorrowTransitionsRequireIdentity(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc("/api/borrows/{id}/approve", approveBorrow).Methods("PUT")
+	router.HandleFunc("/api/borrows/{id}/reject", rejectBorrow).Methods("PUT")
+	router.HandleFunc("/api/borrows/{id}/return", returnBook).Methods("PUT")
+	router.HandleFunc("/api/borrows/{id}/cancel", cancelBorrow).Methods("PUT")
+	router.HandleFunc("/api/borrows/{id}/status", updateBorrowStatus).Methods("PUT")
+
+	for _, path := range []string{"approve", "reject", "return", "cancel", "status"} {
+		body := strings.NewReader(`{"status": "returned", "changed_by": 1}`)
+		req := httptest.NewRequest("PUT", "/api/borrows/7/"+path, body)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("PUT %s without a user = %d, want %d", path, rec.Code, http.StatusUnauthorized)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============ SHOPPING CART ============
+
+var (
+	ErrCartEmpty          = errors.New("cart is empty")
+	ErrCartItemNotFound   = errors.New("cart item not found")
+	ErrMixedCartLocations = errors.New("cart items are at different locations; choose one pickup location")
+)
+
+type CartItem struct {
+	CartItemID        int       `json:"cart_item_id"`
+	BookID            int       `json:"book_id"`
+	Title             string    `json:"title"`
+	Author            string    `json:"author"`
+	CoverImage        string    `json:"cover_image"`
+	CategoryName      string    `json:"category_name"`
+	LocationID        *int      `json:"location_id"`
+	RentalFee         float64   `json:"rental_fee"`
+	Available         bool      `json:"available"`
+	UnavailableReason string    `json:"unavailable_reason,omitempty"`
+	AddedAt           time.Time `json:"added_at"`
+}
+
+type Cart struct {
+	UserID   int        `json:"user_id"`
+	Items    []CartItem `json:"items"`
+	Subtotal float64    `json:"subtotal"`
+}
+
+// GetCart loads the cart and re-validates every item against the current catalog and stock.
+func GetCart(userID int) (*Cart, error) {
+	rows, err := db.Query(`
+		SELECT ci.cart_item_id, ci.book_id, COALESCE(b.title, ''), COALESCE(b.author, ''), COALESCE(b.cover_image, ''),
+		       COALESCE(c.category_name, ''), COALESCE(b.category_id, 0), COALESCE(b.status, ''), ci.location_id, ci.added_at
+		FROM cart_item ci
+		LEFT JOIN book b ON ci.book_id = b.book_id
+		LEFT JOIN category c ON b.category_id = c.category_id
+		WHERE ci.user_id = ?
+		ORDER BY ci.added_at, ci.cart_item_id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	type cartRow struct {
+		item       CartItem
+		categoryID int
+		bookStatus string
+	}
+	var cartRows []cartRow
+	for rows.Next() {
+		var row cartRow
+		var locationID sql.NullInt64
+		err := rows.Scan(&row.item.CartItemID, &row.item.BookID, &row.item.Title, &row.item.Author, &row.item.CoverImage,
+			&row.item.CategoryName, &row.categoryID, &row.bookStatus, &locationID, &row.item.AddedAt)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if locationID.Valid {
+			id := int(locationID.Int64)
+			row.item.LocationID = &id
+		}
+		cartRows = append(cartRows, row)
+	}
+	rows.Close()
+
+	cart := &Cart{UserID: userID, Items: []CartItem{}}
+	for _, row := range cartRows {
+		item := row.item
+		switch {
+		case item.Title == "":
+			item.UnavailableReason = "Book no longer exists"
+		case row.bookStatus != "accepted":
+			item.UnavailableReason = "Book is not available for borrowing"
+		default:
+			available, err := AvailableCopies(item.BookID)
+			if err != nil {
+				return nil, err
+			}
+			if available > 0 {
+				item.Available = true
+			} else {
+				item.UnavailableReason = "All copies are currently on loan"
+			}
+		}
+
+		fee, err := priceFor(PricingRentalFee, row.categoryID, "")
+		if err != nil {
+			return nil, err
+		}
+		item.RentalFee = fee
+		if item.Available {
+			cart.Subtotal += fee
+		}
+		cart.Items = append(cart.Items, item)
+	}
+	return cart, nil
+}
+
+// AddCartItem puts a book in the user's cart; adding a book twice only updates its location.
+func AddCartItem(userID, bookID, locationID int) error {
+	_, err := db.Exec(`
+		INSERT INTO cart_item (user_id, book_id, location_id, added_at)
+		VALUES (?, ?, ?, NOW())
+		ON DUPLICATE KEY UPDATE location_id = VALUES(location_id)
+	`, userID, bookID, nullableID(locationID))
+	return err
+}
+
+func UpdateCartItem(userID, cartItemID, locationID int) error {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM cart_item WHERE cart_item_id = ? AND user_id = ?", cartItemID, userID).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrCartItemNotFound
+	}
+
+	_, err = db.Exec("UPDATE cart_item SET location_id = ? WHERE cart_item_id = ?", nullableID(locationID), cartItemID)
+	return err
+}
+
+func RemoveCartItem(userID, cartItemID int) error {
+	result, err := db.Exec("DELETE FROM cart_item WHERE cart_item_id = ? AND user_id = ?", cartItemID, userID)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrCartItemNotFound
+	}
+	return nil
+}
+
+// MergeCart adds the items of a guest (browser-side) cart to the user's server cart.
+// Books already in the server cart keep their server-side settings.
+func MergeCart(userID int, items []CartItem) error {
+	for _, item := range items {
+		locationID := 0
+		if item.LocationID != nil {
+			locationID = *item.LocationID
+		}
+		_, err := db.Exec(`
+			INSERT IGNORE INTO cart_item (user_id, book_id, location_id, added_at)
+			VALUES (?, ?, ?, NOW())
+		`, userID, item.BookID, nullableID(locationID))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckoutCart turns the cart into a single order in one transaction and empties the cart.
+// The books come from the cart and everything else from req. A zero req.LocationID uses the
+// location chosen for the items, which must then all agree. If any item cannot be borrowed
+// nothing is created.
+func CheckoutCart(req OrderRequest) (*Order, error) {
+	cart, err := GetCart(req.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if len(cart.Items) == 0 {
+		return nil, ErrCartEmpty
+	}
+
+	useItemLocations := req.LocationID == 0
+	req.BookIDs = nil
+	for _, item := range cart.Items {
+		if !item.Available {
+			return nil, fmt.Errorf("%w: \"%s\" %s", ErrNoCopiesAvailable, item.Title, item.UnavailableReason)
+		}
+		if useItemLocations && item.LocationID != nil {
+			if req.LocationID != 0 && req.LocationID != *item.LocationID {
+				return nil, ErrMixedCartLocations
+			}
+			req.LocationID = *item.LocationID
+		}
+		req.BookIDs = append(req.BookIDs, item.BookID)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	order, err := createOrderTx(tx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM cart_item WHERE user_id = ?", req.UserID); err != nil {
+		return nil, err
+	}
+	return order, tx.Commit()
+}
+
+// ============ CART HANDLERS ============
+
+// cartUserID resolves the cart owner, writing a 401 when the caller is anonymous.
+func cartUserID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	userID := actingUserID(r)
+	if userID == 0 {
+		http.Error(w, "Missing user identity", http.StatusUnauthorized)
+		return 0, false
+	}
+	return userID, true
+}
+
+func getCart(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cartUserID(w, r)
+	if !ok {
+		return
+	}
+
+	cart, err := GetCart(userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cart)
+}
+
+func addCartItem(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cartUserID(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		BookID     int `json:"book_id"`
+		LocationID int `json:"location_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.BookID == 0 {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	book, err := GetBookByID(req.BookID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if book == nil {
+		http.Error(w, "Book not found", http.StatusNotFound)
+		return
+	}
+
+	if err := AddCartItem(userID, req.BookID, req.LocationID); err != nil {
+		http.Error(w, "Failed to add item to cart", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Book added to cart",
+	})
+}
+
+func updateCartItem(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cartUserID(w, r)
+	if !ok {
+		return
+	}
+
+	vars := mux.Vars(r)
+	cartItemID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid cart item ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		LocationID int `json:"location_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	err = UpdateCartItem(userID, cartItemID, req.LocationID)
+	if errors.Is(err, ErrCartItemNotFound) {
+		http.Error(w, "Cart item not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update cart item", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Cart item updated",
+	})
+}
+
+func removeCartItem(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cartUserID(w, r)
+	if !ok {
+		return
+	}
+
+	vars := mux.Vars(r)
+	cartItemID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid cart item ID", http.StatusBadRequest)
+		return
+	}
+
+	err = RemoveCartItem(userID, cartItemID)
+	if errors.Is(err, ErrCartItemNotFound) {
+		http.Error(w, "Cart item not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to remove cart item", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Cart item removed",
+	})
+}
+
+func mergeCart(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cartUserID(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Items []CartItem `json:"items"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if err := MergeCart(userID, req.Items); err != nil {
+		http.Error(w, "Failed to merge cart", http.StatusInternalServerError)
+		return
+	}
+
+	cart, err := GetCart(userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cart)
+}
+
+func checkoutCart(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cartUserID(w, r)
+	if !ok {
+		return
+	}
+
+	var req OrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	req.UserID = userID
+
+	order, err := CheckoutCart(req)
+	switch {
+	case errors.Is(err, ErrCartEmpty), errors.Is(err, ErrMixedCartLocations):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		writeOrderError(w, err, "Failed to check out cart")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Cart checked out successfully",
+		"order":   order,
+	})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cartItemRow is one cart_item row of member 5 as GetCart reads it.
+type cartItemRow struct {
+	bookID     int64
+	title      string
+	status     string
+	locationID interface{}
+	available  int64
+}
+
+func cartResponder(items ...cartItemRow) fakeResponder {
+	return func(query string, args []driver.Value) (*fakeRows, error) {
+		switch {
+		case strings.Contains(query, "FROM cart_item ci"):
+			rows := &fakeRows{columns: make([]string, 10)}
+			for i, item := range items {
+				rows.values = append(rows.values, []driver.Value{int64(i + 1), item.bookID, item.title, "Author", "", "Fiction",
+					int64(2), item.status, item.locationID, time.Now()})
+			}
+			return rows, nil
+		case strings.Contains(query, "SUM(stock)"):
+			for _, item := range items {
+				if args[0] == item.bookID {
+					return fakeRow(item.available), nil
+				}
+			}
+		}
+		return nil, nil
+	}
+}
+
+func TestGetCartRevalidatesItems(t *testing.T) {
+	useFakeDB(t, cartResponder(
+		cartItemRow{bookID: 7, title: "On the shelf", status: "accepted", available: 1},
+		cartItemRow{bookID: 8, title: "All out", status: "accepted", available: 0},
+		cartItemRow{bookID: 9, title: "Pending", status: "pending", available: 1},
+		cartItemRow{bookID: 10, title: "", status: "", available: 0},
+	))
+
+	cart, err := GetCart(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cart.Items) != 4 {
+		t.Fatalf("got %d items, want 4", len(cart.Items))
+	}
+	wantAvailable := []bool{true, false, false, false}
+	for i, item := range cart.Items {
+		if item.Available != wantAvailable[i] {
+			t.Errorf("book %d available = %v (%s), want %v", item.BookID, item.Available, item.UnavailableReason, wantAvailable[i])
+		}
+		if !item.Available && item.UnavailableReason == "" {
+			t.Errorf("book %d is unavailable without a reason", item.BookID)
+		}
+	}
+	// Only the borrowable item counts, at the default rental fee
+	if cart.Subtotal != 40000 {
+		t.Errorf("Subtotal = %v, want 40000", cart.Subtotal)
+	}
+}
+
+func TestCheckoutCartRefusals(t *testing.T) {
+	tests := []struct {
+		name  string
+		items []cartItemRow
+		want  error
+	}{
+		{"empty cart", nil, ErrCartEmpty},
+		{"unavailable item", []cartItemRow{
+			{bookID: 7, title: "On the shelf", status: "accepted", available: 1},
+			{bookID: 8, title: "All out", status: "accepted", available: 0},
+		}, ErrNoCopiesAvailable},
+		{"items at different locations", []cartItemRow{
+			{bookID: 7, title: "North", status: "accepted", locationID: int64(1), available: 1},
+			{bookID: 8, title: "South", status: "accepted", locationID: int64(2), available: 1},
+		}, ErrMixedCartLocations},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t, cartResponder(tt.items...))
+
+			if _, err := CheckoutCart(OrderRequest{UserID: 5, DeliveryType: "pickup"}); !errors.Is(err, tt.want) {
+				t.Fatalf("CheckoutCart = %v, want %v", err, tt.want)
+			}
+			if fake.Index("BEGIN") >= 0 || len(fake.Find("DELETE FROM cart_item")) != 0 {
+				t.Error("a refused checkout touched the cart or opened a transaction")
+			}
+		})
+	}
+}
+
+func TestCartRequiresIdentity(t *testing.T) {
+	fake := useFakeDB(t, nil)
+
+	rec := httptest.NewRecorder()
+	getCart(rec, httptest.NewRequest(http.MethodGet, "/api/cart", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous GET /api/cart = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if len(fake.Statements()) != 0 {
+		t.Error("an anonymous cart request reached the database")
+	}
+}
+
+func TestRemoveCartItemIsScopedToTheMember(t *testing.T) {
+	fake := useFakeDB(t, nil)
+
+	if err := RemoveCartItem(5, 3); err != nil {
+		t.Fatal(err)
+	}
+	deletes := fake.Find("DELETE FROM cart_item WHERE cart_item_id = ? AND user_id = ?")
+	if len(deletes) != 1 || deletes[0].Args[1] != int64(5) {
+		t.Errorf("delete statements %+v, want one scoped to member 5", deletes)
+	}
+}
@@ -0,0 +1,1016 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============ NOTIFICATION DELIVERY ============
+
+// Every notification is also queued for delivery outside the app on each channel the member
+// can be reached on. The notification_delivery table is both the queue and the delivery log:
+// the scheduler sends pending rows and retries failures with exponential backoff.
+const (
+	ChannelEmail = "email"
+	ChannelSMS   = "sms"
+	ChannelPush  = "push"
+)
+
+// deliveryChannelNames lists the channels in the order the preferences page shows them.
+var deliveryChannelNames = []string{ChannelEmail, ChannelSMS, ChannelPush}
+
+const (
+	DeliveryPending = "pending"
+	DeliverySent    = "sent"
+	DeliveryFailed  = "failed"
+)
+
+const (
+	// maxDeliveryAttempts is how many times a delivery is tried before it is marked failed.
+	maxDeliveryAttempts = 6
+	// deliveryBaseBackoff doubles after every failed attempt, up to deliveryMaxBackoff.
+	deliveryBaseBackoff = time.Minute
+	deliveryMaxBackoff  = 6 * time.Hour
+	// deliveryBatch caps how many deliveries one scheduler run sends.
+	deliveryBatch = 100
+)
+
+const defaultLanguage = "id"
+
+// deliveryLanguages are the languages messages are templated in.
+var deliveryLanguages = []string{"id", "en"}
+
+var (
+	ErrUnknownChannel       = errors.New("unknown delivery channel")
+	ErrUnsupportedLanguage  = errors.New("unsupported language")
+	ErrPushSubscriptionGone = errors.New("push subscription no longer exists")
+	ErrPushEndpointTaken    = errors.New("push endpoint belongs to another member")
+)
+
+// pushServiceHosts are the push services browsers hand out endpoints for. A
+// leading dot matches any subdomain.
+var pushServiceHosts = []string{
+	"fcm.googleapis.com",
+	"android.googleapis.com",
+	".push.services.mozilla.com",
+	".push.apple.com",
+	".notify.windows.com",
+}
+
+// isPushServiceHost reports whether host belongs to a known push service.
+func isPushServiceHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, h := range pushServiceHosts {
+		if host == h || (strings.HasPrefix(h, ".") && strings.HasSuffix(host, h)) {
+			return true
+		}
+	}
+	return false
+}
+
+// DeliveryMessage is one rendered message addressed to one recipient on one channel.
+type DeliveryMessage struct {
+	Recipient string
+	Subject   string
+	Body      string
+	Link      string
+}
+
+// DeliveryChannel is implemented by every driver that can reach members outside the app.
+type DeliveryChannel interface {
+	Name() string
+	Deliver(msg DeliveryMessage) error
+}
+
+type NotificationDelivery struct {
+	DeliveryID     int        `json:"delivery_id"`
+	NotificationID int        `json:"notification_id"`
+	Channel        string     `json:"channel"`
+	Recipient      string     `json:"recipient"`
+	Language       string     `json:"language"`
+	Subject        string     `json:"subject"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at"`
+	LastError      string     `json:"last_error,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	SentAt         *time.Time `json:"sent_at"`
+}
+
+// ============ EMAIL ============
+
+// smtpEmailChannel sends plain-text email through an SMTP relay.
+type smtpEmailChannel struct {
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+}
+
+func (c *smtpEmailChannel) Name() string {
+	return ChannelEmail
+}
+
+func (c *smtpEmailChannel) Deliver(msg DeliveryMessage) error {
+	body := msg.Body
+	if msg.Link != "" {
+		body += "\r\n\r\n" + msg.Link
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", c.from)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.Recipient)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	buf.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if c.username != "" {
+		auth = smtp.PlainAuth("", c.username, c.password, c.host)
+	}
+	return smtp.SendMail(c.addr, auth, c.from, []string{msg.Recipient}, buf.Bytes())
+}
+
+// ============ SMS ============
+
+// SMSGateway is implemented by every SMS provider the server can talk to.
+type SMSGateway interface {
+	SendSMS(phone, text string) error
+}
+
+// httpSMSGateway posts messages as JSON to a provider's send endpoint.
+type httpSMSGateway struct {
+	url    string
+	apiKey string
+	sender string
+	client *http.Client
+}
+
+func (g *httpSMSGateway) SendSMS(phone, text string) error {
+	payload, err := json.Marshal(map[string]string{"to": phone, "from": g.sender, "text": text})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", g.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if g.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+g.apiKey)
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sms gateway returned %s", resp.Status)
+	}
+	return nil
+}
+
+// smsChannel delivers notifications as text messages through an SMSGateway.
+type smsChannel struct {
+	gateway SMSGateway
+}
+
+func (c *smsChannel) Name() string {
+	return ChannelSMS
+}
+
+func (c *smsChannel) Deliver(msg DeliveryMessage) error {
+	text := msg.Body
+	if msg.Link != "" {
+		text += " " + msg.Link
+	}
+	return c.gateway.SendSMS(msg.Recipient, text)
+}
+
+// ============ WEB PUSH ============
+
+// webPushTTL is how long the push service keeps a message for an offline browser.
+const webPushTTL = 24 * time.Hour
+
+// webPushChannel sends payload-less pushes authenticated with VAPID (RFC 8292). The service
+// worker shows a generic alert that opens the notification list, so nothing has to be
+// encrypted for the subscription.
+type webPushChannel struct {
+	publicKey  string
+	privateKey *ecdsa.PrivateKey
+	subject    string
+	client     *http.Client
+}
+
+// newWebPushChannel loads a VAPID key pair from the base64url-encoded P-256 private scalar.
+func newWebPushChannel(encodedKey, subject string) (*webPushChannel, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encodedKey, "="))
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdh.P256().NewPrivateKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	public := key.PublicKey().Bytes()
+
+	privateKey := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(public[1:33]),
+			Y:     new(big.Int).SetBytes(public[33:65]),
+		},
+		D: new(big.Int).SetBytes(raw),
+	}
+	return &webPushChannel{
+		publicKey:  base64.RawURLEncoding.EncodeToString(public),
+		privateKey: privateKey,
+		subject:    subject,
+		client:     &http.Client{Timeout: 15 * time.Second},
+	}, nil
+}
+
+func (c *webPushChannel) Name() string {
+	return ChannelPush
+}
+
+// vapidToken signs the ES256 JWT that tells the push service who is sending.
+func (c *webPushChannel) vapidToken(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": c.subject,
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, c.privateKey, digest[:])
+	if err != nil {
+		return "", err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func (c *webPushChannel) Deliver(msg DeliveryMessage) error {
+	token, err := c.vapidToken(msg.Recipient)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", msg.Recipient, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("TTL", strconv.Itoa(int(webPushTTL.Seconds())))
+	req.Header.Set("Urgency", "normal")
+	req.Header.Set("Authorization", fmt.Sprintf("vapid t=%s, k=%s", token, c.publicKey))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return ErrPushSubscriptionGone
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("push service returned %s", resp.Status)
+	}
+	return nil
+}
+
+// ============ FAKE CHANNEL ============
+
+// fakeDeliveryChannel logs messages instead of sending them and keeps them for inspection.
+// It stands in for any channel that is not configured; list channel names in
+// FAKE_DELIVERY_FAIL (e.g. "sms,push") to make their deliveries fail and exercise retries.
+type fakeDeliveryChannel struct {
+	name string
+	mu   sync.Mutex
+	sent []DeliveryMessage
+}
+
+func (c *fakeDeliveryChannel) Name() string {
+	return c.name
+}
+
+func (c *fakeDeliveryChannel) Deliver(msg DeliveryMessage) error {
+	for _, name := range strings.Split(os.Getenv("FAKE_DELIVERY_FAIL"), ",") {
+		if strings.TrimSpace(name) == c.name {
+			return fmt.Errorf("fake %s delivery failure", c.name)
+		}
+	}
+
+	c.mu.Lock()
+	c.sent = append(c.sent, msg)
+	c.mu.Unlock()
+	log.Printf("[%s] to %s: %s", c.name, msg.Recipient, msg.Subject)
+	return nil
+}
+
+// Sent returns the messages delivered so far.
+func (c *fakeDeliveryChannel) Sent() []DeliveryMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]DeliveryMessage(nil), c.sent...)
+}
+
+// ============ CHANNEL CONFIGURATION ============
+
+// deliveryChannels holds the driver for each channel; it is filled from the environment when
+// the server starts.
+var deliveryChannels = map[string]DeliveryChannel{}
+
+// configuredDeliveryChannels uses a real driver for every channel whose settings are present
+// and a fake for the rest.
+func configuredDeliveryChannels() map[string]DeliveryChannel {
+	channels := map[string]DeliveryChannel{}
+	for _, name := range deliveryChannelNames {
+		channels[name] = &fakeDeliveryChannel{name: name}
+	}
+
+	if host := os.Getenv("SMTP_HOST"); host != "" {
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		from := os.Getenv("SMTP_FROM")
+		if from == "" {
+			from = "LibMatch <no-reply@libmatch.local>"
+		}
+		channels[ChannelEmail] = &smtpEmailChannel{
+			addr:     host + ":" + port,
+			host:     host,
+			username: os.Getenv("SMTP_USERNAME"),
+			password: os.Getenv("SMTP_PASSWORD"),
+			from:     from,
+		}
+	}
+
+	if gatewayURL := os.Getenv("SMS_GATEWAY_URL"); gatewayURL != "" {
+		channels[ChannelSMS] = &smsChannel{gateway: &httpSMSGateway{
+			url:    gatewayURL,
+			apiKey: os.Getenv("SMS_GATEWAY_API_KEY"),
+			sender: os.Getenv("SMS_SENDER"),
+			client: &http.Client{Timeout: 15 * time.Second},
+		}}
+	}
+
+	if key := os.Getenv("VAPID_PRIVATE_KEY"); key != "" {
+		subject := os.Getenv("VAPID_SUBJECT")
+		if subject == "" {
+			subject = "mailto:admin@libmatch.local"
+		}
+		push, err := newWebPushChannel(key, subject)
+		if err != nil {
+			log.Printf("Invalid VAPID_PRIVATE_KEY, web push is disabled: %v", err)
+		} else {
+			channels[ChannelPush] = push
+		}
+	}
+	return channels
+}
+
+// vapidPublicKey is the key browsers subscribe with, or "" when web push is not configured.
+func vapidPublicKey() string {
+	if push, ok := deliveryChannels[ChannelPush].(*webPushChannel); ok {
+		return push.publicKey
+	}
+	return ""
+}
+
+// appBaseURL turns in-app links into absolute URLs for messages read outside the app.
+func appBaseURL() string {
+	if base := os.Getenv("APP_BASE_URL"); base != "" {
+		return strings.TrimRight(base, "/")
+	}
+	return "http://localhost:8080"
+}
+
+// ============ MESSAGE TEMPLATES ============
+
+type deliveryTemplate struct {
+	Subject string
+	Body    string
+}
+
+// deliveryTemplateData is what message templates can refer to.
+type deliveryTemplateData struct {
+	Name    string
+	Title   string
+	Message string
+	Reason  string
+	Comment string
+}
+
+// rejectionReasonLabelsID translates the rejection reason labels for Indonesian messages.
+var rejectionReasonLabelsID = map[string]string{
+	"incomplete_details":    "Detail buku belum lengkap",
+	"incorrect_details":     "Detail buku tidak tepat",
+	"poor_cover_image":      "Gambar sampul tidak ada atau kurang jelas",
+	"duplicate":             "Buku ini sudah terdaftar",
+	"inappropriate_content": "Konten tidak diizinkan di LibMatch",
+	RejectionOther:          "Lainnya",
+}
+
+// localizedRejectionReason returns the label of a rejection reason in the given language.
+func localizedRejectionReason(code, language string) string {
+	if !supportedLanguage(language) {
+		language = defaultLanguage
+	}
+	if label, ok := rejectionReasonLabelsID[code]; ok && language == "id" {
+		return label
+	}
+	return rejectionReasonLabel(code)
+}
+
+// deliveryTemplates holds the subject and body of each event in every supported language.
+// Events without a template fall back to the in-app message.
+var deliveryTemplates = map[string]map[string]deliveryTemplate{
+	EventBookApproved: {
+		"id": {"Buku Anda disetujui", `Halo {{.Name}}, "{{.Title}}" telah disetujui dan kini tampil di LibMatch.`},
+		"en": {"Your book was approved", `Hi {{.Name}}, "{{.Title}}" was approved and is now listed on LibMatch.`},
+	},
+	EventBookRejected: {
+		"id": {"Buku Anda belum disetujui", `Halo {{.Name}}, "{{.Title}}" belum dapat disetujui.{{if .Reason}} Alasan: {{.Reason}}.{{end}}{{if .Comment}} Catatan moderator: {{.Comment}}{{end}}`},
+		"en": {"Your book was not approved", `Hi {{.Name}}, "{{.Title}}" was not approved.{{if .Reason}} Reason: {{.Reason}}.{{end}}{{if .Comment}} Moderator's note: {{.Comment}}{{end}}`},
+	},
+	EventBorrowRequested: {
+		"id": {"Permintaan pinjam baru", `Halo {{.Name}}, seseorang ingin meminjam "{{.Title}}".`},
+		"en": {"New borrow request", `Hi {{.Name}}, someone asked to borrow "{{.Title}}".`},
+	},
+	EventBorrowApproved: {
+		"id": {"Peminjaman disetujui", `Halo {{.Name}}, permintaan Anda untuk meminjam "{{.Title}}" telah disetujui.`},
+		"en": {"Borrow request approved", `Hi {{.Name}}, your request to borrow "{{.Title}}" was approved.`},
+	},
+	EventDueSoon: {
+		"id": {"Batas pengembalian segera tiba", `Halo {{.Name}}, "{{.Title}}" harus segera dikembalikan.`},
+		"en": {"Your loan is due soon", `Hi {{.Name}}, "{{.Title}}" is due back soon.`},
+	},
+	EventOverdue: {
+		"id": {"Peminjaman terlambat", `Halo {{.Name}}, "{{.Title}}" sudah melewati batas pengembalian. Mohon segera dikembalikan.`},
+		"en": {"Your loan is overdue", `Hi {{.Name}}, "{{.Title}}" is overdue. Please return it as soon as possible.`},
+	},
+	EventHoldReady: {
+		"id": {"Buku siap diambil", `Halo {{.Name}}, "{{.Title}}" yang Anda pesan sudah siap diambil.`},
+		"en": {"Your reserved book is ready", `Hi {{.Name}}, "{{.Title}}" is ready for you to collect.`},
+	},
+}
+
+type compiledDeliveryTemplate struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+var compiledDeliveryTemplates = compileDeliveryTemplates()
+
+func compileDeliveryTemplates() map[string]compiledDeliveryTemplate {
+	compiled := map[string]compiledDeliveryTemplate{}
+	for event, languages := range deliveryTemplates {
+		for language, t := range languages {
+			key := event + "/" + language
+			compiled[key] = compiledDeliveryTemplate{
+				subject: template.Must(template.New(key + "/subject").Parse(t.Subject)),
+				body:    template.Must(template.New(key + "/body").Parse(t.Body)),
+			}
+		}
+	}
+	return compiled
+}
+
+func supportedLanguage(language string) bool {
+	for _, l := range deliveryLanguages {
+		if l == language {
+			return true
+		}
+	}
+	return false
+}
+
+// renderDelivery fills in an event's template in the member's language.
+func renderDelivery(event, language string, data deliveryTemplateData) (string, string, error) {
+	if !supportedLanguage(language) {
+		language = defaultLanguage
+	}
+	t, ok := compiledDeliveryTemplates[event+"/"+language]
+	if !ok {
+		return "LibMatch", data.Message, nil
+	}
+
+	var subject, body bytes.Buffer
+	if err := t.subject.Execute(&subject, data); err != nil {
+		return "", "", err
+	}
+	if err := t.body.Execute(&body, data); err != nil {
+		return "", "", err
+	}
+	return subject.String(), body.String(), nil
+}
+
+// ============ DELIVERY QUEUE ============
+
+// retryBackoff is how long to wait before the next attempt after the given number of tries:
+// base after the first, doubling each time up to max.
+func retryBackoff(attempts int, base, max time.Duration) time.Duration {
+	wait := base
+	for i := 1; i < attempts && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+	return wait
+}
+
+// channelPreferencesFrom returns which channels a member allows; channels are on unless
+// switched off.
+func channelPreferencesFrom(ex execer, userID int) (map[string]bool, error) {
+	preferences := map[string]bool{}
+	for _, name := range deliveryChannelNames {
+		preferences[name] = true
+	}
+
+	rows, err := ex.Query("SELECT channel, enabled FROM notification_channel_preference WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var channel string
+		var enabled bool
+		if err := rows.Scan(&channel, &enabled); err != nil {
+			return nil, err
+		}
+		preferences[channel] = enabled
+	}
+	return preferences, rows.Err()
+}
+
+// enqueueDeliveries queues a notification on every channel the member can be reached on.
+func enqueueDeliveries(ex execer, notificationID int64, userID int, event string, bookID int, message, link string) error {
+	var name, email, phone, language string
+	err := ex.QueryRow(`
+		SELECT COALESCE(name, ''), COALESCE(email, ''), COALESCE(phone, ''), COALESCE(language, ?)
+		FROM user WHERE user_id = ?
+	`, defaultLanguage, userID).Scan(&name, &email, &phone, &language)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	preferences, err := channelPreferencesFrom(ex, userID)
+	if err != nil {
+		return err
+	}
+
+	recipients := map[string][]string{}
+	if email != "" {
+		recipients[ChannelEmail] = []string{email}
+	}
+	if phone != "" {
+		recipients[ChannelSMS] = []string{phone}
+	}
+	if preferences[ChannelPush] {
+		rows, err := ex.Query("SELECT endpoint FROM push_subscription WHERE user_id = ?", userID)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var endpoint string
+			if err := rows.Scan(&endpoint); err != nil {
+				rows.Close()
+				return err
+			}
+			recipients[ChannelPush] = append(recipients[ChannelPush], endpoint)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	data := deliveryTemplateData{Name: name, Message: message}
+	if bookID != 0 {
+		if err := ex.QueryRow("SELECT COALESCE(title, '') FROM book WHERE book_id = ?", bookID).Scan(&data.Title); err != nil && err != sql.ErrNoRows {
+			return err
+		}
+	}
+	if event == EventBookRejected && bookID != 0 {
+		var reason string
+		err := ex.QueryRow(`
+			SELECT COALESCE(reason, ''), COALESCE(comment, '') FROM book_moderation
+			WHERE book_id = ? AND action = ? ORDER BY moderation_id DESC LIMIT 1
+		`, bookID, ModerationRejected).Scan(&reason, &data.Comment)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		data.Reason = localizedRejectionReason(reason, language)
+	}
+	subject, body, err := renderDelivery(event, language, data)
+	if err != nil {
+		return err
+	}
+
+	for _, channel := range deliveryChannelNames {
+		if !preferences[channel] {
+			continue
+		}
+		for _, recipient := range recipients[channel] {
+			_, err := ex.Exec(`
+				INSERT INTO notification_delivery
+					(notification_id, user_id, channel, recipient, language, subject, body, link, status, attempts, next_attempt_at, created_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 0, NOW(), NOW())
+			`, notificationID, userID, channel, recipient, language, subject, body, link, DeliveryPending)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DeliverPendingNotifications sends the deliveries that are due and schedules retries for
+// the ones that fail.
+func DeliverPendingNotifications() (int, error) {
+	rows, err := db.Query(`
+		SELECT delivery_id, channel, recipient, subject, body, COALESCE(link, ''), attempts
+		FROM notification_delivery
+		WHERE status = ? AND next_attempt_at <= NOW()
+		ORDER BY next_attempt_at LIMIT ?
+	`, DeliveryPending, deliveryBatch)
+	if err != nil {
+		return 0, err
+	}
+
+	type pendingDelivery struct {
+		id       int
+		channel  string
+		message  DeliveryMessage
+		attempts int
+	}
+	var pending []pendingDelivery
+	for rows.Next() {
+		var d pendingDelivery
+		if err := rows.Scan(&d.id, &d.channel, &d.message.Recipient, &d.message.Subject, &d.message.Body, &d.message.Link, &d.attempts); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pending = append(pending, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, d := range pending {
+		if d.message.Link != "" {
+			d.message.Link = appBaseURL() + d.message.Link
+		}
+
+		channel, ok := deliveryChannels[d.channel]
+		if !ok {
+			err = fmt.Errorf("%w: %s", ErrUnknownChannel, d.channel)
+		} else {
+			err = channel.Deliver(d.message)
+		}
+		attempts := d.attempts + 1
+
+		if err == nil {
+			_, err = db.Exec(`
+				UPDATE notification_delivery SET status = ?, attempts = ?, last_error = NULL, sent_at = NOW()
+				WHERE delivery_id = ?
+			`, DeliverySent, attempts, d.id)
+			if err != nil {
+				return sent, err
+			}
+			sent++
+			continue
+		}
+
+		if errors.Is(err, ErrPushSubscriptionGone) {
+			if _, dbErr := db.Exec("DELETE FROM push_subscription WHERE endpoint = ?", d.message.Recipient); dbErr != nil {
+				return sent, dbErr
+			}
+		}
+		status := DeliveryPending
+		if attempts >= maxDeliveryAttempts || errors.Is(err, ErrPushSubscriptionGone) || errors.Is(err, ErrUnknownChannel) {
+			status = DeliveryFailed
+		}
+		_, dbErr := db.Exec(`
+			UPDATE notification_delivery SET status = ?, attempts = ?, last_error = ?, next_attempt_at = DATE_ADD(NOW(), INTERVAL ? SECOND)
+			WHERE delivery_id = ?
+		`, status, attempts, err.Error(), int(retryBackoff(attempts, deliveryBaseBackoff, deliveryMaxBackoff).Seconds()), d.id)
+		if dbErr != nil {
+			return sent, dbErr
+		}
+	}
+	return sent, nil
+}
+
+// GetNotificationDeliveries returns the delivery log of one notification.
+func GetNotificationDeliveries(notificationID int) ([]NotificationDelivery, error) {
+	rows, err := db.Query(`
+		SELECT delivery_id, notification_id, channel, recipient, language, subject, status, attempts,
+		       next_attempt_at, COALESCE(last_error, ''), created_at, sent_at
+		FROM notification_delivery WHERE notification_id = ?
+		ORDER BY delivery_id
+	`, notificationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []NotificationDelivery{}
+	for rows.Next() {
+		var d NotificationDelivery
+		var nextAttemptAt, sentAt sql.NullTime
+		err := rows.Scan(&d.DeliveryID, &d.NotificationID, &d.Channel, &d.Recipient, &d.Language, &d.Subject, &d.Status, &d.Attempts,
+			&nextAttemptAt, &d.LastError, &d.CreatedAt, &sentAt)
+		if err != nil {
+			return nil, err
+		}
+		if nextAttemptAt.Valid && d.Status == DeliveryPending {
+			d.NextAttemptAt = &nextAttemptAt.Time
+		}
+		if sentAt.Valid {
+			d.SentAt = &sentAt.Time
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// SetDeliverySettings updates a member's language and the channels they allow.
+func SetDeliverySettings(userID int, language string, channels map[string]bool) error {
+	if language != "" && !supportedLanguage(language) {
+		return fmt.Errorf("%w: %s", ErrUnsupportedLanguage, language)
+	}
+	for channel := range channels {
+		if !knownChannel(channel) {
+			return fmt.Errorf("%w: %s", ErrUnknownChannel, channel)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if language != "" {
+		if _, err := tx.Exec("UPDATE user SET language = ? WHERE user_id = ?", language, userID); err != nil {
+			return err
+		}
+	}
+	for channel, enabled := range channels {
+		_, err := tx.Exec(`
+			INSERT INTO notification_channel_preference (user_id, channel, enabled) VALUES (?, ?, ?)
+			ON DUPLICATE KEY UPDATE enabled = VALUES(enabled)
+		`, userID, channel, enabled)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func knownChannel(channel string) bool {
+	for _, name := range deliveryChannelNames {
+		if name == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// SavePushSubscription registers a browser's push endpoint for a member.
+// An endpoint already registered to another member is refused rather than
+// moved, so nobody can redirect someone else's notifications to themselves.
+func SavePushSubscription(userID int, endpoint string) error {
+	res, err := db.Exec(`
+		INSERT IGNORE INTO push_subscription (user_id, endpoint, created_at) VALUES (?, ?, NOW())
+	`, userID, endpoint)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+	var owner int
+	err = db.QueryRow(`SELECT user_id FROM push_subscription WHERE endpoint = ?`, endpoint).Scan(&owner)
+	if err != nil {
+		return err
+	}
+	if owner != userID {
+		return ErrPushEndpointTaken
+	}
+	return nil
+}
+
+func DeletePushSubscription(userID int, endpoint string) error {
+	_, err := db.Exec("DELETE FROM push_subscription WHERE user_id = ? AND endpoint = ?", userID, endpoint)
+	return err
+}
+
+// ============ DELIVERY HANDLERS ============
+
+// getNotificationDeliveries shows where a notification was sent; admins may see anyone's.
+func getNotificationDeliveries(w http.ResponseWriter, r *http.Request) {
+	userID := requireUser(w, r)
+	if userID == 0 {
+		return
+	}
+	notificationID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid notification ID", http.StatusBadRequest)
+		return
+	}
+
+	var ownerID int
+	err = db.QueryRow("SELECT user_id FROM notification WHERE notification_id = ?", notificationID).Scan(&ownerID)
+	if err == sql.ErrNoRows {
+		http.Error(w, ErrNotificationNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if ownerID != userID && !requireAdmin(w, r) {
+		return
+	}
+
+	deliveries, err := GetNotificationDeliveries(notificationID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+func getDeliverySettings(w http.ResponseWriter, r *http.Request) {
+	userID := requireUser(w, r)
+	if userID == 0 {
+		return
+	}
+
+	var language string
+	err := db.QueryRow("SELECT COALESCE(language, ?) FROM user WHERE user_id = ?", defaultLanguage, userID).Scan(&language)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	preferences, err := channelPreferencesFrom(db, userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"channels":         deliveryChannelNames,
+		"preferences":      preferences,
+		"language":         language,
+		"languages":        deliveryLanguages,
+		"vapid_public_key": vapidPublicKey(),
+	})
+}
+
+// updateDeliverySettings takes {"language": "en", "channels": {"sms": false}}; both are optional.
+func updateDeliverySettings(w http.ResponseWriter, r *http.Request) {
+	userID := requireUser(w, r)
+	if userID == 0 {
+		return
+	}
+
+	var req struct {
+		Language string          `json:"language"`
+		Channels map[string]bool `json:"channels"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	err := SetDeliverySettings(userID, req.Language, req.Channels)
+	if errors.Is(err, ErrUnknownChannel) || errors.Is(err, ErrUnsupportedLanguage) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update delivery settings", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Delivery settings updated",
+	})
+}
+
+func decodePushEndpoint(w http.ResponseWriter, r *http.Request) string {
+	var req struct {
+		Endpoint string `json:"endpoint"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return ""
+	}
+	u, err := url.Parse(req.Endpoint)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		http.Error(w, "Endpoint must be an https URL", http.StatusBadRequest)
+		return ""
+	}
+	if u.Port() != "" || !isPushServiceHost(u.Hostname()) {
+		http.Error(w, "Endpoint must belong to a known push service", http.StatusBadRequest)
+		return ""
+	}
+	return req.Endpoint
+}
+
+// createPushSubscription stores the endpoint of a PushSubscription made by the browser.
+func createPushSubscription(w http.ResponseWriter, r *http.Request) {
+	userID := requireUser(w, r)
+	if userID == 0 {
+		return
+	}
+	endpoint := decodePushEndpoint(w, r)
+	if endpoint == "" {
+		return
+	}
+
+	if err := SavePushSubscription(userID, endpoint); err != nil {
+		if errors.Is(err, ErrPushEndpointTaken) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to save subscription", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Push notifications enabled",
+	})
+}
+
+func deletePushSubscription(w http.ResponseWriter, r *http.Request) {
+	userID := requireUser(w, r)
+	if userID == 0 {
+		return
+	}
+	endpoint := decodePushEndpoint(w, r)
+	if endpoint == "" {
+		return
+	}
+
+	if err := DeletePushSubscription(userID, endpoint); err != nil {
+		http.Error(w, "Failed to remove subscription", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Push notifications disabled",
+	})
+}
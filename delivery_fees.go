@@ -0,0 +1,506 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// ============ DELIVERY FEES ============
+
+const (
+	DeliveryServiceInstant = "instant"
+	DeliveryServiceSameDay = "same_day"
+	DeliveryServiceRegular = "regular"
+)
+
+var (
+	ErrOutsideServiceArea         = errors.New("delivery address is outside the location's service area")
+	ErrDeliveryServiceUnavailable = errors.New("delivery service is not available for this address")
+	ErrDeliveryAddressUnknown     = errors.New("delivery address could not be located, enter a fuller address")
+)
+
+// deliveryServices lists the services in the order they are offered, with their checkout labels.
+var deliveryServices = []struct {
+	Service  string
+	Label    string
+	Estimate string
+}{
+	{DeliveryServiceInstant, "Instant", "1 - 3 hours"},
+	{DeliveryServiceSameDay, "Same Day", "Arrives today before 21:00 WIB"},
+	{DeliveryServiceRegular, "Regular", "2 - 4 days"},
+}
+
+// DeliveryFeeTier prices a service up to a distance as BaseFee + PerKmFee per kilometre.
+// A tier without LocationID applies to every location that has no tier of its own for the service.
+type DeliveryFeeTier struct {
+	TierID        int     `json:"tier_id"`
+	LocationID    *int    `json:"location_id"`
+	Service       string  `json:"service"`
+	MaxDistanceKm float64 `json:"max_distance_km"`
+	BaseFee       float64 `json:"base_fee"`
+	PerKmFee      float64 `json:"per_km_fee"`
+	Active        bool    `json:"active"`
+}
+
+// defaultDeliveryFeeTiers apply until an admin defines a schedule. Nearby instant deliveries keep
+// the flat Rp 23,000 checkout.html used to advertise.
+var defaultDeliveryFeeTiers = []DeliveryFeeTier{
+	{Service: DeliveryServiceInstant, MaxDistanceKm: 5, BaseFee: 23000, Active: true},
+	{Service: DeliveryServiceInstant, MaxDistanceKm: 15, BaseFee: 18000, PerKmFee: 1000, Active: true},
+	{Service: DeliveryServiceSameDay, MaxDistanceKm: 40, BaseFee: 12000, PerKmFee: 300, Active: true},
+	{Service: DeliveryServiceRegular, MaxDistanceKm: 300, BaseFee: 9000, PerKmFee: 100, Active: true},
+}
+
+type DeliveryOption struct {
+	Service    string  `json:"service"`
+	Label      string  `json:"label"`
+	Estimate   string  `json:"estimate"`
+	DistanceKm float64 `json:"distance_km"`
+	Fee        float64 `json:"fee"`
+}
+
+// haversineKm is the great-circle distance between two coordinates.
+func haversineKm(lat1, lng1, lat2, lng2 float64) float64 {
+	const earthRadiusKm = 6371.0
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(lat2 - lat1)
+	dLng := toRad(lng2 - lng1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return earthRadiusKm * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// lendingLocationID returns the location holding the most copies of a book, or 0 for member-held books.
+func lendingLocationID(bookID int) (int, error) {
+	var locationID int
+	err := db.QueryRow(`
+		SELECT location_id FROM book_location
+		WHERE book_id = ? AND stock > 0
+		ORDER BY stock DESC, location_id LIMIT 1
+	`, bookID).Scan(&locationID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return locationID, err
+}
+
+// deliveryDestination geocodes where a delivery goes: the given address, or the member's profile
+// address when none is given. Coordinates sent by the browser are never used for pricing.
+func deliveryDestination(userID int, address string) (*float64, *float64, error) {
+	if strings.TrimSpace(address) == "" && userID != 0 {
+		err := db.QueryRow("SELECT COALESCE(address, '') FROM user WHERE user_id = ?", userID).Scan(&address)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, nil, err
+		}
+	}
+	if strings.TrimSpace(address) == "" {
+		return nil, nil, nil
+	}
+	return geocodeAddress(address)
+}
+
+func scanDeliveryFeeTiers(rows *sql.Rows) ([]DeliveryFeeTier, error) {
+	tiers := []DeliveryFeeTier{}
+	for rows.Next() {
+		var tier DeliveryFeeTier
+		var locationID sql.NullInt64
+		if err := rows.Scan(&tier.TierID, &locationID, &tier.Service, &tier.MaxDistanceKm, &tier.BaseFee, &tier.PerKmFee, &tier.Active); err != nil {
+			return nil, err
+		}
+		if locationID.Valid {
+			id := int(locationID.Int64)
+			tier.LocationID = &id
+		}
+		tiers = append(tiers, tier)
+	}
+	return tiers, nil
+}
+
+// deliveryFeeTiersFor returns the active tiers that apply to a location, location-specific ones first.
+func deliveryFeeTiersFor(locationID int) ([]DeliveryFeeTier, error) {
+	rows, err := db.Query(`
+		SELECT tier_id, location_id, service, max_distance_km, base_fee, per_km_fee, active
+		FROM delivery_fee_tier
+		WHERE active = TRUE AND (location_id IS NULL OR location_id = ?)
+		ORDER BY (location_id IS NOT NULL) DESC, max_distance_km
+	`, locationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tiers, err := scanDeliveryFeeTiers(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(tiers) == 0 {
+		return defaultDeliveryFeeTiers, nil
+	}
+	return tiers, nil
+}
+
+// GetDeliveryOptions prices every delivery service from a location to a destination. It returns
+// nil when the location has no coordinates, so callers can fall back to the flat delivery fee.
+// An unknown destination is refused when the location limits how far it delivers.
+func GetDeliveryOptions(locationID int, destLat, destLng *float64) ([]DeliveryOption, error) {
+	if locationID == 0 {
+		return nil, nil
+	}
+
+	var lat, lng, radius sql.NullFloat64
+	err := db.QueryRow("SELECT latitude, longitude, delivery_radius_km FROM location WHERE location_id = ?", locationID).
+		Scan(&lat, &lng, &radius)
+	if err == sql.ErrNoRows || (err == nil && (!lat.Valid || !lng.Valid)) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if destLat == nil || destLng == nil {
+		if radius.Valid {
+			return nil, ErrDeliveryAddressUnknown
+		}
+		return nil, nil
+	}
+
+	distance := math.Round(haversineKm(lat.Float64, lng.Float64, *destLat, *destLng)*10) / 10
+	if radius.Valid && distance > radius.Float64 {
+		return nil, fmt.Errorf("%w: %.1f km away, limit %.1f km", ErrOutsideServiceArea, distance, radius.Float64)
+	}
+
+	tiers, err := deliveryFeeTiersFor(locationID)
+	if err != nil {
+		return nil, err
+	}
+
+	options := []DeliveryOption{}
+	for _, svc := range deliveryServices {
+		// A location's own tiers replace the shared ones for that service
+		var specific bool
+		for _, tier := range tiers {
+			if tier.Service == svc.Service && tier.LocationID != nil {
+				specific = true
+			}
+		}
+		for _, tier := range tiers {
+			if tier.Service != svc.Service || (specific && tier.LocationID == nil) || distance > tier.MaxDistanceKm {
+				continue
+			}
+			options = append(options, DeliveryOption{
+				Service:    svc.Service,
+				Label:      svc.Label,
+				Estimate:   svc.Estimate,
+				DistanceKm: distance,
+				Fee:        roundRupiah(tier.BaseFee + tier.PerKmFee*distance),
+			})
+			break
+		}
+	}
+	if len(options) == 0 {
+		return nil, fmt.Errorf("%w: %.1f km away", ErrOutsideServiceArea, distance)
+	}
+	return options, nil
+}
+
+// deliveryOptionForQuote works out the delivery options of a quote and the one chosen.
+// Both are nil when the location has no service area to price against.
+func deliveryOptionForQuote(req QuoteRequest) (*DeliveryOption, []DeliveryOption, error) {
+	locationID := req.LocationID
+	if locationID == 0 && len(req.BookIDs) > 0 {
+		var err error
+		if locationID, err = lendingLocationID(req.BookIDs[0]); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	lat, lng, err := deliveryDestination(req.UserID, req.DeliveryAddress)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	options, err := GetDeliveryOptions(locationID, lat, lng)
+	if err != nil || options == nil {
+		return nil, nil, err
+	}
+	if req.DeliveryService == "" {
+		return &options[0], options, nil
+	}
+	for i := range options {
+		if options[i].Service == req.DeliveryService {
+			return &options[i], options, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("%w: %s", ErrDeliveryServiceUnavailable, req.DeliveryService)
+}
+
+func CreateDeliveryFeeTier(tier DeliveryFeeTier) (int, error) {
+	result, err := db.Exec(`
+		INSERT INTO delivery_fee_tier (location_id, service, max_distance_km, base_fee, per_km_fee, active)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, tier.LocationID, tier.Service, tier.MaxDistanceKm, tier.BaseFee, tier.PerKmFee, tier.Active)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+func DeliveryFeeTierExists(tierID int) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM delivery_fee_tier WHERE tier_id = ?", tierID).Scan(&count)
+	return count > 0, err
+}
+
+func UpdateDeliveryFeeTier(tier DeliveryFeeTier) error {
+	_, err := db.Exec(`
+		UPDATE delivery_fee_tier SET location_id = ?, service = ?, max_distance_km = ?, base_fee = ?, per_km_fee = ?, active = ?
+		WHERE tier_id = ?
+	`, tier.LocationID, tier.Service, tier.MaxDistanceKm, tier.BaseFee, tier.PerKmFee, tier.Active, tier.TierID)
+	return err
+}
+
+func DeleteDeliveryFeeTier(tierID int) error {
+	_, err := db.Exec("DELETE FROM delivery_fee_tier WHERE tier_id = ?", tierID)
+	return err
+}
+
+// ============ DELIVERY FEE HANDLERS ============
+
+// validCoordinates reports whether a latitude/longitude pair is on the globe.
+func validCoordinates(lat, lng float64) bool {
+	return lat >= -90 && lat <= 90 && lng >= -180 && lng <= 180
+}
+
+// updateUserCoordinates stores the geocoded position of a member's address. Members can only
+// set their own.
+func updateUserCoordinates(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID, err := strconv.Atoi(vars["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	actingID := requireUser(w, r)
+	if actingID == 0 {
+		return
+	}
+	if actingID != userID {
+		http.Error(w, "You can only update your own coordinates", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		Latitude  float64 `json:"latitude"`
+		Longitude float64 `json:"longitude"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !validCoordinates(req.Latitude, req.Longitude) {
+		http.Error(w, "Valid latitude and longitude are required", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := db.Exec("UPDATE user SET latitude = ?, longitude = ? WHERE user_id = ?", req.Latitude, req.Longitude, userID); err != nil {
+		http.Error(w, "Failed to update coordinates", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Coordinates updated successfully",
+	})
+}
+
+// updateLocationServiceArea sets where a location is and how far it delivers.
+// A null delivery_radius_km removes the limit.
+func updateLocationServiceArea(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	locationID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid location ID", http.StatusBadRequest)
+		return
+	}
+	if !requireLocationManager(w, r, locationID) {
+		return
+	}
+
+	var req struct {
+		Latitude         float64  `json:"latitude"`
+		Longitude        float64  `json:"longitude"`
+		DeliveryRadiusKm *float64 `json:"delivery_radius_km"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !validCoordinates(req.Latitude, req.Longitude) {
+		http.Error(w, "Valid latitude and longitude are required", http.StatusBadRequest)
+		return
+	}
+	if req.DeliveryRadiusKm != nil && *req.DeliveryRadiusKm < 0 {
+		http.Error(w, "Delivery radius must be positive", http.StatusBadRequest)
+		return
+	}
+
+	location, err := GetLocationByID(locationID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if location == nil {
+		http.Error(w, "Location not found", http.StatusNotFound)
+		return
+	}
+
+	_, err = db.Exec("UPDATE location SET latitude = ?, longitude = ?, delivery_radius_km = ? WHERE location_id = ?",
+		req.Latitude, req.Longitude, req.DeliveryRadiusKm, locationID)
+	if err != nil {
+		http.Error(w, "Failed to update service area", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Service area updated successfully",
+	})
+}
+
+func getDeliveryFeeTiers(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`
+		SELECT tier_id, location_id, service, max_distance_km, base_fee, per_km_fee, active
+		FROM delivery_fee_tier ORDER BY location_id, service, max_distance_km
+	`)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	tiers, err := scanDeliveryFeeTiers(rows)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tiers)
+}
+
+// validateDeliveryFeeTier returns an error message for an unusable tier, or an empty string.
+func validateDeliveryFeeTier(tier DeliveryFeeTier) string {
+	known := false
+	for _, svc := range deliveryServices {
+		if svc.Service == tier.Service {
+			known = true
+		}
+	}
+	if !known {
+		return "Unknown delivery service"
+	}
+	if tier.MaxDistanceKm <= 0 || tier.BaseFee < 0 || tier.PerKmFee < 0 {
+		return "Distance must be positive and fees must not be negative"
+	}
+	return ""
+}
+
+func createDeliveryFeeTier(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var tier DeliveryFeeTier
+	if err := json.NewDecoder(r.Body).Decode(&tier); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if msg := validateDeliveryFeeTier(tier); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	tierID, err := CreateDeliveryFeeTier(tier)
+	if err != nil {
+		http.Error(w, "Failed to create delivery fee tier", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Delivery fee tier created successfully",
+		"tier_id": tierID,
+	})
+}
+
+func updateDeliveryFeeTier(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	tierID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid tier ID", http.StatusBadRequest)
+		return
+	}
+
+	var tier DeliveryFeeTier
+	if err := json.NewDecoder(r.Body).Decode(&tier); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if msg := validateDeliveryFeeTier(tier); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	tier.TierID = tierID
+
+	exists, err := DeliveryFeeTierExists(tierID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Delivery fee tier not found", http.StatusNotFound)
+		return
+	}
+
+	if err := UpdateDeliveryFeeTier(tier); err != nil {
+		http.Error(w, "Failed to update delivery fee tier", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Delivery fee tier updated successfully",
+	})
+}
+
+func deleteDeliveryFeeTier(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	tierID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid tier ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := DeleteDeliveryFeeTier(tierID); err != nil {
+		http.Error(w, "Failed to delete delivery fee tier", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Delivery fee tier deleted successfully",
+	})
+}
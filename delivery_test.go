@@ -0,0 +1,168 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderDelivery(t *testing.T) {
+	data := deliveryTemplateData{Name: "Sari", Title: "Laskar Pelangi", Message: "in-app text"}
+
+	subject, body, err := renderDelivery(EventBorrowApproved, "en", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "Borrow request approved" {
+		t.Errorf("en subject = %q", subject)
+	}
+	if !strings.Contains(body, "Hi Sari") || !strings.Contains(body, `"Laskar Pelangi"`) {
+		t.Errorf("en body = %q", body)
+	}
+
+	subject, body, err = renderDelivery(EventBorrowApproved, "id", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "Peminjaman disetujui" || !strings.Contains(body, "Halo Sari") {
+		t.Errorf("id message = %q / %q", subject, body)
+	}
+}
+
+func TestRenderDeliveryFallsBack(t *testing.T) {
+	data := deliveryTemplateData{Name: "Sari", Title: "Laskar Pelangi", Message: "in-app text"}
+
+	subject, _, err := renderDelivery(EventBorrowApproved, "fr", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "Peminjaman disetujui" {
+		t.Errorf("unsupported language rendered %q, want the %s template", subject, defaultLanguage)
+	}
+
+	subject, body, err := renderDelivery("no_such_event", "en", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "LibMatch" || body != "in-app text" {
+		t.Errorf("event without template = %q / %q, want the in-app message", subject, body)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	base, max := time.Minute, 30*time.Minute
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{5, 16 * time.Minute},
+		{6, 30 * time.Minute},
+		{20, 30 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := retryBackoff(tt.attempts, base, max); got != tt.want {
+			t.Errorf("retryBackoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestFakeDeliveryChannel(t *testing.T) {
+	t.Setenv("FAKE_DELIVERY_FAIL", "")
+	c := &fakeDeliveryChannel{name: "sms"}
+	msg := DeliveryMessage{Recipient: "+6281234567890", Subject: "Hi", Body: "Hello"}
+	if err := c.Deliver(msg); err != nil {
+		t.Fatal(err)
+	}
+	sent := c.Sent()
+	if len(sent) != 1 || sent[0] != msg {
+		t.Fatalf("Sent() = %v, want [%v]", sent, msg)
+	}
+
+	sent[0].Body = "changed"
+	if c.Sent()[0].Body != "Hello" {
+		t.Error("Sent() shares its slice with the channel")
+	}
+}
+
+func TestFakeDeliveryChannelFailure(t *testing.T) {
+	t.Setenv("FAKE_DELIVERY_FAIL", "email, sms")
+	sms := &fakeDeliveryChannel{name: "sms"}
+	push := &fakeDeliveryChannel{name: "push"}
+
+	if err := sms.Deliver(DeliveryMessage{Recipient: "+62812"}); err == nil {
+		t.Error("sms delivery succeeded, want a failure")
+	}
+	if len(sms.Sent()) != 0 {
+		t.Error("failed delivery was recorded as sent")
+	}
+	if err := push.Deliver(DeliveryMessage{Recipient: "https://fcm.googleapis.com/fcm/send/x"}); err != nil {
+		t.Errorf("push delivery failed: %v", err)
+	}
+}
+
+func TestIsPushServiceHost(t *testing.T) {
+	tests := map[string]bool{
+		"fcm.googleapis.com":                true,
+		"updates.push.services.mozilla.com": true,
+		"web.push.apple.com":                true,
+		"wns2-by3p.notify.windows.com":      true,
+		"FCM.googleapis.com":                true,
+		"example.com":                       false,
+		"push.apple.com.evil.example":       false,
+		"evilpush.apple.com":                false,
+		"googleapis.com":                    false,
+		"localhost":                         false,
+	}
+	for host, want := range tests {
+		if got := isPushServiceHost(host); got != want {
+			t.Errorf("isPushServiceHost(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+func TestRenderBookRejected(t *testing.T) {
+	tests := []struct {
+		language string
+		reason   string
+		want     []string
+	}{
+		{"en", "duplicate", []string{"Reason: This book is already listed.", "Moderator's note: Same ISBN as book 12"}},
+		{"id", "duplicate", []string{"Alasan: Buku ini sudah terdaftar.", "Catatan moderator: Same ISBN as book 12"}},
+	}
+	for _, tt := range tests {
+		data := deliveryTemplateData{
+			Name:    "Sari",
+			Title:   "Laskar Pelangi",
+			Reason:  localizedRejectionReason(tt.reason, tt.language),
+			Comment: "Same ISBN as book 12",
+		}
+		_, body, err := renderDelivery(EventBookRejected, tt.language, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(body, want) {
+				t.Errorf("%s body = %q, want it to contain %q", tt.language, body, want)
+			}
+		}
+	}
+
+	_, body, err := renderDelivery(EventBookRejected, "en", deliveryTemplateData{Name: "Sari", Title: "Laskar Pelangi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(body, "Reason") || strings.Contains(body, "note") {
+		t.Errorf("body without reason = %q", body)
+	}
+}
+
+func TestRejectionReasonsTranslated(t *testing.T) {
+	for _, r := range rejectionReasons {
+		if _, ok := rejectionReasonLabelsID[r.Code]; !ok {
+			t.Errorf("rejection reason %q has no Indonesian label", r.Code)
+		}
+	}
+}
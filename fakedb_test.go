@@ -0,0 +1,215 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeRows is what a scripted query returns.
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+// fakeResponder answers a query the code under test runs. Returning nil means no rows.
+type fakeResponder func(query string, args []driver.Value) (*fakeRows, error)
+
+// fakeStatement is one statement the code under test sent to the database. InTx is set when it
+// ran on a connection with an open transaction.
+type fakeStatement struct {
+	Query string
+	Args  []driver.Value
+	InTx  bool
+}
+
+// fakeDB records every statement and transaction boundary sent through it and answers
+// queries from a responder, so database code can be tested without MySQL.
+type fakeDB struct {
+	mu         sync.Mutex
+	respond    fakeResponder
+	statements []fakeStatement
+	lastID     int64
+}
+
+var fakeDrivers int64
+
+// useFakeDB points the package's db at a fake for the rest of the test.
+func useFakeDB(t *testing.T, respond fakeResponder) *fakeDB {
+	t.Helper()
+	fake := &fakeDB{respond: respond}
+	name := fmt.Sprintf("fakedb-%d", atomic.AddInt64(&fakeDrivers, 1))
+	sql.Register(name, fakeDriver{fake})
+	conn, err := sql.Open(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := db
+	db = conn
+	t.Cleanup(func() {
+		conn.Close()
+		db = previous
+	})
+	return fake
+}
+
+// fakeRow builds a single-row answer.
+func fakeRow(values ...driver.Value) *fakeRows {
+	columns := make([]string, len(values))
+	for i := range columns {
+		columns[i] = fmt.Sprintf("c%d", i)
+	}
+	return &fakeRows{columns: columns, values: [][]driver.Value{values}}
+}
+
+// Statements returns what was sent so far, with BEGIN, COMMIT and ROLLBACK as their own entries.
+func (f *fakeDB) Statements() []fakeStatement {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeStatement(nil), f.statements...)
+}
+
+// Find returns the statements whose text contains every fragment.
+func (f *fakeDB) Find(fragments ...string) []fakeStatement {
+	var found []fakeStatement
+	for _, s := range f.Statements() {
+		if containsAll(s.Query, fragments...) {
+			found = append(found, s)
+		}
+	}
+	return found
+}
+
+// Index returns the position of the first statement containing every fragment, or -1.
+func (f *fakeDB) Index(fragments ...string) int {
+	for i, s := range f.Statements() {
+		if containsAll(s.Query, fragments...) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (f *fakeDB) record(query string, args []driver.Value, inTx bool) {
+	f.mu.Lock()
+	f.statements = append(f.statements, fakeStatement{Query: strings.Join(strings.Fields(query), " "), Args: args, InTx: inTx})
+	f.mu.Unlock()
+}
+
+func containsAll(query string, fragments ...string) bool {
+	for _, fragment := range fragments {
+		if !strings.Contains(query, fragment) {
+			return false
+		}
+	}
+	return true
+}
+
+type fakeDriver struct{ db *fakeDB }
+
+func (d fakeDriver) Open(string) (driver.Conn, error) {
+	return &fakeConn{db: d.db}, nil
+}
+
+type fakeConn struct {
+	db   *fakeDB
+	inTx bool
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.db.record("BEGIN", nil, false)
+	c.inTx = true
+	return c, nil
+}
+
+func (c *fakeConn) Commit() error {
+	c.inTx = false
+	c.db.record("COMMIT", nil, false)
+	return nil
+}
+
+func (c *fakeConn) Rollback() error {
+	c.inTx = false
+	c.db.record("ROLLBACK", nil, false)
+	return nil
+}
+
+func (c *fakeConn) exec(query string, args []driver.Value) (driver.Result, error) {
+	c.db.record(query, args, c.inTx)
+	if c.db.respond != nil {
+		if _, err := c.db.respond(strings.Join(strings.Fields(query), " "), args); err != nil {
+			return nil, err
+		}
+	}
+	c.db.mu.Lock()
+	c.db.lastID++
+	id := c.db.lastID
+	c.db.mu.Unlock()
+	return fakeResult{id}, nil
+}
+
+func (c *fakeConn) query(query string, args []driver.Value) (driver.Rows, error) {
+	c.db.record(query, args, c.inTx)
+	var rows *fakeRows
+	if c.db.respond != nil {
+		var err error
+		rows, err = c.db.respond(strings.Join(strings.Fields(query), " "), args)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if rows == nil {
+		rows = &fakeRows{columns: []string{"c0"}}
+	}
+	return &fakeRowsCursor{rows: rows}, nil
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.conn.exec(s.query, args)
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.query(s.query, args)
+}
+
+type fakeResult struct{ id int64 }
+
+func (r fakeResult) LastInsertId() (int64, error) { return r.id, nil }
+func (r fakeResult) RowsAffected() (int64, error) { return 1, nil }
+
+type fakeRowsCursor struct {
+	rows *fakeRows
+	next int
+}
+
+func (r *fakeRowsCursor) Columns() []string { return r.rows.columns }
+func (r *fakeRowsCursor) Close() error      { return nil }
+
+func (r *fakeRowsCursor) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows.values) {
+		return io.EOF
+	}
+	copy(dest, r.rows.values[r.next])
+	r.next++
+	return nil
+}
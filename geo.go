@@ -0,0 +1,198 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ============ GEO SEARCH ============
+
+// defaultNearbyRadiusKm is used when a nearby query does not give a radius.
+const defaultNearbyRadiusKm = 10.0
+
+var ErrInvalidGeoQuery = errors.New("lat and lng must be valid coordinates and radius must be positive")
+
+// NearbyLocation is a location with its distance from the point that was searched.
+type NearbyLocation struct {
+	Location
+	DistanceKm float64 `json:"distance_km"`
+}
+
+// NearbyBook is a search result with the closest location that has a copy on the shelf.
+type NearbyBook struct {
+	Book
+	LocationID   int     `json:"nearest_location_id"`
+	LocationName string  `json:"nearest_location_name"`
+	DistanceKm   float64 `json:"distance_km"`
+}
+
+// geocodeAddress looks an address up in the offline geocoding table, matching the longest
+// known fragment it contains. Unknown addresses return nil coordinates.
+func geocodeAddress(address string) (*float64, *float64, error) {
+	var lat, lng float64
+	err := db.QueryRow(`
+		SELECT latitude, longitude FROM geocode_address
+		WHERE ? LIKE CONCAT('%', pattern, '%')
+		ORDER BY LENGTH(pattern) DESC LIMIT 1
+	`, strings.ToLower(address)).Scan(&lat, &lng)
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return &lat, &lng, nil
+}
+
+// fillCoordinates geocodes a location that was saved without coordinates.
+func fillCoordinates(loc *Location) error {
+	if loc.Latitude != nil || loc.Longitude != nil {
+		return nil
+	}
+	lat, lng, err := geocodeAddress(loc.Address)
+	if err != nil {
+		return err
+	}
+	loc.Latitude, loc.Longitude = lat, lng
+	return nil
+}
+
+// GetNearbyLocations lists open locations within radiusKm of a point, nearest first.
+func GetNearbyLocations(lat, lng, radiusKm float64) ([]NearbyLocation, error) {
+	locations, err := GetAllLocations()
+	if err != nil {
+		return nil, err
+	}
+
+	nearby := []NearbyLocation{}
+	for _, loc := range locations {
+		if loc.Latitude == nil || loc.Longitude == nil {
+			continue
+		}
+		distance := haversineKm(lat, lng, *loc.Latitude, *loc.Longitude)
+		if distance <= radiusKm {
+			nearby = append(nearby, NearbyLocation{Location: loc, DistanceKm: distance})
+		}
+	}
+	sort.SliceStable(nearby, func(i, j int) bool { return nearby[i].DistanceKm < nearby[j].DistanceKm })
+	return nearby, nil
+}
+
+// SearchBooksNearby returns accepted titles matching query that have a copy on the shelf at a location within
+// radiusKm, sorted by the distance to the closest such location. An empty query matches every title.
+func SearchBooksNearby(query string, lat, lng, radiusKm float64) ([]NearbyBook, error) {
+	onShelf, shelfArgs := shelfCopiesSQL()
+	rows, err := db.Query(`
+		SELECT b.book_id, b.title, b.author, COALESCE(b.publisher, ''), b.year_published, COALESCE(b.isbn, ''),
+		       b.category_id, c.category_name, COALESCE(b.cover_image, ''),
+		       l.location_id, l.location_name, l.latitude, l.longitude
+		FROM book b
+		LEFT JOIN category c ON b.category_id = c.category_id
+		JOIN book_location bl ON bl.book_id = b.book_id AND bl.stock > 0
+		JOIN location l ON l.location_id = bl.location_id
+		WHERE b.status = 'accepted' AND (b.title LIKE ? OR b.author LIKE ?)
+		  AND l.archived_at IS NULL AND l.latitude IS NOT NULL AND l.longitude IS NOT NULL
+		  AND `+onShelf+` > 0
+	`, append([]interface{}{"%" + query + "%", "%" + query + "%"}, shelfArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	nearest := map[int]*NearbyBook{}
+	for rows.Next() {
+		var result NearbyBook
+		var locLat, locLng float64
+		err := rows.Scan(&result.BookID, &result.Title, &result.Author, &result.Publisher, &result.YearPublished, &result.ISBN,
+			&result.CategoryID, &result.CategoryName, &result.CoverImage,
+			&result.LocationID, &result.LocationName, &locLat, &locLng)
+		if err != nil {
+			return nil, err
+		}
+		result.DistanceKm = haversineKm(lat, lng, locLat, locLng)
+		if result.DistanceKm > radiusKm {
+			continue
+		}
+		if current, ok := nearest[result.BookID]; !ok || result.DistanceKm < current.DistanceKm {
+			nearest[result.BookID] = &result
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	books := make([]NearbyBook, 0, len(nearest))
+	for _, book := range nearest {
+		books = append(books, *book)
+	}
+	sort.Slice(books, func(i, j int) bool {
+		if books[i].DistanceKm != books[j].DistanceKm {
+			return books[i].DistanceKm < books[j].DistanceKm
+		}
+		return books[i].BookID < books[j].BookID
+	})
+	return books, nil
+}
+
+// parseGeoQuery reads lat, lng and an optional radius from the query string.
+// ok is false when neither lat nor lng was given.
+func parseGeoQuery(r *http.Request) (lat, lng, radiusKm float64, ok bool, err error) {
+	q := r.URL.Query()
+	if q.Get("lat") == "" && q.Get("lng") == "" {
+		return 0, 0, 0, false, nil
+	}
+
+	lat, latErr := strconv.ParseFloat(q.Get("lat"), 64)
+	lng, lngErr := strconv.ParseFloat(q.Get("lng"), 64)
+	if latErr != nil || lngErr != nil || !validCoordinates(lat, lng) {
+		return 0, 0, 0, true, ErrInvalidGeoQuery
+	}
+
+	radiusKm = defaultNearbyRadiusKm
+	if raw := q.Get("radius"); raw != "" {
+		radiusKm, err = strconv.ParseFloat(raw, 64)
+		if err != nil || radiusKm <= 0 {
+			return 0, 0, 0, true, ErrInvalidGeoQuery
+		}
+	}
+	return lat, lng, radiusKm, true, nil
+}
+
+// ============ GEO SEARCH HANDLERS ============
+
+func getNearbyLocations(w http.ResponseWriter, r *http.Request) {
+	lat, lng, radiusKm, ok, err := parseGeoQuery(r)
+	if !ok {
+		err = ErrInvalidGeoQuery
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	locations, err := GetNearbyLocations(lat, lng, radiusKm)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(locations)
+}
+
+// searchBooksNearby serves /api/books/search when lat and lng are given.
+func searchBooksNearby(w http.ResponseWriter, r *http.Request, lat, lng, radiusKm float64) {
+	books, err := SearchBooksNearby(r.URL.Query().Get("q"), lat, lng, radiusKm)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(books)
+}
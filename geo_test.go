@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseGeoQuery(t *testing.T) {
+	tests := []struct {
+		query      string
+		wantOK     bool
+		wantErr    bool
+		wantRadius float64
+	}{
+		{"q=dune", false, false, 0},
+		{"lat=-6.2&lng=106.8", true, false, defaultNearbyRadiusKm},
+		{"lat=-6.2&lng=106.8&radius=3.5", true, false, 3.5},
+		{"lat=-6.2", true, true, 0},
+		{"lat=95&lng=106.8", true, true, 0},
+		{"lat=-6.2&lng=106.8&radius=0", true, true, 0},
+		{"lat=-6.2&lng=106.8&radius=far", true, true, 0},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/api/books/search?"+tt.query, nil)
+		_, _, radius, ok, err := parseGeoQuery(r)
+		if ok != tt.wantOK || (err != nil) != tt.wantErr {
+			t.Errorf("%s: ok = %v, err = %v; want ok %v, error %v", tt.query, ok, err, tt.wantOK, tt.wantErr)
+			continue
+		}
+		if err != nil && !errors.Is(err, ErrInvalidGeoQuery) {
+			t.Errorf("%s: err = %v, want %v", tt.query, err, ErrInvalidGeoQuery)
+		}
+		if err == nil && radius != tt.wantRadius {
+			t.Errorf("%s: radius = %v, want %v", tt.query, radius, tt.wantRadius)
+		}
+	}
+}
+
+func TestGeocodeAddress(t *testing.T) {
+	fake := useFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+		if args[0] == "jl. thamrin 1, jakarta" {
+			return fakeRow(-6.19, 106.82), nil
+		}
+		return nil, nil
+	})
+
+	lat, lng, err := geocodeAddress("Jl. Thamrin 1, Jakarta")
+	if err != nil || lat == nil || *lat != -6.19 || *lng != 106.82 {
+		t.Errorf("known address = %v, %v, %v", lat, lng, err)
+	}
+	lat, lng, err = geocodeAddress("Somewhere else")
+	if err != nil || lat != nil || lng != nil {
+		t.Errorf("unknown address = %v, %v, %v; want no coordinates", lat, lng, err)
+	}
+
+	// Coordinates entered by staff are kept as they are
+	given := -7.0
+	loc := Location{Address: "Jl. Thamrin 1, Jakarta", Latitude: &given, Longitude: &given}
+	before := len(fake.Statements())
+	if err := fillCoordinates(&loc); err != nil || *loc.Latitude != -7 || len(fake.Statements()) != before {
+		t.Errorf("fillCoordinates replaced or looked up given coordinates")
+	}
+}
+
+func TestSearchBooksNearbyKeepsTheClosestLocation(t *testing.T) {
+	// Book 7 is on the shelf 1 km and 5 km away, book 8 only 3 km away and book 9 50 km away
+	row := func(bookID int64, locationID int64, lat float64) []driver.Value {
+		return []driver.Value{bookID, "Title", "Author", "", int64(2020), "", int64(2), "Fiction", "",
+			locationID, "Branch", lat, 0.0}
+	}
+	km := 1 / 111.195
+	useFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+		if strings.Contains(query, "JOIN book_location bl") {
+			return &fakeRows{columns: make([]string, 13), values: [][]driver.Value{
+				row(7, 2, 5*km),
+				row(8, 3, 3*km),
+				row(7, 1, 1*km),
+				row(9, 4, 50*km),
+			}}, nil
+		}
+		return nil, nil
+	})
+
+	books, err := SearchBooksNearby("", 0, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(books) != 2 {
+		t.Fatalf("got %d books, want 2 within 10 km", len(books))
+	}
+	if books[0].BookID != 7 || books[0].LocationID != 1 || books[1].BookID != 8 {
+		t.Errorf("results = %+v, want book 7 at location 1 then book 8", books)
+	}
+	if d := books[0].DistanceKm; d < 0.99 || d > 1.01 {
+		t.Errorf("book 7 is %v km away, want 1", d)
+	}
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============ HOLDS AND WAITLIST ============
+
+const (
+	HoldStatusWaiting   = "waiting"
+	HoldStatusReady     = "ready"
+	HoldStatusFulfilled = "fulfilled"
+	HoldStatusExpired   = "expired"
+	HoldStatusCancelled = "cancelled"
+)
+
+// holdPickupWindow is how long a member has to collect a copy assigned to their hold.
+const holdPickupWindow = 3 * 24 * time.Hour
+
+var (
+	ErrHoldNotFound      = errors.New("hold not found")
+	ErrHoldNotCancelable = errors.New("hold is no longer active")
+	ErrDuplicateHold     = errors.New("member already has an active hold on this book")
+	ErrBookAvailable     = errors.New("a copy is available, borrow it instead")
+	ErrNoCopiesAvailable = errors.New("no copies available, place a hold instead")
+)
+
+type Hold struct {
+	HoldID         int        `json:"hold_id"`
+	BookID         int        `json:"book_id"`
+	BookTitle      string     `json:"book_title"`
+	UserID         int        `json:"user_id"`
+	LocationID     *int       `json:"location_id"`
+	Status         string     `json:"status"`
+	QueuePosition  int        `json:"queue_position"`
+	CreatedAt      time.Time  `json:"created_at"`
+	ReadyAt        *time.Time `json:"ready_at"`
+	PickupDeadline *time.Time `json:"pickup_deadline"`
+}
+
+// AvailableCopies returns the copies of a book that are neither out on loan, reserved for a ready hold
+// nor being transferred to a waiting hold. A book without book_location rows is a single member-uploaded copy.
+func AvailableCopies(bookID int) (int, error) {
+	return availableCopies(db, bookID)
+}
+
+// lockBookStockTx serializes everything that takes a copy of a book: the book row covers
+// member uploads without book_location rows, and the stock rows are locked so a stock-take
+// or transfer cannot change them while a borrow is being counted.
+func lockBookStockTx(tx *sql.Tx, bookID int) error {
+	var locked int
+	err := tx.QueryRow("SELECT book_id FROM book WHERE book_id = ? FOR UPDATE", bookID).Scan(&locked)
+	if err == sql.ErrNoRows {
+		return ErrBookNotFound
+	}
+	if err != nil {
+		return err
+	}
+	rows, err := tx.Query("SELECT stock FROM book_location WHERE book_id = ? FOR UPDATE", bookID)
+	if err != nil {
+		return err
+	}
+	return rows.Close()
+}
+
+func availableCopies(ex execer, bookID int) (int, error) {
+	placeholders, args := sqlInList(activeBorrowStatuses)
+	var available int
+	err := ex.QueryRow(`
+		SELECT
+			COALESCE((SELECT SUM(stock) FROM book_location WHERE book_id = ?), 1)
+			- (SELECT COUNT(*) FROM borrow WHERE book_id = ? AND status IN (`+placeholders+`))
+			- (SELECT COUNT(*) FROM book_hold WHERE book_id = ? AND status = 'ready')
+			- (SELECT COUNT(*) FROM location_transfer WHERE book_id = ? AND hold_id IS NOT NULL AND status IN ('requested', 'in_transit'))
+	`, append(append([]interface{}{bookID, bookID}, args...), bookID, bookID)...).Scan(&available)
+	return available, err
+}
+
+// shelfCopiesSQL is the number of copies of a book_location row (aliased bl) still on that
+// branch's shelf: its stock less the copies out on loan from it and those about to be sent away.
+func shelfCopiesSQL() (string, []interface{}) {
+	placeholders, args := sqlInList(activeBorrowStatuses)
+	return `(bl.stock
+		- (SELECT COUNT(*) FROM borrow sbr WHERE sbr.book_id = bl.book_id AND sbr.location_id = bl.location_id AND sbr.status IN (` + placeholders + `))
+		- (SELECT COUNT(*) FROM location_transfer stf WHERE stf.book_id = bl.book_id AND stf.from_location_id = bl.location_id
+		   AND stf.status IN ('requested', 'in_transit')))`, args
+}
+
+// holdSelect reads holds with their place in line. Copies are handed out per location to holds
+// for that location or for any location, so a hold only queues behind those; a hold for any
+// location can take a copy anywhere and only queues behind other such holds.
+const holdSelect = `
+	SELECT h.hold_id, h.book_id, COALESCE(b.title, ''), h.user_id, h.location_id, h.status, h.created_at, h.ready_at, h.pickup_deadline,
+	       CASE WHEN h.status = 'waiting' THEN (
+	           SELECT COUNT(*) FROM book_hold q
+	           WHERE q.book_id = h.book_id AND q.status = 'waiting'
+	             AND (q.location_id IS NULL OR q.location_id <=> h.location_id)
+	             AND (q.created_at < h.created_at OR (q.created_at = h.created_at AND q.hold_id <= h.hold_id))
+	       ) ELSE 0 END
+	FROM book_hold h
+	LEFT JOIN book b ON h.book_id = b.book_id
+`
+
+func scanHolds(rows *sql.Rows) ([]Hold, error) {
+	holds := []Hold{}
+	for rows.Next() {
+		var hold Hold
+		var locationID sql.NullInt64
+		var readyAt, deadline sql.NullTime
+		err := rows.Scan(&hold.HoldID, &hold.BookID, &hold.BookTitle, &hold.UserID, &locationID, &hold.Status,
+			&hold.CreatedAt, &readyAt, &deadline, &hold.QueuePosition)
+		if err != nil {
+			return nil, err
+		}
+		if locationID.Valid {
+			id := int(locationID.Int64)
+			hold.LocationID = &id
+		}
+		if readyAt.Valid {
+			hold.ReadyAt = &readyAt.Time
+		}
+		if deadline.Valid {
+			hold.PickupDeadline = &deadline.Time
+		}
+		holds = append(holds, hold)
+	}
+	return holds, nil
+}
+
+func GetUserHolds(userID int) ([]Hold, error) {
+	rows, err := db.Query(holdSelect+" WHERE h.user_id = ? ORDER BY h.created_at DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanHolds(rows)
+}
+
+// GetBookHoldQueue returns the active holds of a book in queue order.
+func GetBookHoldQueue(bookID int) ([]Hold, error) {
+	rows, err := db.Query(holdSelect+" WHERE h.book_id = ? AND h.status IN ('waiting', 'ready') ORDER BY h.status = 'waiting', h.created_at, h.hold_id", bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanHolds(rows)
+}
+
+// PlaceHold queues a member for a book that currently has no available copy. The book's stock
+// is locked first so two requests from the same member cannot both pass the duplicate check.
+func PlaceHold(userID, bookID, locationID int) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := lockBookStockTx(tx, bookID); err != nil {
+		return 0, err
+	}
+
+	var existing int
+	err = tx.QueryRow(`
+		SELECT COUNT(*) FROM book_hold
+		WHERE user_id = ? AND book_id = ? AND status IN ('waiting', 'ready')
+	`, userID, bookID).Scan(&existing)
+	if err != nil {
+		return 0, err
+	}
+	if existing > 0 {
+		return 0, ErrDuplicateHold
+	}
+
+	available, err := availableCopies(tx, bookID)
+	if err != nil {
+		return 0, err
+	}
+	if available > 0 {
+		return 0, ErrBookAvailable
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO book_hold (book_id, user_id, location_id, status, created_at)
+		VALUES (?, ?, ?, ?, NOW())
+	`, bookID, userID, nullableID(locationID), HoldStatusWaiting)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), tx.Commit()
+}
+
+// CancelHold withdraws a member's hold; a copy already reserved for it goes to the next in line.
+func CancelHold(holdID, userID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var bookID, locationID int
+	var status string
+	err = tx.QueryRow(`
+		SELECT book_id, COALESCE(location_id, 0), status FROM book_hold
+		WHERE hold_id = ? AND user_id = ?
+		FOR UPDATE
+	`, holdID, userID).Scan(&bookID, &locationID, &status)
+	if err == sql.ErrNoRows {
+		return ErrHoldNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if status != HoldStatusWaiting && status != HoldStatusReady {
+		return ErrHoldNotCancelable
+	}
+
+	_, err = tx.Exec("UPDATE book_hold SET status = ?, closed_at = NOW() WHERE hold_id = ?", HoldStatusCancelled, holdID)
+	if err != nil {
+		return err
+	}
+	if err := cancelRequestedTransfersTx(tx, "hold_id", holdID); err != nil {
+		return err
+	}
+
+	if status == HoldStatusReady {
+		if _, err := assignNextHoldTx(tx, bookID, locationID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// assignNextHoldTx gives a freed copy to the oldest waiting hold that can collect it at locationID.
+// Holds without a pickup location accept a copy from anywhere. When no hold can, the copy is
+// transferred to a hold waiting at another location instead. It returns the assigned hold ID, or 0.
+func assignNextHoldTx(tx *sql.Tx, bookID, locationID int) (int, error) {
+	var holdID int
+	err := tx.QueryRow(`
+		SELECT hold_id FROM book_hold
+		WHERE book_id = ? AND status = 'waiting' AND (location_id IS NULL OR location_id = ?)
+		ORDER BY created_at, hold_id
+		LIMIT 1
+		FOR UPDATE
+	`, bookID, nullableID(locationID)).Scan(&holdID)
+	if err == sql.ErrNoRows {
+		_, err = transferForHoldTx(tx, bookID, locationID)
+		return 0, err
+	}
+	if err != nil {
+		return 0, err
+	}
+	// A copy found on the spot makes any transfer still waiting to be sent for this hold unnecessary
+	if err := cancelRequestedTransfersTx(tx, "hold_id", holdID); err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE book_hold SET status = ?, ready_at = NOW(), pickup_deadline = ?
+		WHERE hold_id = ?
+	`, HoldStatusReady, time.Now().Add(holdPickupWindow), holdID)
+	if err != nil {
+		return 0, err
+	}
+	return holdID, notifyHoldReadyTx(tx, holdID)
+}
+
+// assignReturnedCopyTx hands the copy freed by a returned, rejected or cancelled borrow to the hold queue.
+func assignReturnedCopyTx(tx *sql.Tx, borrowID int) error {
+	var bookID, locationID int
+	err := tx.QueryRow("SELECT book_id, COALESCE(location_id, 0) FROM borrow WHERE borrow_id = ?", borrowID).
+		Scan(&bookID, &locationID)
+	if err != nil {
+		return err
+	}
+	_, err = assignNextHoldTx(tx, bookID, locationID)
+	return err
+}
+
+// consumeReadyHoldTx marks the member's ready hold as fulfilled once they borrow the book.
+// It reports whether such a hold existed, in which case the reserved copy is theirs to take.
+func consumeReadyHoldTx(tx *sql.Tx, userID, bookID int) (bool, error) {
+	result, err := tx.Exec(`
+		UPDATE book_hold SET status = ?, closed_at = NOW()
+		WHERE user_id = ? AND book_id = ? AND status = 'ready'
+	`, HoldStatusFulfilled, userID, bookID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// ExpireHolds closes ready holds whose pickup deadline passed and offers the copy to the next in line.
+func ExpireHolds() (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT hold_id, book_id, COALESCE(location_id, 0) FROM book_hold
+		WHERE status = 'ready' AND pickup_deadline < NOW()
+		FOR UPDATE
+	`)
+	if err != nil {
+		return 0, err
+	}
+
+	type expiredHold struct{ holdID, bookID, locationID int }
+	var expired []expiredHold
+	for rows.Next() {
+		var h expiredHold
+		if err := rows.Scan(&h.holdID, &h.bookID, &h.locationID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		expired = append(expired, h)
+	}
+	rows.Close()
+
+	for _, h := range expired {
+		_, err := tx.Exec("UPDATE book_hold SET status = ?, closed_at = NOW() WHERE hold_id = ?", HoldStatusExpired, h.holdID)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := assignNextHoldTx(tx, h.bookID, h.locationID); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(expired), tx.Commit()
+}
+
+// ============ HOLD HANDLERS ============
+
+func placeHold(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bookID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid book ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		UserID     int `json:"user_id"`
+		LocationID int `json:"location_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == 0 {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	book, err := GetBookByID(bookID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if book == nil {
+		http.Error(w, "Book not found", http.StatusNotFound)
+		return
+	}
+
+	holdID, err := PlaceHold(req.UserID, bookID, req.LocationID)
+	switch {
+	case errors.Is(err, ErrDuplicateHold), errors.Is(err, ErrBookAvailable):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "Failed to place hold", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Hold placed successfully",
+		"hold_id": holdID,
+	})
+}
+
+func getBookHolds(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bookID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid book ID", http.StatusBadRequest)
+		return
+	}
+
+	holds, err := GetBookHoldQueue(bookID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(holds)
+}
+
+func getUserHolds(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID, err := strconv.Atoi(vars["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	holds, err := GetUserHolds(userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(holds)
+}
+
+func cancelHold(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	holdID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid hold ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		UserID int `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	err = CancelHold(holdID, req.UserID)
+	switch {
+	case errors.Is(err, ErrHoldNotFound):
+		http.Error(w, "Hold not found", http.StatusNotFound)
+		return
+	case errors.Is(err, ErrHoldNotCancelable):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "Failed to cancel hold", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Hold cancelled successfully",
+	})
+}
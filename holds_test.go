@@ -0,0 +1,76 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// holdResponder answers PlaceHold's queries: the book exists, the member already has
+// existing holds on it and available copies are free.
+func holdResponder(existing, available int64) fakeResponder {
+	return func(query string, args []driver.Value) (*fakeRows, error) {
+		switch {
+		case strings.Contains(query, "FROM book WHERE book_id = ? FOR UPDATE"):
+			return fakeRow(int64(7)), nil
+		case strings.Contains(query, "SELECT COUNT(*) FROM book_hold WHERE user_id"):
+			return fakeRow(existing), nil
+		case strings.Contains(query, "SUM(stock)"):
+			return fakeRow(available), nil
+		}
+		return nil, nil
+	}
+}
+
+func TestPlaceHoldLocksBeforeCheckingForDuplicates(t *testing.T) {
+	fake := useFakeDB(t, holdResponder(0, 0))
+
+	if _, err := PlaceHold(3, 7, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	begin := fake.Index("BEGIN")
+	lock := fake.Index("FROM book WHERE book_id = ? FOR UPDATE")
+	check := fake.Index("SELECT COUNT(*) FROM book_hold WHERE user_id")
+	insert := fake.Index("INSERT INTO book_hold")
+	commit := fake.Index("COMMIT")
+	if begin < 0 || !(begin < lock && lock < check && check < insert && insert < commit) {
+		t.Errorf("statement order begin=%d lock=%d check=%d insert=%d commit=%d, want increasing",
+			begin, lock, check, insert, commit)
+	}
+}
+
+func TestPlaceHoldRefusesDuplicates(t *testing.T) {
+	fake := useFakeDB(t, holdResponder(1, 0))
+
+	_, err := PlaceHold(3, 7, 2)
+	if !errors.Is(err, ErrDuplicateHold) {
+		t.Fatalf("PlaceHold = %v, want %v", err, ErrDuplicateHold)
+	}
+	if len(fake.Find("INSERT INTO book_hold")) != 0 {
+		t.Error("a duplicate hold was inserted")
+	}
+	if fake.Index("COMMIT") >= 0 {
+		t.Error("the refused hold was committed")
+	}
+}
+
+func TestPlaceHoldRefusesAvailableBooks(t *testing.T) {
+	fake := useFakeDB(t, holdResponder(0, 1))
+
+	if _, err := PlaceHold(3, 7, 2); !errors.Is(err, ErrBookAvailable) {
+		t.Fatalf("PlaceHold = %v, want %v", err, ErrBookAvailable)
+	}
+	if len(fake.Find("INSERT INTO book_hold")) != 0 {
+		t.Error("a hold was inserted for an available book")
+	}
+}
+
+func TestPlaceHoldUnknownBook(t *testing.T) {
+	useFakeDB(t, nil)
+
+	if _, err := PlaceHold(3, 7, 2); !errors.Is(err, ErrBookNotFound) {
+		t.Fatalf("PlaceHold = %v, want %v", err, ErrBookNotFound)
+	}
+}
@@ -0,0 +1,906 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============ COPIES AND INVENTORY AUDITS ============
+
+// Every unit of book_location stock is backed by a book_copy row carrying a printable barcode.
+// Copies are created on demand from the stock count, so stock stays the figure the rest of the
+// server works with and copies only add identity for stock-takes.
+const (
+	CopyStatusShelved = "shelved"
+	CopyStatusLost    = "lost"
+)
+
+const (
+	AuditStatusOpen      = "open"
+	AuditStatusSubmitted = "submitted"
+	AuditStatusClosed    = "closed"
+	AuditStatusCancelled = "cancelled"
+)
+
+const (
+	DiscrepancyMissing    = "missing"
+	DiscrepancyUnexpected = "unexpected"
+	DiscrepancyMisplaced  = "misplaced"
+)
+
+const (
+	ResolutionPending   = "pending"
+	ResolutionApproved  = "approved"
+	ResolutionDismissed = "dismissed"
+)
+
+// offShelfBorrowStatuses are the borrow statuses whose copy has physically left its branch.
+var offShelfBorrowStatuses = []string{BorrowStatusDispatched, BorrowStatusOnLoan, BorrowStatusLost}
+
+var (
+	ErrAuditNotFound          = errors.New("audit not found")
+	ErrAuditInProgress        = errors.New("the location already has an audit in progress")
+	ErrAuditNotOpen           = errors.New("audit is not accepting scans")
+	ErrAuditNotSubmitted      = errors.New("audit has not been submitted for approval")
+	ErrDiscrepancyNotFound    = errors.New("discrepancy not found")
+	ErrDiscrepancyResolved    = errors.New("discrepancy has already been resolved")
+	ErrUnexpectedCopyNeedBook = errors.New("approving an unexpected copy needs the book_id it belongs to")
+)
+
+type BookCopy struct {
+	CopyID     int    `json:"copy_id"`
+	BookID     int    `json:"book_id"`
+	BookTitle  string `json:"book_title"`
+	LocationID int    `json:"location_id"`
+	Barcode    string `json:"barcode"`
+	Status     string `json:"status"`
+}
+
+type InventoryAudit struct {
+	AuditID     int        `json:"audit_id"`
+	LocationID  int        `json:"location_id"`
+	Status      string     `json:"status"`
+	StartedBy   int        `json:"started_by"`
+	StartedAt   time.Time  `json:"started_at"`
+	SubmittedAt *time.Time `json:"submitted_at"`
+	ClosedAt    *time.Time `json:"closed_at"`
+	ScanCount   int        `json:"scan_count"`
+}
+
+type InventoryDiscrepancy struct {
+	DiscrepancyID      int     `json:"discrepancy_id"`
+	Kind               string  `json:"kind"`
+	Barcode            string  `json:"barcode"`
+	CopyID             *int    `json:"copy_id"`
+	BookID             *int    `json:"book_id"`
+	BookTitle          string  `json:"book_title"`
+	RecordedLocationID *int    `json:"recorded_location_id"`
+	Resolution         string  `json:"resolution"`
+	Note               *string `json:"note,omitempty"`
+}
+
+// AuditBookSummary explains, per title, how the shelf compares with the records.
+type AuditBookSummary struct {
+	BookID    int    `json:"book_id"`
+	BookTitle string `json:"book_title"`
+	Expected  int    `json:"expected"`
+	Scanned   int    `json:"scanned"`
+	OffShelf  int    `json:"off_shelf"`
+	Missing   int    `json:"missing"`
+}
+
+// AuditReport is the live comparison of an audit's scans with the copies recorded at its location.
+type AuditReport struct {
+	Audit         InventoryAudit         `json:"audit"`
+	Books         []AuditBookSummary     `json:"books"`
+	Discrepancies []InventoryDiscrepancy `json:"discrepancies"`
+}
+
+// syncCopiesTx creates copies for stock at a location that has none yet.
+func syncCopiesTx(tx *sql.Tx, locationID int) error {
+	rows, err := tx.Query(`
+		SELECT bl.book_id, bl.stock - (
+			SELECT COUNT(*) FROM book_copy c
+			WHERE c.book_id = bl.book_id AND c.location_id = bl.location_id AND c.status = 'shelved'
+		)
+		FROM book_location bl
+		WHERE bl.location_id = ?
+	`, locationID)
+	if err != nil {
+		return err
+	}
+
+	shortfall := map[int]int{}
+	for rows.Next() {
+		var bookID, missing int
+		if err := rows.Scan(&bookID, &missing); err != nil {
+			rows.Close()
+			return err
+		}
+		if missing > 0 {
+			shortfall[bookID] = missing
+		}
+	}
+	rows.Close()
+
+	for bookID, missing := range shortfall {
+		for i := 0; i < missing; i++ {
+			_, err := tx.Exec("INSERT INTO book_copy (book_id, location_id, status, created_at) VALUES (?, ?, ?, NOW())",
+				bookID, locationID, CopyStatusShelved)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	_, err = tx.Exec("UPDATE book_copy SET barcode = CONCAT('LMC', LPAD(copy_id, 7, '0')) WHERE barcode IS NULL")
+	return err
+}
+
+// moveCopyStockTx moves one unit of stock between locations; fromLocationID 0 only adds it.
+func moveCopyStockTx(tx *sql.Tx, bookID, fromLocationID, toLocationID int) error {
+	if fromLocationID != 0 {
+		_, err := tx.Exec("UPDATE book_location SET stock = stock - 1 WHERE book_id = ? AND location_id = ? AND stock > 0",
+			bookID, fromLocationID)
+		if err != nil {
+			return err
+		}
+	}
+	if toLocationID == 0 {
+		return nil
+	}
+	result, err := tx.Exec("UPDATE book_location SET stock = stock + 1 WHERE book_id = ? AND location_id = ?", bookID, toLocationID)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil || affected > 0 {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO book_location (book_id, location_id, stock) VALUES (?, ?, 1)", bookID, toLocationID)
+	return err
+}
+
+// relocateAnyCopyTx updates the records of one shelved copy that moved between branches without a scan.
+func relocateAnyCopyTx(tx *sql.Tx, bookID, fromLocationID, toLocationID int) error {
+	_, err := tx.Exec(`
+		UPDATE book_copy SET location_id = ?
+		WHERE book_id = ? AND location_id = ? AND status = 'shelved'
+		ORDER BY copy_id LIMIT 1
+	`, toLocationID, bookID, fromLocationID)
+	return err
+}
+
+func GetLocationCopies(locationID int) ([]BookCopy, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := syncCopiesTx(tx, locationID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT c.copy_id, c.book_id, COALESCE(b.title, ''), c.location_id, c.barcode, c.status
+		FROM book_copy c
+		LEFT JOIN book b ON b.book_id = c.book_id
+		WHERE c.location_id = ? AND c.status = 'shelved'
+		ORDER BY b.title, c.copy_id
+	`, locationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	copies := []BookCopy{}
+	for rows.Next() {
+		var c BookCopy
+		if err := rows.Scan(&c.CopyID, &c.BookID, &c.BookTitle, &c.LocationID, &c.Barcode, &c.Status); err != nil {
+			return nil, err
+		}
+		copies = append(copies, c)
+	}
+	return copies, nil
+}
+
+// StartAudit opens a stock-take at a location; only one may run per location at a time.
+func StartAudit(locationID, staffID int) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var locked int
+	err = tx.QueryRow("SELECT location_id FROM location WHERE location_id = ? FOR UPDATE", locationID).Scan(&locked)
+	if err == sql.ErrNoRows {
+		return 0, ErrLocationNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var running int
+	err = tx.QueryRow("SELECT COUNT(*) FROM inventory_audit WHERE location_id = ? AND status IN ('open', 'submitted')", locationID).
+		Scan(&running)
+	if err != nil {
+		return 0, err
+	}
+	if running > 0 {
+		return 0, ErrAuditInProgress
+	}
+
+	if err := syncCopiesTx(tx, locationID); err != nil {
+		return 0, err
+	}
+
+	result, err := tx.Exec("INSERT INTO inventory_audit (location_id, status, started_by, started_at) VALUES (?, ?, ?, NOW())",
+		locationID, AuditStatusOpen, staffID)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), tx.Commit()
+}
+
+// RecordScan stores a scanned barcode and reports what it is: "expected", "misplaced",
+// "unexpected", or "duplicate" when it was already scanned in this audit.
+func RecordScan(auditID int, barcode string, staffID int) (string, *BookCopy, error) {
+	barcode = strings.ToUpper(strings.TrimSpace(barcode))
+
+	audit, err := GetAudit(auditID)
+	if err != nil {
+		return "", nil, err
+	}
+	if audit == nil {
+		return "", nil, ErrAuditNotFound
+	}
+	if audit.Status != AuditStatusOpen {
+		return "", nil, ErrAuditNotOpen
+	}
+
+	var bookCopy BookCopy
+	err = db.QueryRow(`
+		SELECT c.copy_id, c.book_id, COALESCE(b.title, ''), c.location_id, c.barcode, c.status
+		FROM book_copy c LEFT JOIN book b ON b.book_id = c.book_id
+		WHERE c.barcode = ?
+	`, barcode).Scan(&bookCopy.CopyID, &bookCopy.BookID, &bookCopy.BookTitle, &bookCopy.LocationID, &bookCopy.Barcode, &bookCopy.Status)
+	found := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		return "", nil, err
+	}
+
+	result, err := db.Exec(`
+		INSERT IGNORE INTO inventory_scan (audit_id, barcode, copy_id, scanned_by, scanned_at)
+		VALUES (?, ?, ?, ?, NOW())
+	`, auditID, barcode, nullableID(bookCopy.CopyID), nullableID(staffID))
+	if err != nil {
+		return "", nil, err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return "", nil, err
+	} else if affected == 0 {
+		return "duplicate", nil, nil
+	}
+
+	switch {
+	case !found:
+		return DiscrepancyUnexpected, nil, nil
+	case bookCopy.LocationID != audit.LocationID || bookCopy.Status != CopyStatusShelved:
+		return DiscrepancyMisplaced, &bookCopy, nil
+	default:
+		return "expected", &bookCopy, nil
+	}
+}
+
+// computeDiscrepancies compares an audit's scans with the copies recorded at its location.
+// Unscanned copies are only reported missing beyond the number the location has out on loan
+// or on the road, since those copies cannot be on the shelf.
+func computeDiscrepancies(audit *InventoryAudit) ([]AuditBookSummary, []InventoryDiscrepancy, error) {
+	placeholders, args := sqlInList(offShelfBorrowStatuses)
+	rows, err := db.Query(`
+		SELECT c.book_id, COALESCE(b.title, ''), COUNT(*),
+		       SUM(EXISTS(SELECT 1 FROM inventory_scan s WHERE s.audit_id = ? AND s.copy_id = c.copy_id)),
+		       (SELECT COUNT(*) FROM borrow br WHERE br.book_id = c.book_id AND br.location_id = c.location_id AND br.status IN (`+placeholders+`))
+		       + (SELECT COUNT(*) FROM location_transfer t WHERE t.book_id = c.book_id AND t.from_location_id = c.location_id AND t.status = 'in_transit')
+		FROM book_copy c
+		LEFT JOIN book b ON b.book_id = c.book_id
+		WHERE c.location_id = ? AND c.status = 'shelved'
+		GROUP BY c.book_id, b.title
+		ORDER BY b.title
+	`, append(append([]interface{}{audit.AuditID}, args...), audit.LocationID)...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	books := []AuditBookSummary{}
+	for rows.Next() {
+		var s AuditBookSummary
+		if err := rows.Scan(&s.BookID, &s.BookTitle, &s.Expected, &s.Scanned, &s.OffShelf); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		if s.Missing = s.Expected - s.Scanned - s.OffShelf; s.Missing < 0 {
+			s.Missing = 0
+		}
+		books = append(books, s)
+	}
+	rows.Close()
+
+	discrepancies := []InventoryDiscrepancy{}
+	for _, s := range books {
+		if s.Missing == 0 {
+			continue
+		}
+		missing, err := db.Query(`
+			SELECT c.copy_id, c.barcode FROM book_copy c
+			WHERE c.book_id = ? AND c.location_id = ? AND c.status = 'shelved'
+			  AND NOT EXISTS (SELECT 1 FROM inventory_scan s WHERE s.audit_id = ? AND s.copy_id = c.copy_id)
+			ORDER BY c.copy_id DESC
+			LIMIT ?
+		`, s.BookID, audit.LocationID, audit.AuditID, s.Missing)
+		if err != nil {
+			return nil, nil, err
+		}
+		for missing.Next() {
+			var copyID int
+			d := InventoryDiscrepancy{Kind: DiscrepancyMissing, BookTitle: s.BookTitle, Resolution: ResolutionPending}
+			if err := missing.Scan(&copyID, &d.Barcode); err != nil {
+				missing.Close()
+				return nil, nil, err
+			}
+			bookID, locationID := s.BookID, audit.LocationID
+			d.CopyID, d.BookID, d.RecordedLocationID = &copyID, &bookID, &locationID
+			discrepancies = append(discrepancies, d)
+		}
+		missing.Close()
+	}
+
+	scans, err := db.Query(`
+		SELECT s.barcode, c.copy_id, c.book_id, COALESCE(b.title, ''), c.location_id
+		FROM inventory_scan s
+		LEFT JOIN book_copy c ON c.copy_id = s.copy_id
+		LEFT JOIN book b ON b.book_id = c.book_id
+		WHERE s.audit_id = ? AND (s.copy_id IS NULL OR c.location_id <> ? OR c.status <> 'shelved')
+		ORDER BY s.scan_id
+	`, audit.AuditID, audit.LocationID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer scans.Close()
+	for scans.Next() {
+		var copyID, bookID, locationID sql.NullInt64
+		d := InventoryDiscrepancy{Kind: DiscrepancyUnexpected, Resolution: ResolutionPending}
+		if err := scans.Scan(&d.Barcode, &copyID, &bookID, &d.BookTitle, &locationID); err != nil {
+			return nil, nil, err
+		}
+		if copyID.Valid {
+			d.Kind = DiscrepancyMisplaced
+			c, b, l := int(copyID.Int64), int(bookID.Int64), int(locationID.Int64)
+			d.CopyID, d.BookID, d.RecordedLocationID = &c, &b, &l
+		}
+		discrepancies = append(discrepancies, d)
+	}
+	return books, discrepancies, nil
+}
+
+// SubmitAudit closes scanning and records the discrepancies for approval. An audit without
+// discrepancies is closed straight away.
+func SubmitAudit(auditID int) error {
+	audit, err := GetAudit(auditID)
+	if err != nil {
+		return err
+	}
+	if audit == nil {
+		return ErrAuditNotFound
+	}
+	if audit.Status != AuditStatusOpen {
+		return ErrAuditNotOpen
+	}
+
+	_, discrepancies, err := computeDiscrepancies(audit)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE inventory_audit SET status = ?, submitted_at = NOW() WHERE audit_id = ? AND status = ?",
+		AuditStatusSubmitted, auditID, AuditStatusOpen)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrAuditNotOpen
+	}
+
+	for _, d := range discrepancies {
+		_, err := tx.Exec(`
+			INSERT INTO inventory_discrepancy (audit_id, kind, barcode, copy_id, book_id, recorded_location_id, resolution)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, auditID, d.Kind, d.Barcode, d.CopyID, d.BookID, d.RecordedLocationID, ResolutionPending)
+		if err != nil {
+			return err
+		}
+	}
+	if err := closeAuditIfResolvedTx(tx, auditID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ResolveDiscrepancy approves or dismisses one discrepancy of a submitted audit. Approving a
+// missing copy marks it lost, a misplaced copy is relocated to the audited branch and an
+// unexpected barcode is registered there as a new copy of bookID.
+func ResolveDiscrepancy(auditID, discrepancyID int, approve bool, bookID, staffID int, note string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var auditStatus, kind, resolution, barcode string
+	var locationID int
+	var copyID, copyBookID, recordedLocationID sql.NullInt64
+	err = tx.QueryRow(`
+		SELECT a.status, a.location_id, d.kind, d.resolution, d.barcode, d.copy_id, d.book_id, d.recorded_location_id
+		FROM inventory_discrepancy d
+		JOIN inventory_audit a ON a.audit_id = d.audit_id
+		WHERE d.discrepancy_id = ? AND d.audit_id = ?
+		FOR UPDATE
+	`, discrepancyID, auditID).Scan(&auditStatus, &locationID, &kind, &resolution, &barcode, &copyID, &copyBookID, &recordedLocationID)
+	if err == sql.ErrNoRows {
+		return ErrDiscrepancyNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if auditStatus != AuditStatusSubmitted {
+		return ErrAuditNotSubmitted
+	}
+	if resolution != ResolutionPending {
+		return ErrDiscrepancyResolved
+	}
+
+	newResolution := ResolutionDismissed
+	if approve {
+		newResolution = ResolutionApproved
+		switch kind {
+		case DiscrepancyMissing:
+			_, err = tx.Exec("UPDATE book_copy SET status = ?, lost_at = NOW() WHERE copy_id = ? AND status = ?",
+				CopyStatusLost, copyID.Int64, CopyStatusShelved)
+			if err == nil {
+				err = moveCopyStockTx(tx, int(copyBookID.Int64), locationID, 0)
+			}
+		case DiscrepancyMisplaced:
+			var fromLocationID int
+			var status string
+			err = tx.QueryRow("SELECT location_id, status FROM book_copy WHERE copy_id = ? FOR UPDATE", copyID.Int64).
+				Scan(&fromLocationID, &status)
+			if err == nil {
+				if status != CopyStatusShelved {
+					// A copy written off as lost has turned up again
+					fromLocationID = 0
+				}
+				_, err = tx.Exec("UPDATE book_copy SET location_id = ?, status = ?, lost_at = NULL WHERE copy_id = ?",
+					locationID, CopyStatusShelved, copyID.Int64)
+			}
+			if err == nil {
+				err = moveCopyStockTx(tx, int(copyBookID.Int64), fromLocationID, locationID)
+			}
+		case DiscrepancyUnexpected:
+			if bookID == 0 {
+				return ErrUnexpectedCopyNeedBook
+			}
+			_, err = tx.Exec("INSERT INTO book_copy (book_id, location_id, barcode, status, created_at) VALUES (?, ?, ?, ?, NOW())",
+				bookID, locationID, barcode, CopyStatusShelved)
+			if err == nil {
+				err = moveCopyStockTx(tx, bookID, 0, locationID)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`
+		UPDATE inventory_discrepancy SET resolution = ?, resolved_book_id = ?, resolved_by = ?, resolved_at = NOW(), note = ?
+		WHERE discrepancy_id = ?
+	`, newResolution, nullableID(bookID), nullableID(staffID), note, discrepancyID)
+	if err != nil {
+		return err
+	}
+	if err := closeAuditIfResolvedTx(tx, auditID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func closeAuditIfResolvedTx(tx *sql.Tx, auditID int) error {
+	_, err := tx.Exec(`
+		UPDATE inventory_audit SET status = ?, closed_at = NOW()
+		WHERE audit_id = ? AND status = ?
+		  AND NOT EXISTS (SELECT 1 FROM inventory_discrepancy WHERE audit_id = ? AND resolution = ?)
+	`, AuditStatusClosed, auditID, AuditStatusSubmitted, auditID, ResolutionPending)
+	return err
+}
+
+// CancelAudit abandons an audit that has not been submitted.
+func CancelAudit(auditID int) error {
+	result, err := db.Exec("UPDATE inventory_audit SET status = ?, closed_at = NOW() WHERE audit_id = ? AND status = ?",
+		AuditStatusCancelled, auditID, AuditStatusOpen)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrAuditNotOpen
+	}
+	return nil
+}
+
+const auditSelect = `
+	SELECT a.audit_id, a.location_id, a.status, a.started_by, a.started_at, a.submitted_at, a.closed_at,
+	       (SELECT COUNT(*) FROM inventory_scan s WHERE s.audit_id = a.audit_id)
+	FROM inventory_audit a
+`
+
+func scanAudit(scanner interface{ Scan(...interface{}) error }) (*InventoryAudit, error) {
+	var a InventoryAudit
+	var submittedAt, closedAt sql.NullTime
+	err := scanner.Scan(&a.AuditID, &a.LocationID, &a.Status, &a.StartedBy, &a.StartedAt, &submittedAt, &closedAt, &a.ScanCount)
+	if err != nil {
+		return nil, err
+	}
+	if submittedAt.Valid {
+		a.SubmittedAt = &submittedAt.Time
+	}
+	if closedAt.Valid {
+		a.ClosedAt = &closedAt.Time
+	}
+	return &a, nil
+}
+
+func GetAudit(auditID int) (*InventoryAudit, error) {
+	audit, err := scanAudit(db.QueryRow(auditSelect+" WHERE a.audit_id = ?", auditID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return audit, err
+}
+
+func GetLocationAudits(locationID int) ([]InventoryAudit, error) {
+	rows, err := db.Query(auditSelect+" WHERE a.location_id = ? ORDER BY a.started_at DESC, a.audit_id DESC", locationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	audits := []InventoryAudit{}
+	for rows.Next() {
+		audit, err := scanAudit(rows)
+		if err != nil {
+			return nil, err
+		}
+		audits = append(audits, *audit)
+	}
+	return audits, nil
+}
+
+// GetAuditReport returns the live comparison while an audit is open and the recorded
+// discrepancies with their resolutions once it has been submitted.
+func GetAuditReport(auditID int) (*AuditReport, error) {
+	audit, err := GetAudit(auditID)
+	if err != nil || audit == nil {
+		return nil, err
+	}
+
+	books, discrepancies, err := computeDiscrepancies(audit)
+	if err != nil {
+		return nil, err
+	}
+	report := &AuditReport{Audit: *audit, Books: books, Discrepancies: discrepancies}
+	if audit.Status == AuditStatusOpen || audit.Status == AuditStatusCancelled {
+		return report, nil
+	}
+
+	rows, err := db.Query(`
+		SELECT d.discrepancy_id, d.kind, d.barcode, d.copy_id, d.book_id, COALESCE(b.title, ''), d.recorded_location_id, d.resolution, d.note
+		FROM inventory_discrepancy d
+		LEFT JOIN book b ON b.book_id = d.book_id
+		WHERE d.audit_id = ?
+		ORDER BY d.discrepancy_id
+	`, auditID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report.Discrepancies = []InventoryDiscrepancy{}
+	for rows.Next() {
+		var d InventoryDiscrepancy
+		var copyID, bookID, locationID sql.NullInt64
+		var note sql.NullString
+		if err := rows.Scan(&d.DiscrepancyID, &d.Kind, &d.Barcode, &copyID, &bookID, &d.BookTitle, &locationID, &d.Resolution, &note); err != nil {
+			return nil, err
+		}
+		for _, field := range []struct {
+			value  sql.NullInt64
+			target **int
+		}{{copyID, &d.CopyID}, {bookID, &d.BookID}, {locationID, &d.RecordedLocationID}} {
+			if field.value.Valid {
+				id := int(field.value.Int64)
+				*field.target = &id
+			}
+		}
+		if note.Valid {
+			d.Note = &note.String
+		}
+		report.Discrepancies = append(report.Discrepancies, d)
+	}
+	return report, nil
+}
+
+// ============ INVENTORY HANDLERS ============
+
+func writeAuditError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, ErrAuditNotFound), errors.Is(err, ErrDiscrepancyNotFound), errors.Is(err, ErrLocationNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrUnexpectedCopyNeedBook):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrAuditInProgress), errors.Is(err, ErrAuditNotOpen),
+		errors.Is(err, ErrAuditNotSubmitted), errors.Is(err, ErrDiscrepancyResolved):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, fallback, http.StatusInternalServerError)
+	}
+}
+
+// loadAudit reads the {id} path variable and checks the caller manages the audited location.
+func loadAudit(w http.ResponseWriter, r *http.Request) *InventoryAudit {
+	auditID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid audit ID", http.StatusBadRequest)
+		return nil
+	}
+	audit, err := GetAudit(auditID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return nil
+	}
+	if audit == nil {
+		http.Error(w, "Audit not found", http.StatusNotFound)
+		return nil
+	}
+	if !requireLocationManager(w, r, audit.LocationID) {
+		return nil
+	}
+	return audit
+}
+
+func getLocationCopies(w http.ResponseWriter, r *http.Request) {
+	locationID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid location ID", http.StatusBadRequest)
+		return
+	}
+	if !requireLocationManager(w, r, locationID) {
+		return
+	}
+
+	copies, err := GetLocationCopies(locationID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(copies)
+}
+
+func startAudit(w http.ResponseWriter, r *http.Request) {
+	locationID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid location ID", http.StatusBadRequest)
+		return
+	}
+	if !requireLocationManager(w, r, locationID) {
+		return
+	}
+
+	auditID, err := StartAudit(locationID, actingUserID(r))
+	if err != nil {
+		writeAuditError(w, err, "Failed to start audit")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"message":  "Audit started",
+		"audit_id": auditID,
+	})
+}
+
+func getLocationAudits(w http.ResponseWriter, r *http.Request) {
+	locationID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid location ID", http.StatusBadRequest)
+		return
+	}
+	if !requireLocationManager(w, r, locationID) {
+		return
+	}
+
+	audits, err := GetLocationAudits(locationID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(audits)
+}
+
+func getAuditReport(w http.ResponseWriter, r *http.Request) {
+	audit := loadAudit(w, r)
+	if audit == nil {
+		return
+	}
+
+	report, err := GetAuditReport(audit.AuditID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// recordAuditScan accepts {"barcode": "..."} from a handheld scanner or {"barcodes": [...]} for a batch upload.
+func recordAuditScan(w http.ResponseWriter, r *http.Request) {
+	audit := loadAudit(w, r)
+	if audit == nil {
+		return
+	}
+
+	var req struct {
+		Barcode  string   `json:"barcode"`
+		Barcodes []string `json:"barcodes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.Barcode != "" {
+		req.Barcodes = append(req.Barcodes, req.Barcode)
+	}
+	if len(req.Barcodes) == 0 {
+		http.Error(w, "barcode is required", http.StatusBadRequest)
+		return
+	}
+
+	results := []map[string]interface{}{}
+	for _, barcode := range req.Barcodes {
+		if strings.TrimSpace(barcode) == "" {
+			continue
+		}
+		outcome, bookCopy, err := RecordScan(audit.AuditID, barcode, actingUserID(r))
+		if err != nil {
+			writeAuditError(w, err, "Failed to record scan")
+			return
+		}
+		results = append(results, map[string]interface{}{
+			"barcode": strings.ToUpper(strings.TrimSpace(barcode)),
+			"result":  outcome,
+			"copy":    bookCopy,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"scans":   results,
+	})
+}
+
+func submitAudit(w http.ResponseWriter, r *http.Request) {
+	audit := loadAudit(w, r)
+	if audit == nil {
+		return
+	}
+
+	if err := SubmitAudit(audit.AuditID); err != nil {
+		writeAuditError(w, err, "Failed to submit audit")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Audit submitted for approval",
+	})
+}
+
+func cancelAudit(w http.ResponseWriter, r *http.Request) {
+	audit := loadAudit(w, r)
+	if audit == nil {
+		return
+	}
+
+	if err := CancelAudit(audit.AuditID); err != nil {
+		writeAuditError(w, err, "Failed to cancel audit")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Audit cancelled",
+	})
+}
+
+// resolveDiscrepancy is admin-only so that the staff counting a shelf cannot write off its copies.
+func resolveDiscrepancy(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	auditID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid audit ID", http.StatusBadRequest)
+		return
+	}
+	discrepancyID, err := strconv.Atoi(vars["discrepancyId"])
+	if err != nil {
+		http.Error(w, "Invalid discrepancy ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Action string `json:"action"`
+		BookID int    `json:"book_id"`
+		Note   string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Action != "approve" && req.Action != "dismiss") {
+		http.Error(w, "action must be approve or dismiss", http.StatusBadRequest)
+		return
+	}
+
+	err = ResolveDiscrepancy(auditID, discrepancyID, req.Action == "approve", req.BookID, actingUserID(r), req.Note)
+	if err != nil {
+		writeAuditError(w, err, "Failed to resolve discrepancy")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Discrepancy resolved",
+	})
+}
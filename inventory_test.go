@@ -0,0 +1,185 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStartAuditCreatesMissingCopies(t *testing.T) {
+	fake := useFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+		switch {
+		case strings.Contains(query, "SELECT location_id FROM location WHERE location_id = ? FOR UPDATE"):
+			return fakeRow(int64(2)), nil
+		case strings.Contains(query, "SELECT COUNT(*) FROM inventory_audit"):
+			return fakeRow(int64(0)), nil
+		case strings.Contains(query, "FROM book_location bl WHERE bl.location_id = ?"):
+			// Book 7 has two copies without a barcode yet, book 8 is fully backed
+			return &fakeRows{columns: []string{"book_id", "missing"}, values: [][]driver.Value{
+				{int64(7), int64(2)},
+				{int64(8), int64(0)},
+			}}, nil
+		}
+		return nil, nil
+	})
+
+	if _, err := StartAudit(2, 1); err != nil {
+		t.Fatal(err)
+	}
+	copies := fake.Find("INSERT INTO book_copy")
+	if len(copies) != 2 || copies[0].Args[0] != int64(7) {
+		t.Errorf("created copies %+v, want two of book 7", copies)
+	}
+	if fake.Index("UPDATE book_copy SET barcode") > fake.Index("INSERT INTO inventory_audit") {
+		t.Error("barcodes were assigned after the audit started")
+	}
+}
+
+func TestStartAuditRefusals(t *testing.T) {
+	useFakeDB(t, nil)
+	if _, err := StartAudit(2, 1); !errors.Is(err, ErrLocationNotFound) {
+		t.Errorf("unknown location = %v, want %v", err, ErrLocationNotFound)
+	}
+
+	fake := useFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+		switch {
+		case strings.Contains(query, "SELECT location_id FROM location"):
+			return fakeRow(int64(2)), nil
+		case strings.Contains(query, "SELECT COUNT(*) FROM inventory_audit"):
+			return fakeRow(int64(1)), nil
+		}
+		return nil, nil
+	})
+	if _, err := StartAudit(2, 1); !errors.Is(err, ErrAuditInProgress) {
+		t.Errorf("second audit = %v, want %v", err, ErrAuditInProgress)
+	}
+	if len(fake.Find("INSERT INTO inventory_audit")) != 0 {
+		t.Error("a second audit was started")
+	}
+}
+
+// scanResponder answers RecordScan for audit 3 at location 2 in the given status. Barcode
+// LMC0000001 is shelved at location 2 and LMC0000002 at location 4.
+func scanResponder(auditStatus string) fakeResponder {
+	return func(query string, args []driver.Value) (*fakeRows, error) {
+		switch {
+		case strings.Contains(query, "FROM inventory_audit a WHERE a.audit_id = ?"):
+			return fakeRow(int64(3), int64(2), auditStatus, int64(1), time.Now(), nil, nil, int64(0)), nil
+		case strings.Contains(query, "FROM book_copy c LEFT JOIN book b ON b.book_id = c.book_id WHERE c.barcode = ?"):
+			switch args[0] {
+			case "LMC0000001":
+				return fakeRow(int64(1), int64(7), "Title", int64(2), "LMC0000001", CopyStatusShelved), nil
+			case "LMC0000002":
+				return fakeRow(int64(2), int64(7), "Title", int64(4), "LMC0000002", CopyStatusShelved), nil
+			}
+		}
+		return nil, nil
+	}
+}
+
+func TestRecordScan(t *testing.T) {
+	tests := []struct {
+		barcode string
+		want    string
+	}{
+		{" lmc0000001 ", "expected"},
+		{"LMC0000002", DiscrepancyMisplaced},
+		{"LMC9999999", DiscrepancyUnexpected},
+	}
+	for _, tt := range tests {
+		fake := useFakeDB(t, scanResponder(AuditStatusOpen))
+		got, _, err := RecordScan(3, tt.barcode, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("RecordScan(%q) = %s, want %s", tt.barcode, got, tt.want)
+		}
+		scans := fake.Find("INSERT IGNORE INTO inventory_scan")
+		if len(scans) != 1 || scans[0].Args[1] != strings.ToUpper(strings.TrimSpace(tt.barcode)) {
+			t.Errorf("scan of %q stored as %+v", tt.barcode, scans)
+		}
+	}
+
+	useFakeDB(t, scanResponder(AuditStatusSubmitted))
+	if _, _, err := RecordScan(3, "LMC0000001", 1); !errors.Is(err, ErrAuditNotOpen) {
+		t.Errorf("scan into a submitted audit = %v, want %v", err, ErrAuditNotOpen)
+	}
+}
+
+func TestComputeDiscrepanciesDiscountsCopiesOffTheShelf(t *testing.T) {
+	useFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+		switch {
+		case strings.Contains(query, "GROUP BY c.book_id"):
+			// Four copies recorded, one scanned and two out on loan or in transit
+			return fakeRow(int64(7), "Title", int64(4), int64(1), int64(2)), nil
+		case strings.Contains(query, "SELECT c.copy_id, c.barcode FROM book_copy c"):
+			if args[3] != int64(1) {
+				t.Errorf("asked for %v missing copies, want 1", args[3])
+			}
+			return fakeRow(int64(4), "LMC0000004"), nil
+		case strings.Contains(query, "FROM inventory_scan s LEFT JOIN book_copy c"):
+			return fakeRow("STRAY", nil, nil, "", nil), nil
+		}
+		return nil, nil
+	})
+
+	books, discrepancies, err := computeDiscrepancies(&InventoryAudit{AuditID: 3, LocationID: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(books) != 1 || books[0].Missing != 1 {
+		t.Fatalf("books = %+v, want one copy of book 7 missing", books)
+	}
+	if len(discrepancies) != 2 || discrepancies[0].Kind != DiscrepancyMissing || discrepancies[1].Kind != DiscrepancyUnexpected {
+		t.Errorf("discrepancies = %+v, want one missing copy and one unexpected barcode", discrepancies)
+	}
+}
+
+// discrepancyResponder answers ResolveDiscrepancy for a pending discrepancy of the given kind in audit 3 at location 2.
+func discrepancyResponder(auditStatus, kind, resolution string) fakeResponder {
+	return func(query string, args []driver.Value) (*fakeRows, error) {
+		if strings.Contains(query, "FROM inventory_discrepancy d JOIN inventory_audit a") {
+			var copyID, bookID interface{}
+			if kind != DiscrepancyUnexpected {
+				copyID, bookID = int64(4), int64(7)
+			}
+			return fakeRow(auditStatus, int64(2), kind, resolution, "LMC0000004", copyID, bookID, int64(2)), nil
+		}
+		return nil, nil
+	}
+}
+
+func TestResolveDiscrepancy(t *testing.T) {
+	fake := useFakeDB(t, discrepancyResponder(AuditStatusSubmitted, DiscrepancyMissing, ResolutionPending))
+	if err := ResolveDiscrepancy(3, 5, true, 0, 1, ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.Find("UPDATE book_copy SET status = ?, lost_at = NOW()")) != 1 || len(fake.Find("SET stock = stock - 1")) != 1 {
+		t.Error("approving a missing copy did not write it off")
+	}
+
+	tests := []struct {
+		name                     string
+		status, kind, resolution string
+		bookID                   int
+		want                     error
+	}{
+		{"audit still open", AuditStatusOpen, DiscrepancyMissing, ResolutionPending, 0, ErrAuditNotSubmitted},
+		{"already resolved", AuditStatusSubmitted, DiscrepancyMissing, ResolutionApproved, 0, ErrDiscrepancyResolved},
+		{"unexpected copy without a book", AuditStatusSubmitted, DiscrepancyUnexpected, ResolutionPending, 0, ErrUnexpectedCopyNeedBook},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t, discrepancyResponder(tt.status, tt.kind, tt.resolution))
+			if err := ResolveDiscrepancy(3, 5, true, tt.bookID, 1, ""); !errors.Is(err, tt.want) {
+				t.Fatalf("ResolveDiscrepancy = %v, want %v", err, tt.want)
+			}
+			if fake.Index("COMMIT") >= 0 {
+				t.Error("a refused resolution was committed")
+			}
+		})
+	}
+}
@@ -0,0 +1,833 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============ INVOICES ============
+
+const (
+	InvoiceKindInvoice    = "invoice"
+	InvoiceKindCreditNote = "credit_note"
+
+	InvoiceStatusIssued = "issued"
+	InvoiceStatusVoid   = "void"
+)
+
+var (
+	ErrInvoiceNotFound      = errors.New("invoice not found")
+	ErrInvoiceNotReissuable = errors.New("only issued invoices can be credited or re-issued")
+	ErrCreditExceedsInvoice = errors.New("credit exceeds the uncredited invoice amount")
+	ErrBorrowInOrder        = errors.New("borrow is part of an order; use the order instead")
+)
+
+type InvoiceLine struct {
+	Code        string  `json:"code"`
+	Description string  `json:"description"`
+	Quantity    int     `json:"quantity"`
+	UnitPrice   float64 `json:"unit_price"`
+	Amount      float64 `json:"amount"`
+}
+
+type Invoice struct {
+	InvoiceID        int           `json:"invoice_id"`
+	Number           string        `json:"number"`
+	Kind             string        `json:"kind"`
+	Status           string        `json:"status"`
+	OrderID          *int          `json:"order_id"`
+	BorrowID         *int          `json:"borrow_id"`
+	UserID           int           `json:"user_id"`
+	CustomerName     string        `json:"customer_name"`
+	CustomerEmail    string        `json:"customer_email"`
+	RelatedInvoiceID *int          `json:"related_invoice_id"`
+	RelatedNumber    string        `json:"related_number,omitempty"`
+	Subtotal         float64       `json:"subtotal"`
+	Tax              float64       `json:"tax"`
+	Total            float64       `json:"total"`
+	PaymentStatus    string        `json:"payment_status"`
+	IssuedAt         time.Time     `json:"issued_at"`
+	Lines            []InvoiceLine `json:"lines"`
+}
+
+// nextInvoiceNumberTx hands out the next number of a yearly series such as INV-2026-000042.
+// The sequence row stays locked until tx ends, so numbers are gapless and never reused.
+func nextInvoiceNumberTx(tx *sql.Tx, prefix string, at time.Time) (string, error) {
+	series := fmt.Sprintf("%s-%d", prefix, at.Year())
+	_, err := tx.Exec(`
+		INSERT INTO invoice_sequence (series, last_number) VALUES (?, 1)
+		ON DUPLICATE KEY UPDATE last_number = last_number + 1
+	`, series)
+	if err != nil {
+		return "", err
+	}
+
+	var n int
+	if err := tx.QueryRow("SELECT last_number FROM invoice_sequence WHERE series = ?", series).Scan(&n); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%06d", series, n), nil
+}
+
+// insertInvoiceTx numbers and stores an invoice or credit note with its lines.
+func insertInvoiceTx(tx *sql.Tx, inv *Invoice) error {
+	prefix := "INV"
+	if inv.Kind == InvoiceKindCreditNote {
+		prefix = "CN"
+	}
+	inv.IssuedAt = time.Now()
+	inv.Status = InvoiceStatusIssued
+
+	inv.Subtotal, inv.Tax, inv.Total = 0, 0, 0
+	for _, line := range inv.Lines {
+		if line.Code == PricingTax {
+			inv.Tax += line.Amount
+		} else {
+			inv.Subtotal += line.Amount
+		}
+		inv.Total += line.Amount
+	}
+
+	number, err := nextInvoiceNumberTx(tx, prefix, inv.IssuedAt)
+	if err != nil {
+		return err
+	}
+	inv.Number = number
+
+	var orderID, borrowID, relatedID int
+	if inv.OrderID != nil {
+		orderID = *inv.OrderID
+	}
+	if inv.BorrowID != nil {
+		borrowID = *inv.BorrowID
+	}
+	if inv.RelatedInvoiceID != nil {
+		relatedID = *inv.RelatedInvoiceID
+	}
+	result, err := tx.Exec(`
+		INSERT INTO invoice (invoice_number, kind, status, order_id, borrow_id, user_id, related_invoice_id, subtotal, tax, total, issued_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, inv.Number, inv.Kind, inv.Status, nullableID(orderID), nullableID(borrowID), inv.UserID, nullableID(relatedID),
+		inv.Subtotal, inv.Tax, inv.Total, inv.IssuedAt)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	inv.InvoiceID = int(id)
+
+	for _, line := range inv.Lines {
+		_, err := tx.Exec(`
+			INSERT INTO invoice_line (invoice_id, code, description, quantity, unit_price, amount)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, inv.InvoiceID, line.Code, line.Description, line.Quantity, line.UnitPrice, line.Amount)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// invoiceSourceLines collects the billable lines of an order or stand-alone borrow,
+// followed by a line for anything already refunded. Callers pass the transaction the invoice is
+// written in, so the lines and the refunds credited against the invoice come from the same view.
+func invoiceSourceLines(ex execer, orderID, borrowID int) (int, []InvoiceLine, error) {
+	var userID int
+	var quoteLines []QuoteLine
+	var err error
+	if orderID != 0 {
+		err = ex.QueryRow("SELECT user_id FROM borrow_order WHERE order_id = ?", orderID).Scan(&userID)
+		if err == sql.ErrNoRows {
+			return 0, nil, ErrOrderNotFound
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		quoteLines, err = orderLineItems(ex, orderID)
+	} else {
+		var inOrder sql.NullInt64
+		var total float64
+		err = ex.QueryRow("SELECT user_id, order_id, COALESCE(total_price, 0) FROM borrow WHERE borrow_id = ?", borrowID).
+			Scan(&userID, &inOrder, &total)
+		if err == sql.ErrNoRows {
+			return 0, nil, ErrBorrowNotFound
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		if inOrder.Valid {
+			return 0, nil, ErrBorrowInOrder
+		}
+		quoteLines, err = borrowLineItems(ex, borrowID)
+		// Borrows priced before line items existed only have a total
+		if err == nil && len(quoteLines) == 0 && total > 0 {
+			quoteLines = []QuoteLine{{Code: PricingRentalFee, Description: "Rental", Quantity: 1, UnitPrice: total, Amount: total}}
+		}
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	lines := make([]InvoiceLine, 0, len(quoteLines)+1)
+	for _, q := range quoteLines {
+		lines = append(lines, InvoiceLine{Code: q.Code, Description: q.Description, Quantity: q.Quantity, UnitPrice: q.UnitPrice, Amount: q.Amount})
+	}
+
+	var refunded float64
+	err = ex.QueryRow("SELECT COALESCE(SUM(refunded_amount), 0) FROM payment WHERE order_id <=> ? AND borrow_id <=> ?",
+		nullableID(orderID), nullableID(borrowID)).Scan(&refunded)
+	if err != nil {
+		return 0, nil, err
+	}
+	if refunded > 0 {
+		lines = append(lines, InvoiceLine{Code: "refund", Description: "Refunded", Quantity: 1, UnitPrice: -refunded, Amount: -refunded})
+	}
+	return userID, lines, nil
+}
+
+// activeInvoiceID returns the current invoice of an order or borrow, or 0.
+func activeInvoiceID(q interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}, orderID, borrowID int) (int, error) {
+	var invoiceID int
+	err := q.QueryRow(`
+		SELECT invoice_id FROM invoice
+		WHERE kind = ? AND status = ? AND order_id <=> ? AND borrow_id <=> ?
+		ORDER BY invoice_id DESC LIMIT 1
+	`, InvoiceKindInvoice, InvoiceStatusIssued, nullableID(orderID), nullableID(borrowID)).Scan(&invoiceID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return invoiceID, err
+}
+
+// IssueInvoice returns the current invoice of an order or stand-alone borrow, issuing one if needed.
+func IssueInvoice(orderID, borrowID int) (*Invoice, error) {
+	existing, err := activeInvoiceID(db, orderID, borrowID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != 0 {
+		return GetInvoice(existing)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Lock what is being invoiced and look again, so concurrent calls issue a single invoice
+	var locked int
+	if orderID != 0 {
+		err = tx.QueryRow("SELECT order_id FROM borrow_order WHERE order_id = ? FOR UPDATE", orderID).Scan(&locked)
+	} else {
+		err = tx.QueryRow("SELECT borrow_id FROM borrow WHERE borrow_id = ? FOR UPDATE", borrowID).Scan(&locked)
+	}
+	if err != nil {
+		return nil, err
+	}
+	existing, err = activeInvoiceID(tx, orderID, borrowID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != 0 {
+		tx.Rollback()
+		return GetInvoice(existing)
+	}
+
+	userID, lines, err := invoiceSourceLines(tx, orderID, borrowID)
+	if err != nil {
+		return nil, err
+	}
+
+	inv := &Invoice{Kind: InvoiceKindInvoice, UserID: userID, Lines: lines}
+	if orderID != 0 {
+		inv.OrderID = &orderID
+	} else {
+		inv.BorrowID = &borrowID
+	}
+	if err := insertInvoiceTx(tx, inv); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return GetInvoice(inv.InvoiceID)
+}
+
+// uncreditedAmountTx locks an issued invoice and returns its total less the credit notes against it.
+func uncreditedAmountTx(tx *sql.Tx, invoiceID int) (*Invoice, float64, error) {
+	inv := &Invoice{InvoiceID: invoiceID}
+	var orderID, borrowID sql.NullInt64
+	err := tx.QueryRow(`
+		SELECT invoice_number, kind, status, order_id, borrow_id, user_id, total
+		FROM invoice WHERE invoice_id = ? FOR UPDATE
+	`, invoiceID).Scan(&inv.Number, &inv.Kind, &inv.Status, &orderID, &borrowID, &inv.UserID, &inv.Total)
+	if err == sql.ErrNoRows {
+		return nil, 0, ErrInvoiceNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if inv.Kind != InvoiceKindInvoice || inv.Status != InvoiceStatusIssued {
+		return nil, 0, ErrInvoiceNotReissuable
+	}
+	if orderID.Valid {
+		id := int(orderID.Int64)
+		inv.OrderID = &id
+	}
+	if borrowID.Valid {
+		id := int(borrowID.Int64)
+		inv.BorrowID = &id
+	}
+
+	var credited float64
+	err = tx.QueryRow("SELECT COALESCE(-SUM(total), 0) FROM invoice WHERE related_invoice_id = ? AND kind = ?",
+		invoiceID, InvoiceKindCreditNote).Scan(&credited)
+	if err != nil {
+		return nil, 0, err
+	}
+	return inv, inv.Total - credited, nil
+}
+
+// issueCreditNoteTx credits part of an issued invoice.
+func issueCreditNoteTx(tx *sql.Tx, invoiceID int, amount float64, reason string) (*Invoice, error) {
+	original, remaining, err := uncreditedAmountTx(tx, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	if amount <= 0 || amount > remaining+0.005 {
+		return nil, ErrCreditExceedsInvoice
+	}
+
+	note := &Invoice{
+		Kind:             InvoiceKindCreditNote,
+		OrderID:          original.OrderID,
+		BorrowID:         original.BorrowID,
+		UserID:           original.UserID,
+		RelatedInvoiceID: &invoiceID,
+		Lines: []InvoiceLine{{
+			Code:        "credit",
+			Description: fmt.Sprintf("Credit against %s: %s", original.Number, reason),
+			Quantity:    1,
+			UnitPrice:   -amount,
+			Amount:      -amount,
+		}},
+	}
+	return note, insertInvoiceTx(tx, note)
+}
+
+func IssueCreditNote(invoiceID int, amount float64, reason string) (*Invoice, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	note, err := issueCreditNoteTx(tx, invoiceID, amount, reason)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return GetInvoice(note.InvoiceID)
+}
+
+// creditInvoiceForRefundTx issues a credit note for a refund when the payment's order or borrow was invoiced.
+func creditInvoiceForRefundTx(tx *sql.Tx, p *Payment, amount float64) error {
+	var orderID, borrowID int
+	if p.OrderID != nil {
+		orderID = *p.OrderID
+	}
+	if p.BorrowID != nil {
+		borrowID = *p.BorrowID
+	}
+	invoiceID, err := activeInvoiceID(tx, orderID, borrowID)
+	if err != nil || invoiceID == 0 {
+		return err
+	}
+
+	_, remaining, err := uncreditedAmountTx(tx, invoiceID)
+	if err != nil {
+		return err
+	}
+	amount = math.Min(amount, remaining)
+	if amount <= 0 {
+		return nil
+	}
+	_, err = issueCreditNoteTx(tx, invoiceID, amount, "refund of payment "+p.ProviderRef)
+	return err
+}
+
+// ReissueInvoice voids an invoice, credits what is left of it and issues a fresh invoice
+// that reflects refunds made since.
+func ReissueInvoice(invoiceID int) (*Invoice, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	original, remaining, err := uncreditedAmountTx(tx, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+
+	var orderID, borrowID int
+	if original.OrderID != nil {
+		orderID = *original.OrderID
+	}
+	if original.BorrowID != nil {
+		borrowID = *original.BorrowID
+	}
+	userID, lines, err := invoiceSourceLines(tx, orderID, borrowID)
+	if err != nil {
+		return nil, err
+	}
+
+	if remaining > 0 {
+		if _, err := issueCreditNoteTx(tx, invoiceID, remaining, "invoice re-issued"); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.Exec("UPDATE invoice SET status = ? WHERE invoice_id = ?", InvoiceStatusVoid, invoiceID); err != nil {
+		return nil, err
+	}
+
+	inv := &Invoice{Kind: InvoiceKindInvoice, OrderID: original.OrderID, BorrowID: original.BorrowID, UserID: userID, Lines: lines}
+	if err := insertInvoiceTx(tx, inv); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return GetInvoice(inv.InvoiceID)
+}
+
+const invoiceSelect = `
+	SELECT i.invoice_id, i.invoice_number, i.kind, i.status, i.order_id, i.borrow_id, i.user_id,
+	       COALESCE(u.name, ''), COALESCE(u.email, ''), i.related_invoice_id, COALESCE(ri.invoice_number, ''),
+	       i.subtotal, i.tax, i.total, COALESCE(o.payment_status, b.payment_status, ''), i.issued_at
+	FROM invoice i
+	LEFT JOIN user u ON i.user_id = u.user_id
+	LEFT JOIN invoice ri ON i.related_invoice_id = ri.invoice_id
+	LEFT JOIN borrow_order o ON i.order_id = o.order_id
+	LEFT JOIN borrow b ON i.borrow_id = b.borrow_id`
+
+func scanInvoice(scanner interface{ Scan(...interface{}) error }) (*Invoice, error) {
+	var inv Invoice
+	var orderID, borrowID, relatedID sql.NullInt64
+	err := scanner.Scan(&inv.InvoiceID, &inv.Number, &inv.Kind, &inv.Status, &orderID, &borrowID, &inv.UserID,
+		&inv.CustomerName, &inv.CustomerEmail, &relatedID, &inv.RelatedNumber,
+		&inv.Subtotal, &inv.Tax, &inv.Total, &inv.PaymentStatus, &inv.IssuedAt)
+	if err != nil {
+		return nil, err
+	}
+	if orderID.Valid {
+		id := int(orderID.Int64)
+		inv.OrderID = &id
+	}
+	if borrowID.Valid {
+		id := int(borrowID.Int64)
+		inv.BorrowID = &id
+	}
+	if relatedID.Valid {
+		id := int(relatedID.Int64)
+		inv.RelatedInvoiceID = &id
+	}
+	return &inv, nil
+}
+
+func GetInvoice(invoiceID int) (*Invoice, error) {
+	inv, err := scanInvoice(db.QueryRow(invoiceSelect+" WHERE i.invoice_id = ?", invoiceID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT code, description, quantity, unit_price, amount
+		FROM invoice_line WHERE invoice_id = ? ORDER BY line_id
+	`, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	inv.Lines = []InvoiceLine{}
+	for rows.Next() {
+		var line InvoiceLine
+		if err := rows.Scan(&line.Code, &line.Description, &line.Quantity, &line.UnitPrice, &line.Amount); err != nil {
+			return nil, err
+		}
+		inv.Lines = append(inv.Lines, line)
+	}
+	return inv, nil
+}
+
+func GetUserInvoices(userID int) ([]Invoice, error) {
+	rows, err := db.Query(invoiceSelect+" WHERE i.user_id = ? ORDER BY i.issued_at DESC, i.invoice_id DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invoices := []Invoice{}
+	for rows.Next() {
+		inv, err := scanInvoice(rows)
+		if err != nil {
+			return nil, err
+		}
+		invoices = append(invoices, *inv)
+	}
+	return invoices, nil
+}
+
+// ============ INVOICE RENDERING ============
+
+// formatRupiah formats an amount the Indonesian way, e.g. Rp 40.000.
+func formatRupiah(amount float64) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	digits := strconv.FormatFloat(math.Round(amount), 'f', 0, 64)
+	var groups []string
+	for len(digits) > 3 {
+		groups = append([]string{digits[len(digits)-3:]}, groups...)
+		digits = digits[:len(digits)-3]
+	}
+	groups = append([]string{digits}, groups...)
+	return sign + "Rp " + strings.Join(groups, ".")
+}
+
+func (inv *Invoice) Title() string {
+	if inv.Kind == InvoiceKindCreditNote {
+		return "Credit Note"
+	}
+	return "Invoice"
+}
+
+func (inv *Invoice) Reference() string {
+	if inv.OrderID != nil {
+		return fmt.Sprintf("Order #%d", *inv.OrderID)
+	}
+	if inv.BorrowID != nil {
+		return fmt.Sprintf("Borrow #%d", *inv.BorrowID)
+	}
+	return ""
+}
+
+var invoiceTemplate = template.Must(template.New("invoice").Funcs(template.FuncMap{
+	"rupiah": formatRupiah,
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<title>{{.Title}} {{.Number}}</title>
+<style>
+body { font-family: Arial, sans-serif; color: #333; max-width: 760px; margin: 40px auto; }
+h1 { margin-bottom: 0; }
+table { width: 100%; border-collapse: collapse; margin-top: 24px; }
+th, td { padding: 8px; border-bottom: 1px solid #e0e0e0; text-align: left; }
+td.num, th.num { text-align: right; }
+.totals td { border: none; }
+.void { color: #c0392b; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>LibMatch {{.Title}}</h1>
+<p>
+<strong>{{.Number}}</strong>{{if eq .Status "void"}} <span class="void">VOID</span>{{end}}<br>
+Issued {{.IssuedAt.Format "02 Jan 2006"}}<br>
+{{.Reference}}{{if .RelatedNumber}}<br>Credits invoice {{.RelatedNumber}}{{end}}
+</p>
+<p>Billed to:<br>{{.CustomerName}}<br>{{.CustomerEmail}}</p>
+<table>
+<tr><th>Description</th><th class="num">Qty</th><th class="num">Unit price</th><th class="num">Amount</th></tr>
+{{range .Lines}}<tr><td>{{.Description}}</td><td class="num">{{.Quantity}}</td><td class="num">{{rupiah .UnitPrice}}</td><td class="num">{{rupiah .Amount}}</td></tr>
+{{end}}</table>
+<table class="totals">
+<tr><td class="num">Subtotal</td><td class="num">{{rupiah .Subtotal}}</td></tr>
+<tr><td class="num">Tax</td><td class="num">{{rupiah .Tax}}</td></tr>
+<tr><td class="num"><strong>Total</strong></td><td class="num"><strong>{{rupiah .Total}}</strong></td></tr>
+</table>
+{{if eq .Kind "invoice"}}<p>Payment status: {{if .PaymentStatus}}{{.PaymentStatus}}{{else}}not recorded{{end}}</p>{{end}}
+</body>
+</html>
+`))
+
+// invoiceTextLines lays out an invoice as fixed-width text for the PDF renderer.
+func invoiceTextLines(inv *Invoice) []string {
+	lines := []string{
+		"LibMatch " + inv.Title(),
+		"",
+		"Number:    " + inv.Number,
+		"Issued:    " + inv.IssuedAt.Format("02 Jan 2006"),
+		"Reference: " + inv.Reference(),
+	}
+	if inv.RelatedNumber != "" {
+		lines = append(lines, "Credits:   "+inv.RelatedNumber)
+	}
+	if inv.Status == InvoiceStatusVoid {
+		lines = append(lines, "Status:    VOID")
+	}
+	lines = append(lines, "", "Billed to: "+inv.CustomerName, "           "+inv.CustomerEmail, "")
+
+	lines = append(lines, fmt.Sprintf("%-40s %4s %15s %15s", "Description", "Qty", "Unit price", "Amount"))
+	lines = append(lines, strings.Repeat("-", 77))
+	for _, line := range inv.Lines {
+		description := line.Description
+		if len(description) > 40 {
+			description = description[:37] + "..."
+		}
+		lines = append(lines, fmt.Sprintf("%-40s %4d %15s %15s", description, line.Quantity, formatRupiah(line.UnitPrice), formatRupiah(line.Amount)))
+	}
+	lines = append(lines, strings.Repeat("-", 77))
+	lines = append(lines,
+		fmt.Sprintf("%61s %15s", "Subtotal", formatRupiah(inv.Subtotal)),
+		fmt.Sprintf("%61s %15s", "Tax", formatRupiah(inv.Tax)),
+		fmt.Sprintf("%61s %15s", "Total", formatRupiah(inv.Total)),
+	)
+	if inv.Kind == InvoiceKindInvoice {
+		status := inv.PaymentStatus
+		if status == "" {
+			status = "not recorded"
+		}
+		lines = append(lines, "", "Payment status: "+status)
+	}
+	return lines
+}
+
+// ============ INVOICE HANDLERS ============
+
+func writeInvoiceError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, ErrInvoiceNotFound), errors.Is(err, ErrOrderNotFound), errors.Is(err, ErrBorrowNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrInvoiceNotReissuable), errors.Is(err, ErrCreditExceedsInvoice), errors.Is(err, ErrBorrowInOrder):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, fallback, http.StatusInternalServerError)
+	}
+}
+
+// invoiceSourceOwner returns the member an order or borrow belongs to.
+func invoiceSourceOwner(orderID, borrowID int) (int, error) {
+	var userID int
+	if orderID != 0 {
+		err := db.QueryRow("SELECT user_id FROM borrow_order WHERE order_id = ?", orderID).Scan(&userID)
+		if err == sql.ErrNoRows {
+			return 0, ErrOrderNotFound
+		}
+		return userID, err
+	}
+	err := db.QueryRow("SELECT user_id FROM borrow WHERE borrow_id = ?", borrowID).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, ErrBorrowNotFound
+	}
+	return userID, err
+}
+
+// issueInvoiceHandler issues (or returns) the invoice of an order or borrow, depending on the route.
+// Only the member it belongs to or an admin may do so.
+func issueInvoiceHandler(forOrder bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		if requireUser(w, r) == 0 {
+			return
+		}
+
+		orderID, borrowID := 0, id
+		if forOrder {
+			orderID, borrowID = id, 0
+		}
+		ownerID, err := invoiceSourceOwner(orderID, borrowID)
+		if err != nil {
+			writeInvoiceError(w, err, "Failed to issue invoice")
+			return
+		}
+		if !requireOwnerOrAdmin(w, r, ownerID) {
+			return
+		}
+
+		inv, err := IssueInvoice(orderID, borrowID)
+		if err != nil {
+			writeInvoiceError(w, err, "Failed to issue invoice")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(inv)
+	}
+}
+
+// loadInvoice reads the {id} route variable and writes an error response when the invoice is
+// missing or belongs to another member and the caller is not an admin.
+func loadInvoice(w http.ResponseWriter, r *http.Request) (*Invoice, bool) {
+	vars := mux.Vars(r)
+	invoiceID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return nil, false
+	}
+	if requireUser(w, r) == 0 {
+		return nil, false
+	}
+
+	inv, err := GetInvoice(invoiceID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if inv == nil {
+		http.Error(w, "Invoice not found", http.StatusNotFound)
+		return nil, false
+	}
+	if !requireOwnerOrAdmin(w, r, inv.UserID) {
+		return nil, false
+	}
+	return inv, true
+}
+
+func getInvoice(w http.ResponseWriter, r *http.Request) {
+	inv, ok := loadInvoice(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(inv)
+}
+
+func getInvoiceHTML(w http.ResponseWriter, r *http.Request) {
+	inv, ok := loadInvoice(w, r)
+	if !ok {
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := invoiceTemplate.Execute(&buf, inv); err != nil {
+		http.Error(w, "Failed to render invoice", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+func getInvoicePDF(w http.ResponseWriter, r *http.Request) {
+	inv, ok := loadInvoice(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", inv.Number+".pdf"))
+	w.Write(renderTextPDF(invoiceTextLines(inv)))
+}
+
+func getUserInvoices(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID, err := strconv.Atoi(vars["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	if !requireOwnerOrAdmin(w, r, userID) {
+		return
+	}
+
+	invoices, err := GetUserInvoices(userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invoices)
+}
+
+func createCreditNote(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	invoiceID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Amount float64 `json:"amount"`
+		Reason string  `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Amount <= 0 || req.Reason == "" {
+		http.Error(w, "A positive amount and a reason are required", http.StatusBadRequest)
+		return
+	}
+
+	note, err := IssueCreditNote(invoiceID, req.Amount, req.Reason)
+	if err != nil {
+		writeInvoiceError(w, err, "Failed to issue credit note")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"message":     "Credit note issued",
+		"credit_note": note,
+	})
+}
+
+func reissueInvoice(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	invoiceID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	inv, err := ReissueInvoice(invoiceID)
+	if err != nil {
+		writeInvoiceError(w, err, "Failed to re-issue invoice")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Invoice re-issued",
+		"invoice": inv,
+	})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// invoiceResponder answers lookups of invoice 3, which belongs to member 5.
+func invoiceResponder(query string, args []driver.Value) (*fakeRows, error) {
+	if rows, ok := userRows(query, args, map[int64]string{5: "member", 6: "member", 1: "admin"}); ok {
+		return rows, nil
+	}
+	if strings.Contains(query, "FROM invoice i") {
+		return fakeRow(int64(3), "INV-2026-000003", InvoiceKindInvoice, "issued", nil, int64(9), int64(5),
+			"Member", "member@example.com", nil, "", 40000.0, 4000.0, 44000.0, PayablePaid, time.Now()), nil
+	}
+	return nil, nil
+}
+
+func TestInvoicesAreVisibleToTheirMemberAndAdmins(t *testing.T) {
+	useFakeDB(t, invoiceResponder)
+	router := mux.NewRouter()
+	router.HandleFunc("/api/invoices/{id}", getInvoice).Methods("GET")
+	router.HandleFunc("/api/invoices/{id}/html", getInvoiceHTML).Methods("GET")
+	router.HandleFunc("/api/invoices/{id}/pdf", getInvoicePDF).Methods("GET")
+	router.HandleFunc("/api/users/{userId}/invoices", getUserInvoices).Methods("GET")
+
+	tests := []struct {
+		path, caller string
+		want         int
+	}{
+		{"/api/invoices/3", "", http.StatusUnauthorized},
+		{"/api/invoices/3", "5", http.StatusOK},
+		{"/api/invoices/3", "1", http.StatusOK},
+		{"/api/invoices/3", "6", http.StatusForbidden},
+		{"/api/invoices/3/html", "6", http.StatusForbidden},
+		{"/api/invoices/3/pdf", "6", http.StatusForbidden},
+		{"/api/invoices/3/pdf", "5", http.StatusOK},
+		{"/api/users/5/invoices", "5", http.StatusOK},
+		{"/api/users/5/invoices", "1", http.StatusOK},
+		{"/api/users/5/invoices", "6", http.StatusForbidden},
+		{"/api/users/5/invoices", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		if tt.caller != "" {
+			req.Header.Set("X-User-ID", tt.caller)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("GET %s as %q = %d, want %d", tt.path, tt.caller, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestIssuingAnInvoiceRequiresTheOwner(t *testing.T) {
+	fake := useFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+		if rows, ok := userRows(query, args, map[int64]string{5: "member", 6: "member"}); ok {
+			return rows, nil
+		}
+		if strings.Contains(query, "SELECT user_id FROM borrow_order WHERE order_id = ?") {
+			return fakeRow(int64(5)), nil
+		}
+		return nil, nil
+	})
+	router := mux.NewRouter()
+	router.HandleFunc("/api/orders/{id}/invoice", issueInvoiceHandler(true)).Methods("POST")
+
+	req := httptest.NewRequest("POST", "/api/orders/4/invoice", nil)
+	req.Header.Set("X-User-ID", "6")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("issuing another member's invoice = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	if fake.Index("BEGIN") >= 0 {
+		t.Error("an invoice was started for another member")
+	}
+}
+
+func TestInvoiceSourceLinesReadThroughTheTransaction(t *testing.T) {
+	fake := useFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+		switch {
+		case strings.Contains(query, "FROM borrow WHERE borrow_id"):
+			return fakeRow(int64(5), nil, 44000.0), nil
+		case strings.Contains(query, "FROM borrow_line_item"):
+			return fakeRow(PricingRentalFee, "Rental", int64(2), 1, 40000.0, 40000.0), nil
+		case strings.Contains(query, "SUM(refunded_amount)"):
+			return fakeRow(10000.0), nil
+		}
+		return nil, nil
+	})
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, lines, err := invoiceSourceLines(tx, 0, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if userID != 5 || len(lines) != 2 || lines[1].Amount != -10000 {
+		t.Fatalf("got user %d and lines %+v", userID, lines)
+	}
+	for _, fragment := range []string{"FROM borrow WHERE borrow_id", "FROM borrow_line_item", "SUM(refunded_amount)"} {
+		found := fake.Find(fragment)
+		if len(found) != 1 || !found[0].InTx {
+			t.Errorf("%q did not run once inside the transaction: %+v", fragment, found)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============ MEMBER LEDGER ============
+
+// Ledger accounts. Member accounts carry a user_id, library accounts do not.
+// Amounts are signed: debits are positive and credits negative, and every
+// ledger transaction sums to zero.
+const (
+	LedgerAccountMember  = "member"  // debit balance: member owes the library; credit balance: wallet credit
+	LedgerAccountDeposit = "deposit" // refundable deposits held for the member
+	LedgerAccountCash    = "cash"
+	LedgerAccountSales   = "sales_revenue"
+	LedgerAccountFines   = "fine_revenue"
+	LedgerAccountCredits = "credit_expense"
+)
+
+// Ledger transaction kinds shown on member statements.
+const (
+	LedgerKindCharge         = "charge"
+	LedgerKindPayment        = "payment"
+	LedgerKindRefund         = "refund"
+	LedgerKindChargeReversal = "charge_reversal"
+	LedgerKindDepositRelease = "deposit_release"
+	LedgerKindFineDeduction  = "fine_deduction"
+	LedgerKindFinePayment    = "fine_payment"
+	LedgerKindCredit         = "credit"
+)
+
+var ErrUnbalancedLedger = errors.New("ledger transaction does not balance")
+
+type ledgerPosting struct {
+	Account string
+	UserID  int
+	Amount  float64
+}
+
+type LedgerBalance struct {
+	UserID       int     `json:"user_id"`
+	Owed         float64 `json:"owed"`
+	Credit       float64 `json:"credit"`
+	DepositsHeld float64 `json:"deposits_held"`
+}
+
+type StatementLine struct {
+	TxnID         int       `json:"txn_id"`
+	Kind          string    `json:"kind"`
+	ReferenceType string    `json:"reference_type"`
+	ReferenceID   *int      `json:"reference_id"`
+	Description   string    `json:"description"`
+	Account       string    `json:"account"`
+	Amount        float64   `json:"amount"`
+	Balance       float64   `json:"balance"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// postLedgerTx writes one balanced ledger transaction for a member inside tx.
+func postLedgerTx(tx *sql.Tx, kind string, userID int, refType string, refID int, description string, postings ...ledgerPosting) error {
+	var sum float64
+	for _, p := range postings {
+		sum += p.Amount
+	}
+	if math.Abs(sum) > 0.005 {
+		return fmt.Errorf("%w: %s is off by %.2f", ErrUnbalancedLedger, kind, sum)
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO ledger_txn (kind, user_id, reference_type, reference_id, description, created_at)
+		VALUES (?, ?, ?, ?, ?, NOW())
+	`, kind, userID, refType, nullableID(refID), description)
+	if err != nil {
+		return err
+	}
+	txnID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range postings {
+		if p.Amount == 0 {
+			continue
+		}
+		_, err := tx.Exec("INSERT INTO ledger_entry (txn_id, account, user_id, amount) VALUES (?, ?, ?, ?)",
+			txnID, p.Account, nullableID(p.UserID), p.Amount)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postChargeTx bills a member for a borrow or order; the deposit part is held rather than earned.
+func postChargeTx(tx *sql.Tx, userID int, refType string, refID int, total, deposit float64) error {
+	if total <= 0 {
+		return nil
+	}
+	return postLedgerTx(tx, LedgerKindCharge, userID, refType, refID, fmt.Sprintf("Charge for %s #%d", refType, refID),
+		ledgerPosting{LedgerAccountMember, userID, total},
+		ledgerPosting{LedgerAccountDeposit, userID, -deposit},
+		ledgerPosting{LedgerAccountSales, 0, -(total - deposit)},
+	)
+}
+
+// reverseBorrowChargeTx credits back the charge of a borrow that was rejected or cancelled.
+func reverseBorrowChargeTx(tx *sql.Tx, borrowID int) error {
+	var userID int
+	var total, deposit float64
+	var paymentStatus sql.NullString
+	err := tx.QueryRow("SELECT user_id, COALESCE(total_price, 0), deposit_amount, payment_status FROM borrow WHERE borrow_id = ?", borrowID).
+		Scan(&userID, &total, &deposit, &paymentStatus)
+	if err != nil {
+		return err
+	}
+	// Borrows from before the ledger existed were never charged
+	if !paymentStatus.Valid || total <= 0 {
+		return nil
+	}
+	return postLedgerTx(tx, LedgerKindChargeReversal, userID, "borrow", borrowID, fmt.Sprintf("Reversal of borrow #%d", borrowID),
+		ledgerPosting{LedgerAccountMember, userID, -total},
+		ledgerPosting{LedgerAccountDeposit, userID, deposit},
+		ledgerPosting{LedgerAccountSales, 0, total - deposit},
+	)
+}
+
+// releaseDepositTx returns the deposit of a returned borrow to the member's wallet and uses
+// as much of it as needed towards the borrow's fine, which is first brought up to date.
+func releaseDepositTx(tx *sql.Tx, borrowID int) error {
+	var userID int
+	var deposit float64
+	err := tx.QueryRow("SELECT user_id, deposit_amount FROM borrow WHERE borrow_id = ?", borrowID).Scan(&userID, &deposit)
+	if err != nil || deposit <= 0 {
+		return err
+	}
+
+	err = postLedgerTx(tx, LedgerKindDepositRelease, userID, "borrow", borrowID, fmt.Sprintf("Deposit returned for borrow #%d", borrowID),
+		ledgerPosting{LedgerAccountDeposit, userID, deposit},
+		ledgerPosting{LedgerAccountMember, userID, -deposit},
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := accrueFineTx(tx, borrowID); err != nil {
+		return err
+	}
+	var fineID int
+	var fine float64
+	err = tx.QueryRow("SELECT fine_id, amount - paid_amount FROM fine WHERE borrow_id = ? AND status = ? FOR UPDATE", borrowID, FineStatusOutstanding).
+		Scan(&fineID, &fine)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	deduction := math.Min(fine, deposit)
+	if deduction <= 0 {
+		return nil
+	}
+	_, err = tx.Exec(`
+		UPDATE fine SET paid_amount = paid_amount + ?, status = IF(paid_amount >= amount, ?, status), updated_at = NOW()
+		WHERE fine_id = ?
+	`, deduction, FineStatusPaid, fineID)
+	if err != nil {
+		return err
+	}
+	return postLedgerTx(tx, LedgerKindFineDeduction, userID, "fine", fineID, fmt.Sprintf("Fine for borrow #%d deducted from deposit", borrowID),
+		ledgerPosting{LedgerAccountMember, userID, deduction},
+		ledgerPosting{LedgerAccountFines, 0, -deduction},
+	)
+}
+
+// payableOwnerTx returns the member behind a payment.
+func payableOwnerTx(tx *sql.Tx, p *Payment) (int, error) {
+	var userID int
+	var err error
+	if p.OrderID != nil {
+		err = tx.QueryRow("SELECT user_id FROM borrow_order WHERE order_id = ?", *p.OrderID).Scan(&userID)
+	} else {
+		err = tx.QueryRow("SELECT user_id FROM borrow WHERE borrow_id = ?", *p.BorrowID).Scan(&userID)
+	}
+	return userID, err
+}
+
+func postPaymentTx(tx *sql.Tx, p *Payment, amount float64) error {
+	userID, err := payableOwnerTx(tx, p)
+	if err != nil {
+		return err
+	}
+	return postLedgerTx(tx, LedgerKindPayment, userID, "payment", p.PaymentID, fmt.Sprintf("Payment %s", p.ProviderRef),
+		ledgerPosting{LedgerAccountCash, 0, amount},
+		ledgerPosting{LedgerAccountMember, userID, -amount},
+	)
+}
+
+func postRefundTx(tx *sql.Tx, p *Payment, amount float64) error {
+	userID, err := payableOwnerTx(tx, p)
+	if err != nil {
+		return err
+	}
+	return postLedgerTx(tx, LedgerKindRefund, userID, "payment", p.PaymentID, fmt.Sprintf("Refund of payment %s", p.ProviderRef),
+		ledgerPosting{LedgerAccountMember, userID, amount},
+		ledgerPosting{LedgerAccountCash, 0, -amount},
+	)
+}
+
+// postFinePaymentTx records a fine the member paid at the desk as a charge settled on the spot.
+func postFinePaymentTx(tx *sql.Tx, fineID, userID int, amount float64) error {
+	return postLedgerTx(tx, LedgerKindFinePayment, userID, "fine", fineID, fmt.Sprintf("Fine #%d paid", fineID),
+		ledgerPosting{LedgerAccountMember, userID, amount},
+		ledgerPosting{LedgerAccountFines, 0, -amount},
+		ledgerPosting{LedgerAccountCash, 0, amount},
+		ledgerPosting{LedgerAccountMember, userID, -amount},
+	)
+}
+
+// IssueCredit adds admin-issued credit to a member's wallet.
+func IssueCredit(userID int, amount float64, description string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if description == "" {
+		description = "Credit issued by library"
+	}
+	err = postLedgerTx(tx, LedgerKindCredit, userID, "user", userID, description,
+		ledgerPosting{LedgerAccountCredits, 0, amount},
+		ledgerPosting{LedgerAccountMember, userID, -amount},
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func GetLedgerBalance(userID int) (*LedgerBalance, error) {
+	var member, deposit float64
+	err := db.QueryRow(`
+		SELECT COALESCE(SUM(CASE WHEN account = ? THEN amount END), 0),
+		       COALESCE(SUM(CASE WHEN account = ? THEN amount END), 0)
+		FROM ledger_entry WHERE user_id = ?
+	`, LedgerAccountMember, LedgerAccountDeposit, userID).Scan(&member, &deposit)
+	if err != nil {
+		return nil, err
+	}
+
+	balance := &LedgerBalance{UserID: userID, DepositsHeld: -deposit}
+	if member > 0 {
+		balance.Owed = member
+	} else {
+		balance.Credit = -member
+	}
+	return balance, nil
+}
+
+// GetStatement lists the member's ledger entries, oldest first, with a running balance of what they owe.
+func GetStatement(userID int) ([]StatementLine, error) {
+	rows, err := db.Query(`
+		SELECT t.txn_id, t.kind, t.reference_type, t.reference_id, COALESCE(t.description, ''), e.account, e.amount, t.created_at
+		FROM ledger_entry e
+		JOIN ledger_txn t ON e.txn_id = t.txn_id
+		WHERE e.user_id = ?
+		ORDER BY t.created_at, t.txn_id, e.entry_id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lines := []StatementLine{}
+	var balance float64
+	for rows.Next() {
+		var line StatementLine
+		var refID sql.NullInt64
+		err := rows.Scan(&line.TxnID, &line.Kind, &line.ReferenceType, &refID, &line.Description, &line.Account, &line.Amount, &line.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if refID.Valid {
+			id := int(refID.Int64)
+			line.ReferenceID = &id
+		}
+		if line.Account == LedgerAccountMember {
+			balance += line.Amount
+		}
+		line.Balance = balance
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// ============ LEDGER HANDLERS ============
+
+func getWalletBalance(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID, err := strconv.Atoi(vars["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	balance, err := GetLedgerBalance(userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(balance)
+}
+
+func getWalletStatement(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID, err := strconv.Atoi(vars["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	statement, err := GetStatement(userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statement)
+}
+
+func issueWalletCredit(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	userID, err := strconv.Atoi(vars["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Amount      float64 `json:"amount"`
+		Description string  `json:"description"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Amount <= 0 {
+		http.Error(w, "Credit amount must be positive", http.StatusBadRequest)
+		return
+	}
+
+	user, err := GetUserByID(userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if user == nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if err := IssueCredit(userID, req.Amount, req.Description); err != nil {
+		http.Error(w, "Failed to issue credit", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Credit issued",
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+)
+
+// ledgerEntries returns the account and amount of every ledger entry written, keyed by account.
+func ledgerEntries(fake *fakeDB) map[string]float64 {
+	entries := map[string]float64{}
+	for _, s := range fake.Find("INSERT INTO ledger_entry") {
+		entries[s.Args[1].(string)] += s.Args[3].(float64)
+	}
+	return entries
+}
+
+func borrowChargeResponder(total, deposit float64, paymentStatus driver.Value) fakeResponder {
+	return func(query string, args []driver.Value) (*fakeRows, error) {
+		if strings.Contains(query, "deposit_amount, payment_status FROM borrow") {
+			return fakeRow(int64(5), total, deposit, paymentStatus), nil
+		}
+		return nil, nil
+	}
+}
+
+func TestReverseBorrowChargeCreditsTheBorrowShare(t *testing.T) {
+	quotes := splitOrderQuote(discountedOrderQuote(), []int{1, 2, 3})
+	var credited float64
+	for _, bookID := range []int{1, 2, 3} {
+		q := quotes[bookID]
+		fake := useFakeDB(t, borrowChargeResponder(q.Total, q.Deposit, PayablePaid))
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := reverseBorrowChargeTx(tx, bookID); err != nil {
+			t.Fatal(err)
+		}
+		tx.Rollback()
+
+		entries := ledgerEntries(fake)
+		if entries[LedgerAccountMember] != -q.Total || entries[LedgerAccountDeposit] != q.Deposit ||
+			entries[LedgerAccountSales] != q.Total-q.Deposit {
+			t.Errorf("book %d: reversal entries %v, want member %.0f, deposit %.0f, sales %.0f",
+				bookID, entries, -q.Total, q.Deposit, q.Total-q.Deposit)
+		}
+		credited -= entries[LedgerAccountMember]
+	}
+	if order := discountedOrderQuote(); credited != order.Total {
+		t.Errorf("cancelling every borrow credits %.0f, want the %.0f the order was charged", credited, order.Total)
+	}
+}
+
+func TestReverseBorrowChargeSkipsUnchargedBorrows(t *testing.T) {
+	fake := useFakeDB(t, borrowChargeResponder(40000, 0, nil))
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := reverseBorrowChargeTx(tx, 9); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.Find("INSERT INTO ledger_txn")) != 0 {
+		t.Error("a borrow from before the ledger was reversed")
+	}
+}
+
+func TestPostChargeHoldsTheDeposit(t *testing.T) {
+	fake := useFakeDB(t, nil)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := postChargeTx(tx, 5, "order", 3, 122950, 20000); err != nil {
+		t.Fatal(err)
+	}
+	entries := ledgerEntries(fake)
+	if entries[LedgerAccountMember] != 122950 || entries[LedgerAccountDeposit] != -20000 || entries[LedgerAccountSales] != -102950 {
+		t.Errorf("charge entries = %v", entries)
+	}
+}
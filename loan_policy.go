@@ -0,0 +1,408 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============ LOAN POLICIES ============
+
+type LoanPolicy struct {
+	PolicyID          int     `json:"policy_id"`
+	Name              string  `json:"name"`
+	CategoryID        *int    `json:"category_id"`
+	LocationID        *int    `json:"location_id"`
+	MemberTier        *string `json:"member_tier"`
+	LoanPeriodDays    int     `json:"loan_period_days"`
+	MaxActiveLoans    int     `json:"max_active_loans"`
+	MaxRenewals       int     `json:"max_renewals"`
+	RenewalPeriodDays int     `json:"renewal_period_days"`
+	FinePerDay        float64 `json:"fine_per_day"`
+	FineCap           float64 `json:"fine_cap"`
+}
+
+// defaultLoanPolicy applies when no admin-defined policy matches a borrow.
+var defaultLoanPolicy = LoanPolicy{
+	Name:              "Default",
+	LoanPeriodDays:    14,
+	MaxActiveLoans:    5,
+	MaxRenewals:       2,
+	RenewalPeriodDays: 14,
+	FinePerDay:        1000,
+	FineCap:           50000,
+}
+
+// activeBorrowStatuses are the statuses that count against a member's loan limit.
+var activeBorrowStatuses = []string{
+	BorrowStatusRequested,
+	BorrowStatusApproved,
+	BorrowStatusDispatched,
+	BorrowStatusReadyForPickup,
+	BorrowStatusOnLoan,
+}
+
+// LoanTerms is the outcome of evaluating the loan policy for a prospective borrow.
+type LoanTerms struct {
+	Policy           LoanPolicy `json:"policy"`
+	BorrowDate       time.Time  `json:"borrow_date"`
+	DueDate          time.Time  `json:"due_date"`
+	ActiveLoans      int        `json:"active_loans"`
+	MaxActiveLoans   int        `json:"max_active_loans"`
+	OutstandingFines float64    `json:"outstanding_fines"`
+	CanBorrow        bool       `json:"can_borrow"`
+	BlockedReason    string     `json:"blocked_reason,omitempty"`
+}
+
+const loanPolicyColumns = `policy_id, name, category_id, location_id, member_tier,
+	loan_period_days, max_active_loans, max_renewals, renewal_period_days, fine_per_day, fine_cap`
+
+func scanLoanPolicy(scanner interface{ Scan(...interface{}) error }) (*LoanPolicy, error) {
+	var policy LoanPolicy
+	var categoryID, locationID sql.NullInt64
+	var memberTier sql.NullString
+	err := scanner.Scan(&policy.PolicyID, &policy.Name, &categoryID, &locationID, &memberTier,
+		&policy.LoanPeriodDays, &policy.MaxActiveLoans, &policy.MaxRenewals, &policy.RenewalPeriodDays,
+		&policy.FinePerDay, &policy.FineCap)
+	if err != nil {
+		return nil, err
+	}
+	if categoryID.Valid {
+		id := int(categoryID.Int64)
+		policy.CategoryID = &id
+	}
+	if locationID.Valid {
+		id := int(locationID.Int64)
+		policy.LocationID = &id
+	}
+	if memberTier.Valid {
+		policy.MemberTier = &memberTier.String
+	}
+	return &policy, nil
+}
+
+func GetLoanPolicies() ([]LoanPolicy, error) {
+	rows, err := db.Query("SELECT " + loanPolicyColumns + " FROM loan_policy ORDER BY policy_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	policies := []LoanPolicy{}
+	for rows.Next() {
+		policy, err := scanLoanPolicy(rows)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, *policy)
+	}
+	return policies, nil
+}
+
+func GetLoanPolicyByID(policyID int) (*LoanPolicy, error) {
+	row := db.QueryRow("SELECT "+loanPolicyColumns+" FROM loan_policy WHERE policy_id = ?", policyID)
+	policy, err := scanLoanPolicy(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return policy, err
+}
+
+func CreateLoanPolicy(p LoanPolicy) (int, error) {
+	result, err := db.Exec(`
+		INSERT INTO loan_policy (name, category_id, location_id, member_tier, loan_period_days, max_active_loans, max_renewals, renewal_period_days, fine_per_day, fine_cap)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, p.Name, p.CategoryID, p.LocationID, p.MemberTier, p.LoanPeriodDays, p.MaxActiveLoans, p.MaxRenewals, p.RenewalPeriodDays, p.FinePerDay, p.FineCap)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+func UpdateLoanPolicy(p LoanPolicy) error {
+	_, err := db.Exec(`
+		UPDATE loan_policy SET name = ?, category_id = ?, location_id = ?, member_tier = ?,
+		       loan_period_days = ?, max_active_loans = ?, max_renewals = ?, renewal_period_days = ?,
+		       fine_per_day = ?, fine_cap = ?
+		WHERE policy_id = ?
+	`, p.Name, p.CategoryID, p.LocationID, p.MemberTier, p.LoanPeriodDays, p.MaxActiveLoans, p.MaxRenewals, p.RenewalPeriodDays,
+		p.FinePerDay, p.FineCap, p.PolicyID)
+	return err
+}
+
+func DeleteLoanPolicy(policyID int) error {
+	_, err := db.Exec("DELETE FROM loan_policy WHERE policy_id = ?", policyID)
+	return err
+}
+
+// ResolveLoanPolicy picks the most specific policy matching the category, location and member tier.
+// A zero categoryID or locationID, or an empty tier, only matches policies that leave that scope open.
+func ResolveLoanPolicy(categoryID, locationID int, memberTier string) (LoanPolicy, error) {
+	var tier interface{}
+	if memberTier != "" {
+		tier = memberTier
+	}
+
+	row := db.QueryRow(`
+		SELECT `+loanPolicyColumns+`
+		FROM loan_policy
+		WHERE (category_id IS NULL OR category_id = ?)
+		  AND (location_id IS NULL OR location_id = ?)
+		  AND (member_tier IS NULL OR member_tier = ?)
+		ORDER BY (category_id IS NOT NULL) + (location_id IS NOT NULL) + (member_tier IS NOT NULL) DESC, policy_id DESC
+		LIMIT 1
+	`, nullableID(categoryID), nullableID(locationID), tier)
+	policy, err := scanLoanPolicy(row)
+	if err == sql.ErrNoRows {
+		return defaultLoanPolicy, nil
+	}
+	if err != nil {
+		return LoanPolicy{}, err
+	}
+	return *policy, nil
+}
+
+// CountActiveLoans returns how many borrows of the user are still in progress.
+func CountActiveLoans(userID int) (int, error) {
+	placeholders, args := sqlInList(activeBorrowStatuses)
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM borrow WHERE user_id = ? AND status IN ("+placeholders+")",
+		append([]interface{}{userID}, args...)...).Scan(&count)
+	return count, err
+}
+
+// computeDueDate returns the due date of a loan period starting at from, pushed past any
+// holiday closures of the lending location so a book is never due on a day it cannot be returned.
+func computeDueDate(from time.Time, days, locationID int) (time.Time, error) {
+	due := from.AddDate(0, 0, days)
+	holidays, err := holidayDates(locationID, due, due.AddDate(0, 0, maxHolidaySkip))
+	if err != nil {
+		return due, err
+	}
+	return skipHolidays(due, holidays), nil
+}
+
+// skipHolidays moves due forward one day at a time while it falls on one of the holidays,
+// keyed by YYYY-MM-DD, giving up after maxHolidaySkip days.
+func skipHolidays(due time.Time, holidays map[string]bool) time.Time {
+	for i := 0; i < maxHolidaySkip && holidays[due.Format("2006-01-02")]; i++ {
+		due = due.AddDate(0, 0, 1)
+	}
+	return due
+}
+
+// EvaluateLoanTerms works out the policy, due date and loan allowance for a user borrowing a book.
+func EvaluateLoanTerms(userID, bookID, locationID int, borrowDate time.Time) (*LoanTerms, error) {
+	user, err := GetUserByID(userID)
+	if err != nil || user == nil {
+		return nil, err
+	}
+	book, err := GetBookByID(bookID)
+	if err != nil || book == nil {
+		return nil, err
+	}
+
+	policy, err := ResolveLoanPolicy(book.CategoryID, locationID, user.MemberTier)
+	if err != nil {
+		return nil, err
+	}
+
+	activeLoans, err := CountActiveLoans(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	outstanding, err := OutstandingFines(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	dueDate, err := computeDueDate(borrowDate, policy.LoanPeriodDays, locationID)
+	if err != nil {
+		return nil, err
+	}
+
+	terms := &LoanTerms{
+		Policy:           policy,
+		BorrowDate:       borrowDate,
+		DueDate:          dueDate,
+		ActiveLoans:      activeLoans,
+		MaxActiveLoans:   policy.MaxActiveLoans,
+		OutstandingFines: outstanding,
+		CanBorrow:        true,
+	}
+	if activeLoans >= policy.MaxActiveLoans {
+		terms.CanBorrow = false
+		terms.BlockedReason = fmt.Sprintf("Maximum of %d active loans reached", policy.MaxActiveLoans)
+	} else if outstanding > fineBlockThreshold() {
+		terms.CanBorrow = false
+		terms.BlockedReason = fmt.Sprintf("Outstanding fines of Rp %.0f must be settled before borrowing", outstanding)
+	}
+	return terms, nil
+}
+
+// ============ LOAN POLICY HANDLERS ============
+
+func getLoanPolicies(w http.ResponseWriter, r *http.Request) {
+	policies, err := GetLoanPolicies()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policies)
+}
+
+// validateLoanPolicy returns an error message for an unusable policy, or an empty string.
+func validateLoanPolicy(p LoanPolicy) string {
+	if p.Name == "" {
+		return "Policy name is required"
+	}
+	if p.LoanPeriodDays <= 0 {
+		return "loan_period_days must be positive"
+	}
+	if p.MaxActiveLoans <= 0 {
+		return "max_active_loans must be positive"
+	}
+	if p.MaxRenewals < 0 || p.RenewalPeriodDays < 0 {
+		return "Renewal settings cannot be negative"
+	}
+	if p.FinePerDay < 0 || p.FineCap < 0 {
+		return "Fine settings cannot be negative"
+	}
+	return ""
+}
+
+func createLoanPolicy(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var policy LoanPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if msg := validateLoanPolicy(policy); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	policyID, err := CreateLoanPolicy(policy)
+	if err != nil {
+		http.Error(w, "Failed to create loan policy", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"message":   "Loan policy created successfully",
+		"policy_id": policyID,
+	})
+}
+
+func updateLoanPolicy(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	policyID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid policy ID", http.StatusBadRequest)
+		return
+	}
+
+	var policy LoanPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	policy.PolicyID = policyID
+	if msg := validateLoanPolicy(policy); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	existing, err := GetLoanPolicyByID(policyID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if existing == nil {
+		http.Error(w, "Loan policy not found", http.StatusNotFound)
+		return
+	}
+
+	if err := UpdateLoanPolicy(policy); err != nil {
+		http.Error(w, "Failed to update loan policy", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Loan policy updated successfully",
+	})
+}
+
+func deleteLoanPolicy(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	policyID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid policy ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := DeleteLoanPolicy(policyID); err != nil {
+		http.Error(w, "Failed to delete loan policy", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Loan policy deleted successfully",
+	})
+}
+
+// evaluateLoanPolicy previews the loan terms for ?user_id=&book_id=&location_id= so checkout can show the due date.
+func evaluateLoanPolicy(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	userID, err := strconv.Atoi(query.Get("user_id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	bookID, err := strconv.Atoi(query.Get("book_id"))
+	if err != nil {
+		http.Error(w, "Invalid book ID", http.StatusBadRequest)
+		return
+	}
+	locationID, _ := strconv.Atoi(query.Get("location_id"))
+
+	terms, err := EvaluateLoanTerms(userID, bookID, locationID, time.Now())
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if terms == nil {
+		http.Error(w, "User or book not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(terms)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSkipHolidays(t *testing.T) {
+	due := time.Date(2026, 12, 24, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		holidays map[string]bool
+		want     string
+	}{
+		{"no holidays", nil, "2026-12-24"},
+		{"holiday on another day", map[string]bool{"2026-12-31": true}, "2026-12-24"},
+		{"single closure", map[string]bool{"2026-12-24": true}, "2026-12-25"},
+		{"consecutive closures", map[string]bool{"2026-12-24": true, "2026-12-25": true, "2026-12-26": true}, "2026-12-27"},
+	}
+	for _, tt := range tests {
+		got := skipHolidays(due, tt.holidays)
+		if got.Format("2006-01-02") != tt.want {
+			t.Errorf("%s: skipHolidays = %s, want %s", tt.name, got.Format("2006-01-02"), tt.want)
+		}
+		if got.Hour() != due.Hour() {
+			t.Errorf("%s: skipHolidays changed the time of day to %s", tt.name, got.Format(time.Kitchen))
+		}
+	}
+}
+
+func TestSkipHolidaysGivesUp(t *testing.T) {
+	due := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	holidays := map[string]bool{}
+	for i := 0; i < maxHolidaySkip*2; i++ {
+		holidays[due.AddDate(0, 0, i).Format("2006-01-02")] = true
+	}
+	want := due.AddDate(0, 0, maxHolidaySkip)
+	if got := skipHolidays(due, holidays); !got.Equal(want) {
+		t.Errorf("skipHolidays = %s, want %s", got, want)
+	}
+}
+
+func TestValidateLoanPolicy(t *testing.T) {
+	valid := LoanPolicy{Name: "Students", LoanPeriodDays: 21, MaxActiveLoans: 3}
+	tests := []struct {
+		name   string
+		change func(*LoanPolicy)
+		want   bool
+	}{
+		{"valid", func(p *LoanPolicy) {}, true},
+		{"no name", func(p *LoanPolicy) { p.Name = "" }, false},
+		{"no loan period", func(p *LoanPolicy) { p.LoanPeriodDays = 0 }, false},
+		{"no loan allowance", func(p *LoanPolicy) { p.MaxActiveLoans = 0 }, false},
+		{"negative renewals", func(p *LoanPolicy) { p.MaxRenewals = -1 }, false},
+		{"negative fine", func(p *LoanPolicy) { p.FinePerDay = -500 }, false},
+	}
+	for _, tt := range tests {
+		p := valid
+		tt.change(&p)
+		if got := validateLoanPolicy(p) == ""; got != tt.want {
+			t.Errorf("%s: valid = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestResolveLoanPolicyFallsBackToTheDefault(t *testing.T) {
+	fake := useFakeDB(t, nil)
+
+	policy, err := ResolveLoanPolicy(0, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy != defaultLoanPolicy {
+		t.Errorf("got %+v, want the default policy", policy)
+	}
+	// Unscoped lookups must only match policies that leave the scope open
+	args := fake.Find("FROM loan_policy")[0].Args
+	for i, arg := range args {
+		if arg != nil {
+			t.Errorf("scope argument %d = %v, want NULL", i, arg)
+		}
+	}
+}
+
+// loanTermsResponder answers EvaluateLoanTerms for member 5 and book 7 under a policy allowing
+// two loans over 21 days, with the given active loans and outstanding fines.
+func loanTermsResponder(activeLoans int64, fines float64) fakeResponder {
+	return func(query string, args []driver.Value) (*fakeRows, error) {
+		if rows, ok := userRows(query, args, map[int64]string{5: "member"}); ok {
+			return rows, nil
+		}
+		switch {
+		case strings.Contains(query, "FROM book b LEFT JOIN category c"):
+			return fakeRow(int64(7), "Title", "Author", "", int64(2020), "", int64(2), "Fiction", int64(0),
+				"", "", "", "", "", "", "approved", int64(0)), nil
+		case strings.Contains(query, "FROM loan_policy"):
+			return fakeRow(int64(1), "Standard", nil, nil, nil, int64(21), int64(2), int64(1), int64(7), 1000.0, 20000.0), nil
+		case strings.Contains(query, "SELECT COUNT(*) FROM borrow WHERE user_id"):
+			return fakeRow(activeLoans), nil
+		case strings.Contains(query, "FROM fine WHERE user_id"):
+			return fakeRow(fines), nil
+		}
+		return nil, nil
+	}
+}
+
+func TestEvaluateLoanTerms(t *testing.T) {
+	borrowDate := time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		activeLoans int64
+		fines       float64
+		canBorrow   bool
+	}{
+		{"within the allowance", 1, 0, true},
+		{"at the loan limit", 2, 0, false},
+		{"fines over the threshold", 0, 60000, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeDB(t, loanTermsResponder(tt.activeLoans, tt.fines))
+
+			terms, err := EvaluateLoanTerms(5, 7, 0, borrowDate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if terms.CanBorrow != tt.canBorrow {
+				t.Errorf("CanBorrow = %v (%s), want %v", terms.CanBorrow, terms.BlockedReason, tt.canBorrow)
+			}
+			if want := borrowDate.AddDate(0, 0, 21); !terms.DueDate.Equal(want) {
+				t.Errorf("DueDate = %v, want %v", terms.DueDate, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============ LOCATION MANAGEMENT ============
+
+// maxHolidaySkip bounds how far a due date is pushed past consecutive holiday closures.
+const maxHolidaySkip = 30
+
+var (
+	ErrHolidayExists    = errors.New("a holiday is already recorded for that date")
+	ErrLocationArchived = errors.New("location is archived and no longer lends books")
+)
+
+// LocationHoliday closes one location, or every location when LocationID is nil, for a day.
+type LocationHoliday struct {
+	HolidayID  int    `json:"holiday_id"`
+	LocationID *int   `json:"location_id"`
+	Date       string `json:"date"`
+	Name       string `json:"name"`
+}
+
+const locationColumns = `location_id, location_name, address, COALESCE(owner_id, 0), COALESCE(phone, ''), COALESCE(email, ''),
+	latitude, longitude, delivery_radius_km, pickup_slot_capacity, archived_at`
+
+func scanLocation(scanner interface{ Scan(...interface{}) error }) (*Location, error) {
+	var loc Location
+	var archivedAt sql.NullTime
+	err := scanner.Scan(&loc.LocationID, &loc.LocationName, &loc.Address, &loc.OwnerID, &loc.Phone, &loc.Email,
+		&loc.Latitude, &loc.Longitude, &loc.DeliveryRadiusKm, &loc.PickupSlotCapacity, &archivedAt)
+	if err != nil {
+		return nil, err
+	}
+	if archivedAt.Valid {
+		loc.ArchivedAt = &archivedAt.Time
+	}
+	return &loc, nil
+}
+
+// checkLocationActive fails for a location that does not exist or has been archived.
+func checkLocationActive(ex execer, locationID int) error {
+	var archived bool
+	err := ex.QueryRow("SELECT archived_at IS NOT NULL FROM location WHERE location_id = ?", locationID).Scan(&archived)
+	if err == sql.ErrNoRows {
+		return ErrLocationNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if archived {
+		return ErrLocationArchived
+	}
+	return nil
+}
+
+func CreateLocation(loc Location) (int, error) {
+	result, err := db.Exec(`
+		INSERT INTO location (location_name, address, owner_id, phone, email, latitude, longitude, delivery_radius_km, pickup_slot_capacity)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, loc.LocationName, loc.Address, nullableID(loc.OwnerID), loc.Phone, loc.Email,
+		loc.Latitude, loc.Longitude, loc.DeliveryRadiusKm, loc.PickupSlotCapacity)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+func UpdateLocation(loc Location) error {
+	_, err := db.Exec(`
+		UPDATE location SET location_name = ?, address = ?, owner_id = ?, phone = ?, email = ?,
+			latitude = ?, longitude = ?, delivery_radius_km = ?, pickup_slot_capacity = ?
+		WHERE location_id = ?
+	`, loc.LocationName, loc.Address, nullableID(loc.OwnerID), loc.Phone, loc.Email,
+		loc.Latitude, loc.Longitude, loc.DeliveryRadiusKm, loc.PickupSlotCapacity, loc.LocationID)
+	return err
+}
+
+// ArchiveLocation hides a location from members without losing the borrows and stock that reference it.
+func ArchiveLocation(locationID int) error {
+	_, err := db.Exec("UPDATE location SET archived_at = COALESCE(archived_at, NOW()) WHERE location_id = ?", locationID)
+	return err
+}
+
+func RestoreLocation(locationID int) error {
+	_, err := db.Exec("UPDATE location SET archived_at = NULL WHERE location_id = ?", locationID)
+	return err
+}
+
+// GetHolidays lists a location's closures together with the nationwide ones, from today on.
+func GetHolidays(locationID int) ([]LocationHoliday, error) {
+	rows, err := db.Query(`
+		SELECT holiday_id, location_id, DATE_FORMAT(holiday_date, '%Y-%m-%d'), name
+		FROM location_holiday
+		WHERE (location_id IS NULL OR location_id = ?) AND holiday_date >= CURDATE()
+		ORDER BY holiday_date, holiday_id
+	`, nullableID(locationID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	holidays := []LocationHoliday{}
+	for rows.Next() {
+		var h LocationHoliday
+		var id sql.NullInt64
+		if err := rows.Scan(&h.HolidayID, &id, &h.Date, &h.Name); err != nil {
+			return nil, err
+		}
+		if id.Valid {
+			locID := int(id.Int64)
+			h.LocationID = &locID
+		}
+		holidays = append(holidays, h)
+	}
+	return holidays, nil
+}
+
+func CreateHoliday(locationID int, date time.Time, name string) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM location_holiday WHERE location_id <=> ? AND holiday_date = ?",
+		nullableID(locationID), date.Format("2006-01-02")).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	if count > 0 {
+		return 0, ErrHolidayExists
+	}
+
+	result, err := db.Exec("INSERT INTO location_holiday (location_id, holiday_date, name) VALUES (?, ?, ?)",
+		nullableID(locationID), date.Format("2006-01-02"), name)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// DeleteHoliday removes a closure of the given location; a zero locationID targets nationwide holidays.
+func DeleteHoliday(locationID, holidayID int) (bool, error) {
+	result, err := db.Exec("DELETE FROM location_holiday WHERE holiday_id = ? AND location_id <=> ?", holidayID, nullableID(locationID))
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// holidayDates returns the closure days of a location between two dates, keyed by YYYY-MM-DD.
+func holidayDates(locationID int, from, to time.Time) (map[string]bool, error) {
+	rows, err := db.Query(`
+		SELECT DATE_FORMAT(holiday_date, '%Y-%m-%d') FROM location_holiday
+		WHERE (location_id IS NULL OR location_id = ?) AND holiday_date BETWEEN ? AND ?
+	`, nullableID(locationID), from.Format("2006-01-02"), to.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	dates := map[string]bool{}
+	for rows.Next() {
+		var date string
+		if err := rows.Scan(&date); err != nil {
+			return nil, err
+		}
+		dates[date] = true
+	}
+	return dates, nil
+}
+
+// ============ LOCATION MANAGEMENT HANDLERS ============
+
+// requireLocationManager writes an error response and returns false unless the caller is an
+// admin or the owner of the location.
+func requireLocationManager(w http.ResponseWriter, r *http.Request, locationID int) bool {
+	userID := actingUserID(r)
+	if userID == 0 {
+		http.Error(w, "Missing user identity", http.StatusUnauthorized)
+		return false
+	}
+
+	user, err := GetUserByID(userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return false
+	}
+	if user != nil && user.Role == "admin" {
+		return true
+	}
+
+	location, err := GetLocationByID(locationID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return false
+	}
+	if location == nil {
+		http.Error(w, "Location not found", http.StatusNotFound)
+		return false
+	}
+	if user == nil || location.OwnerID != userID {
+		http.Error(w, "Only the location owner or an admin can manage this location", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// validateLocation returns an error message for an unusable location, or an empty string.
+func validateLocation(loc Location) string {
+	if loc.LocationName == "" || loc.Address == "" {
+		return "Location name and address are required"
+	}
+	if (loc.Latitude == nil) != (loc.Longitude == nil) ||
+		(loc.Latitude != nil && !validCoordinates(*loc.Latitude, *loc.Longitude)) {
+		return "Latitude and longitude must be given together and be valid"
+	}
+	if loc.PickupSlotCapacity < 0 || (loc.DeliveryRadiusKm != nil && *loc.DeliveryRadiusKm < 0) {
+		return "Capacity and delivery radius must not be negative"
+	}
+	if loc.OwnerID != 0 {
+		owner, err := GetUserByID(loc.OwnerID)
+		if err != nil || owner == nil {
+			return "Owner not found"
+		}
+	}
+	return ""
+}
+
+func createLocation(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var loc Location
+	if err := json.NewDecoder(r.Body).Decode(&loc); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if loc.PickupSlotCapacity == 0 {
+		loc.PickupSlotCapacity = 5
+	}
+	if err := fillCoordinates(&loc); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if msg := validateLocation(loc); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	locationID, err := CreateLocation(loc)
+	if err != nil {
+		http.Error(w, "Failed to create location", http.StatusInternalServerError)
+		return
+	}
+	if len(loc.Hours) > 0 {
+		if err := SetOpeningHours(locationID, loc.Hours); err != nil {
+			writePickupSlotError(w, err, "Failed to save opening hours")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"message":     "Location created successfully",
+		"location_id": locationID,
+	})
+}
+
+// updateLocation lets an owner edit their branch; only admins may hand it to another owner.
+func updateLocation(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	locationID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid location ID", http.StatusBadRequest)
+		return
+	}
+	if !requireLocationManager(w, r, locationID) {
+		return
+	}
+
+	existing, err := GetLocationByID(locationID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if existing == nil {
+		http.Error(w, "Location not found", http.StatusNotFound)
+		return
+	}
+
+	// owner_id is optional; leaving it out keeps the current owner and null clears it
+	var req struct {
+		Location
+		OwnerID json.RawMessage `json:"owner_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	loc := req.Location
+	loc.LocationID = locationID
+	loc.OwnerID = existing.OwnerID
+	if len(req.OwnerID) > 0 {
+		var ownerID *int
+		if err := json.Unmarshal(req.OwnerID, &ownerID); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		loc.OwnerID = 0
+		if ownerID != nil {
+			loc.OwnerID = *ownerID
+		}
+	}
+	caller, err := GetUserByID(actingUserID(r))
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if loc.OwnerID != existing.OwnerID && (caller == nil || caller.Role != "admin") {
+		http.Error(w, "Only an admin can change the location owner", http.StatusForbidden)
+		return
+	}
+	if loc.PickupSlotCapacity == 0 {
+		loc.PickupSlotCapacity = existing.PickupSlotCapacity
+	}
+	if err := fillCoordinates(&loc); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if msg := validateLocation(loc); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	if err := UpdateLocation(loc); err != nil {
+		http.Error(w, "Failed to update location", http.StatusInternalServerError)
+		return
+	}
+	if len(loc.Hours) > 0 {
+		if err := SetOpeningHours(locationID, loc.Hours); err != nil {
+			writePickupSlotError(w, err, "Failed to save opening hours")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Location updated successfully",
+	})
+}
+
+func archiveLocation(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	locationID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid location ID", http.StatusBadRequest)
+		return
+	}
+
+	location, err := GetLocationByID(locationID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if location == nil {
+		http.Error(w, "Location not found", http.StatusNotFound)
+		return
+	}
+
+	if err := ArchiveLocation(locationID); err != nil {
+		http.Error(w, "Failed to archive location", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Location archived successfully",
+	})
+}
+
+func restoreLocation(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	locationID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid location ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := RestoreLocation(locationID); err != nil {
+		http.Error(w, "Failed to restore location", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Location restored successfully",
+	})
+}
+
+// getLocationHolidays lists upcoming closures; /api/holidays (no {id}) lists the nationwide ones only.
+func getLocationHolidays(w http.ResponseWriter, r *http.Request) {
+	var locationID int
+	if raw, ok := mux.Vars(r)["id"]; ok {
+		id, err := strconv.Atoi(raw)
+		if err != nil {
+			http.Error(w, "Invalid location ID", http.StatusBadRequest)
+			return
+		}
+		locationID = id
+	}
+
+	holidays, err := GetHolidays(locationID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(holidays)
+}
+
+// createLocationHoliday records a closure for a location, or a nationwide holiday on /api/holidays.
+func createLocationHoliday(w http.ResponseWriter, r *http.Request) {
+	var locationID int
+	if raw, ok := mux.Vars(r)["id"]; ok {
+		id, err := strconv.Atoi(raw)
+		if err != nil {
+			http.Error(w, "Invalid location ID", http.StatusBadRequest)
+			return
+		}
+		locationID = id
+		if !requireLocationManager(w, r, locationID) {
+			return
+		}
+	} else if !requireAdmin(w, r) {
+		return
+	}
+
+	var req struct {
+		Date string `json:"date"`
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	date, err := time.ParseInLocation("2006-01-02", req.Date, time.Local)
+	if err != nil || req.Name == "" {
+		http.Error(w, "A YYYY-MM-DD date and a name are required", http.StatusBadRequest)
+		return
+	}
+
+	holidayID, err := CreateHoliday(locationID, date, req.Name)
+	if errors.Is(err, ErrHolidayExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to create holiday", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"message":    "Holiday created successfully",
+		"holiday_id": holidayID,
+	})
+}
+
+func deleteLocationHoliday(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var locationID int
+	if raw, ok := vars["id"]; ok {
+		id, err := strconv.Atoi(raw)
+		if err != nil {
+			http.Error(w, "Invalid location ID", http.StatusBadRequest)
+			return
+		}
+		locationID = id
+		if !requireLocationManager(w, r, locationID) {
+			return
+		}
+	} else if !requireAdmin(w, r) {
+		return
+	}
+
+	holidayID, err := strconv.Atoi(vars["holidayId"])
+	if err != nil {
+		http.Error(w, "Invalid holiday ID", http.StatusBadRequest)
+		return
+	}
+
+	found, err := DeleteHoliday(locationID, holidayID)
+	if err != nil {
+		http.Error(w, "Failed to delete holiday", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Holiday not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Holiday deleted successfully",
+	})
+}
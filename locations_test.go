@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// locationResponder answers for location 2, owned by user 3, with user 1 an admin and users 3
+// and 4 members.
+func locationResponder(archived bool) fakeResponder {
+	return func(query string, args []driver.Value) (*fakeRows, error) {
+		if rows, ok := userRows(query, args, map[int64]string{1: "admin", 3: "member", 4: "member"}); ok {
+			return rows, nil
+		}
+		if args[0] != int64(2) {
+			return nil, nil
+		}
+		var archivedAt interface{}
+		if archived {
+			archivedAt = time.Now()
+		}
+		switch {
+		case strings.Contains(query, "SELECT archived_at IS NOT NULL FROM location"):
+			return fakeRow(archived), nil
+		case strings.Contains(query, "FROM location WHERE location_id = ?"):
+			return fakeRow(int64(2), "Central", "1 Main St", int64(3), "", "", 10.5, 106.7, nil, int64(4), archivedAt), nil
+		}
+		return nil, nil
+	}
+}
+
+func TestCheckLocationActive(t *testing.T) {
+	useFakeDB(t, locationResponder(false))
+	if err := checkLocationActive(db, 2); err != nil {
+		t.Errorf("open location = %v", err)
+	}
+	if err := checkLocationActive(db, 9); !errors.Is(err, ErrLocationNotFound) {
+		t.Errorf("unknown location = %v, want %v", err, ErrLocationNotFound)
+	}
+
+	useFakeDB(t, locationResponder(true))
+	if err := checkLocationActive(db, 2); !errors.Is(err, ErrLocationArchived) {
+		t.Errorf("archived location = %v, want %v", err, ErrLocationArchived)
+	}
+}
+
+func TestRequireLocationManager(t *testing.T) {
+	useFakeDB(t, locationResponder(false))
+	tests := []struct {
+		name       string
+		user       string
+		locationID int
+		want       int
+	}{
+		{"anonymous", "", 2, http.StatusUnauthorized},
+		{"admin", "1", 2, http.StatusOK},
+		{"owner", "3", 2, http.StatusOK},
+		{"another member", "4", 2, http.StatusForbidden},
+		{"unknown location", "3", 9, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("PUT", "/", nil)
+		if tt.user != "" {
+			req.Header.Set("X-User-ID", tt.user)
+		}
+		rec := httptest.NewRecorder()
+		if ok := requireLocationManager(rec, req, tt.locationID); ok != (tt.want == http.StatusOK) {
+			t.Errorf("%s: allowed = %v", tt.name, ok)
+		}
+		if rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestUpdateLocationOwner(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc("/api/locations/{id}", updateLocation).Methods("PUT")
+	body := `{"location_name": "Central", "address": "1 Main St", "latitude": 10.5, "longitude": 106.7%s}`
+
+	tests := []struct {
+		name      string
+		user      string
+		owner     string
+		want      int
+		wantOwner interface{}
+	}{
+		{"owner leaves owner_id out", "3", "", http.StatusOK, int64(3)},
+		{"owner hands the location on", "3", `, "owner_id": 4`, http.StatusForbidden, nil},
+		{"admin reassigns", "1", `, "owner_id": 4`, http.StatusOK, int64(4)},
+		{"admin clears the owner", "1", `, "owner_id": null`, http.StatusOK, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t, locationResponder(false))
+			req := httptest.NewRequest("PUT", "/api/locations/2", strings.NewReader(strings.Replace(body, "%s", tt.owner, 1)))
+			req.Header.Set("X-User-ID", tt.user)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+
+			updates := fake.Find("UPDATE location SET location_name")
+			if tt.want != http.StatusOK {
+				if len(updates) != 0 {
+					t.Error("a refused update was written")
+				}
+				return
+			}
+			if len(updates) != 1 || updates[0].Args[2] != tt.wantOwner {
+				t.Errorf("updates %+v, want owner %v", updates, tt.wantOwner)
+			}
+			// Capacity left out keeps the current value
+			if updates[0].Args[8] != int64(4) {
+				t.Errorf("pickup capacity written as %v, want 4", updates[0].Args[8])
+			}
+		})
+	}
+}
+
+func TestCreateHolidayRefusesDuplicates(t *testing.T) {
+	fake := useFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+		if strings.Contains(query, "SELECT COUNT(*) FROM location_holiday") {
+			return fakeRow(int64(1)), nil
+		}
+		return nil, nil
+	})
+	date := time.Date(2026, 12, 25, 0, 0, 0, 0, time.UTC)
+	if _, err := CreateHoliday(0, date, "Christmas"); !errors.Is(err, ErrHolidayExists) {
+		t.Fatalf("duplicate holiday = %v, want %v", err, ErrHolidayExists)
+	}
+	checked := fake.Find("location_id <=> ?")
+	if len(checked) != 1 || checked[0].Args[0] != nil || checked[0].Args[1] != "2026-12-25" {
+		t.Errorf("duplicate check %+v, want the nationwide closure on 2026-12-25", checked)
+	}
+	if len(fake.Find("INSERT INTO location_holiday")) != 0 {
+		t.Error("a duplicate holiday was stored")
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -21,7 +22,9 @@ import (
 
 var db *sql.DB
 
-func init() {
+// connectDatabase opens the database and brings its schema up to date. It runs from main
+// rather than init so the package's tests do not need a database.
+func connectDatabase() {
 	godotenv.Load()
 
 	var err error
@@ -40,9 +43,15 @@ func init() {
 		log.Fatal("Database ping error:", err)
 	}
 	fmt.Println("Database connected successfully")
+
+	if err := migrateSchema(); err != nil {
+		log.Fatal("Database migration error:", err)
+	}
 }
 
 func main() {
+	connectDatabase()
+
 	router := mux.NewRouter()
 
 	router.Use(corsMiddleware)
@@ -73,19 +82,157 @@ func main() {
 	router.HandleFunc("/api/books/{id}", deleteBook).Methods("DELETE")
 	router.HandleFunc("/api/books/{bookId}/view", incrementBookView).Methods("POST") // Added new route
 
+	router.HandleFunc("/api/books/{id}/holds", placeHold).Methods("POST")
+	router.HandleFunc("/api/books/{id}/holds", getBookHolds).Methods("GET")
+	router.HandleFunc("/api/users/{userId}/holds", getUserHolds).Methods("GET")
+	router.HandleFunc("/api/holds/{id}/cancel", cancelHold).Methods("PUT")
+
+	router.HandleFunc("/api/users/{userId}/fines", getUserFines).Methods("GET")
+	router.HandleFunc("/api/users/{userId}/balance", getUserBalance).Methods("GET")
+	router.HandleFunc("/api/fines/{id}/pay", settleFineHandler(FineStatusPaid, "Fine marked as paid")).Methods("PUT")
+	router.HandleFunc("/api/fines/{id}/waive", settleFineHandler(FineStatusWaived, "Fine waived")).Methods("PUT")
+
 	router.HandleFunc("/api/categories", getCategories).Methods("GET")
 
+	router.HandleFunc("/api/loan-policies", getLoanPolicies).Methods("GET")
+	router.HandleFunc("/api/loan-policies", createLoanPolicy).Methods("POST")
+	router.HandleFunc("/api/loan-policies/evaluate", evaluateLoanPolicy).Methods("GET")
+	router.HandleFunc("/api/loan-policies/{id}", updateLoanPolicy).Methods("PUT")
+	router.HandleFunc("/api/loan-policies/{id}", deleteLoanPolicy).Methods("DELETE")
+
 	router.HandleFunc("/api/locations", getLocations).Methods("GET")
+	router.HandleFunc("/api/locations/nearby", getNearbyLocations).Methods("GET")
 	router.HandleFunc("/api/locations/{id}", getLocation).Methods("GET")
+	router.HandleFunc("/api/locations", createLocation).Methods("POST")
+	router.HandleFunc("/api/locations/{id}", updateLocation).Methods("PUT")
+	router.HandleFunc("/api/locations/{id}", archiveLocation).Methods("DELETE")
+	router.HandleFunc("/api/locations/{id}/restore", restoreLocation).Methods("POST")
+	router.HandleFunc("/api/locations/{id}/holidays", getLocationHolidays).Methods("GET")
+	router.HandleFunc("/api/locations/{id}/holidays", createLocationHoliday).Methods("POST")
+	router.HandleFunc("/api/locations/{id}/holidays/{holidayId}", deleteLocationHoliday).Methods("DELETE")
+	router.HandleFunc("/api/holidays", getLocationHolidays).Methods("GET")
+	router.HandleFunc("/api/holidays", createLocationHoliday).Methods("POST")
+	router.HandleFunc("/api/holidays/{holidayId}", deleteLocationHoliday).Methods("DELETE")
+	router.HandleFunc("/api/transfers", createTransfer).Methods("POST")
+	router.HandleFunc("/api/transfers/{id}", getTransfer).Methods("GET")
+	router.HandleFunc("/api/transfers/{id}/dispatch", dispatchTransfer).Methods("POST")
+	router.HandleFunc("/api/transfers/{id}/receive", receiveTransfer).Methods("POST")
+	router.HandleFunc("/api/transfers/{id}/cancel", cancelTransfer).Methods("POST")
+	router.HandleFunc("/api/locations/{id}/transfers", getLocationTransfers).Methods("GET")
+	router.HandleFunc("/api/locations/{id}/copies", getLocationCopies).Methods("GET")
+	router.HandleFunc("/api/locations/{id}/audits", getLocationAudits).Methods("GET")
+	router.HandleFunc("/api/locations/{id}/audits", startAudit).Methods("POST")
+	router.HandleFunc("/api/audits/{id}", getAuditReport).Methods("GET")
+	router.HandleFunc("/api/audits/{id}/scans", recordAuditScan).Methods("POST")
+	router.HandleFunc("/api/audits/{id}/submit", submitAudit).Methods("POST")
+	router.HandleFunc("/api/audits/{id}/cancel", cancelAudit).Methods("POST")
+	router.HandleFunc("/api/audits/{id}/discrepancies/{discrepancyId}", resolveDiscrepancy).Methods("POST")
+	router.HandleFunc("/api/notifications", getNotifications).Methods("GET")
+	router.HandleFunc("/api/notifications/unread-count", getUnreadNotificationCount).Methods("GET")
+	router.HandleFunc("/api/notifications/read-all", markAllNotificationsRead).Methods("POST")
+	router.HandleFunc("/api/notifications/preferences", getNotificationPreferences).Methods("GET")
+	router.HandleFunc("/api/notifications/preferences", updateNotificationPreferences).Methods("PUT")
+	router.HandleFunc("/api/notifications/channels", getDeliverySettings).Methods("GET")
+	router.HandleFunc("/api/notifications/channels", updateDeliverySettings).Methods("PUT")
+	router.HandleFunc("/api/notifications/{id}/read", markNotificationRead).Methods("POST")
+	router.HandleFunc("/api/notifications/{id}/deliveries", getNotificationDeliveries).Methods("GET")
+	router.HandleFunc("/api/push/subscriptions", createPushSubscription).Methods("POST")
+	router.HandleFunc("/api/push/subscriptions", deletePushSubscription).Methods("DELETE")
+
+	router.HandleFunc("/api/events/stream", streamEvents).Methods("GET")
+
+	router.HandleFunc("/api/webhooks", getWebhooks).Methods("GET")
+	router.HandleFunc("/api/webhooks", createWebhook).Methods("POST")
+	router.HandleFunc("/api/webhooks/dead-letters", getDeadWebhooks).Methods("GET")
+	router.HandleFunc("/api/webhooks/deliveries/{id}/replay", replayWebhookDelivery).Methods("POST")
+	router.HandleFunc("/api/webhooks/{id}", updateWebhook).Methods("PUT")
+	router.HandleFunc("/api/webhooks/{id}", deleteWebhook).Methods("DELETE")
+	router.HandleFunc("/api/webhooks/{id}/deliveries", getWebhookDeliveries).Methods("GET")
+	router.HandleFunc("/api/webhooks/{id}/replay", replayDeadWebhooks).Methods("POST")
 
 	router.HandleFunc("/api/borrows", createBorrow).Methods("POST")
 	router.HandleFunc("/api/borrows", getBorrows).Methods("GET")
+	router.HandleFunc("/api/borrows/overdue", getOverdueBorrows).Methods("GET")
 	router.HandleFunc("/api/borrows/{id}", getBorrow).Methods("GET")
 	router.HandleFunc("/api/borrows/user/{userId}", getUserBorrows).Methods("GET")
 	router.HandleFunc("/api/borrows/{id}/approve", approveBorrow).Methods("PUT")
 	router.HandleFunc("/api/borrows/{id}/reject", rejectBorrow).Methods("PUT")
 	router.HandleFunc("/api/borrows/{id}/return", returnBook).Methods("PUT")
+	router.HandleFunc("/api/borrows/{id}/cancel", cancelBorrow).Methods("PUT")
+	router.HandleFunc("/api/borrows/{id}/renew", renewBorrow).Methods("POST")
+	router.HandleFunc("/api/borrows/{id}/status", updateBorrowStatus).Methods("PUT")
+	router.HandleFunc("/api/borrows/{id}/history", getBorrowHistory).Methods("GET")
+	router.HandleFunc("/api/borrows/{id}/line-items", getBorrowLineItems).Methods("GET")
+
+	router.HandleFunc("/api/orders", createOrder).Methods("POST")
+	router.HandleFunc("/api/orders/{id}", getOrder).Methods("GET")
+	router.HandleFunc("/api/orders/{id}/status", updateOrderStatus).Methods("PUT")
+	router.HandleFunc("/api/orders/{id}/history", getOrderHistory).Methods("GET")
+	router.HandleFunc("/api/users/{userId}/orders", getUserOrders).Methods("GET")
+
+	router.HandleFunc("/api/orders/{id}/payments", createPaymentHandler(true)).Methods("POST")
+	router.HandleFunc("/api/borrows/{id}/payments", createPaymentHandler(false)).Methods("POST")
+	router.HandleFunc("/api/payments/webhook", paymentWebhook).Methods("POST")
+	router.HandleFunc("/api/payments/{id}", getPayment).Methods("GET")
+	router.HandleFunc("/api/payments/{id}/capture", capturePayment).Methods("POST")
+	router.HandleFunc("/api/payments/{id}/refund", refundPayment).Methods("POST")
+
+	router.HandleFunc("/api/users/{userId}/wallet", getWalletBalance).Methods("GET")
+	router.HandleFunc("/api/users/{userId}/wallet/statement", getWalletStatement).Methods("GET")
+	router.HandleFunc("/api/users/{userId}/wallet/credits", issueWalletCredit).Methods("POST")
+
+	router.HandleFunc("/api/vouchers", getVouchers).Methods("GET")
+	router.HandleFunc("/api/vouchers", createVoucher).Methods("POST")
+	router.HandleFunc("/api/vouchers/{id}", updateVoucher).Methods("PUT")
+	router.HandleFunc("/api/vouchers/{id}", deleteVoucher).Methods("DELETE")
+	router.HandleFunc("/api/vouchers/{id}/redemptions", getVoucherRedemptions).Methods("GET")
+	router.HandleFunc("/api/orders/{id}/invoice", issueInvoiceHandler(true)).Methods("POST")
+	router.HandleFunc("/api/borrows/{id}/invoice", issueInvoiceHandler(false)).Methods("POST")
+	router.HandleFunc("/api/invoices/{id}", getInvoice).Methods("GET")
+	router.HandleFunc("/api/invoices/{id}/html", getInvoiceHTML).Methods("GET")
+	router.HandleFunc("/api/invoices/{id}/pdf", getInvoicePDF).Methods("GET")
+	router.HandleFunc("/api/invoices/{id}/credit-notes", createCreditNote).Methods("POST")
+	router.HandleFunc("/api/invoices/{id}/reissue", reissueInvoice).Methods("POST")
+	router.HandleFunc("/api/users/{userId}/invoices", getUserInvoices).Methods("GET")
+	router.HandleFunc("/api/borrows/{id}/shipment", createShipment).Methods("POST")
+	router.HandleFunc("/api/borrows/{id}/shipment", getBorrowShipment).Methods("GET")
+	router.HandleFunc("/api/shipments/{id}", getShipment).Methods("GET")
+	router.HandleFunc("/api/shipments/{id}/events", addShipmentEvent).Methods("POST")
+	router.HandleFunc("/api/users/{userId}/coordinates", updateUserCoordinates).Methods("PUT")
+	router.HandleFunc("/api/locations/{id}/service-area", updateLocationServiceArea).Methods("PUT")
+	router.HandleFunc("/api/delivery-fee-tiers", getDeliveryFeeTiers).Methods("GET")
+	router.HandleFunc("/api/delivery-fee-tiers", createDeliveryFeeTier).Methods("POST")
+	router.HandleFunc("/api/delivery-fee-tiers/{id}", updateDeliveryFeeTier).Methods("PUT")
+	router.HandleFunc("/api/delivery-fee-tiers/{id}", deleteDeliveryFeeTier).Methods("DELETE")
+	router.HandleFunc("/api/locations/{id}/hours", getOpeningHours).Methods("GET")
+	router.HandleFunc("/api/locations/{id}/hours", updateOpeningHours).Methods("PUT")
+	router.HandleFunc("/api/locations/{id}/pickup-slots", getPickupSlots).Methods("GET")
+	router.HandleFunc("/api/locations/{id}/pickup-slots/reserve", reservePickupSlot).Methods("POST")
+	router.HandleFunc("/api/locations/{id}/pickups", getLocationPickups).Methods("GET")
+	router.HandleFunc("/api/pickup-appointments/{id}", cancelPickupAppointment).Methods("DELETE")
+
+	router.HandleFunc("/api/cart", getCart).Methods("GET")
+	router.HandleFunc("/api/cart/items", addCartItem).Methods("POST")
+	router.HandleFunc("/api/cart/items/{id}", updateCartItem).Methods("PUT")
+	router.HandleFunc("/api/cart/items/{id}", removeCartItem).Methods("DELETE")
+	router.HandleFunc("/api/cart/merge", mergeCart).Methods("POST")
+	router.HandleFunc("/api/cart/checkout", checkoutCart).Methods("POST")
+
+	router.HandleFunc("/api/checkout/quote", createCheckoutQuote).Methods("POST")
+	router.HandleFunc("/api/pricing-rules", getPricingRules).Methods("GET")
+	router.HandleFunc("/api/pricing-rules", createPricingRule).Methods("POST")
+	router.HandleFunc("/api/pricing-rules/{id}", updatePricingRule).Methods("PUT")
+	router.HandleFunc("/api/pricing-rules/{id}", deletePricingRule).Methods("DELETE")
 	router.HandleFunc("/api/books/{id}/status", updateBookStatus).Methods("PUT")
+	router.HandleFunc("/api/books/{id}/resubmit", resubmitBook).Methods("POST")
+	router.HandleFunc("/api/books/{id}/moderation", getBookModeration).Methods("GET")
+	router.HandleFunc("/api/moderation/reasons", getModerationReasons).Methods("GET")
+	router.HandleFunc("/api/moderation/queue", getModerationQueue).Methods("GET")
+	router.HandleFunc("/api/moderation/queue/claim-next", claimNextBook).Methods("POST")
+	router.HandleFunc("/api/moderation/bulk", bulkModerate).Methods("POST")
+	router.HandleFunc("/api/moderation/metrics", getModerationMetrics).Methods("GET")
+	router.HandleFunc("/api/books/{id}/claim", claimBook).Methods("POST")
+	router.HandleFunc("/api/books/{id}/claim", releaseBook).Methods("DELETE")
 
 	router.HandleFunc("/api/reviews", createReview).Methods("POST")
 	router.HandleFunc("/api/reviews/book/{bookId}", getBookReviews).Methods("GET")
@@ -96,6 +243,10 @@ func main() {
 		http.ServeFile(w, r, "FrontEnd/index.html")
 	})
 
+	deliveryChannels = configuredDeliveryChannels()
+	startScheduler(scheduledJobs)
+	go realtimeHub.Run()
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
@@ -131,6 +282,7 @@ type User struct {
 	Address      string `json:"address"`
 	Role         string `json:"role"`
 	ProfileImage string `json:"profile_image"`
+	MemberTier   string `json:"member_tier"`
 }
 
 type RegisterRequest struct {
@@ -172,10 +324,18 @@ type Category struct {
 }
 
 type Location struct {
-	LocationID   int    `json:"location_id"`
-	LocationName string `json:"location_name"`
-	Address      string `json:"address"`
-	OwnerID      int    `json:"owner_id"`
+	LocationID         int            `json:"location_id"`
+	LocationName       string         `json:"location_name"`
+	Address            string         `json:"address"`
+	OwnerID            int            `json:"owner_id"`
+	Phone              string         `json:"phone"`
+	Email              string         `json:"email"`
+	Latitude           *float64       `json:"latitude"`
+	Longitude          *float64       `json:"longitude"`
+	DeliveryRadiusKm   *float64       `json:"delivery_radius_km"`
+	PickupSlotCapacity int            `json:"pickup_slot_capacity"`
+	ArchivedAt         *time.Time     `json:"archived_at,omitempty"`
+	Hours              []OpeningHours `json:"hours,omitempty"`
 }
 
 type BookLocation struct {
@@ -194,9 +354,13 @@ type Borrow struct {
 	DueDate         string         `json:"due_date"`
 	Status          string         `json:"status"`
 	DeliveryType    string         `json:"delivery_type"`
+	LocationID      int            `json:"location_id"`
 	PickupLocation  sql.NullString `json:"pickup_location"`
 	DeliveryAddress sql.NullString `json:"delivery_address"`
 	TotalPrice      float64        `json:"total_price"`
+	RenewalCount    int            `json:"renewal_count"`
+	OrderID         int            `json:"order_id"`
+	PaymentStatus   string         `json:"payment_status"`
 }
 
 type BorrowRequest struct {
@@ -743,44 +907,14 @@ func uploadBook(w http.ResponseWriter, r *http.Request) {
 		fmt.Sscanf(uploadedByStr, "%d", &uploadedBy)
 	}
 
-	var coverImagePath string
-	file, handler, err := r.FormFile("cover_image")
-	if err == nil {
-		defer file.Close()
-
-		uploadsDir := "./FrontEnd/uploads"
-		if _, err := os.Stat(uploadsDir); os.IsNotExist(err) {
-			os.MkdirAll(uploadsDir, 0755)
-		}
-
-		ext := strings.TrimPrefix(filepath.Ext(handler.Filename), ".")
-		if ext == "" {
-			ext = "jpg"
-		}
-		filename := fmt.Sprintf("book_cover_%d_%d.%s", time.Now().Unix(), rand.Intn(10000), ext)
-		filepath := filepath.Join(uploadsDir, filename)
-
-		dst, err := os.Create(filepath)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"success": false,
-				"error":   "Failed to save cover image",
-			})
-			return
-		}
-		defer dst.Close()
-
-		if _, err := io.Copy(dst, file); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"success": false,
-				"error":   "Failed to write cover image",
-			})
-			return
-		}
-
-		coverImagePath = "/FrontEnd/uploads/" + filename
+	coverImagePath, err := saveCoverImage(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Failed to save cover image",
+		})
+		return
 	}
 
 	status := "pending"
@@ -788,7 +922,7 @@ func uploadBook(w http.ResponseWriter, r *http.Request) {
 		status = "accepted"
 	}
 
-	_, err = db.Exec(`
+	result, err := db.Exec(`
 		INSERT INTO book (title, author, publisher, year_published, isbn, category_id, uploaded_by, uploader_name, uploader_email, uploader_phone, description, cover_image, location, status)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`, title, author, publisher, yearPublished, isbn, categoryID, uploadedBy, uploaderName, uploaderEmail, uploaderPhone, description, coverImagePath, location, status)
@@ -802,6 +936,28 @@ func uploadBook(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
+	bookID, _ := result.LastInsertId()
+	if err := recordBookSubmission(int(bookID), uploadedBy, status); err != nil {
+		log.Printf("Error recording submission of book %d: %v", bookID, err)
+	}
+	queueWebhookEventLogged(WebhookBookUploaded, map[string]interface{}{
+		"book_id":     bookID,
+		"title":       title,
+		"author":      author,
+		"isbn":        isbn,
+		"uploaded_by": uploadedBy,
+		"status":      status,
+	})
+	if status == "pending" {
+		err := emitEvent(db, AudienceAdmins, 0, RealtimeBookPending, map[string]interface{}{
+			"book_id":     bookID,
+			"title":       title,
+			"uploaded_by": uploadedBy,
+		})
+		if err != nil {
+			log.Printf("Error announcing pending book %d: %v", bookID, err)
+		}
+	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -811,6 +967,38 @@ func uploadBook(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// saveCoverImage stores the "cover_image" file of a multipart form under FrontEnd/uploads and
+// returns its public path, or "" when the form has no cover.
+func saveCoverImage(r *http.Request) (string, error) {
+	file, handler, err := r.FormFile("cover_image")
+	if err != nil {
+		return "", nil
+	}
+	defer file.Close()
+
+	uploadsDir := "./FrontEnd/uploads"
+	if _, err := os.Stat(uploadsDir); os.IsNotExist(err) {
+		os.MkdirAll(uploadsDir, 0755)
+	}
+
+	ext := strings.TrimPrefix(filepath.Ext(handler.Filename), ".")
+	if ext == "" {
+		ext = "jpg"
+	}
+	filename := fmt.Sprintf("book_cover_%d_%d.%s", time.Now().Unix(), rand.Intn(10000), ext)
+
+	dst, err := os.Create(filepath.Join(uploadsDir, filename))
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, file); err != nil {
+		return "", err
+	}
+	return "/FrontEnd/uploads/" + filename, nil
+}
+
 func editBook(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	bookID, err := strconv.Atoi(vars["id"])
@@ -864,6 +1052,16 @@ func deleteBook(w http.ResponseWriter, r *http.Request) {
 }
 
 func searchBooks(w http.ResponseWriter, r *http.Request) {
+	lat, lng, radiusKm, nearby, err := parseGeoQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if nearby {
+		searchBooksNearby(w, r, lat, lng, radiusKm)
+		return
+	}
+
 	query := r.URL.Query().Get("q")
 	if query == "" {
 		http.Error(w, "Search query required", http.StatusBadRequest)
@@ -1154,44 +1352,6 @@ func getNewArrivals(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(books)
 }
 
-func updateBookStatus(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	bookID, err := strconv.Atoi(vars["id"])
-	if err != nil {
-		http.Error(w, "Invalid book ID", http.StatusBadRequest)
-		return
-	}
-
-	var req struct {
-		Status string `json:"status"`
-	}
-	err = json.NewDecoder(r.Body).Decode(&req)
-	if err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
-		return
-	}
-
-	if req.Status != "pending" && req.Status != "accepted" && req.Status != "rejected" {
-		http.Error(w, "Invalid status. Must be 'pending', 'accepted', or 'rejected'", http.StatusBadRequest)
-		return
-	}
-
-	_, err = db.Exec("UPDATE book SET status = ? WHERE book_id = ?", req.Status, bookID)
-	if err != nil {
-		log.Printf("Error updating book status: %v", err)
-		http.Error(w, "Failed to update book status", http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"message": "Book status updated successfully",
-		"book_id": bookID,
-		"status":  req.Status,
-	})
-}
-
 func getUserBorrowedBooks(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	userID := vars["userId"]
@@ -1275,6 +1435,12 @@ func getLocations(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
+	for i := range locations {
+		if locations[i].Hours, err = GetOpeningHours(locations[i].LocationID); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(locations)
@@ -1297,6 +1463,10 @@ func getLocation(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Location not found", http.StatusNotFound)
 		return
 	}
+	if location.Hours, err = GetOpeningHours(locationID); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(location)
@@ -1308,26 +1478,76 @@ func createBorrow(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		UserID       int    `json:"user_id"`
 		BookID       int    `json:"book_id"`
+		LocationID   int    `json:"location_id"`
 		DeliveryType string `json:"delivery_type"`
+		Insurance    bool   `json:"insurance"`
+		VoucherCode  string `json:"voucher_code"`
+
+		DeliveryService string `json:"delivery_service"`
+		DeliveryAddress string `json:"delivery_address"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	if req.DeliveryType == "delivery" && strings.TrimSpace(req.DeliveryAddress) == "" {
+		http.Error(w, ErrMissingDeliveryAddress.Error(), http.StatusBadRequest)
+		return
+	}
 
-	// Determine borrowDate, dueDate, and totalPrice based on deliveryType
+	// Loan period and loan limit come from the matching loan policy
 	borrowDate := time.Now()
-	dueDate := borrowDate.AddDate(0, 0, 14) // 14 days from borrow date
-	var totalPrice float64
+	terms, err := EvaluateLoanTerms(req.UserID, req.BookID, req.LocationID, borrowDate)
+	if err != nil {
+		http.Error(w, "Failed to evaluate loan policy", http.StatusInternalServerError)
+		return
+	}
+	if terms == nil {
+		http.Error(w, "User or book not found", http.StatusNotFound)
+		return
+	}
+	if !terms.CanBorrow {
+		http.Error(w, terms.BlockedReason, http.StatusConflict)
+		return
+	}
+	dueDate := terms.DueDate
+
+	// The price is always computed here; totals sent by the browser are never trusted
+	quote, err := BuildQuote(QuoteRequest{
+		UserID:       req.UserID,
+		BookIDs:      []int{req.BookID},
+		DeliveryType: req.DeliveryType,
+		Insurance:    req.Insurance,
+		LocationID:   req.LocationID,
+		VoucherCode:  req.VoucherCode,
 
-	if req.DeliveryType == "delivery" {
-		totalPrice = 113300.00 // Example price for delivery
-	} else { // Pickup
-		totalPrice = 88000.00 // Example price for pickup
+		DeliveryService: req.DeliveryService,
+		DeliveryAddress: req.DeliveryAddress,
+	})
+	if errors.Is(err, ErrVoucherInvalid) || errors.Is(err, ErrOutsideServiceArea) || errors.Is(err, ErrDeliveryServiceUnavailable) ||
+		errors.Is(err, ErrDeliveryAddressUnknown) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to price borrow", http.StatusInternalServerError)
+		return
 	}
 
-	borrowID, err := CreateBorrow(req.UserID, req.BookID, borrowDate, dueDate, req.DeliveryType, totalPrice)
+	borrowID, err := CreateBorrow(req.UserID, req.BookID, req.LocationID, borrowDate, dueDate, req.DeliveryType, req.DeliveryAddress, quote)
+	if errors.Is(err, ErrMissingDeliveryAddress) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, ErrNoCopiesAvailable) || errors.Is(err, ErrVoucherInvalid) || errors.Is(err, ErrLocationArchived) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if errors.Is(err, ErrLocationNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to create borrow", http.StatusInternalServerError)
 		return
@@ -1337,6 +1557,8 @@ func createBorrow(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success":   true,
 		"borrow_id": borrowID,
+		"due_date":  dueDate,
+		"quote":     quote,
 		"message":   "Book borrowed successfully",
 	})
 }
@@ -1433,66 +1655,24 @@ func getUserBorrows(w http.ResponseWriter, r *http.Request) {
 }
 
 func approveBorrow(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	borrowID, err := strconv.Atoi(vars["id"])
-	if err != nil {
-		http.Error(w, "Invalid borrow ID", http.StatusBadRequest)
-		return
-	}
-
-	_, err = db.Exec("UPDATE borrow SET status = 'approved' WHERE borrow_id = ?", borrowID)
-	if err != nil {
-		http.Error(w, "Failed to approve borrow", http.StatusInternalServerError)
+	if !requireAdmin(w, r) {
 		return
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"message": "Borrow approved successfully",
-	})
+	handleBorrowTransition(w, r, BorrowStatusApproved, "Failed to approve borrow", "Borrow approved successfully")
 }
 
 func rejectBorrow(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	borrowID, err := strconv.Atoi(vars["id"])
-	if err != nil {
-		http.Error(w, "Invalid borrow ID", http.StatusBadRequest)
-		return
-	}
-
-	_, err = db.Exec("UPDATE borrow SET status = 'rejected' WHERE borrow_id = ?", borrowID)
-	if err != nil {
-		http.Error(w, "Failed to reject borrow", http.StatusInternalServerError)
+	if !requireAdmin(w, r) {
 		return
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"message": "Borrow rejected successfully",
-	})
+	handleBorrowTransition(w, r, BorrowStatusRejected, "Failed to reject borrow", "Borrow rejected successfully")
 }
 
 func returnBook(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	borrowID, err := strconv.Atoi(vars["id"])
-	if err != nil {
-		http.Error(w, "Invalid borrow ID", http.StatusBadRequest)
-		return
-	}
-
-	err = ReturnBook(borrowID)
-	if err != nil {
-		http.Error(w, "Failed to return book", http.StatusInternalServerError)
+	if !requireAdmin(w, r) {
 		return
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"message": "Book returned successfully",
-	})
+	handleBorrowTransition(w, r, BorrowStatusReturned, "Failed to return book", "Book returned successfully")
 }
 
 // ============ REVIEW HANDLERS ============
@@ -1510,6 +1690,13 @@ func createReview(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to create review", http.StatusInternalServerError)
 		return
 	}
+	queueWebhookEventLogged(WebhookReviewCreated, map[string]interface{}{
+		"review_id": reviewID,
+		"book_id":   review.BookID,
+		"user_id":   review.UserID,
+		"rating":    review.Rating,
+		"comment":   review.Comment,
+	})
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -1573,8 +1760,8 @@ func getCategories(w http.ResponseWriter, r *http.Request) {
 
 func GetUserByEmail(email string) (*User, error) {
 	var user User
-	err := db.QueryRow("SELECT user_id, name, email, password, phone, address, role, COALESCE(profile_image, '') FROM user WHERE email = ?", email).
-		Scan(&user.UserID, &user.Name, &user.Email, &user.Password, &user.Phone, &user.Address, &user.Role, &user.ProfileImage)
+	err := db.QueryRow("SELECT user_id, name, email, password, phone, address, role, COALESCE(profile_image, ''), COALESCE(member_tier, 'standard') FROM user WHERE email = ?", email).
+		Scan(&user.UserID, &user.Name, &user.Email, &user.Password, &user.Phone, &user.Address, &user.Role, &user.ProfileImage, &user.MemberTier)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -1586,8 +1773,8 @@ func GetUserByEmail(email string) (*User, error) {
 
 func GetUserByID(userID int) (*User, error) {
 	var user User
-	err := db.QueryRow("SELECT user_id, name, email, password, phone, address, role, COALESCE(profile_image, '') FROM user WHERE user_id = ?", userID).
-		Scan(&user.UserID, &user.Name, &user.Email, &user.Password, &user.Phone, &user.Address, &user.Role, &user.ProfileImage)
+	err := db.QueryRow("SELECT user_id, name, email, password, phone, address, role, COALESCE(profile_image, ''), COALESCE(member_tier, 'standard') FROM user WHERE user_id = ?", userID).
+		Scan(&user.UserID, &user.Name, &user.Email, &user.Password, &user.Phone, &user.Address, &user.Role, &user.ProfileImage, &user.MemberTier)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -1732,7 +1919,7 @@ func GetBooksByUploader(userID int) ([]Book, error) {
 }
 
 func GetAllLocations() ([]Location, error) {
-	rows, err := db.Query("SELECT location_id, location_name, address, owner_id FROM location")
+	rows, err := db.Query("SELECT " + locationColumns + " FROM location WHERE archived_at IS NULL ORDER BY location_name")
 	if err != nil {
 		return nil, err
 	}
@@ -1740,34 +1927,80 @@ func GetAllLocations() ([]Location, error) {
 
 	var locations []Location
 	for rows.Next() {
-		var loc Location
-		err := rows.Scan(&loc.LocationID, &loc.LocationName, &loc.Address, &loc.OwnerID)
+		loc, err := scanLocation(rows)
 		if err != nil {
 			return nil, err
 		}
-		locations = append(locations, loc)
+		locations = append(locations, *loc)
 	}
 	return locations, nil
 }
 
 func GetLocationByID(locationID int) (*Location, error) {
-	var loc Location
-	err := db.QueryRow("SELECT location_id, location_name, address, owner_id FROM location WHERE location_id = ?", locationID).
-		Scan(&loc.LocationID, &loc.LocationName, &loc.Address, &loc.OwnerID)
+	loc, err := scanLocation(db.QueryRow("SELECT "+locationColumns+" FROM location WHERE location_id = ?", locationID))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	return &loc, nil
+	return loc, nil
 }
 
-func CreateBorrow(userID, bookID int, borrowDate, dueDate time.Time, deliveryType string, totalPrice float64) (int, error) {
-	result, err := db.Exec(`
-		INSERT INTO borrow (user_id, book_id, borrow_date, due_date, status, delivery_type, total_price)
-		VALUES (?, ?, ?, ?, 'active', ?, ?)
-	`, userID, bookID, borrowDate, dueDate, deliveryType, totalPrice)
+func CreateBorrow(userID, bookID, locationID int, borrowDate, dueDate time.Time, deliveryType, deliveryAddress string, quote *Quote) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	borrowID, err := createBorrowTx(tx, userID, bookID, locationID, borrowDate, dueDate, deliveryType, deliveryAddress, quote)
+	if err != nil {
+		return 0, err
+	}
+	if err := postChargeTx(tx, userID, "borrow", borrowID, quote.Total, quote.Deposit); err != nil {
+		return 0, err
+	}
+	if err := redeemVoucherTx(tx, quote, userID, 0, borrowID); err != nil {
+		return 0, err
+	}
+	return borrowID, tx.Commit()
+}
+
+// createBorrowTx inserts a requested borrow with its history and line items inside tx.
+// Delivery borrows must carry the address the courier will be booked to.
+func createBorrowTx(tx *sql.Tx, userID, bookID, locationID int, borrowDate, dueDate time.Time, deliveryType, deliveryAddress string, quote *Quote) (int, error) {
+	if deliveryType == "delivery" && strings.TrimSpace(deliveryAddress) == "" {
+		return 0, ErrMissingDeliveryAddress
+	}
+	if locationID != 0 {
+		if err := checkLocationActive(tx, locationID); err != nil {
+			return 0, err
+		}
+	}
+	// Concurrent borrows of the last copy queue up here and count after each other commits
+	if err := lockBookStockTx(tx, bookID); err != nil {
+		return 0, err
+	}
+	// A member collecting a copy reserved for their hold skips the availability check
+	hadHold, err := consumeReadyHoldTx(tx, userID, bookID)
+	if err != nil {
+		return 0, err
+	}
+	if !hadHold {
+		available, err := availableCopies(tx, bookID)
+		if err != nil {
+			return 0, err
+		}
+		if available <= 0 {
+			return 0, ErrNoCopiesAvailable
+		}
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO borrow (user_id, book_id, location_id, borrow_date, due_date, status, delivery_type, delivery_address, total_price, deposit_amount, payment_status)
+		VALUES (?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?, ?, ?)
+	`, userID, bookID, nullableID(locationID), borrowDate, dueDate, BorrowStatusRequested, deliveryType, deliveryAddress, quote.Total, quote.Deposit, PayableUnpaid)
 
 	if err != nil {
 		return 0, err
@@ -1778,15 +2011,38 @@ func CreateBorrow(userID, bookID int, borrowDate, dueDate time.Time, deliveryTyp
 		return 0, err
 	}
 
+	if err := recordBorrowStatusTx(tx, int(lastInsertID), "", BorrowStatusRequested, userID, ""); err != nil {
+		return 0, err
+	}
+	if err := notifyBorrowTx(tx, int(lastInsertID), EventBorrowRequested); err != nil {
+		return 0, err
+	}
+	if err := emitBorrowStatusTx(tx, int(lastInsertID), "", BorrowStatusRequested); err != nil {
+		return 0, err
+	}
+	if err := queueBorrowWebhookTx(tx, int(lastInsertID), WebhookBorrowCreated); err != nil {
+		return 0, err
+	}
+
+	if deliveryType == "pickup" {
+		if err := transferForPickupTx(tx, int(lastInsertID), bookID, locationID); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := saveBorrowLineItemsTx(tx, int(lastInsertID), quote); err != nil {
+		return 0, err
+	}
+
 	return int(lastInsertID), nil
 }
 
 func GetBorrowByID(borrowID int) (*Borrow, error) {
 	var borrow Borrow
 	err := db.QueryRow(`
-		SELECT borrow_id, user_id, book_id, borrow_date, due_date, return_date, status, delivery_type, COALESCE(pickup_location, ''), COALESCE(delivery_address, ''), total_price
+		SELECT borrow_id, user_id, book_id, borrow_date, due_date, return_date, status, delivery_type, COALESCE(location_id, 0), COALESCE(pickup_location, ''), COALESCE(delivery_address, ''), total_price, renewal_count, COALESCE(order_id, 0), COALESCE(payment_status, '')
 		FROM borrow WHERE borrow_id = ?
-	`, borrowID).Scan(&borrow.BorrowID, &borrow.UserID, &borrow.BookID, &borrow.BorrowDate, &borrow.DueDate, &borrow.ReturnDate, &borrow.Status, &borrow.DeliveryType, &borrow.PickupLocation, &borrow.DeliveryAddress, &borrow.TotalPrice)
+	`, borrowID).Scan(&borrow.BorrowID, &borrow.UserID, &borrow.BookID, &borrow.BorrowDate, &borrow.DueDate, &borrow.ReturnDate, &borrow.Status, &borrow.DeliveryType, &borrow.LocationID, &borrow.PickupLocation, &borrow.DeliveryAddress, &borrow.TotalPrice, &borrow.RenewalCount, &borrow.OrderID, &borrow.PaymentStatus)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -1798,7 +2054,7 @@ func GetBorrowByID(borrowID int) (*Borrow, error) {
 
 func GetUserBorrows(userID int) ([]Borrow, error) {
 	rows, err := db.Query(`
-		SELECT borrow_id, user_id, book_id, borrow_date, due_date, return_date, status, delivery_type, COALESCE(pickup_location, ''), COALESCE(delivery_address, ''), total_price
+		SELECT borrow_id, user_id, book_id, borrow_date, due_date, return_date, status, delivery_type, COALESCE(location_id, 0), COALESCE(pickup_location, ''), COALESCE(delivery_address, ''), total_price, renewal_count, COALESCE(order_id, 0), COALESCE(payment_status, '')
 		FROM borrow WHERE user_id = ? ORDER BY borrow_date DESC
 	`, userID)
 	if err != nil {
@@ -1809,7 +2065,7 @@ func GetUserBorrows(userID int) ([]Borrow, error) {
 	var borrows []Borrow
 	for rows.Next() {
 		var borrow Borrow
-		err := rows.Scan(&borrow.BorrowID, &borrow.UserID, &borrow.BookID, &borrow.BorrowDate, &borrow.DueDate, &borrow.ReturnDate, &borrow.Status, &borrow.DeliveryType, &borrow.PickupLocation, &borrow.DeliveryAddress, &borrow.TotalPrice)
+		err := rows.Scan(&borrow.BorrowID, &borrow.UserID, &borrow.BookID, &borrow.BorrowDate, &borrow.DueDate, &borrow.ReturnDate, &borrow.Status, &borrow.DeliveryType, &borrow.LocationID, &borrow.PickupLocation, &borrow.DeliveryAddress, &borrow.TotalPrice, &borrow.RenewalCount, &borrow.OrderID, &borrow.PaymentStatus)
 		if err != nil {
 			return nil, err
 		}
@@ -1819,7 +2075,7 @@ func GetUserBorrows(userID int) ([]Borrow, error) {
 }
 
 func ReturnBook(borrowID int) error {
-	_, err := db.Exec("UPDATE borrow SET return_date = NOW(), status = 'returned' WHERE borrow_id = ?", borrowID)
+	_, err := TransitionBorrow(borrowID, BorrowStatusReturned, 0, "")
 	return err
 }
 
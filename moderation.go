@@ -0,0 +1,543 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============ BOOK MODERATION ============
+
+const (
+	BookStatusPending  = "pending"
+	BookStatusAccepted = "accepted"
+	BookStatusRejected = "rejected"
+)
+
+// Actions recorded in a book's moderation history.
+const (
+	ModerationSubmitted   = "submitted"
+	ModerationResubmitted = "resubmitted"
+	ModerationApproved    = "approved"
+	ModerationRejected    = "rejected"
+	ModerationReopened    = "reopened"
+)
+
+// bookStatusTransitions lists the statuses a moderator may move a book to from each status.
+// Moving back to pending reopens a decision; uploaders resubmit through ResubmitBook instead.
+var bookStatusTransitions = map[string][]string{
+	BookStatusPending:  {BookStatusAccepted, BookStatusRejected},
+	BookStatusAccepted: {BookStatusRejected, BookStatusPending},
+	BookStatusRejected: {BookStatusAccepted, BookStatusPending},
+}
+
+// RejectionReason is one of the fixed reasons a moderator picks when rejecting a book.
+type RejectionReason struct {
+	Code  string `json:"code"`
+	Label string `json:"label"`
+}
+
+const RejectionOther = "other"
+
+var rejectionReasons = []RejectionReason{
+	{"incomplete_details", "Book details are incomplete"},
+	{"incorrect_details", "Book details are incorrect"},
+	{"poor_cover_image", "Cover image is missing or unclear"},
+	{"duplicate", "This book is already listed"},
+	{"inappropriate_content", "Content is not allowed on LibMatch"},
+	{RejectionOther, "Other"},
+}
+
+// moderationFields are the book fields a moderator can leave a note on.
+var moderationFields = []string{
+	"title", "author", "publisher", "year_published", "isbn", "category_id", "description", "cover_image", "location",
+}
+
+var (
+	ErrBookNotFound        = errors.New("book not found")
+	ErrInvalidBookStatus   = errors.New("invalid book status change")
+	ErrInvalidModeration   = errors.New("invalid moderation decision")
+	ErrNotUploader         = errors.New("only the uploader can resubmit this book")
+	ErrBookNotRejected     = errors.New("only rejected books can be resubmitted")
+	ErrInvalidResubmission = errors.New("invalid resubmission")
+)
+
+// ModerationDecision is what a moderator submits when reviewing a book.
+type ModerationDecision struct {
+	Status     string            `json:"status"`
+	Reason     string            `json:"reason"`
+	Comment    string            `json:"comment"`
+	FieldNotes map[string]string `json:"field_notes"`
+}
+
+type ModerationEntry struct {
+	ModerationID int               `json:"moderation_id"`
+	BookID       int               `json:"book_id"`
+	Action       string            `json:"action"`
+	ActorID      int               `json:"actor_id"`
+	ActorName    string            `json:"actor_name"`
+	FromStatus   string            `json:"from_status"`
+	ToStatus     string            `json:"to_status"`
+	Reason       string            `json:"reason,omitempty"`
+	ReasonLabel  string            `json:"reason_label,omitempty"`
+	Comment      string            `json:"comment,omitempty"`
+	FieldNotes   map[string]string `json:"field_notes,omitempty"`
+	CreatedAt    time.Time         `json:"created_at"`
+}
+
+// BookResubmission holds the corrected details an uploader sends with a resubmission.
+type BookResubmission struct {
+	Title         string
+	Author        string
+	Publisher     string
+	YearPublished int
+	ISBN          string
+	CategoryID    int
+	Description   string
+	Location      string
+	CoverImage    string
+	Note          string
+}
+
+func rejectionReasonLabel(code string) string {
+	for _, r := range rejectionReasons {
+		if r.Code == code {
+			return r.Label
+		}
+	}
+	return ""
+}
+
+func moderationField(field string) bool {
+	for _, f := range moderationFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+func canTransitionBook(from, to string) bool {
+	for _, allowed := range bookStatusTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// validateDecision checks that a rejection explains itself; other decisions take an
+// optional comment only.
+func validateDecision(d ModerationDecision) error {
+	if d.Status != BookStatusRejected {
+		if d.Reason != "" || len(d.FieldNotes) > 0 {
+			return fmt.Errorf("%w: reasons and field notes only apply to rejections", ErrInvalidModeration)
+		}
+		return nil
+	}
+
+	if rejectionReasonLabel(d.Reason) == "" {
+		return fmt.Errorf("%w: pick a rejection reason", ErrInvalidModeration)
+	}
+	if d.Reason == RejectionOther && d.Comment == "" {
+		return fmt.Errorf("%w: explain the rejection in a comment", ErrInvalidModeration)
+	}
+	for field := range d.FieldNotes {
+		if !moderationField(field) {
+			return fmt.Errorf("%w: unknown field %s", ErrInvalidModeration, field)
+		}
+	}
+	return nil
+}
+
+// recordModerationTx appends an entry to a book's moderation history.
+func recordModerationTx(ex execer, bookID, actorID int, action, from, to, reason, comment string, fieldNotes map[string]string) error {
+	var notes interface{}
+	if len(fieldNotes) > 0 {
+		data, err := json.Marshal(fieldNotes)
+		if err != nil {
+			return err
+		}
+		notes = string(data)
+	}
+	_, err := ex.Exec(`
+		INSERT INTO book_moderation (book_id, actor_id, action, from_status, to_status, reason, comment, field_notes, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, NOW())
+	`, bookID, nullableID(actorID), action, from, to, reason, comment, notes)
+	return err
+}
+
+// lockBookTx returns a book's status and uploader, locking the row for the transaction.
+func lockBookTx(tx *sql.Tx, bookID int) (string, int, error) {
+	var status string
+	var uploaderID int
+	err := tx.QueryRow("SELECT COALESCE(status, 'pending'), COALESCE(uploaded_by, 0) FROM book WHERE book_id = ? FOR UPDATE", bookID).
+		Scan(&status, &uploaderID)
+	if err == sql.ErrNoRows {
+		return "", 0, ErrBookNotFound
+	}
+	return status, uploaderID, err
+}
+
+// recordBookSubmission starts the history of a newly uploaded book and, when it awaits
+// review, tells the moderators.
+func recordBookSubmission(bookID, uploaderID int, status string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := recordModerationTx(tx, bookID, uploaderID, ModerationSubmitted, "", status, "", "", nil); err != nil {
+		return err
+	}
+	if status == BookStatusPending {
+		if _, err := tx.Exec("UPDATE book SET submitted_at = NOW() WHERE book_id = ?", bookID); err != nil {
+			return err
+		}
+		if err := notifyModeratorsTx(tx, bookID, EventBookSubmitted); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ModerateBook applies a moderator's decision, records it and tells the uploader.
+func ModerateBook(bookID, moderatorID int, d ModerationDecision) error {
+	if err := validateDecision(d); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	from, _, err := lockBookTx(tx, bookID)
+	if err != nil {
+		return err
+	}
+	if !canTransitionBook(from, d.Status) {
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidBookStatus, from, d.Status)
+	}
+	if err := checkClaimTx(tx, bookID, moderatorID); err != nil {
+		return err
+	}
+
+	// A decision ends any claim; reopening puts the book at the back of the queue.
+	_, err = tx.Exec(`
+		UPDATE book SET status = ?, claimed_by = NULL, claim_expires_at = NULL,
+		       submitted_at = IF(? = ?, NOW(), submitted_at)
+		WHERE book_id = ?
+	`, d.Status, d.Status, BookStatusPending, bookID)
+	if err != nil {
+		return err
+	}
+
+	action := ModerationReopened
+	switch d.Status {
+	case BookStatusAccepted:
+		action = ModerationApproved
+	case BookStatusRejected:
+		action = ModerationRejected
+	}
+	if err := recordModerationTx(tx, bookID, moderatorID, action, from, d.Status, d.Reason, d.Comment, d.FieldNotes); err != nil {
+		return err
+	}
+	if err := notifyBookReviewTx(tx, bookID, d); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// checkResubmittable returns an error unless the book is rejected and was uploaded by the user.
+// ResubmitBook repeats the check under lock; this lets the handler fail before storing uploads.
+func checkResubmittable(ex execer, bookID, userID int) error {
+	var status string
+	var uploaderID int
+	err := ex.QueryRow("SELECT COALESCE(status, 'pending'), COALESCE(uploaded_by, 0) FROM book WHERE book_id = ?", bookID).
+		Scan(&status, &uploaderID)
+	if err == sql.ErrNoRows {
+		return ErrBookNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if uploaderID != userID {
+		return ErrNotUploader
+	}
+	if status != BookStatusRejected {
+		return ErrBookNotRejected
+	}
+	return nil
+}
+
+// ResubmitBook saves an uploader's corrections to a rejected book and puts it back in review.
+func ResubmitBook(bookID, userID int, changes BookResubmission) error {
+	if changes.Title == "" || changes.Author == "" || changes.CategoryID == 0 {
+		return fmt.Errorf("%w: title, author, and category are required", ErrInvalidResubmission)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	status, uploaderID, err := lockBookTx(tx, bookID)
+	if err != nil {
+		return err
+	}
+	if uploaderID != userID {
+		return ErrNotUploader
+	}
+	if status != BookStatusRejected {
+		return ErrBookNotRejected
+	}
+
+	_, err = tx.Exec(`
+		UPDATE book SET title = ?, author = ?, publisher = ?, year_published = ?, isbn = ?, category_id = ?,
+		       description = ?, location = ?, cover_image = COALESCE(NULLIF(?, ''), cover_image), status = ?,
+		       submitted_at = NOW()
+		WHERE book_id = ?
+	`, changes.Title, changes.Author, changes.Publisher, changes.YearPublished, changes.ISBN, changes.CategoryID,
+		changes.Description, changes.Location, changes.CoverImage, BookStatusPending, bookID)
+	if err != nil {
+		return err
+	}
+
+	if err := recordModerationTx(tx, bookID, userID, ModerationResubmitted, status, BookStatusPending, "", changes.Note, nil); err != nil {
+		return err
+	}
+	if err := notifyModeratorsTx(tx, bookID, EventBookResubmitted); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetModerationHistory returns a book's moderation entries, oldest first.
+func GetModerationHistory(bookID int) ([]ModerationEntry, error) {
+	rows, err := db.Query(`
+		SELECT m.moderation_id, m.book_id, m.action, COALESCE(m.actor_id, 0), COALESCE(u.name, ''),
+		       COALESCE(m.from_status, ''), m.to_status, COALESCE(m.reason, ''), COALESCE(m.comment, ''),
+		       COALESCE(m.field_notes, ''), m.created_at
+		FROM book_moderation m LEFT JOIN user u ON u.user_id = m.actor_id
+		WHERE m.book_id = ?
+		ORDER BY m.created_at, m.moderation_id
+	`, bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []ModerationEntry{}
+	for rows.Next() {
+		var e ModerationEntry
+		var notes string
+		err := rows.Scan(&e.ModerationID, &e.BookID, &e.Action, &e.ActorID, &e.ActorName,
+			&e.FromStatus, &e.ToStatus, &e.Reason, &e.Comment, &notes, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		e.ReasonLabel = rejectionReasonLabel(e.Reason)
+		if notes != "" {
+			if err := json.Unmarshal([]byte(notes), &e.FieldNotes); err != nil {
+				return nil, err
+			}
+		}
+		history = append(history, e)
+	}
+	return history, rows.Err()
+}
+
+// ============ MODERATION HANDLERS ============
+
+func writeModerationError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, ErrBookNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrInvalidModeration), errors.Is(err, ErrInvalidResubmission):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrNotUploader):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, ErrInvalidBookStatus), errors.Is(err, ErrBookNotRejected), errors.Is(err, ErrClaimedByOther):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, fallback, http.StatusInternalServerError)
+	}
+}
+
+// announceBookStatus pushes a book's new status to open admin pages and webhook subscribers.
+func announceBookStatus(bookID int, status string) {
+	err := emitEvent(db, AudienceAdmins, 0, RealtimeBookStatusChanged, map[string]interface{}{"book_id": bookID, "status": status})
+	if err != nil {
+		log.Printf("Error announcing status of book %d: %v", bookID, err)
+	}
+	queueWebhookEventLogged(WebhookBookStatusChanged, map[string]interface{}{"book_id": bookID, "status": status})
+}
+
+// updateBookStatus approves, rejects or reopens a book. Rejections take a reason code, an
+// optional comment and optional notes keyed by field, e.g. {"isbn": "Check the last digit"}.
+func updateBookStatus(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	vars := mux.Vars(r)
+	bookID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid book ID", http.StatusBadRequest)
+		return
+	}
+
+	var req ModerationDecision
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if req.Status != BookStatusPending && req.Status != BookStatusAccepted && req.Status != BookStatusRejected {
+		http.Error(w, "Invalid status. Must be 'pending', 'accepted', or 'rejected'", http.StatusBadRequest)
+		return
+	}
+
+	if err := ModerateBook(bookID, actingUserID(r), req); err != nil {
+		if !errors.Is(err, ErrInvalidBookStatus) && !errors.Is(err, ErrInvalidModeration) && !errors.Is(err, ErrBookNotFound) &&
+			!errors.Is(err, ErrClaimedByOther) {
+			log.Printf("Error updating book status: %v", err)
+		}
+		writeModerationError(w, err, "Failed to update book status")
+		return
+	}
+	announceBookStatus(bookID, req.Status)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Book status updated successfully",
+		"book_id": bookID,
+		"status":  req.Status,
+	})
+}
+
+// resubmitBook takes the same multipart form as an upload, with an optional new cover and a
+// "note" for the moderators.
+func resubmitBook(w http.ResponseWriter, r *http.Request) {
+	userID := requireUser(w, r)
+	if userID == 0 {
+		return
+	}
+	bookID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid book ID", http.StatusBadRequest)
+		return
+	}
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		http.Error(w, "Failed to parse form data", http.StatusBadRequest)
+		return
+	}
+
+	changes := BookResubmission{
+		Title:       r.FormValue("title"),
+		Author:      r.FormValue("author"),
+		Publisher:   r.FormValue("publisher"),
+		ISBN:        r.FormValue("isbn"),
+		Description: r.FormValue("description"),
+		Location:    r.FormValue("location"),
+		Note:        r.FormValue("note"),
+	}
+	changes.CategoryID, _ = strconv.Atoi(r.FormValue("category_id"))
+	changes.YearPublished, _ = strconv.Atoi(r.FormValue("year_published"))
+
+	if err := checkResubmittable(db, bookID, userID); err != nil {
+		writeModerationError(w, err, "Failed to resubmit book")
+		return
+	}
+	changes.CoverImage, err = saveCoverImage(r)
+	if err != nil {
+		http.Error(w, "Failed to save cover image", http.StatusInternalServerError)
+		return
+	}
+
+	if err := ResubmitBook(bookID, userID, changes); err != nil {
+		if changes.CoverImage != "" {
+			os.Remove("." + changes.CoverImage)
+		}
+		writeModerationError(w, err, "Failed to resubmit book")
+		return
+	}
+	announceBookStatus(bookID, BookStatusPending)
+	err = emitEvent(db, AudienceAdmins, 0, RealtimeBookPending, map[string]interface{}{
+		"book_id":     bookID,
+		"title":       changes.Title,
+		"uploaded_by": userID,
+	})
+	if err != nil {
+		log.Printf("Error announcing pending book %d: %v", bookID, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Book resubmitted for review",
+	})
+}
+
+// getBookModeration shows a book's status and moderation history to its uploader and admins.
+func getBookModeration(w http.ResponseWriter, r *http.Request) {
+	userID := requireUser(w, r)
+	if userID == 0 {
+		return
+	}
+	bookID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid book ID", http.StatusBadRequest)
+		return
+	}
+
+	var status string
+	var uploaderID int
+	err = db.QueryRow("SELECT COALESCE(status, 'pending'), COALESCE(uploaded_by, 0) FROM book WHERE book_id = ?", bookID).
+		Scan(&status, &uploaderID)
+	if err == sql.ErrNoRows {
+		writeModerationError(w, ErrBookNotFound, "")
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if uploaderID != userID && !requireAdmin(w, r) {
+		return
+	}
+
+	history, err := GetModerationHistory(bookID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"book_id": bookID,
+		"status":  status,
+		"history": history,
+	})
+}
+
+func getModerationReasons(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"reasons": rejectionReasons,
+		"fields":  moderationFields,
+	})
+}
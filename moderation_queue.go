@@ -0,0 +1,593 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============ MODERATION QUEUE ============
+
+// Moderators claim a pending book before deciding on it. A claim is a lease: it lapses after
+// moderationLease unless renewed, so a book someone walked away from goes back to the queue.
+const moderationLease = 15 * time.Minute
+
+// Pending books age from the moment they were (re)submitted.
+const (
+	moderationSLAWarning = 24 * time.Hour
+	moderationSLABreach  = 48 * time.Hour
+)
+
+const (
+	SLAOnTrack  = "on_track"
+	SLAWarning  = "warning"
+	SLABreached = "breached"
+)
+
+const (
+	QueueFilterAll       = "all"
+	QueueFilterUnclaimed = "unclaimed"
+	QueueFilterMine      = "mine"
+)
+
+// maxBulkModeration caps how many books one bulk decision may cover.
+const maxBulkModeration = 100
+
+var (
+	ErrClaimedByOther = errors.New("book is claimed by another moderator")
+	ErrNotPending     = errors.New("book is not pending review")
+	ErrNotClaimed     = errors.New("book is not claimed by you")
+	ErrQueueEmpty     = errors.New("no unclaimed books to review")
+)
+
+type QueueItem struct {
+	BookID         int        `json:"book_id"`
+	Title          string     `json:"title"`
+	Author         string     `json:"author"`
+	CoverImage     string     `json:"cover_image"`
+	UploaderName   string     `json:"uploader_name"`
+	SubmittedAt    time.Time  `json:"submitted_at"`
+	AgeHours       float64    `json:"age_hours"`
+	SLA            string     `json:"sla"`
+	ClaimedBy      int        `json:"claimed_by"`
+	ClaimedByName  string     `json:"claimed_by_name"`
+	ClaimExpiresAt *time.Time `json:"claim_expires_at"`
+	ClaimedByMe    bool       `json:"claimed_by_me"`
+}
+
+type QueueSummary struct {
+	Pending        int     `json:"pending"`
+	Unclaimed      int     `json:"unclaimed"`
+	Warning        int     `json:"warning"`
+	Breached       int     `json:"breached"`
+	OldestAgeHours float64 `json:"oldest_age_hours"`
+}
+
+// ModeratorMetrics summarises how quickly one moderator decides after submission.
+type ModeratorMetrics struct {
+	ModeratorID         int     `json:"moderator_id"`
+	ModeratorName       string  `json:"moderator_name"`
+	Decisions           int     `json:"decisions"`
+	Approved            int     `json:"approved"`
+	Rejected            int     `json:"rejected"`
+	AvgDecisionHours    float64 `json:"avg_decision_hours"`
+	MedianDecisionHours float64 `json:"median_decision_hours"`
+	P90DecisionHours    float64 `json:"p90_decision_hours"`
+	WithinSLA           int     `json:"within_sla"`
+}
+
+// BulkResult reports the outcome of one book in a bulk decision.
+type BulkResult struct {
+	BookID  int    `json:"book_id"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+func slaStatus(age time.Duration) string {
+	switch {
+	case age >= moderationSLABreach:
+		return SLABreached
+	case age >= moderationSLAWarning:
+		return SLAWarning
+	}
+	return SLAOnTrack
+}
+
+// activeClaimSQL is true when a book is held by a moderator whose lease has not lapsed.
+// Leases are compared with the database clock, the same clock that set them.
+const activeClaimSQL = "(claimed_by IS NOT NULL AND COALESCE(claim_expires_at > NOW(), FALSE))"
+
+// GetModerationQueue lists pending books oldest first. Lapsed claims are shown as unclaimed.
+func GetModerationQueue(moderatorID int) ([]QueueItem, error) {
+	rows, err := db.Query(`
+		SELECT b.book_id, b.title, b.author, COALESCE(b.cover_image, ''), COALESCE(b.uploader_name, ''),
+		       COALESCE(b.submitted_at, NOW()), TIMESTAMPDIFF(SECOND, COALESCE(b.submitted_at, NOW()), NOW()),
+		       COALESCE(b.claimed_by, 0), COALESCE(u.name, ''), b.claim_expires_at, `+activeClaimSQL+`
+		FROM book b LEFT JOIN user u ON u.user_id = b.claimed_by
+		WHERE b.status = ?
+		ORDER BY b.submitted_at, b.book_id
+	`, BookStatusPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	queue := []QueueItem{}
+	for rows.Next() {
+		var item QueueItem
+		var ageSeconds int64
+		var expiresAt sql.NullTime
+		var claimed bool
+		err := rows.Scan(&item.BookID, &item.Title, &item.Author, &item.CoverImage, &item.UploaderName,
+			&item.SubmittedAt, &ageSeconds, &item.ClaimedBy, &item.ClaimedByName, &expiresAt, &claimed)
+		if err != nil {
+			return nil, err
+		}
+
+		if claimed {
+			item.ClaimExpiresAt = &expiresAt.Time
+			item.ClaimedByMe = item.ClaimedBy == moderatorID
+		} else {
+			item.ClaimedBy = 0
+			item.ClaimedByName = ""
+		}
+		age := time.Duration(ageSeconds) * time.Second
+		item.AgeHours = age.Hours()
+		item.SLA = slaStatus(age)
+		queue = append(queue, item)
+	}
+	return queue, rows.Err()
+}
+
+func summarizeQueue(queue []QueueItem) QueueSummary {
+	var summary QueueSummary
+	for _, item := range queue {
+		summary.Pending++
+		if item.ClaimedBy == 0 {
+			summary.Unclaimed++
+		}
+		switch item.SLA {
+		case SLAWarning:
+			summary.Warning++
+		case SLABreached:
+			summary.Breached++
+		}
+		if item.AgeHours > summary.OldestAgeHours {
+			summary.OldestAgeHours = item.AgeHours
+		}
+	}
+	return summary
+}
+
+// claimBookTx gives a moderator the lease on a pending book, renewing it if they hold it.
+func claimBookTx(tx *sql.Tx, bookID, moderatorID int) (time.Time, error) {
+	var status string
+	var claimedBy int
+	var claimed bool
+	err := tx.QueryRow(`
+		SELECT COALESCE(status, 'pending'), COALESCE(claimed_by, 0), `+activeClaimSQL+`
+		FROM book WHERE book_id = ? FOR UPDATE
+	`, bookID).Scan(&status, &claimedBy, &claimed)
+	if err == sql.ErrNoRows {
+		return time.Time{}, ErrBookNotFound
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	if status != BookStatusPending {
+		return time.Time{}, ErrNotPending
+	}
+	if claimed && claimedBy != moderatorID {
+		return time.Time{}, ErrClaimedByOther
+	}
+
+	_, err = tx.Exec(`
+		UPDATE book SET claimed_by = ?, claim_expires_at = NOW() + INTERVAL ? SECOND WHERE book_id = ?
+	`, moderatorID, int(moderationLease.Seconds()), bookID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var expires time.Time
+	err = tx.QueryRow("SELECT claim_expires_at FROM book WHERE book_id = ?", bookID).Scan(&expires)
+	return expires, err
+}
+
+// ClaimBook claims a pending book for a moderator and returns when the lease ends.
+func ClaimBook(bookID, moderatorID int) (time.Time, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	expires, err := claimBookTx(tx, bookID, moderatorID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return expires, tx.Commit()
+}
+
+// ClaimNextBook claims the oldest pending book nobody holds.
+func ClaimNextBook(moderatorID int) (int, time.Time, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	var bookID int
+	err = tx.QueryRow(`
+		SELECT book_id FROM book
+		WHERE status = ? AND NOT `+activeClaimSQL+`
+		ORDER BY submitted_at, book_id LIMIT 1 FOR UPDATE
+	`, BookStatusPending).Scan(&bookID)
+	if err == sql.ErrNoRows {
+		return 0, time.Time{}, ErrQueueEmpty
+	}
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	expires, err := claimBookTx(tx, bookID, moderatorID)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return bookID, expires, tx.Commit()
+}
+
+// ReleaseBook hands a claimed book back to the queue.
+func ReleaseBook(bookID, moderatorID int) error {
+	result, err := db.Exec(`
+		UPDATE book SET claimed_by = NULL, claim_expires_at = NULL
+		WHERE book_id = ? AND claimed_by = ? AND claim_expires_at > NOW()
+	`, bookID, moderatorID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotClaimed
+	}
+	return nil
+}
+
+// checkClaimTx stops a moderator from deciding on a book someone else currently holds.
+// Unclaimed books can still be decided directly.
+func checkClaimTx(tx *sql.Tx, bookID, moderatorID int) error {
+	var claimedBy int
+	var claimed bool
+	err := tx.QueryRow("SELECT COALESCE(claimed_by, 0), "+activeClaimSQL+" FROM book WHERE book_id = ?", bookID).
+		Scan(&claimedBy, &claimed)
+	if err == sql.ErrNoRows {
+		return ErrBookNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if claimed && claimedBy != moderatorID {
+		return ErrClaimedByOther
+	}
+	return nil
+}
+
+// BulkModerate applies the same decision to several books, each in its own transaction, so
+// one book that cannot be decided does not hold back the rest.
+func BulkModerate(bookIDs []int, moderatorID int, d ModerationDecision) []BulkResult {
+	results := make([]BulkResult, 0, len(bookIDs))
+	for _, bookID := range bookIDs {
+		result := BulkResult{BookID: bookID, Success: true}
+		if err := ModerateBook(bookID, moderatorID, d); err != nil {
+			result.Success = false
+			result.Error = err.Error()
+		} else {
+			announceBookStatus(bookID, d.Status)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// percentile returns the p-th percentile of sorted values by nearest rank.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(p*float64(len(sorted))+0.999999) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// GetModeratorMetrics measures time-to-decision per moderator for decisions since a time.
+// A decision is timed from the latest (re)submission of the book that preceded it.
+func GetModeratorMetrics(since time.Time) ([]ModeratorMetrics, error) {
+	rows, err := db.Query(`
+		SELECT COALESCE(m.actor_id, 0), COALESCE(u.name, ''), m.to_status,
+		       TIMESTAMPDIFF(SECOND, (
+		           SELECT MAX(s.created_at) FROM book_moderation s
+		           WHERE s.book_id = m.book_id AND s.action IN (?, ?, ?) AND s.created_at <= m.created_at
+		       ), m.created_at)
+		FROM book_moderation m LEFT JOIN user u ON u.user_id = m.actor_id
+		WHERE m.action IN (?, ?) AND m.created_at >= ?
+	`, ModerationSubmitted, ModerationResubmitted, ModerationReopened, ModerationApproved, ModerationRejected, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byModerator := map[int]*ModeratorMetrics{}
+	durations := map[int][]float64{}
+	for rows.Next() {
+		var moderatorID int
+		var name, status string
+		var seconds sql.NullInt64
+		if err := rows.Scan(&moderatorID, &name, &status, &seconds); err != nil {
+			return nil, err
+		}
+
+		m, ok := byModerator[moderatorID]
+		if !ok {
+			m = &ModeratorMetrics{ModeratorID: moderatorID, ModeratorName: name}
+			byModerator[moderatorID] = m
+		}
+		m.Decisions++
+		if status == BookStatusAccepted {
+			m.Approved++
+		} else {
+			m.Rejected++
+		}
+		// Books submitted before moderation history was kept have no start time.
+		if seconds.Valid {
+			durations[moderatorID] = append(durations[moderatorID], float64(seconds.Int64)/3600)
+			if time.Duration(seconds.Int64)*time.Second < moderationSLABreach {
+				m.WithinSLA++
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	metrics := []ModeratorMetrics{}
+	for id, m := range byModerator {
+		hours := durations[id]
+		sort.Float64s(hours)
+		if len(hours) > 0 {
+			total := 0.0
+			for _, h := range hours {
+				total += h
+			}
+			m.AvgDecisionHours = total / float64(len(hours))
+			m.MedianDecisionHours = percentile(hours, 0.5)
+			m.P90DecisionHours = percentile(hours, 0.9)
+		}
+		metrics = append(metrics, *m)
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].Decisions > metrics[j].Decisions })
+	return metrics, nil
+}
+
+// ============ MODERATION QUEUE HANDLERS ============
+
+// announceClaim lets other moderators' queues show who picked up or let go of a book.
+func announceClaim(bookID, moderatorID int) {
+	err := emitEvent(db, AudienceAdmins, 0, RealtimeModerationClaim, map[string]interface{}{"book_id": bookID, "claimed_by": moderatorID})
+	if err != nil {
+		log.Printf("Error announcing claim on book %d: %v", bookID, err)
+	}
+}
+
+func writeQueueError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, ErrQueueEmpty):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrClaimedByOther), errors.Is(err, ErrNotPending), errors.Is(err, ErrNotClaimed):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		writeModerationError(w, err, fallback)
+	}
+}
+
+// getModerationQueue lists pending books with their age and claim; ?filter= is all,
+// unclaimed or mine.
+func getModerationQueue(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	filter := r.URL.Query().Get("filter")
+	if filter == "" {
+		filter = QueueFilterAll
+	}
+	if filter != QueueFilterAll && filter != QueueFilterUnclaimed && filter != QueueFilterMine {
+		http.Error(w, "Invalid filter. Must be 'all', 'unclaimed', or 'mine'", http.StatusBadRequest)
+		return
+	}
+
+	moderatorID := actingUserID(r)
+	queue, err := GetModerationQueue(moderatorID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	summary := summarizeQueue(queue)
+	if filter != QueueFilterAll {
+		filtered := []QueueItem{}
+		for _, item := range queue {
+			if (filter == QueueFilterUnclaimed && item.ClaimedBy == 0) || (filter == QueueFilterMine && item.ClaimedByMe) {
+				filtered = append(filtered, item)
+			}
+		}
+		queue = filtered
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"items":         queue,
+		"summary":       summary,
+		"lease_minutes": int(moderationLease.Minutes()),
+	})
+}
+
+func claimBook(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	bookID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid book ID", http.StatusBadRequest)
+		return
+	}
+
+	moderatorID := actingUserID(r)
+	expires, err := ClaimBook(bookID, moderatorID)
+	if err != nil {
+		writeQueueError(w, err, "Failed to claim book")
+		return
+	}
+	announceClaim(bookID, moderatorID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":          true,
+		"message":          "Book claimed",
+		"book_id":          bookID,
+		"claim_expires_at": expires,
+	})
+}
+
+// claimNextBook claims the oldest unclaimed pending book.
+func claimNextBook(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	moderatorID := actingUserID(r)
+	bookID, expires, err := ClaimNextBook(moderatorID)
+	if err != nil {
+		writeQueueError(w, err, "Failed to claim book")
+		return
+	}
+	announceClaim(bookID, moderatorID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":          true,
+		"message":          "Book claimed",
+		"book_id":          bookID,
+		"claim_expires_at": expires,
+	})
+}
+
+func releaseBook(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	bookID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid book ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := ReleaseBook(bookID, actingUserID(r)); err != nil {
+		writeQueueError(w, err, "Failed to release book")
+		return
+	}
+	announceClaim(bookID, 0)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Book released to the queue",
+	})
+}
+
+// bulkModerate takes {"book_ids": [...], "status": "rejected", "reason": ..., "comment": ...}.
+func bulkModerate(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var req struct {
+		BookIDs []int `json:"book_ids"`
+		ModerationDecision
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if len(req.BookIDs) == 0 || len(req.BookIDs) > maxBulkModeration {
+		http.Error(w, fmt.Sprintf("Select between 1 and %d books", maxBulkModeration), http.StatusBadRequest)
+		return
+	}
+	if req.Status != BookStatusAccepted && req.Status != BookStatusRejected {
+		http.Error(w, "Invalid status. Must be 'accepted' or 'rejected'", http.StatusBadRequest)
+		return
+	}
+	if err := validateDecision(req.ModerationDecision); err != nil {
+		writeModerationError(w, err, "Invalid decision")
+		return
+	}
+
+	results := BulkModerate(req.BookIDs, actingUserID(r), req.ModerationDecision)
+	succeeded := 0
+	for _, result := range results {
+		if result.Success {
+			succeeded++
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   succeeded == len(results),
+		"message":   fmt.Sprintf("%d of %d books updated", succeeded, len(results)),
+		"succeeded": succeeded,
+		"results":   results,
+	})
+}
+
+// getModerationMetrics reports time-to-decision per moderator over the last ?days= (30).
+func getModerationMetrics(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	days := 30
+	if raw := r.URL.Query().Get("days"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid days", http.StatusBadRequest)
+			return
+		}
+		days = parsed
+	}
+
+	metrics, err := GetModeratorMetrics(time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	queue, err := GetModerationQueue(actingUserID(r))
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"days":               days,
+		"moderators":         metrics,
+		"queue":              summarizeQueue(queue),
+		"sla_warning_hours":  moderationSLAWarning.Hours(),
+		"sla_breached_hours": moderationSLABreach.Hours(),
+	})
+}
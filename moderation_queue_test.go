@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSLAStatus(t *testing.T) {
+	tests := []struct {
+		age  time.Duration
+		want string
+	}{
+		{time.Hour, SLAOnTrack},
+		{moderationSLAWarning - time.Second, SLAOnTrack},
+		{moderationSLAWarning, SLAWarning},
+		{moderationSLABreach, SLABreached},
+		{7 * 24 * time.Hour, SLABreached},
+	}
+	for _, tt := range tests {
+		if got := slaStatus(tt.age); got != tt.want {
+			t.Errorf("slaStatus(%v) = %s, want %s", tt.age, got, tt.want)
+		}
+	}
+}
+
+func TestGetModerationQueueHidesLapsedClaims(t *testing.T) {
+	expires := time.Now().Add(moderationLease)
+	useFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+		if strings.Contains(query, "FROM book b LEFT JOIN user u ON u.user_id = b.claimed_by") {
+			return &fakeRows{columns: make([]string, 11), values: [][]driver.Value{
+				{int64(7), "Held", "A", "", "Uploader", time.Now(), int64(50 * 3600), int64(1), "Mod One", expires, true},
+				{int64(8), "Lapsed", "B", "", "Uploader", time.Now(), int64(30 * 3600), int64(2), "Mod Two", time.Now().Add(-time.Minute), false},
+				{int64(9), "Fresh", "C", "", "Uploader", time.Now(), int64(3600), int64(0), "", nil, false},
+			}}, nil
+		}
+		return nil, nil
+	})
+
+	queue, err := GetModerationQueue(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queue) != 3 {
+		t.Fatalf("queue has %d books, want 3", len(queue))
+	}
+	if !queue[0].ClaimedByMe || queue[0].ClaimExpiresAt == nil || queue[0].SLA != SLABreached {
+		t.Errorf("held book = %+v, want claimed by me and breached", queue[0])
+	}
+	if queue[1].ClaimedBy != 0 || queue[1].ClaimedByName != "" || queue[1].ClaimExpiresAt != nil {
+		t.Errorf("lapsed claim still shown: %+v", queue[1])
+	}
+
+	summary := summarizeQueue(queue)
+	want := QueueSummary{Pending: 3, Unclaimed: 2, Warning: 1, Breached: 1, OldestAgeHours: 50}
+	if summary != want {
+		t.Errorf("summary = %+v, want %+v", summary, want)
+	}
+}
+
+func TestClaimBook(t *testing.T) {
+	fake := useFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+		if strings.Contains(query, "SELECT claim_expires_at FROM book") {
+			return fakeRow(time.Now().Add(moderationLease)), nil
+		}
+		return bookReview{status: BookStatusPending, claimedBy: 1, claimed: true}.respond(query, args)
+	})
+	if _, err := ClaimBook(7, 1); err != nil {
+		t.Fatalf("renewing my own claim = %v", err)
+	}
+	leased := fake.Find("UPDATE book SET claimed_by = ?, claim_expires_at")
+	if len(leased) != 1 || leased[0].Args[0] != int64(1) || leased[0].Args[1] != int64(moderationLease.Seconds()) {
+		t.Errorf("lease %+v, want moderator 1 for %v", leased, moderationLease)
+	}
+
+	tests := []struct {
+		name string
+		book bookReview
+		want error
+	}{
+		{"held by another moderator", bookReview{status: BookStatusPending, claimedBy: 2, claimed: true}, ErrClaimedByOther},
+		{"already decided", bookReview{status: BookStatusAccepted}, ErrNotPending},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t, tt.book.respond)
+			if _, err := ClaimBook(7, 1); !errors.Is(err, tt.want) {
+				t.Fatalf("ClaimBook = %v, want %v", err, tt.want)
+			}
+			if len(fake.Find("UPDATE book SET claimed_by")) != 0 {
+				t.Error("a refused claim was written")
+			}
+		})
+	}
+
+	// Another moderator's lapsed lease does not stop a new claim
+	useFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+		if strings.Contains(query, "SELECT claim_expires_at FROM book") {
+			return fakeRow(time.Now().Add(moderationLease)), nil
+		}
+		return bookReview{status: BookStatusPending, claimedBy: 2}.respond(query, args)
+	})
+	if _, err := ClaimBook(7, 1); err != nil {
+		t.Errorf("claiming over a lapsed lease = %v", err)
+	}
+}
+
+func TestClaimNextBookWithEmptyQueue(t *testing.T) {
+	useFakeDB(t, nil)
+	if _, _, err := ClaimNextBook(1); !errors.Is(err, ErrQueueEmpty) {
+		t.Errorf("ClaimNextBook = %v, want %v", err, ErrQueueEmpty)
+	}
+}
+
+func TestModerateBookRespectsClaims(t *testing.T) {
+	fake := useFakeDB(t, bookReview{status: BookStatusPending, uploader: 3, claimedBy: 2, claimed: true}.respond)
+	if err := ModerateBook(7, 1, ModerationDecision{Status: BookStatusAccepted}); !errors.Is(err, ErrClaimedByOther) {
+		t.Fatalf("deciding on another moderator's book = %v, want %v", err, ErrClaimedByOther)
+	}
+	if len(fake.Find("UPDATE book SET status")) != 0 {
+		t.Error("a book held by another moderator was decided")
+	}
+
+	fake = useFakeDB(t, bookReview{status: BookStatusPending, uploader: 3, claimedBy: 1, claimed: true}.respond)
+	if err := ModerateBook(7, 1, ModerationDecision{Status: BookStatusAccepted}); err != nil {
+		t.Fatal(err)
+	}
+	if decided := fake.Find("UPDATE book SET status = ?, claimed_by = NULL, claim_expires_at = NULL"); len(decided) != 1 {
+		t.Error("deciding did not end the claim")
+	}
+}
+
+func TestBulkModerateReportsEachBook(t *testing.T) {
+	useFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+		book := bookReview{status: BookStatusPending, uploader: 3}
+		if len(args) > 0 && args[0] == int64(8) {
+			book.status = BookStatusAccepted
+		}
+		return book.respond(query, args)
+	})
+
+	results := BulkModerate([]int{7, 8, 9}, 1, ModerationDecision{Status: BookStatusAccepted})
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3", len(results))
+	}
+	for _, r := range results {
+		if want := r.BookID != 8; r.Success != want {
+			t.Errorf("book %d success = %v (%s), want %v", r.BookID, r.Success, r.Error, want)
+		}
+	}
+}
+
+func TestGetModeratorMetrics(t *testing.T) {
+	useFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+		if strings.Contains(query, "FROM book_moderation m LEFT JOIN user u") {
+			return &fakeRows{columns: make([]string, 4), values: [][]driver.Value{
+				{int64(1), "Mod One", BookStatusAccepted, int64(2 * 3600)},
+				{int64(1), "Mod One", BookStatusRejected, int64(60 * 3600)},
+				{int64(1), "Mod One", BookStatusAccepted, int64(4 * 3600)},
+				{int64(2), "Mod Two", BookStatusAccepted, nil},
+			}}, nil
+		}
+		return nil, nil
+	})
+
+	metrics, err := GetModeratorMetrics(time.Now().AddDate(0, 0, -30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 2 {
+		t.Fatalf("got metrics for %d moderators, want 2", len(metrics))
+	}
+	got := metrics[0]
+	want := ModeratorMetrics{ModeratorID: 1, ModeratorName: "Mod One", Decisions: 3, Approved: 2, Rejected: 1,
+		AvgDecisionHours: 22, MedianDecisionHours: 4, P90DecisionHours: 60, WithinSLA: 2}
+	if got != want {
+		t.Errorf("metrics = %+v, want %+v", got, want)
+	}
+	if metrics[1].Decisions != 1 || metrics[1].AvgDecisionHours != 0 || metrics[1].WithinSLA != 0 {
+		t.Errorf("untimed decision counted as %+v", metrics[1])
+	}
+}
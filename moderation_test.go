@@ -0,0 +1,159 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// bookReview describes the book row the moderation code reads: its status, uploader and any
+// claim on it, with claimed telling whether that claim's lease is still running.
+type bookReview struct {
+	status    string
+	uploader  int64
+	claimedBy int64
+	claimed   bool
+}
+
+func (b bookReview) respond(query string, args []driver.Value) (*fakeRows, error) {
+	switch {
+	case strings.Contains(query, "SELECT COALESCE(status, 'pending'), COALESCE(uploaded_by, 0) FROM book"):
+		return fakeRow(b.status, b.uploader), nil
+	case strings.Contains(query, "SELECT COALESCE(status, 'pending'), COALESCE(claimed_by, 0)"):
+		return fakeRow(b.status, b.claimedBy, b.claimed), nil
+	case strings.Contains(query, "SELECT COALESCE(claimed_by, 0)"):
+		return fakeRow(b.claimedBy, b.claimed), nil
+	case strings.Contains(query, "SELECT COALESCE(uploaded_by, 0), title FROM book"):
+		return fakeRow(b.uploader, "Title"), nil
+	case strings.Contains(query, "SELECT title FROM book"):
+		return fakeRow("Title"), nil
+	case strings.Contains(query, "SELECT user_id FROM user WHERE role = 'admin'"):
+		return &fakeRows{columns: []string{"user_id"}, values: [][]driver.Value{{int64(1)}, {int64(2)}}}, nil
+	}
+	return nil, nil
+}
+
+func TestValidateDecision(t *testing.T) {
+	tests := []struct {
+		name string
+		d    ModerationDecision
+		ok   bool
+	}{
+		{"approval", ModerationDecision{Status: BookStatusAccepted, Comment: "Looks good"}, true},
+		{"approval with a reason", ModerationDecision{Status: BookStatusAccepted, Reason: "duplicate"}, false},
+		{"rejection", ModerationDecision{Status: BookStatusRejected, Reason: "incorrect_details", FieldNotes: map[string]string{"isbn": "Check the last digit"}}, true},
+		{"rejection without a reason", ModerationDecision{Status: BookStatusRejected}, false},
+		{"unknown reason", ModerationDecision{Status: BookStatusRejected, Reason: "boring"}, false},
+		{"other without a comment", ModerationDecision{Status: BookStatusRejected, Reason: RejectionOther}, false},
+		{"other with a comment", ModerationDecision{Status: BookStatusRejected, Reason: RejectionOther, Comment: "Wrong edition"}, true},
+		{"note on an unknown field", ModerationDecision{Status: BookStatusRejected, Reason: "incorrect_details", FieldNotes: map[string]string{"price": "Too high"}}, false},
+	}
+	for _, tt := range tests {
+		err := validateDecision(tt.d)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: validateDecision = %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidModeration) {
+			t.Errorf("%s: error %v is not %v", tt.name, err, ErrInvalidModeration)
+		}
+	}
+}
+
+func TestCanTransitionBook(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{BookStatusPending, BookStatusAccepted, true},
+		{BookStatusPending, BookStatusRejected, true},
+		{BookStatusPending, BookStatusPending, false},
+		{BookStatusAccepted, BookStatusPending, true},
+		{BookStatusRejected, BookStatusAccepted, true},
+		{BookStatusAccepted, "deleted", false},
+	}
+	for _, tt := range tests {
+		if got := canTransitionBook(tt.from, tt.to); got != tt.want {
+			t.Errorf("canTransitionBook(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestModerateBookRecordsAndNotifies(t *testing.T) {
+	fake := useFakeDB(t, bookReview{status: BookStatusPending, uploader: 3}.respond)
+	d := ModerationDecision{Status: BookStatusRejected, Reason: "poor_cover_image", Comment: "The cover is blurry.",
+		FieldNotes: map[string]string{"cover_image": "Use a sharper photo"}}
+	if err := ModerateBook(7, 1, d); err != nil {
+		t.Fatal(err)
+	}
+
+	history := fake.Find("INSERT INTO book_moderation")
+	if len(history) != 1 {
+		t.Fatalf("recorded %d history entries, want 1", len(history))
+	}
+	args := history[0].Args
+	if args[2] != ModerationRejected || args[3] != BookStatusPending || args[4] != BookStatusRejected || args[5] != "poor_cover_image" {
+		t.Errorf("history entry %v, want a pending -> rejected rejection for a poor cover", args)
+	}
+	if args[7] != `{"cover_image":"Use a sharper photo"}` {
+		t.Errorf("field notes stored as %v", args[7])
+	}
+
+	notices := fake.Find("INSERT INTO notification")
+	if len(notices) != 1 || notices[0].Args[0] != int64(3) || notices[0].Args[2] != EventBookRejected {
+		t.Fatalf("notifications %+v, want a rejection notice for the uploader", notices)
+	}
+	if message := notices[0].Args[3].(string); !strings.Contains(message, "Cover image is missing or unclear") || !strings.Contains(message, "The cover is blurry.") {
+		t.Errorf("rejection notice %q is missing the reason or comment", message)
+	}
+}
+
+func TestModerateBookRefusesInvalidTransition(t *testing.T) {
+	fake := useFakeDB(t, bookReview{status: BookStatusAccepted, uploader: 3}.respond)
+	err := ModerateBook(7, 1, ModerationDecision{Status: BookStatusAccepted})
+	if !errors.Is(err, ErrInvalidBookStatus) {
+		t.Fatalf("approving an approved book = %v, want %v", err, ErrInvalidBookStatus)
+	}
+	if len(fake.Find("UPDATE book SET status")) != 0 || len(fake.Find("INSERT INTO book_moderation")) != 0 {
+		t.Error("a refused decision was written")
+	}
+}
+
+func TestResubmitBook(t *testing.T) {
+	changes := BookResubmission{Title: "Title", Author: "Author", CategoryID: 2, Note: "Fixed the ISBN"}
+
+	fake := useFakeDB(t, bookReview{status: BookStatusRejected, uploader: 3}.respond)
+	if err := ResubmitBook(7, 3, changes); err != nil {
+		t.Fatal(err)
+	}
+	history := fake.Find("INSERT INTO book_moderation")
+	if len(history) != 1 || history[0].Args[2] != ModerationResubmitted || history[0].Args[4] != BookStatusPending || history[0].Args[6] != "Fixed the ISBN" {
+		t.Errorf("history %+v, want a resubmission back to pending with the uploader's note", history)
+	}
+	if notices := fake.Find("INSERT INTO notification"); len(notices) != 2 || notices[0].Args[2] != EventBookResubmitted {
+		t.Errorf("notifications %+v, want a resubmission notice for each moderator", notices)
+	}
+
+	tests := []struct {
+		name    string
+		book    bookReview
+		userID  int
+		changes BookResubmission
+		want    error
+	}{
+		{"someone else's book", bookReview{status: BookStatusRejected, uploader: 3}, 4, changes, ErrNotUploader},
+		{"book not rejected", bookReview{status: BookStatusPending, uploader: 3}, 3, changes, ErrBookNotRejected},
+		{"title missing", bookReview{status: BookStatusRejected, uploader: 3}, 3, BookResubmission{Author: "Author", CategoryID: 2}, ErrInvalidResubmission},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t, tt.book.respond)
+			if err := ResubmitBook(7, tt.userID, tt.changes); !errors.Is(err, tt.want) {
+				t.Fatalf("ResubmitBook = %v, want %v", err, tt.want)
+			}
+			if fake.Index("UPDATE book SET title") >= 0 {
+				t.Error("a refused resubmission changed the book")
+			}
+		})
+	}
+}
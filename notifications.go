@@ -0,0 +1,516 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============ NOTIFICATION CENTER ============
+
+const (
+	EventBookApproved    = "book_approved"
+	EventBookRejected    = "book_rejected"
+	EventBorrowRequested = "borrow_requested"
+	EventBorrowApproved  = "borrow_approved"
+	EventDueSoon         = ReminderDueSoon
+	EventOverdue         = ReminderOverdue
+	EventHoldReady       = "hold_ready"
+	EventBookSubmitted   = "book_submitted"
+	EventBookResubmitted = "book_resubmitted"
+)
+
+// NotificationEvent describes an event members can subscribe to.
+type NotificationEvent struct {
+	Event string `json:"event"`
+	Label string `json:"label"`
+}
+
+// notificationEvents lists every event in the order the preferences page shows them.
+// All of them are delivered unless the member turns them off.
+var notificationEvents = []NotificationEvent{
+	{EventBookApproved, "A book you uploaded was approved"},
+	{EventBookRejected, "A book you uploaded was rejected"},
+	{EventBorrowRequested, "Someone asked to borrow a book you uploaded"},
+	{EventBorrowApproved, "Your borrow request was approved"},
+	{EventDueSoon, "A loan is due soon"},
+	{EventOverdue, "A loan is overdue"},
+	{EventHoldReady, "A book you reserved is ready to collect"},
+	{EventBookSubmitted, "A new book is waiting for review (moderators)"},
+	{EventBookResubmitted, "A rejected book was resubmitted (moderators)"},
+}
+
+// notificationPageSize caps how many notifications one request returns.
+const notificationPageSize = 50
+
+var (
+	ErrNotificationNotFound = errors.New("notification not found")
+	ErrUnknownEvent         = errors.New("unknown notification event")
+)
+
+type Notification struct {
+	NotificationID int        `json:"notification_id"`
+	UserID         int        `json:"user_id"`
+	Event          string     `json:"event"`
+	BookID         *int       `json:"book_id"`
+	Message        string     `json:"message"`
+	Link           string     `json:"link"`
+	CreatedAt      time.Time  `json:"created_at"`
+	ReadAt         *time.Time `json:"read_at"`
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx, so events can be emitted inside the
+// transaction that caused them or on their own.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func knownEvent(event string) bool {
+	for _, e := range notificationEvents {
+		if e.Event == event {
+			return true
+		}
+	}
+	return false
+}
+
+// notify stores a notification for a user unless they have switched the event off.
+// A zero bookID leaves the notification unattached to a book.
+func notify(ex execer, userID int, event string, bookID int, message, link string) error {
+	if userID == 0 {
+		return nil
+	}
+
+	var enabled bool
+	err := ex.QueryRow("SELECT enabled FROM notification_preference WHERE user_id = ? AND event = ?", userID, event).Scan(&enabled)
+	if err == nil && !enabled {
+		return nil
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	result, err := ex.Exec(`
+		INSERT INTO notification (user_id, book_id, event, message, link, created_at)
+		VALUES (?, ?, ?, ?, ?, NOW())
+	`, userID, nullableID(bookID), event, message, link)
+	if err != nil {
+		return err
+	}
+	notificationID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	if err := enqueueDeliveries(ex, notificationID, userID, event, bookID, message, link); err != nil {
+		return err
+	}
+	return emitEvent(ex, AudienceUser, userID, RealtimeNotification, map[string]interface{}{
+		"notification_id": notificationID,
+		"event":           event,
+		"book_id":         bookID,
+		"message":         message,
+		"link":            link,
+	})
+}
+
+// notifyBorrowTx tells the people involved in a borrow about its new status.
+func notifyBorrowTx(tx *sql.Tx, borrowID int, event string) error {
+	var userID, bookID, uploaderID int
+	var title string
+	err := tx.QueryRow(`
+		SELECT br.user_id, br.book_id, COALESCE(bk.title, ''), COALESCE(bk.uploaded_by, 0)
+		FROM borrow br LEFT JOIN book bk ON bk.book_id = br.book_id
+		WHERE br.borrow_id = ?
+	`, borrowID).Scan(&userID, &bookID, &title, &uploaderID)
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("/FrontEnd/borrowed-book-detail.html?borrow_id=%d", borrowID)
+	switch event {
+	case EventBorrowRequested:
+		if uploaderID == userID {
+			return nil
+		}
+		return notify(tx, uploaderID, event, bookID, fmt.Sprintf("Someone asked to borrow \"%s\".", title), "")
+	case EventBorrowApproved:
+		return notify(tx, userID, event, bookID, fmt.Sprintf("Your request to borrow \"%s\" was approved.", title), link)
+	}
+	return nil
+}
+
+// notifyHoldReadyTx tells a member the copy they reserved is waiting for them.
+func notifyHoldReadyTx(tx *sql.Tx, holdID int) error {
+	var userID, bookID int
+	var title string
+	var deadline sql.NullTime
+	err := tx.QueryRow(`
+		SELECT h.user_id, h.book_id, COALESCE(b.title, ''), h.pickup_deadline
+		FROM book_hold h LEFT JOIN book b ON b.book_id = h.book_id
+		WHERE h.hold_id = ?
+	`, holdID).Scan(&userID, &bookID, &title, &deadline)
+	if err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf("\"%s\" is ready for you to collect.", title)
+	if deadline.Valid {
+		message = fmt.Sprintf("\"%s\" is ready for you to collect by %s.", title, deadline.Time.Format("02 Jan 2006"))
+	}
+	return notify(tx, userID, EventHoldReady, bookID, message, fmt.Sprintf("/FrontEnd/public-book-detail.html?id=%d", bookID))
+}
+
+// notifyBookReviewTx tells the uploader of a book about a moderator's decision, including
+// why it was rejected.
+func notifyBookReviewTx(ex execer, bookID int, d ModerationDecision) error {
+	var uploaderID int
+	var title string
+	err := ex.QueryRow("SELECT COALESCE(uploaded_by, 0), title FROM book WHERE book_id = ?", bookID).Scan(&uploaderID, &title)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch d.Status {
+	case BookStatusAccepted:
+		return notify(ex, uploaderID, EventBookApproved, bookID, fmt.Sprintf("\"%s\" was approved and is now listed.", title),
+			fmt.Sprintf("/FrontEnd/public-book-detail.html?id=%d", bookID))
+	case BookStatusRejected:
+		message := fmt.Sprintf("\"%s\" was not approved: %s.", title, rejectionReasonLabel(d.Reason))
+		if d.Comment != "" {
+			message += " " + d.Comment
+		}
+		return notify(ex, uploaderID, EventBookRejected, bookID, message, fmt.Sprintf("/FrontEnd/resubmit-book.html?id=%d", bookID))
+	}
+	return nil
+}
+
+// notifyModeratorsTx tells every admin that a book is waiting for review.
+func notifyModeratorsTx(ex execer, bookID int, event string) error {
+	var title string
+	if err := ex.QueryRow("SELECT title FROM book WHERE book_id = ?", bookID).Scan(&title); err != nil {
+		return err
+	}
+	message := fmt.Sprintf("\"%s\" is waiting for review.", title)
+	if event == EventBookResubmitted {
+		message = fmt.Sprintf("\"%s\" was corrected and resubmitted for review.", title)
+	}
+
+	rows, err := ex.Query("SELECT user_id FROM user WHERE role = 'admin'")
+	if err != nil {
+		return err
+	}
+	var adminIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		adminIDs = append(adminIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range adminIDs {
+		if err := notify(ex, id, event, bookID, message, "/FrontEnd/admin-request.html"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func GetNotifications(userID int, unreadOnly bool, limit int) ([]Notification, error) {
+	query := `
+		SELECT notification_id, user_id, COALESCE(event, ''), book_id, message, COALESCE(link, ''), created_at, read_at
+		FROM notification WHERE user_id = ?`
+	if unreadOnly {
+		query += " AND read_at IS NULL"
+	}
+	rows, err := db.Query(query+" ORDER BY created_at DESC, notification_id DESC LIMIT ?", userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		var n Notification
+		var bookID sql.NullInt64
+		var readAt sql.NullTime
+		if err := rows.Scan(&n.NotificationID, &n.UserID, &n.Event, &bookID, &n.Message, &n.Link, &n.CreatedAt, &readAt); err != nil {
+			return nil, err
+		}
+		if bookID.Valid {
+			id := int(bookID.Int64)
+			n.BookID = &id
+		}
+		if readAt.Valid {
+			n.ReadAt = &readAt.Time
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, nil
+}
+
+func UnreadNotificationCount(userID int) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM notification WHERE user_id = ? AND read_at IS NULL", userID).Scan(&count)
+	return count, err
+}
+
+func MarkNotificationRead(userID, notificationID int) error {
+	result, err := db.Exec(`
+		UPDATE notification SET read_at = COALESCE(read_at, NOW())
+		WHERE notification_id = ? AND user_id = ?
+	`, notificationID, userID)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		// COALESCE leaves an already read row unchanged, so check it exists before failing
+		var exists bool
+		err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM notification WHERE notification_id = ? AND user_id = ?)", notificationID, userID).
+			Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNotificationNotFound
+		}
+	}
+	return nil
+}
+
+func MarkAllNotificationsRead(userID int) (int, error) {
+	result, err := db.Exec("UPDATE notification SET read_at = NOW() WHERE user_id = ? AND read_at IS NULL", userID)
+	if err != nil {
+		return 0, err
+	}
+	affected, err := result.RowsAffected()
+	return int(affected), err
+}
+
+// GetNotificationPreferences returns whether each event is enabled for a user.
+func GetNotificationPreferences(userID int) (map[string]bool, error) {
+	preferences := map[string]bool{}
+	for _, e := range notificationEvents {
+		preferences[e.Event] = true
+	}
+
+	rows, err := db.Query("SELECT event, enabled FROM notification_preference WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var event string
+		var enabled bool
+		if err := rows.Scan(&event, &enabled); err != nil {
+			return nil, err
+		}
+		if _, ok := preferences[event]; ok {
+			preferences[event] = enabled
+		}
+	}
+	return preferences, nil
+}
+
+// SetNotificationPreferences updates the events given; events left out keep their setting.
+func SetNotificationPreferences(userID int, preferences map[string]bool) error {
+	for event := range preferences {
+		if !knownEvent(event) {
+			return fmt.Errorf("%w: %s", ErrUnknownEvent, event)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for event, enabled := range preferences {
+		_, err := tx.Exec(`
+			INSERT INTO notification_preference (user_id, event, enabled) VALUES (?, ?, ?)
+			ON DUPLICATE KEY UPDATE enabled = VALUES(enabled)
+		`, userID, event, enabled)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ============ NOTIFICATION HANDLERS ============
+
+// requireUser returns the acting user, or writes 401 and returns 0.
+func requireUser(w http.ResponseWriter, r *http.Request) int {
+	userID := actingUserID(r)
+	if userID == 0 {
+		http.Error(w, "Missing user identity", http.StatusUnauthorized)
+	}
+	return userID
+}
+
+// getNotifications lists the caller's notifications, newest first; ?unread=true hides read ones.
+func getNotifications(w http.ResponseWriter, r *http.Request) {
+	userID := requireUser(w, r)
+	if userID == 0 {
+		return
+	}
+
+	limit := notificationPageSize
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n > 0 && n < notificationPageSize {
+			limit = n
+		}
+	}
+
+	notifications, err := GetNotifications(userID, r.URL.Query().Get("unread") == "true", limit)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	unread, err := UnreadNotificationCount(userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"notifications": notifications,
+		"unread_count":  unread,
+	})
+}
+
+func getUnreadNotificationCount(w http.ResponseWriter, r *http.Request) {
+	userID := requireUser(w, r)
+	if userID == 0 {
+		return
+	}
+
+	unread, err := UnreadNotificationCount(userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"unread_count": unread})
+}
+
+func markNotificationRead(w http.ResponseWriter, r *http.Request) {
+	userID := requireUser(w, r)
+	if userID == 0 {
+		return
+	}
+
+	notificationID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid notification ID", http.StatusBadRequest)
+		return
+	}
+
+	err = MarkNotificationRead(userID, notificationID)
+	if errors.Is(err, ErrNotificationNotFound) {
+		http.Error(w, "Notification not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update notification", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Notification marked as read",
+	})
+}
+
+func markAllNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	userID := requireUser(w, r)
+	if userID == 0 {
+		return
+	}
+
+	updated, err := MarkAllNotificationsRead(userID)
+	if err != nil {
+		http.Error(w, "Failed to update notifications", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "All notifications marked as read",
+		"updated": updated,
+	})
+}
+
+func getNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	userID := requireUser(w, r)
+	if userID == 0 {
+		return
+	}
+
+	preferences, err := GetNotificationPreferences(userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"events":      notificationEvents,
+		"preferences": preferences,
+	})
+}
+
+// updateNotificationPreferences takes a map of event to enabled, e.g. {"due_soon": false}.
+func updateNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	userID := requireUser(w, r)
+	if userID == 0 {
+		return
+	}
+
+	var preferences map[string]bool
+	if err := json.NewDecoder(r.Body).Decode(&preferences); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	err := SetNotificationPreferences(userID, preferences)
+	if errors.Is(err, ErrUnknownEvent) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update preferences", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Notification preferences updated",
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// preferenceResponder answers the preference lookup in notify with the given setting, or no
+// row when enabled is nil.
+func preferenceResponder(enabled interface{}) fakeResponder {
+	return func(query string, args []driver.Value) (*fakeRows, error) {
+		if strings.Contains(query, "SELECT enabled FROM notification_preference") && enabled != nil {
+			return fakeRow(enabled), nil
+		}
+		return nil, nil
+	}
+}
+
+func TestNotifyRespectsPreferences(t *testing.T) {
+	tests := []struct {
+		name    string
+		userID  int
+		enabled interface{}
+		want    bool
+	}{
+		{"no preference stored", 3, nil, true},
+		{"switched on", 3, true, true},
+		{"switched off", 3, false, false},
+		{"no recipient", 0, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t, preferenceResponder(tt.enabled))
+			if err := notify(db, tt.userID, EventDueSoon, 7, "Due soon", ""); err != nil {
+				t.Fatal(err)
+			}
+			stored := fake.Find("INSERT INTO notification")
+			if got := len(stored) == 1; got != tt.want {
+				t.Fatalf("notification stored = %v, want %v", got, tt.want)
+			}
+			if !tt.want {
+				return
+			}
+			if stored[0].Args[0] != int64(3) || stored[0].Args[1] != int64(7) || stored[0].Args[2] != EventDueSoon {
+				t.Errorf("stored %v, want user 3, book 7, %s", stored[0].Args, EventDueSoon)
+			}
+			pushed := fake.Find("INSERT INTO realtime_event")
+			if len(pushed) != 1 || pushed[0].Args[0] != AudienceUser || pushed[0].Args[2] != RealtimeNotification {
+				t.Errorf("real-time events %+v, want one notification for the user", pushed)
+			}
+		})
+	}
+}
+
+func TestNotifyBorrowRequestedSkipsOwnUpload(t *testing.T) {
+	for _, uploader := range []int64{3, 5} {
+		fake := useFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+			if strings.Contains(query, "FROM borrow br LEFT JOIN book bk") {
+				return fakeRow(int64(3), int64(7), "Title", uploader), nil
+			}
+			return nil, nil
+		})
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := notifyBorrowTx(tx, 9, EventBorrowRequested); err != nil {
+			t.Fatal(err)
+		}
+		tx.Rollback()
+
+		stored := fake.Find("INSERT INTO notification")
+		if uploader == 3 && len(stored) != 0 {
+			t.Error("a member was told they asked to borrow their own upload")
+		}
+		if uploader == 5 && (len(stored) != 1 || stored[0].Args[0] != int64(5)) {
+			t.Errorf("uploader notifications %+v, want one for user 5", stored)
+		}
+	}
+}
+
+func TestNotificationPreferences(t *testing.T) {
+	useFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+		if strings.Contains(query, "SELECT event, enabled FROM notification_preference") {
+			return &fakeRows{columns: []string{"event", "enabled"}, values: [][]driver.Value{
+				{EventDueSoon, false},
+				{"retired_event", false},
+			}}, nil
+		}
+		return nil, nil
+	})
+
+	preferences, err := GetNotificationPreferences(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(preferences) != len(notificationEvents) {
+		t.Errorf("got %d preferences, want one per event (%d)", len(preferences), len(notificationEvents))
+	}
+	if preferences[EventDueSoon] || !preferences[EventOverdue] {
+		t.Errorf("preferences = %v, want due soon off and the rest on by default", preferences)
+	}
+
+	fake := useFakeDB(t, nil)
+	err = SetNotificationPreferences(3, map[string]bool{EventDueSoon: true, "retired_event": false})
+	if !errors.Is(err, ErrUnknownEvent) {
+		t.Fatalf("unknown event = %v, want %v", err, ErrUnknownEvent)
+	}
+	if len(fake.Statements()) != 0 {
+		t.Error("preferences were written despite an unknown event")
+	}
+}
+
+func TestGetNotificationsLimit(t *testing.T) {
+	tests := []struct {
+		query string
+		want  int64
+	}{
+		{"", notificationPageSize},
+		{"&limit=10", 10},
+		{"&limit=500", notificationPageSize},
+		{"&limit=-1", notificationPageSize},
+	}
+	for _, tt := range tests {
+		fake := useFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+			if strings.Contains(query, "SELECT COUNT(*) FROM notification") {
+				return fakeRow(int64(0)), nil
+			}
+			return nil, nil
+		})
+		rec := httptest.NewRecorder()
+		getNotifications(rec, httptest.NewRequest("GET", "/api/notifications?user_id=3"+tt.query, nil))
+		if rec.Code != 200 {
+			t.Fatalf("limit %q: status %d", tt.query, rec.Code)
+		}
+		listed := fake.Find("FROM notification WHERE user_id = ?", "LIMIT ?")
+		if len(listed) != 1 || listed[0].Args[1] != tt.want {
+			t.Errorf("limit %q listed with %+v, want limit %d", tt.query, listed, tt.want)
+		}
+	}
+
+	useFakeDB(t, nil)
+	rec := httptest.NewRecorder()
+	getNotifications(rec, httptest.NewRequest("GET", "/api/notifications", nil))
+	if rec.Code != 401 {
+		t.Errorf("anonymous request = %d, want 401", rec.Code)
+	}
+}
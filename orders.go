@@ -0,0 +1,775 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============ CHECKOUT ORDERS ============
+
+var (
+	ErrOrderNotFound       = errors.New("order not found")
+	ErrOrderEmpty          = errors.New("order has no books")
+	ErrDuplicateOrderBook  = errors.New("a book appears more than once in the order")
+	ErrMissingOrderAddress = errors.New("delivery orders need a delivery address")
+)
+
+// BorrowBlockedError reports that loan policy or fines prevent the member from borrowing.
+type BorrowBlockedError struct {
+	Reason string
+}
+
+func (e *BorrowBlockedError) Error() string {
+	return e.Reason
+}
+
+// OrderRequest describes a checkout of several books with one delivery and one payment.
+type OrderRequest struct {
+	UserID          int    `json:"user_id"`
+	BookIDs         []int  `json:"book_ids"`
+	DeliveryType    string `json:"delivery_type"`
+	LocationID      int    `json:"location_id"`
+	DeliveryAddress string `json:"delivery_address"`
+	Insurance       bool   `json:"insurance"`
+	VoucherCode     string `json:"voucher_code"`
+	DeliveryService string `json:"delivery_service"`
+	// PickupAppointmentID confirms the pickup slot the member held during checkout.
+	PickupAppointmentID int `json:"pickup_appointment_id"`
+}
+
+type Order struct {
+	OrderID         int         `json:"order_id"`
+	UserID          int         `json:"user_id"`
+	Status          string      `json:"status"`
+	DeliveryType    string      `json:"delivery_type"`
+	LocationID      *int        `json:"location_id"`
+	DeliveryAddress string      `json:"delivery_address"`
+	Subtotal        float64     `json:"subtotal"`
+	Tax             float64     `json:"tax"`
+	Total           float64     `json:"total"`
+	PaymentStatus   string      `json:"payment_status"`
+	CreatedAt       time.Time   `json:"created_at"`
+	BorrowIDs       []int       `json:"borrow_ids"`
+	Lines           []QuoteLine `json:"lines,omitempty"`
+}
+
+type OrderStatusChange struct {
+	HistoryID  int       `json:"history_id"`
+	OrderID    int       `json:"order_id"`
+	FromStatus *string   `json:"from_status"`
+	ToStatus   string    `json:"to_status"`
+	ChangedBy  *int      `json:"changed_by"`
+	Note       string    `json:"note"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// closedBorrowStatuses are left untouched when an order moves as a whole.
+var closedBorrowStatuses = map[string]bool{
+	BorrowStatusReturned:  true,
+	BorrowStatusRejected:  true,
+	BorrowStatusCancelled: true,
+}
+
+// recordOrderStatusTx appends a row to the order's transition history.
+func recordOrderStatusTx(tx *sql.Tx, orderID int, from, to string, changedBy int, note string) error {
+	var fromValue interface{}
+	if from != "" {
+		fromValue = from
+	}
+	_, err := tx.Exec(`
+		INSERT INTO order_status_history (order_id, from_status, to_status, changed_by, note, created_at)
+		VALUES (?, ?, ?, ?, ?, NOW())
+	`, orderID, fromValue, to, nullableID(changedBy), note)
+	return err
+}
+
+// createOrderTx validates every book against the loan policy, prices the order as a whole
+// and creates one borrow per book inside tx.
+func createOrderTx(tx *sql.Tx, req OrderRequest) (*Order, error) {
+	if len(req.BookIDs) == 0 {
+		return nil, ErrOrderEmpty
+	}
+	if req.DeliveryType == "delivery" && req.DeliveryAddress == "" {
+		return nil, ErrMissingOrderAddress
+	}
+	seen := map[int]bool{}
+	for _, bookID := range req.BookIDs {
+		if seen[bookID] {
+			return nil, fmt.Errorf("%w: %d", ErrDuplicateOrderBook, bookID)
+		}
+		seen[bookID] = true
+	}
+
+	borrowDate := time.Now()
+	dueDates := map[int]time.Time{}
+	for i, bookID := range req.BookIDs {
+		terms, err := EvaluateLoanTerms(req.UserID, bookID, req.LocationID, borrowDate)
+		if err != nil {
+			return nil, err
+		}
+		if terms == nil {
+			return nil, fmt.Errorf("%w: %d", ErrQuoteBookNotFound, bookID)
+		}
+		if !terms.CanBorrow {
+			return nil, &BorrowBlockedError{Reason: terms.BlockedReason}
+		}
+		// Borrows earlier in this order are not counted by EvaluateLoanTerms yet
+		if terms.ActiveLoans+i >= terms.MaxActiveLoans {
+			return nil, &BorrowBlockedError{Reason: fmt.Sprintf("Maximum of %d active loans reached", terms.MaxActiveLoans)}
+		}
+		dueDates[bookID] = terms.DueDate
+	}
+
+	quote, err := BuildQuote(QuoteRequest{
+		UserID:       req.UserID,
+		BookIDs:      req.BookIDs,
+		DeliveryType: req.DeliveryType,
+		Insurance:    req.Insurance,
+		LocationID:   req.LocationID,
+		VoucherCode:  req.VoucherCode,
+
+		DeliveryService: req.DeliveryService,
+		DeliveryAddress: req.DeliveryAddress,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO borrow_order (user_id, status, delivery_type, location_id, delivery_address, subtotal, tax, total, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, req.UserID, BorrowStatusRequested, req.DeliveryType, nullableID(req.LocationID), req.DeliveryAddress,
+		quote.Subtotal, quote.Tax, quote.Total, borrowDate)
+	if err != nil {
+		return nil, err
+	}
+	lastInsertID, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	orderID := int(lastInsertID)
+
+	order := &Order{
+		OrderID:         orderID,
+		UserID:          req.UserID,
+		Status:          BorrowStatusRequested,
+		DeliveryType:    req.DeliveryType,
+		DeliveryAddress: req.DeliveryAddress,
+		Subtotal:        quote.Subtotal,
+		Tax:             quote.Tax,
+		Total:           quote.Total,
+		PaymentStatus:   PayableUnpaid,
+		CreatedAt:       borrowDate,
+		BorrowIDs:       []int{},
+		Lines:           quote.Lines,
+	}
+	if req.LocationID != 0 {
+		order.LocationID = &req.LocationID
+	}
+
+	// Lock the books in id order before taking copies so two orders sharing books cannot deadlock
+	lockOrder := append([]int(nil), req.BookIDs...)
+	sort.Ints(lockOrder)
+	for _, bookID := range lockOrder {
+		if err := lockBookStockTx(tx, bookID); err != nil {
+			return nil, err
+		}
+	}
+
+	borrowQuotes := splitOrderQuote(quote, req.BookIDs)
+	for _, bookID := range req.BookIDs {
+		borrowID, err := createBorrowTx(tx, req.UserID, bookID, req.LocationID, borrowDate, dueDates[bookID], req.DeliveryType, req.DeliveryAddress, borrowQuotes[bookID])
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec("UPDATE borrow SET order_id = ? WHERE borrow_id = ?", orderID, borrowID)
+		if err != nil {
+			return nil, err
+		}
+		order.BorrowIDs = append(order.BorrowIDs, borrowID)
+	}
+
+	for _, line := range quote.Lines {
+		var bookID interface{}
+		if line.BookID != nil {
+			bookID = *line.BookID
+		}
+		_, err := tx.Exec(`
+			INSERT INTO order_line_item (order_id, code, description, book_id, quantity, unit_price, amount)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, orderID, line.Code, line.Description, bookID, line.Quantity, line.UnitPrice, line.Amount)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if req.DeliveryType == "pickup" && req.PickupAppointmentID != 0 {
+		if err := confirmPickupAppointmentTx(tx, req.PickupAppointmentID, req.UserID, req.LocationID, orderID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := recordOrderStatusTx(tx, orderID, "", BorrowStatusRequested, req.UserID, ""); err != nil {
+		return nil, err
+	}
+	if err := postChargeTx(tx, req.UserID, "order", orderID, quote.Total, quote.Deposit); err != nil {
+		return nil, err
+	}
+	if err := redeemVoucherTx(tx, quote, req.UserID, orderID, 0); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// splitOrderQuote divides an order's quote into one quote per book, so that a borrow carries
+// exactly what the member pays for it and cancelling it credits back no more and no less.
+// Rental and deposit lines belong to their book. The voucher discount is shared among the books
+// it applied to, tax follows each book's discounted rental, and delivery and insurance are shared
+// equally. Rounding differences go to the last book, so the borrows add up to the order.
+func splitOrderQuote(quote *Quote, bookIDs []int) map[int]*Quote {
+	quotes := map[int]*Quote{}
+	rentals := map[int]float64{}
+	for _, bookID := range bookIDs {
+		quotes[bookID] = &Quote{DeliveryType: quote.DeliveryType, DeliveryService: quote.DeliveryService, Lines: []QuoteLine{}}
+	}
+	for _, line := range quote.Lines {
+		if line.BookID == nil || quotes[*line.BookID] == nil {
+			continue
+		}
+		q := quotes[*line.BookID]
+		q.Lines = append(q.Lines, line)
+		if line.Code == PricingDeposit {
+			q.Deposit += line.Amount
+		} else {
+			q.Subtotal += line.Amount
+			rentals[*line.BookID] += line.Amount
+		}
+	}
+
+	discountWeights := map[int]float64{}
+	for bookID, rental := range quote.DiscountedRentals {
+		if quotes[bookID] != nil {
+			discountWeights[bookID] = rental
+		}
+	}
+	taxWeights := map[int]float64{}
+	equalWeights := map[int]float64{}
+	for _, bookID := range bookIDs {
+		equalWeights[bookID] = 1
+	}
+
+	for _, line := range quote.Lines {
+		if line.BookID != nil {
+			continue
+		}
+		weights := equalWeights
+		switch line.Code {
+		case PricingDiscount:
+			weights = discountWeights
+		case PricingTax:
+			// Discounts are shared out before tax, which is charged on the discounted rental
+			for _, bookID := range bookIDs {
+				taxWeights[bookID] = rentals[bookID] - quotes[bookID].Discount
+			}
+			weights = taxWeights
+		}
+		for bookID, amount := range shareAmount(line.Amount, bookIDs, weights) {
+			q := quotes[bookID]
+			q.Lines = append(q.Lines, QuoteLine{
+				Code:        line.Code,
+				Description: line.Description + " (share)",
+				Quantity:    1,
+				UnitPrice:   amount,
+				Amount:      amount,
+			})
+			switch line.Code {
+			case PricingDiscount:
+				q.Discount -= amount
+			case PricingTax:
+				q.Tax += amount
+			}
+		}
+	}
+
+	for _, q := range quotes {
+		for _, line := range q.Lines {
+			q.Total += line.Amount
+		}
+	}
+	return quotes
+}
+
+// shareAmount splits amount across the books in proportion to their weights, rounded to whole
+// rupiah with the remainder on the last weighted book. Books without weight get nothing; when
+// no book has weight the amount is split equally.
+func shareAmount(amount float64, bookIDs []int, weights map[int]float64) map[int]float64 {
+	var total float64
+	last := -1
+	for i, bookID := range bookIDs {
+		if weights[bookID] > 0 {
+			total += weights[bookID]
+			last = i
+		}
+	}
+	if last < 0 {
+		weights = map[int]float64{}
+		for _, bookID := range bookIDs {
+			weights[bookID] = 1
+		}
+		total = float64(len(bookIDs))
+		last = len(bookIDs) - 1
+	}
+
+	shares := map[int]float64{}
+	var given float64
+	for i, bookID := range bookIDs {
+		if weights[bookID] <= 0 {
+			continue
+		}
+		share := amount - given
+		if i != last {
+			share = roundRupiah(amount * weights[bookID] / total)
+		}
+		shares[bookID] = share
+		given += share
+	}
+	return shares
+}
+
+// CreateOrder creates an order and all of its borrows, or nothing at all.
+func CreateOrder(req OrderRequest) (*Order, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	order, err := createOrderTx(tx, req)
+	if err != nil {
+		return nil, err
+	}
+	return order, tx.Commit()
+}
+
+// lockBorrowOrderTx locks the order a borrow belongs to, if any. The order id never changes once
+// the borrow is created, so reading it without a lock is safe.
+func lockBorrowOrderTx(tx *sql.Tx, borrowID int) error {
+	var orderID sql.NullInt64
+	err := tx.QueryRow("SELECT order_id FROM borrow WHERE borrow_id = ?", borrowID).Scan(&orderID)
+	if err == sql.ErrNoRows {
+		return ErrBorrowNotFound
+	}
+	if err != nil || !orderID.Valid {
+		return err
+	}
+	var locked int
+	return tx.QueryRow("SELECT order_id FROM borrow_order WHERE order_id = ? FOR UPDATE", orderID.Int64).Scan(&locked)
+}
+
+// syncOrderStatusTx moves the order of a borrow along once all of its open borrows agree on a status.
+// Rejected and cancelled borrows are ignored unless every borrow in the order ended that way.
+func syncOrderStatusTx(tx *sql.Tx, borrowID, changedBy int, note string) error {
+	var orderID sql.NullInt64
+	err := tx.QueryRow("SELECT order_id FROM borrow WHERE borrow_id = ?", borrowID).Scan(&orderID)
+	if err != nil || !orderID.Valid {
+		return err
+	}
+
+	var current string
+	err = tx.QueryRow("SELECT status FROM borrow_order WHERE order_id = ? FOR UPDATE", orderID.Int64).Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT status FROM borrow WHERE order_id = ?", orderID.Int64)
+	if err != nil {
+		return err
+	}
+	open := map[string]bool{}
+	dropped := map[string]bool{}
+	for rows.Next() {
+		var status string
+		if err := rows.Scan(&status); err != nil {
+			rows.Close()
+			return err
+		}
+		if status == BorrowStatusRejected || status == BorrowStatusCancelled {
+			dropped[status] = true
+		} else {
+			open[status] = true
+		}
+	}
+	rows.Close()
+
+	var next string
+	switch {
+	case len(open) == 1:
+		for status := range open {
+			next = status
+		}
+	case len(open) == 0 && dropped[BorrowStatusCancelled]:
+		next = BorrowStatusCancelled
+	case len(open) == 0:
+		next = BorrowStatusRejected
+	}
+	if next == "" || next == current {
+		return nil
+	}
+
+	if _, err := tx.Exec("UPDATE borrow_order SET status = ? WHERE order_id = ?", next, orderID.Int64); err != nil {
+		return err
+	}
+	// The voucher was used on the order as a whole, so it is given back once nothing is left of it
+	if next == BorrowStatusRejected || next == BorrowStatusCancelled {
+		if err := releaseVoucherRedemptionTx(tx, "order_id", int(orderID.Int64)); err != nil {
+			return err
+		}
+	}
+	return recordOrderStatusTx(tx, int(orderID.Int64), current, next, changedBy, note)
+}
+
+// TransitionOrder moves every open borrow of an order to a new status in one transaction.
+func TransitionOrder(orderID int, to string, changedBy int, note string) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var from string
+	err = tx.QueryRow("SELECT status FROM borrow_order WHERE order_id = ? FOR UPDATE", orderID).Scan(&from)
+	if err == sql.ErrNoRows {
+		return "", ErrOrderNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	rows, err := tx.Query("SELECT borrow_id, status FROM borrow WHERE order_id = ? ORDER BY borrow_id", orderID)
+	if err != nil {
+		return from, err
+	}
+	var borrowIDs []int
+	for rows.Next() {
+		var borrowID int
+		var status string
+		if err := rows.Scan(&borrowID, &status); err != nil {
+			rows.Close()
+			return from, err
+		}
+		if status != to && !closedBorrowStatuses[status] {
+			borrowIDs = append(borrowIDs, borrowID)
+		}
+	}
+	rows.Close()
+
+	if len(borrowIDs) == 0 {
+		return from, fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, from, to)
+	}
+	for _, borrowID := range borrowIDs {
+		if _, err := transitionBorrowTx(tx, borrowID, to, changedBy, note); err != nil {
+			return from, err
+		}
+	}
+	return from, tx.Commit()
+}
+
+func scanOrder(scanner interface{ Scan(...interface{}) error }) (*Order, error) {
+	var order Order
+	var locationID sql.NullInt64
+	err := scanner.Scan(&order.OrderID, &order.UserID, &order.Status, &order.DeliveryType, &locationID,
+		&order.DeliveryAddress, &order.Subtotal, &order.Tax, &order.Total, &order.PaymentStatus, &order.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if locationID.Valid {
+		id := int(locationID.Int64)
+		order.LocationID = &id
+	}
+	order.BorrowIDs = []int{}
+	return &order, nil
+}
+
+const orderSelect = `
+	SELECT order_id, user_id, status, delivery_type, location_id, COALESCE(delivery_address, ''),
+	       subtotal, tax, total, payment_status, created_at
+	FROM borrow_order`
+
+// loadOrderBorrowIDs fills in the borrows belonging to the order.
+func loadOrderBorrowIDs(order *Order) error {
+	rows, err := db.Query("SELECT borrow_id FROM borrow WHERE order_id = ? ORDER BY borrow_id", order.OrderID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var borrowID int
+		if err := rows.Scan(&borrowID); err != nil {
+			return err
+		}
+		order.BorrowIDs = append(order.BorrowIDs, borrowID)
+	}
+	return nil
+}
+
+func GetOrderByID(orderID int) (*Order, error) {
+	order, err := scanOrder(db.QueryRow(orderSelect+" WHERE order_id = ?", orderID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := loadOrderBorrowIDs(order); err != nil {
+		return nil, err
+	}
+
+	lines, err := GetOrderLineItems(orderID)
+	if err != nil {
+		return nil, err
+	}
+	order.Lines = lines
+	return order, nil
+}
+
+func GetUserOrders(userID int) ([]Order, error) {
+	rows, err := db.Query(orderSelect+" WHERE user_id = ? ORDER BY created_at DESC, order_id DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+
+	orders := []Order{}
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		orders = append(orders, *order)
+	}
+	rows.Close()
+
+	for i := range orders {
+		if err := loadOrderBorrowIDs(&orders[i]); err != nil {
+			return nil, err
+		}
+	}
+	return orders, nil
+}
+
+func GetOrderLineItems(orderID int) ([]QuoteLine, error) {
+	return orderLineItems(db, orderID)
+}
+
+func orderLineItems(ex execer, orderID int) ([]QuoteLine, error) {
+	rows, err := ex.Query(`
+		SELECT code, description, book_id, quantity, unit_price, amount
+		FROM order_line_item WHERE order_id = ? ORDER BY line_id
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lines := []QuoteLine{}
+	for rows.Next() {
+		var line QuoteLine
+		var bookID sql.NullInt64
+		if err := rows.Scan(&line.Code, &line.Description, &bookID, &line.Quantity, &line.UnitPrice, &line.Amount); err != nil {
+			return nil, err
+		}
+		if bookID.Valid {
+			id := int(bookID.Int64)
+			line.BookID = &id
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// GetOrderHistory returns every status change of an order, oldest first.
+func GetOrderHistory(orderID int) ([]OrderStatusChange, error) {
+	rows, err := db.Query(`
+		SELECT history_id, order_id, from_status, to_status, changed_by, COALESCE(note, ''), created_at
+		FROM order_status_history
+		WHERE order_id = ?
+		ORDER BY created_at, history_id
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []OrderStatusChange{}
+	for rows.Next() {
+		var change OrderStatusChange
+		var fromStatus sql.NullString
+		var changedBy sql.NullInt64
+		err := rows.Scan(&change.HistoryID, &change.OrderID, &fromStatus, &change.ToStatus, &changedBy, &change.Note, &change.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if fromStatus.Valid {
+			change.FromStatus = &fromStatus.String
+		}
+		if changedBy.Valid {
+			id := int(changedBy.Int64)
+			change.ChangedBy = &id
+		}
+		history = append(history, change)
+	}
+	return history, nil
+}
+
+// ============ ORDER HANDLERS ============
+
+// writeOrderError maps order creation errors onto HTTP status codes.
+func writeOrderError(w http.ResponseWriter, err error, fallback string) {
+	var blocked *BorrowBlockedError
+	switch {
+	case errors.Is(err, ErrOrderEmpty), errors.Is(err, ErrDuplicateOrderBook), errors.Is(err, ErrMissingOrderAddress),
+		errors.Is(err, ErrVoucherInvalid), errors.Is(err, ErrOutsideServiceArea), errors.Is(err, ErrDeliveryServiceUnavailable),
+		errors.Is(err, ErrDeliveryAddressUnknown):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrQuoteBookNotFound), errors.Is(err, ErrLocationNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrNoCopiesAvailable), errors.As(err, &blocked), errors.Is(err, ErrPickupAppointmentStale),
+		errors.Is(err, ErrPickupAppointmentNotFound), errors.Is(err, ErrLocationArchived):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, fallback, http.StatusInternalServerError)
+	}
+}
+
+func createOrder(w http.ResponseWriter, r *http.Request) {
+	var req OrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	order, err := CreateOrder(req)
+	if err != nil {
+		writeOrderError(w, err, "Failed to create order")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Order created successfully",
+		"order":   order,
+	})
+}
+
+func getOrder(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	orderID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	order, err := GetOrderByID(orderID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if order == nil {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(order)
+}
+
+func getUserOrders(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID, err := strconv.Atoi(vars["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	orders, err := GetUserOrders(userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orders)
+}
+
+// updateOrderStatus moves all open borrows of an order to the requested status.
+func updateOrderStatus(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	orderID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Status    string `json:"status"`
+		ChangedBy int    `json:"changed_by"`
+		Note      string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := borrowStatusTimestamps[req.Status]; !ok {
+		http.Error(w, "Unknown order status", http.StatusBadRequest)
+		return
+	}
+
+	from, err := TransitionOrder(orderID, req.Status, req.ChangedBy, req.Note)
+	switch {
+	case errors.Is(err, ErrOrderNotFound):
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	case err != nil:
+		writeBorrowTransitionError(w, err, "Failed to update order status")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"message":     "Order status updated successfully",
+		"order_id":    orderID,
+		"from_status": from,
+		"status":      req.Status,
+	})
+}
+
+func getOrderHistory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	orderID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	history, err := GetOrderHistory(orderID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
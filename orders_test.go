@@ -0,0 +1,226 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// discountedOrderQuote is a delivery order of three books with a 50% voucher on books 1 and 3,
+// refundable deposits on books 1 and 2, insurance and 10% tax.
+func discountedOrderQuote() *Quote {
+	one, two, three := 1, 2, 3
+	return &Quote{
+		DeliveryType: "delivery",
+		Lines: []QuoteLine{
+			{Code: PricingRentalFee, BookID: &one, Quantity: 1, UnitPrice: 40000, Amount: 40000},
+			{Code: PricingDeposit, BookID: &one, Quantity: 1, UnitPrice: 10000, Amount: 10000},
+			{Code: PricingRentalFee, BookID: &two, Quantity: 1, UnitPrice: 40000, Amount: 40000},
+			{Code: PricingDeposit, BookID: &two, Quantity: 1, UnitPrice: 10000, Amount: 10000},
+			{Code: PricingRentalFee, BookID: &three, Quantity: 1, UnitPrice: 25000, Amount: 25000},
+			{Code: PricingDiscount, Quantity: 1, UnitPrice: -32500, Amount: -32500},
+			{Code: PricingDeliveryFee, Quantity: 1, UnitPrice: 23000, Amount: 23000},
+			{Code: PricingInsurance, Quantity: 1, UnitPrice: 200, Amount: 200},
+			{Code: PricingTax, Quantity: 1, UnitPrice: 7250, Amount: 7250},
+		},
+		Subtotal:          105000,
+		Deposit:           20000,
+		Discount:          32500,
+		Tax:               7250,
+		DiscountedRentals: map[int]float64{1: 40000, 3: 25000},
+		Total:             122950,
+	}
+}
+
+func lineTotal(q *Quote, code string) float64 {
+	var total float64
+	for _, line := range q.Lines {
+		if line.Code == code {
+			total += line.Amount
+		}
+	}
+	return total
+}
+
+func TestSplitOrderQuoteAddsUpToTheOrder(t *testing.T) {
+	quote := discountedOrderQuote()
+	quotes := splitOrderQuote(quote, []int{1, 2, 3})
+
+	var total, deposit float64
+	for _, q := range quotes {
+		total += q.Total
+		deposit += q.Deposit
+	}
+	if total != quote.Total {
+		t.Errorf("borrow totals add up to %.0f, want the order total %.0f", total, quote.Total)
+	}
+	if deposit != quote.Deposit {
+		t.Errorf("borrow deposits add up to %.0f, want %.0f", deposit, quote.Deposit)
+	}
+	for _, code := range []string{PricingRentalFee, PricingDeposit, PricingDiscount, PricingDeliveryFee, PricingInsurance, PricingTax} {
+		var shared float64
+		for _, q := range quotes {
+			shared += lineTotal(q, code)
+		}
+		if want := lineTotal(quote, code); shared != want {
+			t.Errorf("%s lines add up to %.0f across borrows, want %.0f", code, shared, want)
+		}
+	}
+}
+
+func TestSplitOrderQuoteShares(t *testing.T) {
+	quotes := splitOrderQuote(discountedOrderQuote(), []int{1, 2, 3})
+
+	tests := []struct {
+		bookID                                    int
+		discount, delivery, insurance, tax, total float64
+	}{
+		{1, -20000, 7667, 67, 2000, 39734},
+		{2, 0, 7667, 67, 4000, 61734},
+		{3, -12500, 7666, 66, 1250, 21482},
+	}
+	for _, tt := range tests {
+		q := quotes[tt.bookID]
+		got := []float64{lineTotal(q, PricingDiscount), lineTotal(q, PricingDeliveryFee), lineTotal(q, PricingInsurance), lineTotal(q, PricingTax), q.Total}
+		want := []float64{tt.discount, tt.delivery, tt.insurance, tt.tax, tt.total}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("book %d: discount, delivery, insurance, tax, total = %v, want %v", tt.bookID, got, want)
+				break
+			}
+		}
+		if q.Discount != -tt.discount || q.Tax != tt.tax {
+			t.Errorf("book %d: Discount %.0f, Tax %.0f, want %.0f, %.0f", tt.bookID, q.Discount, q.Tax, -tt.discount, tt.tax)
+		}
+	}
+}
+
+func TestSplitOrderQuoteWithoutVoucher(t *testing.T) {
+	one, two := 1, 2
+	quote := &Quote{
+		DeliveryType: "pickup",
+		Lines: []QuoteLine{
+			{Code: PricingRentalFee, BookID: &one, Quantity: 1, UnitPrice: 40000, Amount: 40000},
+			{Code: PricingRentalFee, BookID: &two, Quantity: 1, UnitPrice: 30000, Amount: 30000},
+			{Code: PricingTax, Quantity: 1, UnitPrice: 7000, Amount: 7000},
+		},
+		Total: 77000,
+	}
+	quotes := splitOrderQuote(quote, []int{1, 2})
+	if quotes[1].Total != 44000 || quotes[2].Total != 33000 {
+		t.Errorf("borrow totals = %.0f, %.0f, want 44000, 33000", quotes[1].Total, quotes[2].Total)
+	}
+}
+
+func TestShareAmount(t *testing.T) {
+	shares := shareAmount(100, []int{1, 2, 3}, map[int]float64{1: 1, 2: 1, 3: 1})
+	if shares[1] != 33 || shares[2] != 33 || shares[3] != 34 {
+		t.Errorf("equal shares of 100 = %v, want 33, 33, 34", shares)
+	}
+
+	shares = shareAmount(-300, []int{1, 2, 3}, map[int]float64{1: 2, 3: 1})
+	if shares[1] != -200 || shares[3] != -100 {
+		t.Errorf("weighted shares of -300 = %v, want -200 and -100", shares)
+	}
+	if _, ok := shares[2]; ok {
+		t.Errorf("book without weight got a share: %v", shares)
+	}
+
+	shares = shareAmount(50, []int{4, 5}, nil)
+	if shares[4] != 25 || shares[5] != 25 {
+		t.Errorf("unweighted shares of 50 = %v, want an equal split", shares)
+	}
+}
+
+func TestCreateOrderRefusals(t *testing.T) {
+	tests := []struct {
+		name string
+		req  OrderRequest
+		want error
+	}{
+		{"no books", OrderRequest{UserID: 5, DeliveryType: "pickup"}, ErrOrderEmpty},
+		{"delivery without address", OrderRequest{UserID: 5, BookIDs: []int{7}, DeliveryType: "delivery"}, ErrMissingOrderAddress},
+		{"book twice", OrderRequest{UserID: 5, BookIDs: []int{7, 8, 7}, DeliveryType: "pickup"}, ErrDuplicateOrderBook},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeDB(t, nil)
+			if _, err := CreateOrder(tt.req); !errors.Is(err, tt.want) {
+				t.Fatalf("CreateOrder = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateOrderCountsItsOwnBooksAgainstTheLoanLimit(t *testing.T) {
+	// One loan already out under a policy allowing two
+	fake := useFakeDB(t, loanTermsResponder(1, 0))
+
+	_, err := CreateOrder(OrderRequest{UserID: 5, BookIDs: []int{7, 8}, DeliveryType: "pickup"})
+	var blocked *BorrowBlockedError
+	if !errors.As(err, &blocked) {
+		t.Fatalf("CreateOrder = %v, want a BorrowBlockedError", err)
+	}
+	if len(fake.Find("INSERT INTO borrow_order")) != 0 {
+		t.Error("an order over the loan limit was created")
+	}
+}
+
+func TestSyncOrderStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []string
+		want     string
+	}{
+		{"all approved", []string{BorrowStatusApproved, BorrowStatusApproved}, BorrowStatusApproved},
+		{"approved apart from a rejected one", []string{BorrowStatusApproved, BorrowStatusRejected}, BorrowStatusApproved},
+		{"all rejected", []string{BorrowStatusRejected, BorrowStatusRejected}, BorrowStatusRejected},
+		{"rejected and cancelled", []string{BorrowStatusRejected, BorrowStatusCancelled}, BorrowStatusCancelled},
+		{"borrows disagree", []string{BorrowStatusApproved, BorrowStatusOnLoan}, ""},
+		{"nothing changed", []string{BorrowStatusRequested, BorrowStatusRequested}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t, orderResponder(tt.statuses...))
+			syncOrder(t)
+
+			updates := fake.Find("UPDATE borrow_order SET status = ?")
+			if tt.want == "" {
+				if len(updates) != 0 {
+					t.Errorf("order moved to %v, want it left alone", updates[0].Args[0])
+				}
+				return
+			}
+			if len(updates) != 1 || updates[0].Args[0] != tt.want {
+				t.Fatalf("order updates = %+v, want one to %s", updates, tt.want)
+			}
+			if len(fake.Find("INSERT INTO order_status_history")) != 1 {
+				t.Error("the order's status change was not recorded")
+			}
+		})
+	}
+}
+
+func TestTransitionOrderRefusals(t *testing.T) {
+	useFakeDB(t, nil)
+	if _, err := TransitionOrder(4, BorrowStatusApproved, 1, ""); !errors.Is(err, ErrOrderNotFound) {
+		t.Fatalf("TransitionOrder on an unknown order = %v, want %v", err, ErrOrderNotFound)
+	}
+
+	useFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+		switch {
+		case strings.Contains(query, "SELECT status FROM borrow_order"):
+			return fakeRow(BorrowStatusRequested), nil
+		case strings.Contains(query, "SELECT borrow_id, status FROM borrow WHERE order_id"):
+			return &fakeRows{columns: []string{"borrow_id", "status"}, values: [][]driver.Value{
+				{int64(9), BorrowStatusApproved},
+				{int64(10), BorrowStatusRejected},
+			}}, nil
+		}
+		return nil, nil
+	})
+	if _, err := TransitionOrder(4, BorrowStatusApproved, 1, ""); !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("TransitionOrder with nothing to move = %v, want %v", err, ErrInvalidTransition)
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============ OVERDUE DETECTION AND REMINDERS ============
+
+// dueSoonWindow is how far ahead of the due date the pre-due reminder goes out.
+const dueSoonWindow = 48 * time.Hour
+
+const (
+	ReminderDueSoon = "due_soon"
+	ReminderOverdue = "overdue"
+)
+
+// ReminderChannel delivers a reminder message of the given kind to a member.
+type ReminderChannel interface {
+	Send(userID, bookID int, kind, message string) error
+}
+
+// notificationTableChannel stores reminders in the notification center shown inside the app.
+type notificationTableChannel struct{}
+
+func (notificationTableChannel) Send(userID, bookID int, kind, message string) error {
+	return notify(db, userID, kind, bookID, message, "/FrontEnd/your-books.html")
+}
+
+var reminderChannel ReminderChannel = notificationTableChannel{}
+
+type OverdueBorrow struct {
+	BorrowID     int       `json:"borrow_id"`
+	UserID       int       `json:"user_id"`
+	UserName     string    `json:"user_name"`
+	BookID       int       `json:"book_id"`
+	Title        string    `json:"title"`
+	DueDate      time.Time `json:"due_date"`
+	DaysOverdue  int       `json:"days_overdue"`
+	AccruedFine  float64   `json:"accrued_fine"`
+	OverdueSince time.Time `json:"overdue_since"`
+}
+
+// FlagOverdueBorrows marks borrows on loan past their due date.
+func FlagOverdueBorrows() (int, error) {
+	result, err := db.Exec(`
+		UPDATE borrow SET overdue_since = due_date
+		WHERE status = ? AND due_date < NOW() AND overdue_since IS NULL
+	`, BorrowStatusOnLoan)
+	if err != nil {
+		return 0, err
+	}
+	affected, err := result.RowsAffected()
+	return int(affected), err
+}
+
+// flagLateReturnTx flags a borrow being returned after its due date, so it is fined even if the
+// scheduler has not yet seen it overdue.
+func flagLateReturnTx(tx *sql.Tx, borrowID int) error {
+	_, err := tx.Exec(`
+		UPDATE borrow SET overdue_since = due_date
+		WHERE borrow_id = ? AND due_date < NOW() AND overdue_since IS NULL
+	`, borrowID)
+	return err
+}
+
+type reminderCandidate struct {
+	borrowID int
+	userID   int
+	bookID   int
+	title    string
+	dueDate  time.Time
+}
+
+func findReminderCandidates(kind, condition string, args ...interface{}) ([]reminderCandidate, error) {
+	rows, err := db.Query(`
+		SELECT br.borrow_id, br.user_id, br.book_id, COALESCE(bk.title, ''), br.due_date
+		FROM borrow br
+		LEFT JOIN book bk ON br.book_id = bk.book_id
+		LEFT JOIN borrow_reminder rm ON rm.borrow_id = br.borrow_id AND rm.kind = ? AND rm.due_date = br.due_date
+		WHERE br.status = ? AND rm.reminder_id IS NULL AND `+condition,
+		append([]interface{}{kind, BorrowStatusOnLoan}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var candidates []reminderCandidate
+	for rows.Next() {
+		var c reminderCandidate
+		if err := rows.Scan(&c.borrowID, &c.userID, &c.bookID, &c.title, &c.dueDate); err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates, nil
+}
+
+// SendDueReminders sends one pre-due reminder and one overdue reminder per loan period.
+func SendDueReminders(channel ReminderChannel) (int, error) {
+	dueSoon, err := findReminderCandidates(ReminderDueSoon, "br.due_date BETWEEN NOW() AND ?", time.Now().Add(dueSoonWindow))
+	if err != nil {
+		return 0, err
+	}
+	overdue, err := findReminderCandidates(ReminderOverdue, "br.overdue_since IS NOT NULL")
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	send := func(kind string, c reminderCandidate, message string) error {
+		// Claim the reminder first so a crash never sends the same one twice
+		result, err := db.Exec(`
+			INSERT IGNORE INTO borrow_reminder (borrow_id, kind, due_date, sent_at)
+			VALUES (?, ?, ?, NOW())
+		`, c.borrowID, kind, c.dueDate)
+		if err != nil {
+			return err
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			return nil
+		}
+		if err := channel.Send(c.userID, c.bookID, kind, message); err != nil {
+			// Release the claim so the next run tries this reminder again
+			if _, releaseErr := db.Exec("DELETE FROM borrow_reminder WHERE borrow_id = ? AND kind = ? AND due_date = ?", c.borrowID, kind, c.dueDate); releaseErr != nil {
+				return fmt.Errorf("%v (releasing reminder claim: %v)", err, releaseErr)
+			}
+			return err
+		}
+		sent++
+		return nil
+	}
+
+	for _, c := range dueSoon {
+		message := fmt.Sprintf("Your loan of \"%s\" is due on %s.", c.title, c.dueDate.Format("02 Jan 2006"))
+		if err := send(ReminderDueSoon, c, message); err != nil {
+			return sent, err
+		}
+	}
+	for _, c := range overdue {
+		message := fmt.Sprintf("Your loan of \"%s\" was due on %s and is now overdue. Fines accrue daily until it is returned.", c.title, c.dueDate.Format("02 Jan 2006"))
+		if err := send(ReminderOverdue, c, message); err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// ============ FINES ============
+
+const (
+	FineStatusOutstanding = "outstanding"
+	FineStatusPaid        = "paid"
+	FineStatusWaived      = "waived"
+)
+
+var ErrFineNotOutstanding = errors.New("fine is not outstanding")
+
+type Fine struct {
+	FineID      int       `json:"fine_id"`
+	BorrowID    int       `json:"borrow_id"`
+	UserID      int       `json:"user_id"`
+	BookTitle   string    `json:"book_title"`
+	DaysOverdue int       `json:"days_overdue"`
+	Amount      float64   `json:"amount"`
+	PaidAmount  float64   `json:"paid_amount"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// fineBlockThreshold is the outstanding fine total above which new borrows are refused.
+func fineBlockThreshold() float64 {
+	if raw := os.Getenv("FINE_BLOCK_THRESHOLD"); raw != "" {
+		if value, err := strconv.ParseFloat(raw, 64); err == nil {
+			return value
+		}
+	}
+	return 50000
+}
+
+// fineAmount applies the policy rate and cap to a number of overdue days.
+func fineAmount(policy LoanPolicy, daysOverdue int) float64 {
+	amount := float64(daysOverdue) * policy.FinePerDay
+	if policy.FineCap > 0 && amount > policy.FineCap {
+		amount = policy.FineCap
+	}
+	return amount
+}
+
+// AccrueFines recalculates the outstanding fine of every flagged overdue borrow.
+// Returned and lost borrows stop accruing at the date they left the member's hands.
+func AccrueFines() (int, error) {
+	return accrueFines(db, "")
+}
+
+// accrueFineTx brings the fine of one borrow up to date inside tx.
+func accrueFineTx(tx *sql.Tx, borrowID int) error {
+	_, err := accrueFines(tx, " AND br.borrow_id = ?", borrowID)
+	return err
+}
+
+func accrueFines(ex execer, filter string, args ...interface{}) (int, error) {
+	rows, err := ex.Query(`
+		SELECT br.borrow_id, br.user_id, br.due_date, COALESCE(br.return_date, br.lost_at, NOW()),
+		       COALESCE(br.location_id, 0), COALESCE(bk.category_id, 0), COALESCE(u.member_tier, 'standard')
+		FROM borrow br
+		JOIN book bk ON br.book_id = bk.book_id
+		JOIN user u ON br.user_id = u.user_id
+		LEFT JOIN fine f ON f.borrow_id = br.borrow_id
+		WHERE br.overdue_since IS NOT NULL
+		  AND br.status IN (?, ?, ?)
+		  AND (f.fine_id IS NULL OR f.status = ?)`+filter,
+		append([]interface{}{BorrowStatusOnLoan, BorrowStatusReturned, BorrowStatusLost, FineStatusOutstanding}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+
+	type accrual struct {
+		borrowID, userID, days int
+		amount                 float64
+	}
+	var accruals []accrual
+	for rows.Next() {
+		var borrowID, userID, locationID, categoryID int
+		var dueDate, until time.Time
+		var memberTier string
+		if err := rows.Scan(&borrowID, &userID, &dueDate, &until, &locationID, &categoryID, &memberTier); err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		days := int(until.Sub(dueDate).Hours() / 24)
+		if days < 1 {
+			continue
+		}
+		policy, err := ResolveLoanPolicy(categoryID, locationID, memberTier)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		accruals = append(accruals, accrual{borrowID, userID, days, fineAmount(policy, days)})
+	}
+	rows.Close()
+
+	for _, a := range accruals {
+		_, err := ex.Exec(`
+			INSERT INTO fine (borrow_id, user_id, days_overdue, amount, status, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, NOW(), NOW())
+			ON DUPLICATE KEY UPDATE days_overdue = VALUES(days_overdue), amount = VALUES(amount), updated_at = NOW()
+		`, a.borrowID, a.userID, a.days, a.amount, FineStatusOutstanding)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(accruals), nil
+}
+
+// OutstandingFines returns the total unpaid fines of a member.
+func OutstandingFines(userID int) (float64, error) {
+	var total float64
+	err := db.QueryRow("SELECT COALESCE(SUM(amount - paid_amount), 0) FROM fine WHERE user_id = ? AND status = ?", userID, FineStatusOutstanding).
+		Scan(&total)
+	return total, err
+}
+
+func GetUserFines(userID int) ([]Fine, error) {
+	rows, err := db.Query(`
+		SELECT f.fine_id, f.borrow_id, f.user_id, COALESCE(bk.title, ''), f.days_overdue, f.amount, f.paid_amount, f.status, f.created_at, f.updated_at
+		FROM fine f
+		JOIN borrow br ON f.borrow_id = br.borrow_id
+		LEFT JOIN book bk ON br.book_id = bk.book_id
+		WHERE f.user_id = ?
+		ORDER BY f.created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fines := []Fine{}
+	for rows.Next() {
+		var fine Fine
+		err := rows.Scan(&fine.FineID, &fine.BorrowID, &fine.UserID, &fine.BookTitle, &fine.DaysOverdue, &fine.Amount,
+			&fine.PaidAmount, &fine.Status, &fine.CreatedAt, &fine.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		fines = append(fines, fine)
+	}
+	return fines, nil
+}
+
+// SettleFine closes an outstanding fine as paid or waived. Paid fines are recorded in the member ledger,
+// less whatever was already deducted from the deposit.
+func SettleFine(fineID int, status string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var amount float64
+	err = tx.QueryRow("SELECT user_id, amount - paid_amount FROM fine WHERE fine_id = ? AND status = ? FOR UPDATE", fineID, FineStatusOutstanding).
+		Scan(&userID, &amount)
+	if err == sql.ErrNoRows {
+		return ErrFineNotOutstanding
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE fine SET status = ?, updated_at = NOW() WHERE fine_id = ?", status, fineID)
+	if err != nil {
+		return err
+	}
+
+	if status == FineStatusPaid && amount > 0 {
+		if err := postFinePaymentTx(tx, fineID, userID, amount); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func GetOverdueBorrows() ([]OverdueBorrow, error) {
+	rows, err := db.Query(`
+		SELECT br.borrow_id, br.user_id, COALESCE(u.name, ''), br.book_id, COALESCE(bk.title, ''), br.due_date,
+		       br.overdue_since, COALESCE(f.amount, 0)
+		FROM borrow br
+		LEFT JOIN user u ON br.user_id = u.user_id
+		LEFT JOIN book bk ON br.book_id = bk.book_id
+		LEFT JOIN fine f ON f.borrow_id = br.borrow_id
+		WHERE br.status = ? AND br.overdue_since IS NOT NULL
+		ORDER BY br.due_date
+	`, BorrowStatusOnLoan)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	overdue := []OverdueBorrow{}
+	for rows.Next() {
+		var o OverdueBorrow
+		err := rows.Scan(&o.BorrowID, &o.UserID, &o.UserName, &o.BookID, &o.Title, &o.DueDate, &o.OverdueSince, &o.AccruedFine)
+		if err != nil {
+			return nil, err
+		}
+		o.DaysOverdue = int(time.Since(o.DueDate).Hours() / 24)
+		overdue = append(overdue, o)
+	}
+	return overdue, nil
+}
+
+// ============ OVERDUE AND FINE HANDLERS ============
+
+func getOverdueBorrows(w http.ResponseWriter, r *http.Request) {
+	overdue, err := GetOverdueBorrows()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(overdue)
+}
+
+func getUserFines(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID, err := strconv.Atoi(vars["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	fines, err := GetUserFines(userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fines)
+}
+
+func getUserBalance(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID, err := strconv.Atoi(vars["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	outstanding, err := OutstandingFines(userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	threshold := fineBlockThreshold()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id":           userID,
+		"outstanding_fines": outstanding,
+		"block_threshold":   threshold,
+		"borrowing_blocked": outstanding > threshold,
+	})
+}
+
+func settleFineHandler(status, success string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireAdmin(w, r) {
+			return
+		}
+
+		vars := mux.Vars(r)
+		fineID, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			http.Error(w, "Invalid fine ID", http.StatusBadRequest)
+			return
+		}
+
+		err = SettleFine(fineID, status)
+		if errors.Is(err, ErrFineNotOutstanding) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to update fine", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"message": success,
+			"fine_id": fineID,
+			"status":  status,
+		})
+	}
+}
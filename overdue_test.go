@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFineAmount(t *testing.T) {
+	policy := LoanPolicy{FinePerDay: 1000, FineCap: 5000}
+	tests := []struct {
+		days int
+		want float64
+	}{
+		{1, 1000},
+		{4, 4000},
+		{5, 5000},
+		{30, 5000},
+	}
+	for _, tt := range tests {
+		if got := fineAmount(policy, tt.days); got != tt.want {
+			t.Errorf("fineAmount(%d days) = %v, want %v", tt.days, got, tt.want)
+		}
+	}
+
+	uncapped := LoanPolicy{FinePerDay: 1000}
+	if got := fineAmount(uncapped, 30); got != 30000 {
+		t.Errorf("uncapped fineAmount(30 days) = %v, want 30000", got)
+	}
+}
+
+func TestFineBlockThreshold(t *testing.T) {
+	t.Setenv("FINE_BLOCK_THRESHOLD", "")
+	if got := fineBlockThreshold(); got != 50000 {
+		t.Errorf("default threshold = %v, want 50000", got)
+	}
+	t.Setenv("FINE_BLOCK_THRESHOLD", "20000")
+	if got := fineBlockThreshold(); got != 20000 {
+		t.Errorf("configured threshold = %v, want 20000", got)
+	}
+	t.Setenv("FINE_BLOCK_THRESHOLD", "lots")
+	if got := fineBlockThreshold(); got != 50000 {
+		t.Errorf("unparsable threshold = %v, want the default 50000", got)
+	}
+}
+
+func TestAccrueFinesUsesDaysPastDue(t *testing.T) {
+	due := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	fake := useFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+		if strings.Contains(query, "FROM borrow br JOIN book bk") {
+			return &fakeRows{
+				columns: []string{"borrow_id", "user_id", "due_date", "until", "location_id", "category_id", "member_tier"},
+				values: [][]driver.Value{
+					{int64(9), int64(5), due, due.AddDate(0, 0, 5), int64(0), int64(2), "standard"},
+					{int64(10), int64(6), due, due.Add(12 * time.Hour), int64(0), int64(2), "standard"},
+				},
+			}, nil
+		}
+		return nil, nil
+	})
+
+	accrued, err := AccrueFines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accrued != 1 {
+		t.Fatalf("accrued %d fines, want 1", accrued)
+	}
+	inserts := fake.Find("INSERT INTO fine")
+	if len(inserts) != 1 {
+		t.Fatalf("got %d fine inserts, want 1", len(inserts))
+	}
+	// Five days at the default policy's rate
+	args := inserts[0].Args
+	if args[0] != int64(9) || args[2] != int64(5) || args[3] != 5000.0 {
+		t.Errorf("fine insert args = %v, want borrow 9 fined 5000 for 5 days", args)
+	}
+}
+
+// recordingReminders collects reminders and fails for the members listed in failFor.
+type recordingReminders struct {
+	sent    []string
+	failFor map[int]bool
+}
+
+func (c *recordingReminders) Send(userID, bookID int, kind, message string) error {
+	if c.failFor[userID] {
+		return errors.New("channel down")
+	}
+	c.sent = append(c.sent, kind)
+	return nil
+}
+
+func reminderResponder(query string, args []driver.Value) (*fakeRows, error) {
+	if !strings.Contains(query, "FROM borrow br LEFT JOIN book bk") {
+		return nil, nil
+	}
+	due := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	if args[0] == ReminderDueSoon {
+		return fakeRow(int64(9), int64(5), int64(7), "Soon", due), nil
+	}
+	return fakeRow(int64(10), int64(6), int64(8), "Late", due), nil
+}
+
+func TestSendDueReminders(t *testing.T) {
+	fake := useFakeDB(t, reminderResponder)
+	channel := &recordingReminders{}
+
+	sent, err := SendDueReminders(channel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 2 || strings.Join(channel.sent, ",") != ReminderDueSoon+","+ReminderOverdue {
+		t.Errorf("sent %d reminders %v, want one due-soon and one overdue", sent, channel.sent)
+	}
+	if len(fake.Find("INSERT IGNORE INTO borrow_reminder")) != 2 {
+		t.Error("reminders were not claimed before sending")
+	}
+}
+
+func TestSendDueRemindersReleasesFailedClaims(t *testing.T) {
+	fake := useFakeDB(t, reminderResponder)
+	channel := &recordingReminders{failFor: map[int]bool{6: true}}
+
+	sent, err := SendDueReminders(channel)
+	if err == nil {
+		t.Fatal("expected the channel failure to be returned")
+	}
+	if sent != 1 {
+		t.Errorf("sent %d reminders, want 1", sent)
+	}
+	released := fake.Find("DELETE FROM borrow_reminder")
+	if len(released) != 1 || released[0].Args[0] != int64(10) {
+		t.Errorf("released claims %+v, want the failed reminder of borrow 10", released)
+	}
+}
+
+func TestSettleFine(t *testing.T) {
+	outstanding := func(query string, args []driver.Value) (*fakeRows, error) {
+		if strings.Contains(query, "FROM fine WHERE fine_id = ?") {
+			return fakeRow(int64(5), 4000.0), nil
+		}
+		return nil, nil
+	}
+
+	t.Run("paid", func(t *testing.T) {
+		fake := useFakeDB(t, outstanding)
+		if err := SettleFine(3, FineStatusPaid); err != nil {
+			t.Fatal(err)
+		}
+		if len(fake.Find("INSERT INTO ledger_entry")) == 0 {
+			t.Error("a paid fine was not recorded in the ledger")
+		}
+	})
+	t.Run("waived", func(t *testing.T) {
+		fake := useFakeDB(t, outstanding)
+		if err := SettleFine(3, FineStatusWaived); err != nil {
+			t.Fatal(err)
+		}
+		if len(fake.Find("INSERT INTO ledger_entry")) != 0 {
+			t.Error("a waived fine was recorded as paid")
+		}
+	})
+	t.Run("not outstanding", func(t *testing.T) {
+		useFakeDB(t, nil)
+		if err := SettleFine(3, FineStatusPaid); !errors.Is(err, ErrFineNotOutstanding) {
+			t.Fatalf("SettleFine = %v, want %v", err, ErrFineNotOutstanding)
+		}
+	})
+}
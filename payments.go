@@ -0,0 +1,616 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============ PAYMENTS ============
+
+// Payment statuses as tracked per payment attempt.
+const (
+	PaymentStatusPending           = "pending"
+	PaymentStatusCaptured          = "captured"
+	PaymentStatusFailed            = "failed"
+	PaymentStatusRefunded          = "refunded"
+	PaymentStatusPartiallyRefunded = "partially_refunded"
+)
+
+// Payment states of an order or borrow.
+const (
+	PayableUnpaid   = "unpaid"
+	PayablePaid     = "paid"
+	PayableRefunded = "refunded"
+)
+
+var (
+	ErrPaymentNotFound     = errors.New("payment not found")
+	ErrAlreadyPaid         = errors.New("already paid")
+	ErrNothingToPay        = errors.New("nothing to pay")
+	ErrPaymentNotPending   = errors.New("payment is not pending")
+	ErrPaymentNotCaptured  = errors.New("payment has not been captured")
+	ErrRefundExceedsAmount = errors.New("refund exceeds the captured amount")
+	ErrPaymentRequired     = errors.New("borrow must be paid before it can be approved")
+)
+
+type Payment struct {
+	PaymentID      int       `json:"payment_id"`
+	OrderID        *int      `json:"order_id"`
+	BorrowID       *int      `json:"borrow_id"`
+	Provider       string    `json:"provider"`
+	ProviderRef    string    `json:"provider_ref"`
+	ClientSecret   string    `json:"client_secret,omitempty"`
+	Amount         float64   `json:"amount"`
+	RefundedAmount float64   `json:"refunded_amount"`
+	Currency       string    `json:"currency"`
+	Status         string    `json:"status"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+const paymentCurrency = "IDR"
+
+const paymentSelect = `
+	SELECT payment_id, order_id, borrow_id, provider, provider_ref, amount, refunded_amount, currency, status, created_at
+	FROM payment`
+
+func scanPayment(scanner interface{ Scan(...interface{}) error }) (*Payment, error) {
+	var p Payment
+	var orderID, borrowID sql.NullInt64
+	err := scanner.Scan(&p.PaymentID, &orderID, &borrowID, &p.Provider, &p.ProviderRef, &p.Amount,
+		&p.RefundedAmount, &p.Currency, &p.Status, &p.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if orderID.Valid {
+		id := int(orderID.Int64)
+		p.OrderID = &id
+	}
+	if borrowID.Valid {
+		id := int(borrowID.Int64)
+		p.BorrowID = &id
+	}
+	return &p, nil
+}
+
+func GetPaymentByID(paymentID int) (*Payment, error) {
+	p, err := scanPayment(db.QueryRow(paymentSelect+" WHERE payment_id = ?", paymentID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return p, err
+}
+
+// payableAmount returns the amount due and the current payment state of an order or a stand-alone borrow.
+func payableAmount(orderID, borrowID int) (float64, string, error) {
+	var amount float64
+	var status sql.NullString
+	var err error
+	if orderID != 0 {
+		err = db.QueryRow("SELECT total, payment_status FROM borrow_order WHERE order_id = ?", orderID).Scan(&amount, &status)
+		if err == sql.ErrNoRows {
+			return 0, "", ErrOrderNotFound
+		}
+	} else {
+		err = db.QueryRow("SELECT COALESCE(total_price, 0), payment_status FROM borrow WHERE borrow_id = ?", borrowID).Scan(&amount, &status)
+		if err == sql.ErrNoRows {
+			return 0, "", ErrBorrowNotFound
+		}
+	}
+	return amount, status.String, err
+}
+
+// CreatePayment opens a payment intent with the provider for an order or a borrow that is not part of one.
+func CreatePayment(orderID, borrowID int) (*Payment, error) {
+	amount, status, err := payableAmount(orderID, borrowID)
+	if err != nil {
+		return nil, err
+	}
+	if status == PayablePaid {
+		return nil, ErrAlreadyPaid
+	}
+	if amount <= 0 {
+		return nil, ErrNothingToPay
+	}
+
+	description := fmt.Sprintf("LibMatch borrow #%d", borrowID)
+	if orderID != 0 {
+		description = fmt.Sprintf("LibMatch order #%d", orderID)
+	}
+	intent, err := paymentProvider.CreateIntent(amount, paymentCurrency, description)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO payment (order_id, borrow_id, provider, provider_ref, amount, refunded_amount, currency, status, created_at)
+		VALUES (?, ?, ?, ?, ?, 0, ?, ?, NOW())
+	`, nullableID(orderID), nullableID(borrowID), paymentProvider.Name(), intent.ProviderRef, amount, paymentCurrency, PaymentStatusPending)
+	if err != nil {
+		return nil, err
+	}
+	lastInsertID, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the newest intent can be paid, so an abandoned attempt is never captured on top of it
+	_, err = db.Exec(`
+		UPDATE payment SET status = ?
+		WHERE status = ? AND payment_id <> ? AND (order_id = ? OR borrow_id = ?)
+	`, PaymentStatusFailed, PaymentStatusPending, lastInsertID, nullableID(orderID), nullableID(borrowID))
+	if err != nil {
+		return nil, err
+	}
+
+	payment, err := GetPaymentByID(int(lastInsertID))
+	if err != nil || payment == nil {
+		return nil, err
+	}
+	payment.ClientSecret = intent.ClientSecret
+	return payment, nil
+}
+
+// setPayableStatusTx copies a payment state onto the order or borrow a payment belongs to.
+// Order payments are copied onto every borrow in the order as well.
+func setPayableStatusTx(tx *sql.Tx, p *Payment, status string) error {
+	if p.OrderID != nil {
+		if _, err := tx.Exec("UPDATE borrow_order SET payment_status = ? WHERE order_id = ?", status, *p.OrderID); err != nil {
+			return err
+		}
+		_, err := tx.Exec("UPDATE borrow SET payment_status = ? WHERE order_id = ?", status, *p.OrderID)
+		return err
+	}
+	if p.BorrowID != nil {
+		_, err := tx.Exec("UPDATE borrow SET payment_status = ? WHERE borrow_id = ?", status, *p.BorrowID)
+		return err
+	}
+	return nil
+}
+
+// lockPayableTx locks the order or borrow a payment is for and returns its payment status.
+func lockPayableTx(tx *sql.Tx, p *Payment) (string, error) {
+	var status sql.NullString
+	var err error
+	switch {
+	case p.OrderID != nil:
+		err = tx.QueryRow("SELECT payment_status FROM borrow_order WHERE order_id = ? FOR UPDATE", *p.OrderID).Scan(&status)
+	case p.BorrowID != nil:
+		err = tx.QueryRow("SELECT payment_status FROM borrow WHERE borrow_id = ? FOR UPDATE", *p.BorrowID).Scan(&status)
+	}
+	return status.String, err
+}
+
+// markPaymentCaptured records a successful capture; repeated notifications are ignored. A capture
+// of something already paid through another intent is recorded but not posted again.
+func markPaymentCaptured(p *Payment) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	payableStatus, err := lockPayableTx(tx, p)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec("UPDATE payment SET status = ? WHERE payment_id = ? AND status = ?",
+		PaymentStatusCaptured, p.PaymentID, PaymentStatusPending)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil || affected == 0 {
+		return err
+	}
+	if payableStatus == PayablePaid {
+		log.Printf("Payment %d captured for something already paid; refund it through /api/payments/%d/refund", p.PaymentID, p.PaymentID)
+		return tx.Commit()
+	}
+
+	if err := setPayableStatusTx(tx, p, PayablePaid); err != nil {
+		return err
+	}
+	if err := postPaymentTx(tx, p, p.Amount); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func markPaymentFailed(p *Payment) error {
+	_, err := db.Exec("UPDATE payment SET status = ? WHERE payment_id = ? AND status = ?",
+		PaymentStatusFailed, p.PaymentID, PaymentStatusPending)
+	return err
+}
+
+// CapturePayment asks the provider to collect a pending payment.
+func CapturePayment(paymentID int) (*Payment, error) {
+	p, err := GetPaymentByID(paymentID)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, ErrPaymentNotFound
+	}
+	if p.Status != PaymentStatusPending {
+		return nil, ErrPaymentNotPending
+	}
+	orderID, borrowID := 0, 0
+	if p.OrderID != nil {
+		orderID = *p.OrderID
+	} else if p.BorrowID != nil {
+		borrowID = *p.BorrowID
+	}
+	_, status, err := payableAmount(orderID, borrowID)
+	if err != nil {
+		return nil, err
+	}
+	if status == PayablePaid {
+		return nil, ErrAlreadyPaid
+	}
+
+	if err := paymentProvider.Capture(p.ProviderRef, p.Amount); err != nil {
+		if errors.Is(err, ErrPaymentDeclined) {
+			if err := markPaymentFailed(p); err != nil {
+				return nil, err
+			}
+		}
+		return nil, err
+	}
+
+	if err := markPaymentCaptured(p); err != nil {
+		return nil, err
+	}
+	return GetPaymentByID(paymentID)
+}
+
+// recordRefund adds a refunded amount to a captured payment.
+func recordRefund(p *Payment, amount float64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := recordRefundTx(tx, p, amount, 0); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// recordRefundTx books a refund inside tx. reserved is the part of amount that RefundPayment
+// set aside before calling the provider and is released as the refund is recorded.
+func recordRefundTx(tx *sql.Tx, p *Payment, amount, reserved float64) error {
+	var refunded, pending, total float64
+	var status string
+	err := tx.QueryRow("SELECT refunded_amount, refund_reserved, amount, status FROM payment WHERE payment_id = ? FOR UPDATE", p.PaymentID).
+		Scan(&refunded, &pending, &total, &status)
+	if err != nil {
+		return err
+	}
+	if status != PaymentStatusCaptured && status != PaymentStatusPartiallyRefunded {
+		return ErrPaymentNotCaptured
+	}
+	pending -= reserved
+	if refunded+pending+amount > total {
+		return ErrRefundExceedsAmount
+	}
+
+	refunded += amount
+	next := PaymentStatusPartiallyRefunded
+	if refunded >= total {
+		next = PaymentStatusRefunded
+	}
+	_, err = tx.Exec("UPDATE payment SET refunded_amount = ?, refund_reserved = ?, status = ? WHERE payment_id = ?",
+		refunded, pending, next, p.PaymentID)
+	if err != nil {
+		return err
+	}
+	if err := postRefundTx(tx, p, amount); err != nil {
+		return err
+	}
+	if err := creditInvoiceForRefundTx(tx, p, amount); err != nil {
+		return err
+	}
+
+	if next == PaymentStatusRefunded {
+		if err := setPayableStatusTx(tx, p, PayableRefunded); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reserveRefund sets amount aside on a payment so concurrent refunds cannot exceed it while the
+// provider is being called. An amount of 0 reserves what is left and the reserved amount is returned.
+func reserveRefund(paymentID int, amount float64) (float64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var refunded, pending, total float64
+	var status string
+	err = tx.QueryRow("SELECT refunded_amount, refund_reserved, amount, status FROM payment WHERE payment_id = ? FOR UPDATE", paymentID).
+		Scan(&refunded, &pending, &total, &status)
+	if err == sql.ErrNoRows {
+		return 0, ErrPaymentNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	if status != PaymentStatusCaptured && status != PaymentStatusPartiallyRefunded {
+		return 0, ErrPaymentNotCaptured
+	}
+	if amount == 0 {
+		amount = total - refunded - pending
+	}
+	if amount <= 0 || refunded+pending+amount > total {
+		return 0, ErrRefundExceedsAmount
+	}
+
+	_, err = tx.Exec("UPDATE payment SET refund_reserved = refund_reserved + ? WHERE payment_id = ?", amount, paymentID)
+	if err != nil {
+		return 0, err
+	}
+	return amount, tx.Commit()
+}
+
+// RefundPayment returns part or all of a captured payment; an amount of 0 refunds what is left.
+// The amount is reserved before the provider is called and booked once it succeeds.
+func RefundPayment(paymentID int, amount float64) (*Payment, error) {
+	amount, err := reserveRefund(paymentID, amount)
+	if err != nil {
+		return nil, err
+	}
+	p, err := GetPaymentByID(paymentID)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := paymentProvider.Refund(p.ProviderRef, amount); err != nil {
+		if _, releaseErr := db.Exec("UPDATE payment SET refund_reserved = refund_reserved - ? WHERE payment_id = ?", amount, paymentID); releaseErr != nil {
+			log.Printf("Error releasing refund reservation on payment %d: %v", paymentID, releaseErr)
+		}
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := recordRefundTx(tx, p, amount, amount); err != nil {
+		// The provider has paid out; the reservation stays so the amount cannot be refunded twice
+		log.Printf("Payment %d refunded %.2f at %s but recording it failed: %v", paymentID, amount, p.Provider, err)
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Payment %d refunded %.2f at %s but recording it failed: %v", paymentID, amount, p.Provider, err)
+		return nil, err
+	}
+	return GetPaymentByID(paymentID)
+}
+
+// HandlePaymentEvent applies a verified provider notification to the matching payment.
+func HandlePaymentEvent(event *PaymentEvent) error {
+	p, err := scanPayment(db.QueryRow(paymentSelect+" WHERE provider = ? AND provider_ref = ?",
+		paymentProvider.Name(), event.ProviderRef))
+	if err == sql.ErrNoRows {
+		return ErrPaymentNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	switch event.Type {
+	case PaymentEventCaptured:
+		return markPaymentCaptured(p)
+	case PaymentEventFailed:
+		return markPaymentFailed(p)
+	case PaymentEventRefunded:
+		amount := event.Amount
+		if amount == 0 {
+			amount = p.Amount - p.RefundedAmount
+		}
+		return recordRefund(p, amount)
+	}
+	return nil
+}
+
+// checkBorrowPaidTx blocks approval of a borrow that still has an unpaid balance.
+// Borrows created before payments were introduced have no payment status and are let through.
+func checkBorrowPaidTx(tx *sql.Tx, borrowID int) error {
+	var status sql.NullString
+	var total float64
+	err := tx.QueryRow("SELECT payment_status, COALESCE(total_price, 0) FROM borrow WHERE borrow_id = ?", borrowID).
+		Scan(&status, &total)
+	if err != nil {
+		return err
+	}
+	if status.Valid && status.String != PayablePaid && total > 0 {
+		return ErrPaymentRequired
+	}
+	return nil
+}
+
+// ============ PAYMENT HANDLERS ============
+
+// writePaymentError maps payment errors onto HTTP status codes.
+func writePaymentError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, ErrPaymentNotFound), errors.Is(err, ErrOrderNotFound), errors.Is(err, ErrBorrowNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrPaymentDeclined):
+		http.Error(w, err.Error(), http.StatusPaymentRequired)
+	case errors.Is(err, ErrAlreadyPaid), errors.Is(err, ErrNothingToPay), errors.Is(err, ErrPaymentNotPending),
+		errors.Is(err, ErrPaymentNotCaptured), errors.Is(err, ErrRefundExceedsAmount):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, fallback, http.StatusInternalServerError)
+	}
+}
+
+// createPaymentHandler starts a payment for an order or borrow, depending on which route it serves.
+func createPaymentHandler(forOrder bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+
+		var payment *Payment
+		if forOrder {
+			payment, err = CreatePayment(id, 0)
+		} else {
+			var orderID sql.NullInt64
+			err = db.QueryRow("SELECT order_id FROM borrow WHERE borrow_id = ?", id).Scan(&orderID)
+			if err == sql.ErrNoRows {
+				http.Error(w, "Borrow not found", http.StatusNotFound)
+				return
+			}
+			if err == nil && orderID.Valid {
+				http.Error(w, fmt.Sprintf("Borrow is part of order %d; pay the order instead", orderID.Int64), http.StatusConflict)
+				return
+			}
+			if err == nil {
+				payment, err = CreatePayment(0, id)
+			}
+		}
+		if err != nil {
+			writePaymentError(w, err, "Failed to create payment")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"message": "Payment created",
+			"payment": payment,
+		})
+	}
+}
+
+func getPayment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	paymentID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid payment ID", http.StatusBadRequest)
+		return
+	}
+
+	payment, err := GetPaymentByID(paymentID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if payment == nil {
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(payment)
+}
+
+func capturePayment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	paymentID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid payment ID", http.StatusBadRequest)
+		return
+	}
+
+	payment, err := CapturePayment(paymentID)
+	if err != nil {
+		writePaymentError(w, err, "Failed to capture payment")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Payment captured",
+		"payment": payment,
+	})
+}
+
+func refundPayment(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	paymentID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid payment ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Amount float64 `json:"amount"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	payment, err := RefundPayment(paymentID, req.Amount)
+	if err != nil {
+		writePaymentError(w, err, "Failed to refund payment")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Payment refunded",
+		"payment": payment,
+	})
+}
+
+// paymentWebhook receives signed notifications from the payment provider.
+func paymentWebhook(w http.ResponseWriter, r *http.Request) {
+	payload, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	event, err := paymentProvider.VerifyWebhook(payload, r.Header.Get("X-Payment-Signature"))
+	if errors.Is(err, ErrWebhookSecretMissing) {
+		log.Printf("Refusing payment webhook: %v", err)
+		http.Error(w, "Payment webhooks are not configured", http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, ErrInvalidWebhookSignature) {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid webhook payload", http.StatusBadRequest)
+		return
+	}
+
+	if err := HandlePaymentEvent(event); err != nil {
+		writePaymentError(w, err, "Failed to process webhook")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+	})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFakePaymentProviderVerifiesWebhooks(t *testing.T) {
+	provider := &fakePaymentProvider{}
+	payload := []byte(`{"type":"payment.captured","provider_ref":"fake_pi_1","amount":44000}`)
+
+	t.Setenv("PAYMENT_WEBHOOK_SECRET", "")
+	if _, err := provider.VerifyWebhook(payload, "anything"); !errors.Is(err, ErrWebhookSecretMissing) {
+		t.Errorf("without a secret = %v, want %v", err, ErrWebhookSecretMissing)
+	}
+
+	t.Setenv("PAYMENT_WEBHOOK_SECRET", "s3cret")
+	if _, err := provider.VerifyWebhook(payload, signPaymentWebhook("other", payload)); !errors.Is(err, ErrInvalidWebhookSignature) {
+		t.Errorf("with a wrong signature = %v, want %v", err, ErrInvalidWebhookSignature)
+	}
+	event, err := provider.VerifyWebhook(payload, signPaymentWebhook("s3cret", payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != PaymentEventCaptured || event.ProviderRef != "fake_pi_1" || event.Amount != 44000 {
+		t.Errorf("event = %+v", event)
+	}
+}
+
+func TestFakePaymentProviderDeclinesAboveTheLimit(t *testing.T) {
+	provider := &fakePaymentProvider{}
+	t.Setenv("FAKE_PAYMENT_DECLINE_ABOVE", "50000")
+
+	if err := provider.Capture("fake_pi_1", 50000); err != nil {
+		t.Errorf("capture at the limit = %v, want success", err)
+	}
+	if err := provider.Capture("fake_pi_1", 50001); !errors.Is(err, ErrPaymentDeclined) {
+		t.Errorf("capture above the limit = %v, want %v", err, ErrPaymentDeclined)
+	}
+}
+
+// payableResponder answers payment lookups for borrow 9, which costs total and is in the given payment status.
+func payableResponder(total float64, status interface{}) fakeResponder {
+	return func(query string, args []driver.Value) (*fakeRows, error) {
+		switch {
+		case strings.Contains(query, "SELECT COALESCE(total_price, 0), payment_status FROM borrow"):
+			return fakeRow(total, status), nil
+		case strings.Contains(query, "FROM payment WHERE payment_id = ?"):
+			return fakeRow(args[0], nil, int64(9), "fake", "fake_pi_1", total, 0.0, paymentCurrency, PaymentStatusPending, time.Now()), nil
+		}
+		return nil, nil
+	}
+}
+
+func TestCreatePayment(t *testing.T) {
+	fake := useFakeDB(t, payableResponder(44000, PayableUnpaid))
+
+	payment, err := CreatePayment(0, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.Amount != 44000 || payment.ClientSecret == "" {
+		t.Errorf("payment = %+v, want 44000 with a client secret", payment)
+	}
+	// Older pending intents are failed so only the newest can be captured
+	superseded := fake.Find("UPDATE payment SET status = ?", "payment_id <> ?")
+	if len(superseded) != 1 || superseded[0].Args[0] != PaymentStatusFailed {
+		t.Errorf("superseding statements = %+v", superseded)
+	}
+}
+
+func TestCreatePaymentRefusals(t *testing.T) {
+	tests := []struct {
+		name   string
+		total  float64
+		status string
+		want   error
+	}{
+		{"already paid", 44000, PayablePaid, ErrAlreadyPaid},
+		{"free borrow", 0, PayableUnpaid, ErrNothingToPay},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t, payableResponder(tt.total, tt.status))
+			if _, err := CreatePayment(0, 9); !errors.Is(err, tt.want) {
+				t.Fatalf("CreatePayment = %v, want %v", err, tt.want)
+			}
+			if len(fake.Find("INSERT INTO payment")) != 0 {
+				t.Error("a refused payment was created")
+			}
+		})
+	}
+}
+
+func TestCheckBorrowPaid(t *testing.T) {
+	tests := []struct {
+		name   string
+		status interface{}
+		total  float64
+		want   error
+	}{
+		{"unpaid", PayableUnpaid, 44000, ErrPaymentRequired},
+		{"paid", PayablePaid, 44000, nil},
+		{"free", PayableUnpaid, 0, nil},
+		{"created before payments", nil, 44000, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+				return fakeRow(tt.status, tt.total), nil
+			})
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+			if err := checkBorrowPaidTx(tx, 9); !errors.Is(err, tt.want) {
+				t.Errorf("checkBorrowPaidTx = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReserveRefund(t *testing.T) {
+	// A captured payment of 44000 with 10000 refunded and 4000 reserved by a refund in flight
+	captured := func(status string) fakeResponder {
+		return func(query string, args []driver.Value) (*fakeRows, error) {
+			if strings.Contains(query, "FROM payment WHERE payment_id = ? FOR UPDATE") {
+				return fakeRow(10000.0, 4000.0, 44000.0, status), nil
+			}
+			return nil, nil
+		}
+	}
+
+	useFakeDB(t, captured(PaymentStatusPartiallyRefunded))
+	reserved, err := reserveRefund(3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reserved != 30000 {
+		t.Errorf("reserved %v, want the remaining 30000", reserved)
+	}
+
+	fake := useFakeDB(t, captured(PaymentStatusPartiallyRefunded))
+	if _, err := reserveRefund(3, 30001); !errors.Is(err, ErrRefundExceedsAmount) {
+		t.Errorf("reserving too much = %v, want %v", err, ErrRefundExceedsAmount)
+	}
+	if len(fake.Find("refund_reserved = refund_reserved +")) != 0 {
+		t.Error("an excessive refund was reserved")
+	}
+
+	useFakeDB(t, captured(PaymentStatusPending))
+	if _, err := reserveRefund(3, 1000); !errors.Is(err, ErrPaymentNotCaptured) {
+		t.Errorf("refunding a pending payment = %v, want %v", err, ErrPaymentNotCaptured)
+	}
+}
+
+func TestCaptureOfSomethingAlreadyPaidIsNotPostedTwice(t *testing.T) {
+	borrowID := 9
+	fake := useFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+		if strings.Contains(query, "SELECT payment_status FROM borrow WHERE borrow_id = ? FOR UPDATE") {
+			return fakeRow(PayablePaid), nil
+		}
+		return nil, nil
+	})
+
+	if err := markPaymentCaptured(&Payment{PaymentID: 3, BorrowID: &borrowID, Amount: 44000}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.Find("UPDATE payment SET status = ?")) != 1 || fake.Index("COMMIT") < 0 {
+		t.Error("the capture itself was not recorded")
+	}
+	if len(fake.Find("INSERT INTO ledger_entry")) != 0 {
+		t.Error("a second payment for something already paid was posted to the ledger")
+	}
+}
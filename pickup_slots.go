@@ -0,0 +1,644 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============ OPENING HOURS & PICKUP SLOTS ============
+
+const (
+	AppointmentStatusHeld      = "held"
+	AppointmentStatusBooked    = "booked"
+	AppointmentStatusCollected = "collected"
+	AppointmentStatusExpired   = "expired"
+	AppointmentStatusMissed    = "missed"
+	AppointmentStatusCancelled = "cancelled"
+)
+
+const (
+	pickupSlotLength = time.Hour
+	// pickupHoldDuration is how long a slot chosen at checkout stays reserved before the order confirms it.
+	pickupHoldDuration = 15 * time.Minute
+	// pickupMissedGrace is how long after a slot ends a booked pickup is still waited for.
+	pickupMissedGrace = 2 * time.Hour
+)
+
+var (
+	ErrLocationNotFound          = errors.New("location not found")
+	ErrInvalidOpeningHours       = errors.New("invalid opening hours")
+	ErrPickupSlotUnavailable     = errors.New("pickup slot is not offered")
+	ErrPickupSlotFull            = errors.New("pickup slot is fully booked")
+	ErrPickupAppointmentNotFound = errors.New("pickup appointment not found")
+	ErrPickupAppointmentStale    = errors.New("pickup appointment has expired or belongs to another checkout")
+)
+
+// OpeningHours are a location's hours on one weekday, 0 being Sunday. Times are "HH:MM".
+type OpeningHours struct {
+	Weekday   int    `json:"weekday"`
+	Closed    bool   `json:"closed"`
+	OpenTime  string `json:"open_time,omitempty"`
+	CloseTime string `json:"close_time,omitempty"`
+}
+
+// defaultOpeningHours apply to locations that never had hours configured: Monday to Saturday, 09:00 - 17:00.
+func defaultOpeningHours() []OpeningHours {
+	hours := make([]OpeningHours, 7)
+	for day := range hours {
+		hours[day] = OpeningHours{Weekday: day, OpenTime: "09:00", CloseTime: "17:00"}
+	}
+	hours[time.Sunday] = OpeningHours{Weekday: int(time.Sunday), Closed: true}
+	return hours
+}
+
+type PickupSlot struct {
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Capacity  int       `json:"capacity"`
+	Booked    int       `json:"booked"`
+	Available int       `json:"available"`
+}
+
+type PickupAppointment struct {
+	AppointmentID int        `json:"appointment_id"`
+	LocationID    int        `json:"location_id"`
+	UserID        int        `json:"user_id"`
+	OrderID       *int       `json:"order_id"`
+	SlotStart     time.Time  `json:"slot_start"`
+	SlotEnd       time.Time  `json:"slot_end"`
+	Status        string     `json:"status"`
+	ExpiresAt     *time.Time `json:"expires_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// LocationPickup is a row of the staff pickup list.
+type LocationPickup struct {
+	PickupAppointment
+	MemberName  string   `json:"member_name"`
+	MemberPhone string   `json:"member_phone"`
+	Books       []string `json:"books"`
+}
+
+// parseClock parses an "HH:MM" time into minutes after midnight.
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func GetOpeningHours(locationID int) ([]OpeningHours, error) {
+	rows, err := db.Query("SELECT weekday, open_time, close_time FROM location_hours WHERE location_id = ?", locationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hours := make([]OpeningHours, 7)
+	for day := range hours {
+		hours[day] = OpeningHours{Weekday: day, Closed: true}
+	}
+	configured := false
+	for rows.Next() {
+		var h OpeningHours
+		if err := rows.Scan(&h.Weekday, &h.OpenTime, &h.CloseTime); err != nil {
+			return nil, err
+		}
+		if h.Weekday >= 0 && h.Weekday < 7 {
+			hours[h.Weekday] = h
+			configured = true
+		}
+	}
+	if !configured {
+		return defaultOpeningHours(), nil
+	}
+	return hours, nil
+}
+
+// SetOpeningHours replaces a location's weekly hours. Weekdays left out are closed.
+func SetOpeningHours(locationID int, hours []OpeningHours) error {
+	for _, h := range hours {
+		if h.Weekday < 0 || h.Weekday > 6 {
+			return fmt.Errorf("%w: weekday %d", ErrInvalidOpeningHours, h.Weekday)
+		}
+		if h.Closed {
+			continue
+		}
+		open, err1 := parseClock(h.OpenTime)
+		closing, err2 := parseClock(h.CloseTime)
+		if err1 != nil || err2 != nil || open >= closing {
+			return fmt.Errorf("%w: weekday %d", ErrInvalidOpeningHours, h.Weekday)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM location_hours WHERE location_id = ?", locationID); err != nil {
+		return err
+	}
+	for _, h := range hours {
+		if h.Closed {
+			continue
+		}
+		_, err := tx.Exec("INSERT INTO location_hours (location_id, weekday, open_time, close_time) VALUES (?, ?, ?, ?)",
+			locationID, h.Weekday, h.OpenTime, h.CloseTime)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// openingWindow returns when a location opens and closes on the given day; ok is false when it is closed.
+func openingWindow(locationID int, day time.Time) (open, closing time.Time, ok bool, err error) {
+	hours, err := GetOpeningHours(locationID)
+	if err != nil {
+		return
+	}
+	h := hours[day.Weekday()]
+	if h.Closed {
+		return
+	}
+	holidays, err := holidayDates(locationID, day, day)
+	if err != nil || holidays[day.Format("2006-01-02")] {
+		return
+	}
+	openMin, err := parseClock(h.OpenTime)
+	if err != nil {
+		return
+	}
+	closeMin, err := parseClock(h.CloseTime)
+	if err != nil {
+		return
+	}
+	midnight := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location())
+	return midnight.Add(time.Duration(openMin) * time.Minute), midnight.Add(time.Duration(closeMin) * time.Minute), true, nil
+}
+
+// activeAppointmentsClause matches appointments that take up a slot's capacity.
+const activeAppointmentsClause = `(status IN ('booked', 'collected') OR (status = 'held' AND expires_at > NOW()))`
+
+// GetPickupSlots lists the slots of a day that have not started yet, with how many are taken.
+func GetPickupSlots(locationID int, day time.Time) ([]PickupSlot, error) {
+	var capacity int
+	err := db.QueryRow("SELECT pickup_slot_capacity FROM location WHERE location_id = ?", locationID).Scan(&capacity)
+	if err == sql.ErrNoRows {
+		return nil, ErrLocationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	slots := []PickupSlot{}
+	open, closing, ok, err := openingWindow(locationID, day)
+	if err != nil || !ok {
+		return slots, err
+	}
+
+	rows, err := db.Query(`
+		SELECT slot_start, COUNT(*) FROM pickup_appointment
+		WHERE location_id = ? AND slot_start >= ? AND slot_start < ? AND `+activeAppointmentsClause+`
+		GROUP BY slot_start
+	`, locationID, open, closing)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	booked := map[int64]int{}
+	for rows.Next() {
+		var start time.Time
+		var count int
+		if err := rows.Scan(&start, &count); err != nil {
+			return nil, err
+		}
+		booked[start.Unix()] = count
+	}
+
+	now := time.Now()
+	for start := open; !start.Add(pickupSlotLength).After(closing); start = start.Add(pickupSlotLength) {
+		if !start.After(now) {
+			continue
+		}
+		taken := booked[start.Unix()]
+		available := capacity - taken
+		if available < 0 {
+			available = 0
+		}
+		slots = append(slots, PickupSlot{Start: start, End: start.Add(pickupSlotLength), Capacity: capacity, Booked: taken, Available: available})
+	}
+	return slots, nil
+}
+
+// ReservePickupSlot holds a slot for a member while they finish checkout. A member holds
+// one slot per location at a time, so choosing another releases the previous one.
+func ReservePickupSlot(userID, locationID int, slotStart time.Time) (*PickupAppointment, error) {
+	if err := checkLocationActive(db, locationID); err != nil {
+		return nil, err
+	}
+	slots, err := GetPickupSlots(locationID, slotStart)
+	if err != nil {
+		return nil, err
+	}
+	offered := false
+	for _, slot := range slots {
+		if slot.Start.Equal(slotStart) {
+			offered = true
+		}
+	}
+	if !offered {
+		return nil, ErrPickupSlotUnavailable
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Locking the location serialises reservations so the capacity check cannot race
+	var capacity int
+	err = tx.QueryRow("SELECT pickup_slot_capacity FROM location WHERE location_id = ? FOR UPDATE", locationID).Scan(&capacity)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("UPDATE pickup_appointment SET status = ? WHERE user_id = ? AND location_id = ? AND status = ?",
+		AppointmentStatusCancelled, userID, locationID, AppointmentStatusHeld)
+	if err != nil {
+		return nil, err
+	}
+
+	var taken int
+	err = tx.QueryRow("SELECT COUNT(*) FROM pickup_appointment WHERE location_id = ? AND slot_start = ? AND "+activeAppointmentsClause,
+		locationID, slotStart).Scan(&taken)
+	if err != nil {
+		return nil, err
+	}
+	if taken >= capacity {
+		return nil, ErrPickupSlotFull
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO pickup_appointment (location_id, user_id, slot_start, slot_end, status, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, DATE_ADD(NOW(), INTERVAL ? MINUTE), NOW())
+	`, locationID, userID, slotStart, slotStart.Add(pickupSlotLength), AppointmentStatusHeld, int(pickupHoldDuration.Minutes()))
+	if err != nil {
+		return nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return GetPickupAppointment(int(id))
+}
+
+// confirmPickupAppointmentTx books a held slot for the order created at checkout.
+func confirmPickupAppointmentTx(tx *sql.Tx, appointmentID, userID, locationID, orderID int) error {
+	var owner, location int
+	var status string
+	var expired bool
+	err := tx.QueryRow(`
+		SELECT user_id, location_id, status, COALESCE(expires_at < NOW(), FALSE)
+		FROM pickup_appointment WHERE appointment_id = ? FOR UPDATE
+	`, appointmentID).Scan(&owner, &location, &status, &expired)
+	if err == sql.ErrNoRows {
+		return ErrPickupAppointmentNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if owner != userID || location != locationID || status != AppointmentStatusHeld || expired {
+		return ErrPickupAppointmentStale
+	}
+
+	_, err = tx.Exec("UPDATE pickup_appointment SET status = ?, order_id = ?, expires_at = NULL WHERE appointment_id = ?",
+		AppointmentStatusBooked, orderID, appointmentID)
+	return err
+}
+
+// completePickupAppointmentTx marks the appointment of a borrow's order collected once the book is handed over.
+func completePickupAppointmentTx(tx *sql.Tx, borrowID int) error {
+	_, err := tx.Exec(`
+		UPDATE pickup_appointment SET status = ?
+		WHERE status = ? AND order_id = (SELECT order_id FROM borrow WHERE borrow_id = ?)
+	`, AppointmentStatusCollected, AppointmentStatusBooked, borrowID)
+	return err
+}
+
+// ExpirePickupAppointments frees slots held at checkout but never confirmed, and marks
+// booked pickups nobody came for as missed.
+func ExpirePickupAppointments() (int, error) {
+	held, err := db.Exec("UPDATE pickup_appointment SET status = ? WHERE status = ? AND expires_at < NOW()",
+		AppointmentStatusExpired, AppointmentStatusHeld)
+	if err != nil {
+		return 0, err
+	}
+	missed, err := db.Exec("UPDATE pickup_appointment SET status = ? WHERE status = ? AND slot_end < ?",
+		AppointmentStatusMissed, AppointmentStatusBooked, time.Now().Add(-pickupMissedGrace))
+	if err != nil {
+		return 0, err
+	}
+
+	heldCount, _ := held.RowsAffected()
+	missedCount, _ := missed.RowsAffected()
+	return int(heldCount + missedCount), nil
+}
+
+// CancelPickupAppointment releases a member's held or booked slot.
+func CancelPickupAppointment(appointmentID, userID int) error {
+	result, err := db.Exec(`
+		UPDATE pickup_appointment SET status = ?
+		WHERE appointment_id = ? AND user_id = ? AND status IN (?, ?)
+	`, AppointmentStatusCancelled, appointmentID, userID, AppointmentStatusHeld, AppointmentStatusBooked)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrPickupAppointmentNotFound
+	}
+	return nil
+}
+
+const pickupAppointmentSelect = `
+	SELECT appointment_id, location_id, user_id, order_id, slot_start, slot_end, status, expires_at, created_at
+	FROM pickup_appointment`
+
+func scanPickupAppointment(scanner interface{ Scan(...interface{}) error }) (*PickupAppointment, error) {
+	var a PickupAppointment
+	var orderID sql.NullInt64
+	var expiresAt sql.NullTime
+	err := scanner.Scan(&a.AppointmentID, &a.LocationID, &a.UserID, &orderID, &a.SlotStart, &a.SlotEnd, &a.Status, &expiresAt, &a.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if orderID.Valid {
+		id := int(orderID.Int64)
+		a.OrderID = &id
+	}
+	if expiresAt.Valid {
+		a.ExpiresAt = &expiresAt.Time
+	}
+	return &a, nil
+}
+
+func GetPickupAppointment(appointmentID int) (*PickupAppointment, error) {
+	a, err := scanPickupAppointment(db.QueryRow(pickupAppointmentSelect+" WHERE appointment_id = ?", appointmentID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return a, err
+}
+
+// GetLocationPickups lists the booked and collected pickups of a day, earliest slot first.
+func GetLocationPickups(locationID int, day time.Time) ([]LocationPickup, error) {
+	start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location())
+	rows, err := db.Query(`
+		SELECT a.appointment_id, a.location_id, a.user_id, a.order_id, a.slot_start, a.slot_end, a.status, a.expires_at, a.created_at,
+		       COALESCE(u.name, ''), COALESCE(u.phone, ''),
+		       COALESCE((SELECT GROUP_CONCAT(bk.title ORDER BY b.borrow_id SEPARATOR '\n')
+		                 FROM borrow b JOIN book bk ON b.book_id = bk.book_id
+		                 WHERE b.order_id = a.order_id), '')
+		FROM pickup_appointment a
+		LEFT JOIN user u ON a.user_id = u.user_id
+		WHERE a.location_id = ? AND a.slot_start >= ? AND a.slot_start < ? AND a.status IN (?, ?, ?)
+		ORDER BY a.slot_start, a.appointment_id
+	`, locationID, start, start.AddDate(0, 0, 1), AppointmentStatusBooked, AppointmentStatusCollected, AppointmentStatusMissed)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pickups := []LocationPickup{}
+	for rows.Next() {
+		var p LocationPickup
+		var orderID sql.NullInt64
+		var expiresAt sql.NullTime
+		var titles string
+		err := rows.Scan(&p.AppointmentID, &p.LocationID, &p.UserID, &orderID, &p.SlotStart, &p.SlotEnd, &p.Status, &expiresAt, &p.CreatedAt,
+			&p.MemberName, &p.MemberPhone, &titles)
+		if err != nil {
+			return nil, err
+		}
+		if orderID.Valid {
+			id := int(orderID.Int64)
+			p.OrderID = &id
+		}
+		p.Books = []string{}
+		if titles != "" {
+			p.Books = strings.Split(titles, "\n")
+		}
+		pickups = append(pickups, p)
+	}
+	return pickups, nil
+}
+
+// ============ PICKUP SLOT HANDLERS ============
+
+// parseDayParam reads an optional YYYY-MM-DD "date" query parameter, defaulting to today.
+func parseDayParam(r *http.Request) (time.Time, error) {
+	raw := r.URL.Query().Get("date")
+	if raw == "" {
+		return time.Now(), nil
+	}
+	return time.ParseInLocation("2006-01-02", raw, time.Local)
+}
+
+func writePickupSlotError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, ErrLocationNotFound), errors.Is(err, ErrPickupAppointmentNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrInvalidOpeningHours), errors.Is(err, ErrPickupSlotUnavailable):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrPickupSlotFull), errors.Is(err, ErrPickupAppointmentStale), errors.Is(err, ErrLocationArchived):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, fallback, http.StatusInternalServerError)
+	}
+}
+
+func getOpeningHours(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	locationID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid location ID", http.StatusBadRequest)
+		return
+	}
+
+	hours, err := GetOpeningHours(locationID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hours)
+}
+
+func updateOpeningHours(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	locationID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid location ID", http.StatusBadRequest)
+		return
+	}
+	if !requireLocationManager(w, r, locationID) {
+		return
+	}
+
+	var hours []OpeningHours
+	if err := json.NewDecoder(r.Body).Decode(&hours); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	location, err := GetLocationByID(locationID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if location == nil {
+		http.Error(w, "Location not found", http.StatusNotFound)
+		return
+	}
+
+	if err := SetOpeningHours(locationID, hours); err != nil {
+		writePickupSlotError(w, err, "Failed to update opening hours")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Opening hours updated successfully",
+	})
+}
+
+func getPickupSlots(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	locationID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid location ID", http.StatusBadRequest)
+		return
+	}
+	day, err := parseDayParam(r)
+	if err != nil {
+		http.Error(w, "Invalid date", http.StatusBadRequest)
+		return
+	}
+
+	slots, err := GetPickupSlots(locationID, day)
+	if err != nil {
+		writePickupSlotError(w, err, "Failed to load pickup slots")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(slots)
+}
+
+func reservePickupSlot(w http.ResponseWriter, r *http.Request) {
+	userID := actingUserID(r)
+	if userID == 0 {
+		http.Error(w, "Missing user identity", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	locationID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid location ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		SlotStart time.Time `json:"slot_start"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SlotStart.IsZero() {
+		http.Error(w, "slot_start is required", http.StatusBadRequest)
+		return
+	}
+
+	appointment, err := ReservePickupSlot(userID, locationID, req.SlotStart.In(time.Local))
+	if err != nil {
+		writePickupSlotError(w, err, "Failed to reserve pickup slot")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(appointment)
+}
+
+func cancelPickupAppointment(w http.ResponseWriter, r *http.Request) {
+	userID := actingUserID(r)
+	if userID == 0 {
+		http.Error(w, "Missing user identity", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	appointmentID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid appointment ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := CancelPickupAppointment(appointmentID, userID); err != nil {
+		writePickupSlotError(w, err, "Failed to cancel pickup appointment")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Pickup appointment cancelled",
+	})
+}
+
+// getLocationPickups is the staff view of a location's pickups, today unless ?date= is given.
+func getLocationPickups(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	locationID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid location ID", http.StatusBadRequest)
+		return
+	}
+	if !requireLocationManager(w, r, locationID) {
+		return
+	}
+	day, err := parseDayParam(r)
+	if err != nil {
+		http.Error(w, "Invalid date", http.StatusBadRequest)
+		return
+	}
+
+	pickups, err := GetLocationPickups(locationID, day)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pickups)
+}
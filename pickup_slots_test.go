@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseClock(t *testing.T) {
+	if got, err := parseClock("09:30"); err != nil || got != 570 {
+		t.Errorf("parseClock(09:30) = %d, %v; want 570", got, err)
+	}
+	if _, err := parseClock("9.30"); err == nil {
+		t.Error("parseClock accepted 9.30")
+	}
+}
+
+func TestSetOpeningHoursValidates(t *testing.T) {
+	tests := []struct {
+		name  string
+		hours []OpeningHours
+	}{
+		{"unknown weekday", []OpeningHours{{Weekday: 7, OpenTime: "09:00", CloseTime: "17:00"}}},
+		{"closes before opening", []OpeningHours{{Weekday: 1, OpenTime: "17:00", CloseTime: "09:00"}}},
+		{"unreadable time", []OpeningHours{{Weekday: 1, OpenTime: "nine", CloseTime: "17:00"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t, nil)
+			if err := SetOpeningHours(2, tt.hours); !errors.Is(err, ErrInvalidOpeningHours) {
+				t.Fatalf("SetOpeningHours = %v, want %v", err, ErrInvalidOpeningHours)
+			}
+			if len(fake.Statements()) != 0 {
+				t.Error("invalid hours reached the database")
+			}
+		})
+	}
+}
+
+func TestSetOpeningHoursStoresOpenDays(t *testing.T) {
+	fake := useFakeDB(t, nil)
+
+	err := SetOpeningHours(2, []OpeningHours{
+		{Weekday: 1, OpenTime: "09:00", CloseTime: "17:00"},
+		{Weekday: 0, Closed: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.Find("DELETE FROM location_hours")) != 1 || len(fake.Find("INSERT INTO location_hours")) != 1 {
+		t.Errorf("statements = %+v, want the week replaced by one open day", fake.Statements())
+	}
+}
+
+func TestGetOpeningHoursDefaults(t *testing.T) {
+	useFakeDB(t, nil)
+
+	hours, err := GetOpeningHours(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hours[time.Sunday].Closed || hours[time.Monday].Closed || hours[time.Monday].OpenTime != "09:00" {
+		t.Errorf("hours = %+v, want the default Monday to Saturday week", hours)
+	}
+}
+
+// slotsResponder answers GetPickupSlots for a location with two pickups per slot, default hours
+// and one appointment at the given time.
+func slotsResponder(bookedAt time.Time) fakeResponder {
+	return func(query string, args []driver.Value) (*fakeRows, error) {
+		switch {
+		case strings.Contains(query, "SELECT pickup_slot_capacity FROM location"):
+			return fakeRow(int64(2)), nil
+		case strings.Contains(query, "SELECT slot_start, COUNT(*) FROM pickup_appointment"):
+			return fakeRow(bookedAt, int64(1)), nil
+		}
+		return nil, nil
+	}
+}
+
+func TestGetPickupSlots(t *testing.T) {
+	monday := time.Date(2030, 1, 7, 0, 0, 0, 0, time.Local)
+	useFakeDB(t, slotsResponder(monday.Add(10*time.Hour)))
+
+	slots, err := GetPickupSlots(2, monday)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Hourly slots from 09:00 to 17:00
+	if len(slots) != 8 {
+		t.Fatalf("got %d slots, want 8", len(slots))
+	}
+	if !slots[0].Start.Equal(monday.Add(9*time.Hour)) || !slots[7].End.Equal(monday.Add(17*time.Hour)) {
+		t.Errorf("slots run %v to %v, want 09:00 to 17:00", slots[0].Start, slots[7].End)
+	}
+	if slots[1].Booked != 1 || slots[1].Available != 1 || slots[0].Available != 2 {
+		t.Errorf("10:00 slot %+v and 09:00 slot %+v, want one and two places left", slots[1], slots[0])
+	}
+
+	sunday := monday.AddDate(0, 0, -1)
+	slots, err = GetPickupSlots(2, sunday)
+	if err != nil || len(slots) != 0 {
+		t.Errorf("Sunday slots = %v, %v; want none", slots, err)
+	}
+}
+
+func TestConfirmPickupAppointment(t *testing.T) {
+	tests := []struct {
+		name     string
+		owner    int64
+		location int64
+		status   string
+		expired  bool
+		want     error
+	}{
+		{"held by the member", 5, 2, AppointmentStatusHeld, false, nil},
+		{"another member's", 6, 2, AppointmentStatusHeld, false, ErrPickupAppointmentStale},
+		{"another location", 5, 3, AppointmentStatusHeld, false, ErrPickupAppointmentStale},
+		{"already booked", 5, 2, AppointmentStatusBooked, false, ErrPickupAppointmentStale},
+		{"hold expired", 5, 2, AppointmentStatusHeld, true, ErrPickupAppointmentStale},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+				if strings.Contains(query, "FROM pickup_appointment WHERE appointment_id = ? FOR UPDATE") {
+					return fakeRow(tt.owner, tt.location, tt.status, tt.expired), nil
+				}
+				return nil, nil
+			})
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+
+			if err := confirmPickupAppointmentTx(tx, 8, 5, 2, 4); !errors.Is(err, tt.want) {
+				t.Fatalf("confirmPickupAppointmentTx = %v, want %v", err, tt.want)
+			}
+			booked := len(fake.Find("UPDATE pickup_appointment SET status = ?, order_id = ?")) == 1
+			if booked != (tt.want == nil) {
+				t.Errorf("appointment booked = %v", booked)
+			}
+		})
+	}
+}
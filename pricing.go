@@ -0,0 +1,498 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// ============ PRICING ENGINE ============
+
+const (
+	PricingRentalFee   = "rental_fee"
+	PricingDeliveryFee = "delivery_fee"
+	PricingInsurance   = "insurance"
+	PricingTax         = "tax"
+	PricingDeposit     = "deposit"
+)
+
+// defaultPricing mirrors the prices checkout.html used to compute in the browser.
+// Admin-defined rules take precedence over these.
+var defaultPricing = map[string]float64{
+	PricingRentalFee:   40000,
+	PricingDeliveryFee: 23000,
+	PricingInsurance:   200,
+	PricingTax:         0.10,
+	PricingDeposit:     0, // refundable deposits are off until an admin adds a deposit rule
+}
+
+var ErrQuoteBookNotFound = errors.New("book not found")
+
+// PricingRule is an admin-configurable price. Amount is used by fees, Rate by tax.
+// CategoryID narrows a rental fee to one category, DeliveryType narrows a delivery fee to one method.
+type PricingRule struct {
+	RuleID       int     `json:"rule_id"`
+	Kind         string  `json:"kind"`
+	CategoryID   *int    `json:"category_id"`
+	DeliveryType *string `json:"delivery_type"`
+	Amount       float64 `json:"amount"`
+	Rate         float64 `json:"rate"`
+	Active       bool    `json:"active"`
+}
+
+type QuoteRequest struct {
+	UserID       int    `json:"user_id"`
+	BookIDs      []int  `json:"book_ids"`
+	DeliveryType string `json:"delivery_type"`
+	Insurance    bool   `json:"insurance"`
+	LocationID   int    `json:"location_id"`
+	VoucherCode  string `json:"voucher_code"`
+
+	// DeliveryService picks one of the delivery options. The destination is the geocoded delivery
+	// address, or the member's profile address when none is given.
+	DeliveryService string `json:"delivery_service"`
+	DeliveryAddress string `json:"delivery_address"`
+}
+
+type QuoteLine struct {
+	Code        string  `json:"code"`
+	Description string  `json:"description"`
+	BookID      *int    `json:"book_id,omitempty"`
+	Quantity    int     `json:"quantity"`
+	UnitPrice   float64 `json:"unit_price"`
+	Amount      float64 `json:"amount"`
+}
+
+type Quote struct {
+	DeliveryType    string           `json:"delivery_type"`
+	DeliveryService string           `json:"delivery_service,omitempty"`
+	DeliveryOptions []DeliveryOption `json:"delivery_options,omitempty"`
+	Lines           []QuoteLine      `json:"lines"`
+	Subtotal        float64          `json:"subtotal"`
+	Tax             float64          `json:"tax"`
+	Deposit         float64          `json:"deposit"`
+	Discount        float64          `json:"discount"`
+	VoucherCode     string           `json:"voucher_code,omitempty"`
+	VoucherID       int              `json:"-"`
+	// DiscountedRentals is the rental of each book the voucher applied to, by book ID.
+	DiscountedRentals map[int]float64 `json:"-"`
+	Total             float64         `json:"total"`
+}
+
+func roundRupiah(amount float64) float64 {
+	return math.Round(amount)
+}
+
+func scanPricingRules(rows *sql.Rows) ([]PricingRule, error) {
+	rules := []PricingRule{}
+	for rows.Next() {
+		var rule PricingRule
+		var categoryID sql.NullInt64
+		var deliveryType sql.NullString
+		if err := rows.Scan(&rule.RuleID, &rule.Kind, &categoryID, &deliveryType, &rule.Amount, &rule.Rate, &rule.Active); err != nil {
+			return nil, err
+		}
+		if categoryID.Valid {
+			id := int(categoryID.Int64)
+			rule.CategoryID = &id
+		}
+		if deliveryType.Valid {
+			rule.DeliveryType = &deliveryType.String
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func GetPricingRules() ([]PricingRule, error) {
+	rows, err := db.Query("SELECT rule_id, kind, category_id, delivery_type, amount, rate, active FROM pricing_rule ORDER BY kind, rule_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanPricingRules(rows)
+}
+
+func CreatePricingRule(rule PricingRule) (int, error) {
+	result, err := db.Exec(`
+		INSERT INTO pricing_rule (kind, category_id, delivery_type, amount, rate, active)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, rule.Kind, rule.CategoryID, rule.DeliveryType, rule.Amount, rule.Rate, rule.Active)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+func PricingRuleExists(ruleID int) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM pricing_rule WHERE rule_id = ?", ruleID).Scan(&count)
+	return count > 0, err
+}
+
+func UpdatePricingRule(rule PricingRule) error {
+	_, err := db.Exec(`
+		UPDATE pricing_rule SET kind = ?, category_id = ?, delivery_type = ?, amount = ?, rate = ?, active = ?
+		WHERE rule_id = ?
+	`, rule.Kind, rule.CategoryID, rule.DeliveryType, rule.Amount, rule.Rate, rule.Active, rule.RuleID)
+	return err
+}
+
+func DeletePricingRule(ruleID int) error {
+	_, err := db.Exec("DELETE FROM pricing_rule WHERE rule_id = ?", ruleID)
+	return err
+}
+
+// priceFor returns the value of the most specific active rule of a kind, falling back to defaultPricing.
+func priceFor(kind string, categoryID int, deliveryType string) (float64, error) {
+	var amount, rate float64
+	err := db.QueryRow(`
+		SELECT amount, rate FROM pricing_rule
+		WHERE kind = ? AND active = TRUE
+		  AND (category_id IS NULL OR category_id = ?)
+		  AND (delivery_type IS NULL OR delivery_type = ?)
+		ORDER BY (category_id IS NOT NULL) + (delivery_type IS NOT NULL) DESC, rule_id DESC
+		LIMIT 1
+	`, kind, nullableID(categoryID), deliveryType).Scan(&amount, &rate)
+	if err == sql.ErrNoRows {
+		return defaultPricing[kind], nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if kind == PricingTax {
+		return rate, nil
+	}
+	return amount, nil
+}
+
+// BuildQuote prices a checkout: one rental line per book, then delivery, insurance and tax on the rental subtotal.
+func BuildQuote(req QuoteRequest) (*Quote, error) {
+	quote := &Quote{DeliveryType: req.DeliveryType, Lines: []QuoteLine{}}
+	bookCategories := map[int]int{}
+
+	for _, bookID := range req.BookIDs {
+		book, err := GetBookByID(bookID)
+		if err != nil {
+			return nil, err
+		}
+		if book == nil {
+			return nil, fmt.Errorf("%w: %d", ErrQuoteBookNotFound, bookID)
+		}
+
+		fee, err := priceFor(PricingRentalFee, book.CategoryID, "")
+		if err != nil {
+			return nil, err
+		}
+		id := bookID
+		bookCategories[bookID] = book.CategoryID
+		quote.Lines = append(quote.Lines, QuoteLine{
+			Code:        PricingRentalFee,
+			Description: "Rental: " + book.Title,
+			BookID:      &id,
+			Quantity:    1,
+			UnitPrice:   fee,
+			Amount:      fee,
+		})
+		quote.Subtotal += fee
+
+		deposit, err := priceFor(PricingDeposit, book.CategoryID, "")
+		if err != nil {
+			return nil, err
+		}
+		if deposit > 0 {
+			quote.Lines = append(quote.Lines, QuoteLine{
+				Code:        PricingDeposit,
+				Description: "Refundable deposit: " + book.Title,
+				BookID:      &id,
+				Quantity:    1,
+				UnitPrice:   deposit,
+				Amount:      deposit,
+			})
+			quote.Deposit += deposit
+		}
+	}
+
+	if req.VoucherCode != "" {
+		if err := applyVoucher(quote, req, bookCategories); err != nil {
+			return nil, err
+		}
+	}
+
+	if req.DeliveryType == "delivery" {
+		option, options, err := deliveryOptionForQuote(req)
+		if err != nil {
+			return nil, err
+		}
+		if option != nil {
+			quote.DeliveryService = option.Service
+			quote.DeliveryOptions = options
+			quote.Lines = append(quote.Lines, QuoteLine{
+				Code:        PricingDeliveryFee,
+				Description: fmt.Sprintf("Delivery: %s (%.1f km)", option.Label, option.DistanceKm),
+				Quantity:    1,
+				UnitPrice:   option.Fee,
+				Amount:      option.Fee,
+			})
+		} else {
+			// A location without coordinates or service area charges the flat delivery fee
+			fee, err := priceFor(PricingDeliveryFee, 0, req.DeliveryType)
+			if err != nil {
+				return nil, err
+			}
+			quote.Lines = append(quote.Lines, QuoteLine{Code: PricingDeliveryFee, Description: "Delivery", Quantity: 1, UnitPrice: fee, Amount: fee})
+		}
+
+		if req.Insurance {
+			insurance, err := priceFor(PricingInsurance, 0, req.DeliveryType)
+			if err != nil {
+				return nil, err
+			}
+			quote.Lines = append(quote.Lines, QuoteLine{Code: PricingInsurance, Description: "Shipping insurance", Quantity: 1, UnitPrice: insurance, Amount: insurance})
+		}
+	}
+
+	rate, err := priceFor(PricingTax, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	quote.Tax = roundRupiah((quote.Subtotal - quote.Discount) * rate)
+	quote.Lines = append(quote.Lines, QuoteLine{
+		Code:        PricingTax,
+		Description: fmt.Sprintf("Tax (%g%%)", rate*100),
+		Quantity:    1,
+		UnitPrice:   quote.Tax,
+		Amount:      quote.Tax,
+	})
+
+	for _, line := range quote.Lines {
+		quote.Total += line.Amount
+	}
+	quote.Total = roundRupiah(quote.Total)
+	return quote, nil
+}
+
+// saveBorrowLineItemsTx stores the quote a borrow was created from.
+func saveBorrowLineItemsTx(tx *sql.Tx, borrowID int, quote *Quote) error {
+	for _, line := range quote.Lines {
+		var bookID interface{}
+		if line.BookID != nil {
+			bookID = *line.BookID
+		}
+		_, err := tx.Exec(`
+			INSERT INTO borrow_line_item (borrow_id, code, description, book_id, quantity, unit_price, amount)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, borrowID, line.Code, line.Description, bookID, line.Quantity, line.UnitPrice, line.Amount)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func GetBorrowLineItems(borrowID int) ([]QuoteLine, error) {
+	return borrowLineItems(db, borrowID)
+}
+
+func borrowLineItems(ex execer, borrowID int) ([]QuoteLine, error) {
+	rows, err := ex.Query(`
+		SELECT code, description, book_id, quantity, unit_price, amount
+		FROM borrow_line_item WHERE borrow_id = ? ORDER BY line_id
+	`, borrowID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lines := []QuoteLine{}
+	for rows.Next() {
+		var line QuoteLine
+		var bookID sql.NullInt64
+		if err := rows.Scan(&line.Code, &line.Description, &bookID, &line.Quantity, &line.UnitPrice, &line.Amount); err != nil {
+			return nil, err
+		}
+		if bookID.Valid {
+			id := int(bookID.Int64)
+			line.BookID = &id
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// ============ PRICING HANDLERS ============
+
+func createCheckoutQuote(w http.ResponseWriter, r *http.Request) {
+	var req QuoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if len(req.BookIDs) == 0 {
+		http.Error(w, "At least one book is required", http.StatusBadRequest)
+		return
+	}
+
+	quote, err := BuildQuote(req)
+	if errors.Is(err, ErrQuoteBookNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrVoucherInvalid) || errors.Is(err, ErrOutsideServiceArea) || errors.Is(err, ErrDeliveryServiceUnavailable) ||
+		errors.Is(err, ErrDeliveryAddressUnknown) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to build quote", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(quote)
+}
+
+func getBorrowLineItems(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	borrowID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid borrow ID", http.StatusBadRequest)
+		return
+	}
+
+	lines, err := GetBorrowLineItems(borrowID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lines)
+}
+
+func getPricingRules(w http.ResponseWriter, r *http.Request) {
+	rules, err := GetPricingRules()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+// validatePricingRule returns an error message for an unusable rule, or an empty string.
+func validatePricingRule(rule PricingRule) string {
+	if _, ok := defaultPricing[rule.Kind]; !ok {
+		return "Unknown pricing rule kind"
+	}
+	if rule.Amount < 0 || rule.Rate < 0 || rule.Rate > 1 {
+		return "Amount must be positive and rate between 0 and 1"
+	}
+	return ""
+}
+
+func createPricingRule(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var rule PricingRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if msg := validatePricingRule(rule); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	ruleID, err := CreatePricingRule(rule)
+	if err != nil {
+		http.Error(w, "Failed to create pricing rule", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Pricing rule created successfully",
+		"rule_id": ruleID,
+	})
+}
+
+func updatePricingRule(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	ruleID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid rule ID", http.StatusBadRequest)
+		return
+	}
+
+	var rule PricingRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	rule.RuleID = ruleID
+	if msg := validatePricingRule(rule); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	found, err := PricingRuleExists(ruleID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Pricing rule not found", http.StatusNotFound)
+		return
+	}
+
+	if err := UpdatePricingRule(rule); err != nil {
+		http.Error(w, "Failed to update pricing rule", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Pricing rule updated successfully",
+	})
+}
+
+func deletePricingRule(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	ruleID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid rule ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := DeletePricingRule(ruleID); err != nil {
+		http.Error(w, "Failed to delete pricing rule", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Pricing rule deleted successfully",
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// pricingResponder answers BuildQuote for books 7 and 8 in category 2, with the given rental
+// fee rule for that category, or the defaults when it is zero.
+func pricingResponder(categoryRental float64) fakeResponder {
+	return func(query string, args []driver.Value) (*fakeRows, error) {
+		switch {
+		case strings.Contains(query, "FROM book b LEFT JOIN category c"):
+			id := args[0].(int64)
+			if id != 7 && id != 8 {
+				return nil, nil
+			}
+			return fakeRow(id, "Title", "Author", "", int64(2020), "", int64(2), "Fiction", int64(0),
+				"", "", "", "", "", "", "approved", int64(0)), nil
+		case strings.Contains(query, "FROM pricing_rule"):
+			if categoryRental > 0 && args[0] == PricingRentalFee && args[1] == int64(2) {
+				return fakeRow(categoryRental, 0.0), nil
+			}
+		}
+		return nil, nil
+	}
+}
+
+func TestBuildQuoteWithDefaultPrices(t *testing.T) {
+	useFakeDB(t, pricingResponder(0))
+
+	quote, err := BuildQuote(QuoteRequest{UserID: 5, BookIDs: []int{7, 8}, DeliveryType: "pickup"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quote.Subtotal != 80000 || quote.Tax != 8000 || quote.Total != 88000 {
+		t.Errorf("subtotal %v, tax %v, total %v; want 80000, 8000, 88000", quote.Subtotal, quote.Tax, quote.Total)
+	}
+	if got := lineTotal(quote, PricingDeliveryFee); got != 0 {
+		t.Errorf("pickup was charged %v for delivery", got)
+	}
+}
+
+func TestBuildQuoteUsesCategoryRules(t *testing.T) {
+	useFakeDB(t, pricingResponder(25000))
+
+	quote, err := BuildQuote(QuoteRequest{UserID: 5, BookIDs: []int{7}, DeliveryType: "delivery", Insurance: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lineTotal(quote, PricingRentalFee); got != 25000 {
+		t.Errorf("rental = %v, want the category rule's 25000", got)
+	}
+	// Without delivery tiers the flat default delivery fee applies
+	if got := lineTotal(quote, PricingDeliveryFee); got != 23000 {
+		t.Errorf("delivery = %v, want 23000", got)
+	}
+	if got := lineTotal(quote, PricingInsurance); got != 200 {
+		t.Errorf("insurance = %v, want 200", got)
+	}
+	// Tax only applies to the rental
+	if quote.Tax != 2500 || quote.Total != 25000+23000+200+2500 {
+		t.Errorf("tax %v, total %v; want 2500, 50700", quote.Tax, quote.Total)
+	}
+}
+
+func TestBuildQuoteUnknownBook(t *testing.T) {
+	useFakeDB(t, pricingResponder(0))
+
+	if _, err := BuildQuote(QuoteRequest{BookIDs: []int{7, 99}}); !errors.Is(err, ErrQuoteBookNotFound) {
+		t.Fatalf("BuildQuote = %v, want %v", err, ErrQuoteBookNotFound)
+	}
+}
+
+func TestValidatePricingRule(t *testing.T) {
+	tests := []struct {
+		rule PricingRule
+		want bool
+	}{
+		{PricingRule{Kind: PricingRentalFee, Amount: 30000}, true},
+		{PricingRule{Kind: PricingTax, Rate: 0.11}, true},
+		{PricingRule{Kind: "surcharge", Amount: 1000}, false},
+		{PricingRule{Kind: PricingDeliveryFee, Amount: -1}, false},
+		{PricingRule{Kind: PricingTax, Rate: 11}, false},
+	}
+	for _, tt := range tests {
+		if got := validatePricingRule(tt.rule) == ""; got != tt.want {
+			t.Errorf("validatePricingRule(%+v) valid = %v, want %v", tt.rule, got, tt.want)
+		}
+	}
+}
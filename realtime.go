@@ -0,0 +1,358 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ============ REAL-TIME EVENTS ============
+
+// Events are written to realtime_event inside the transaction that causes them, and a single
+// dispatcher fans them out to the open streams. Auto-increment IDs are handed out at insert but
+// transactions commit in any order, so the dispatcher numbers each event with a seq once it can
+// see it and streams resume by that number. Only committed changes are ever pushed, and a client
+// that reconnects with Last-Event-ID is replayed what it missed straight from the table.
+const (
+	AudienceUser   = "user"
+	AudienceAdmins = "admins"
+)
+
+const (
+	RealtimeNotification        = "notification"
+	RealtimeBookPending         = "book.pending"
+	RealtimeBookStatusChanged   = "book.status_changed"
+	RealtimeBorrowCreated       = "borrow.created"
+	RealtimeBorrowStatusChanged = "borrow.status_changed"
+	RealtimeModerationClaim     = "moderation.claim_changed"
+)
+
+const (
+	// realtimePollInterval is how often the dispatcher looks for new events.
+	realtimePollInterval = time.Second
+	// realtimeHeartbeat keeps idle streams from being closed by proxies.
+	realtimeHeartbeat = 25 * time.Second
+	// realtimeRetention is how far back a reconnecting client can resume from.
+	realtimeRetention = 24 * time.Hour
+	// realtimeBuffer is how many events a slow stream may fall behind before it is dropped;
+	// the browser then reconnects and catches up from the table.
+	realtimeBuffer = 32
+	// realtimeBatch caps how many events are read per poll or replay.
+	realtimeBatch = 500
+)
+
+// RealtimeEvent is a dispatched event; EventID is its seq, the position in the stream.
+type RealtimeEvent struct {
+	EventID  int64
+	Audience string
+	UserID   int
+	Type     string
+	Payload  json.RawMessage
+}
+
+// emitEvent records an event for one user or, with AudienceAdmins, for every admin.
+func emitEvent(ex execer, audience string, userID int, eventType string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = ex.Exec(`
+		INSERT INTO realtime_event (audience, user_id, event_type, payload, created_at)
+		VALUES (?, ?, ?, ?, NOW())
+	`, audience, nullableID(userID), eventType, string(data))
+	return err
+}
+
+// emitBorrowStatusTx tells the borrower and the admins that a borrow changed status.
+func emitBorrowStatusTx(tx *sql.Tx, borrowID int, from, to string) error {
+	var userID, bookID int
+	err := tx.QueryRow("SELECT user_id, book_id FROM borrow WHERE borrow_id = ?", borrowID).Scan(&userID, &bookID)
+	if err != nil {
+		return err
+	}
+
+	eventType := RealtimeBorrowStatusChanged
+	if from == "" {
+		eventType = RealtimeBorrowCreated
+	}
+	payload := map[string]interface{}{"borrow_id": borrowID, "book_id": bookID, "from": from, "to": to}
+	if err := emitEvent(tx, AudienceUser, userID, eventType, payload); err != nil {
+		return err
+	}
+	return emitEvent(tx, AudienceAdmins, 0, eventType, payload)
+}
+
+// PurgeRealtimeEvents deletes events older than the resume window.
+func PurgeRealtimeEvents() (int, error) {
+	result, err := db.Exec("DELETE FROM realtime_event WHERE created_at < ?", time.Now().Add(-realtimeRetention))
+	if err != nil {
+		return 0, err
+	}
+	affected, err := result.RowsAffected()
+	return int(affected), err
+}
+
+func scanRealtimeEvents(rows *sql.Rows) ([]RealtimeEvent, error) {
+	defer rows.Close()
+	var events []RealtimeEvent
+	for rows.Next() {
+		var e RealtimeEvent
+		var payload string
+		if err := rows.Scan(&e.EventID, &e.Audience, &e.UserID, &e.Type, &payload); err != nil {
+			return nil, err
+		}
+		e.Payload = json.RawMessage(payload)
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// realtimeEventsSince returns the dispatched events after seq afterID that a user may see.
+func realtimeEventsSince(afterID int64, userID int, admin bool) ([]RealtimeEvent, error) {
+	rows, err := db.Query(`
+		SELECT seq, audience, COALESCE(user_id, 0), event_type, payload FROM realtime_event
+		WHERE seq > ? AND ((audience = ? AND user_id = ?) OR (audience = ? AND ?))
+		ORDER BY seq LIMIT ?
+	`, afterID, AudienceUser, userID, AudienceAdmins, admin, realtimeBatch)
+	if err != nil {
+		return nil, err
+	}
+	return scanRealtimeEvents(rows)
+}
+
+// ============ REAL-TIME HUB ============
+
+type realtimeSubscriber struct {
+	userID int
+	admin  bool
+	events chan RealtimeEvent
+	// dropped is closed when the hub gives up on a subscriber that fell too far behind.
+	dropped chan struct{}
+}
+
+func (s *realtimeSubscriber) wants(e RealtimeEvent) bool {
+	switch e.Audience {
+	case AudienceUser:
+		return e.UserID == s.userID
+	case AudienceAdmins:
+		return s.admin
+	}
+	return false
+}
+
+// RealtimeHub fans dispatched events out to the open streams. Idle streams cost one parked
+// goroutine and a small buffered channel each, so thousands of them are cheap.
+type RealtimeHub struct {
+	mu          sync.RWMutex
+	subscribers map[*realtimeSubscriber]struct{}
+	lastID      int64
+}
+
+var realtimeHub = &RealtimeHub{subscribers: map[*realtimeSubscriber]struct{}{}}
+
+func (h *RealtimeHub) subscribe(userID int, admin bool) (*realtimeSubscriber, int64) {
+	s := &realtimeSubscriber{
+		userID:  userID,
+		admin:   admin,
+		events:  make(chan RealtimeEvent, realtimeBuffer),
+		dropped: make(chan struct{}),
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subscribers[s] = struct{}{}
+	return s, h.lastID
+}
+
+func (h *RealtimeHub) unsubscribe(s *realtimeSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subscribers[s]; ok {
+		delete(h.subscribers, s)
+		close(s.dropped)
+	}
+}
+
+func (h *RealtimeHub) broadcast(events []RealtimeEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, e := range events {
+		for s := range h.subscribers {
+			if !s.wants(e) {
+				continue
+			}
+			select {
+			case s.events <- e:
+			default:
+				delete(h.subscribers, s)
+				close(s.dropped)
+			}
+		}
+		h.lastID = e.EventID
+	}
+}
+
+// sequenceEvents numbers the committed events that have no seq yet, after lastSeq, and returns
+// them in their new order. A plain read never sees uncommitted rows, so an event whose
+// transaction is still open is simply numbered on a later poll.
+func sequenceEvents(lastSeq int64) ([]RealtimeEvent, error) {
+	rows, err := db.Query(`
+		SELECT event_id, audience, COALESCE(user_id, 0), event_type, payload FROM realtime_event
+		WHERE seq IS NULL ORDER BY event_id LIMIT ?
+	`, realtimeBatch)
+	if err != nil {
+		return nil, err
+	}
+	events, err := scanRealtimeEvents(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range events {
+		seq := lastSeq + 1
+		if _, err := db.Exec("UPDATE realtime_event SET seq = ? WHERE event_id = ?", seq, events[i].EventID); err != nil {
+			return events[:i], err
+		}
+		events[i].EventID = seq
+		lastSeq = seq
+	}
+	return events, nil
+}
+
+// Run numbers and broadcasts newly committed events until the process exits.
+func (h *RealtimeHub) Run() {
+	// With nothing numbered yet, continue above every ID ever handed out so that no stream
+	// resuming from an older position skips new events
+	var lastSeq sql.NullInt64
+	err := db.QueryRow(`
+		SELECT COALESCE(MAX(seq), (
+			SELECT AUTO_INCREMENT - 1 FROM information_schema.TABLES
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'realtime_event'
+		), 0) FROM realtime_event
+	`).Scan(&lastSeq)
+	if err != nil {
+		log.Printf("Real-time hub could not read the last event: %v", err)
+	}
+	h.mu.Lock()
+	h.lastID = lastSeq.Int64
+	h.mu.Unlock()
+
+	ticker := time.NewTicker(realtimePollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.mu.RLock()
+		after := h.lastID
+		h.mu.RUnlock()
+
+		events, err := sequenceEvents(after)
+		if err != nil {
+			log.Printf("Real-time hub poll failed: %v", err)
+		}
+		if len(events) > 0 {
+			h.broadcast(events)
+		}
+	}
+}
+
+// ============ REAL-TIME HANDLERS ============
+
+func writeRealtimeEvent(w http.ResponseWriter, e RealtimeEvent) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.EventID, e.Type, e.Payload)
+	return err
+}
+
+// streamEvents is a Server-Sent Events stream of the caller's events. Browsers pass the user
+// as ?user_id= since EventSource cannot set headers, and resume with the Last-Event-ID header.
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	userID := requireUser(w, r)
+	if userID == 0 {
+		return
+	}
+	user, err := GetUserByID(userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if user == nil {
+		http.Error(w, "User not found", http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	resumeFrom, _ := strconv.ParseInt(lastEventID, 10, 64)
+
+	// Subscribe before replaying so nothing dispatched in between is lost; the replay
+	// position then filters out anything delivered twice.
+	sub, hubPosition := realtimeHub.subscribe(userID, user.Role == "admin")
+	defer realtimeHub.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintf(w, "retry: 3000\n\n")
+
+	delivered := hubPosition
+	if resumeFrom > 0 {
+		delivered = resumeFrom
+		for delivered < hubPosition {
+			missed, err := realtimeEventsSince(delivered, userID, sub.admin)
+			if err != nil {
+				return
+			}
+			if len(missed) == 0 {
+				break
+			}
+			for _, e := range missed {
+				if e.EventID > hubPosition {
+					break
+				}
+				if writeRealtimeEvent(w, e) != nil {
+					return
+				}
+				delivered = e.EventID
+			}
+			if len(missed) < realtimeBatch {
+				break
+			}
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(realtimeHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-sub.dropped:
+			return
+		case e := <-sub.events:
+			if e.EventID <= delivered {
+				continue
+			}
+			if writeRealtimeEvent(w, e) != nil {
+				return
+			}
+			delivered = e.EventID
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprintf(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
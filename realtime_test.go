@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEmitBorrowStatus(t *testing.T) {
+	tests := []struct {
+		from string
+		want string
+	}{
+		{"", RealtimeBorrowCreated},
+		{BorrowStatusRequested, RealtimeBorrowStatusChanged},
+	}
+	for _, tt := range tests {
+		fake := useFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+			if strings.Contains(query, "SELECT user_id, book_id FROM borrow") {
+				return fakeRow(int64(3), int64(7)), nil
+			}
+			return nil, nil
+		})
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := emitBorrowStatusTx(tx, 9, tt.from, BorrowStatusApproved); err != nil {
+			t.Fatal(err)
+		}
+		tx.Commit()
+
+		emitted := fake.Find("INSERT INTO realtime_event")
+		if len(emitted) != 2 {
+			t.Fatalf("from %q emitted %d events, want one for the borrower and one for admins", tt.from, len(emitted))
+		}
+		if emitted[0].Args[0] != AudienceUser || emitted[0].Args[1] != int64(3) || emitted[1].Args[0] != AudienceAdmins || emitted[1].Args[1] != nil {
+			t.Errorf("audiences %v and %v, want user 3 then admins", emitted[0].Args[:2], emitted[1].Args[:2])
+		}
+		for _, e := range emitted {
+			if e.Args[2] != tt.want || !e.InTx {
+				t.Errorf("from %q emitted %v (in tx %v), want %s inside the transaction", tt.from, e.Args[2], e.InTx, tt.want)
+			}
+		}
+	}
+}
+
+func TestRealtimeHubBroadcast(t *testing.T) {
+	hub := &RealtimeHub{subscribers: map[*realtimeSubscriber]struct{}{}}
+	member, _ := hub.subscribe(3, false)
+	admin, _ := hub.subscribe(1, true)
+
+	hub.broadcast([]RealtimeEvent{
+		{EventID: 1, Audience: AudienceUser, UserID: 3, Type: RealtimeNotification},
+		{EventID: 2, Audience: AudienceUser, UserID: 4, Type: RealtimeNotification},
+		{EventID: 3, Audience: AudienceAdmins, Type: RealtimeBookPending},
+	})
+	if len(member.events) != 1 || (<-member.events).EventID != 1 {
+		t.Error("member did not get exactly their own event")
+	}
+	if len(admin.events) != 1 || (<-admin.events).EventID != 3 {
+		t.Error("admin did not get exactly the admin event")
+	}
+	if _, position := hub.subscribe(5, false); position != 3 {
+		t.Errorf("new subscriber starts at %d, want 3", position)
+	}
+
+	// A subscriber that stops reading is dropped instead of holding up everyone else
+	var flood []RealtimeEvent
+	for i := 0; i <= realtimeBuffer; i++ {
+		flood = append(flood, RealtimeEvent{EventID: int64(4 + i), Audience: AudienceUser, UserID: 3})
+	}
+	hub.broadcast(flood)
+	select {
+	case <-member.dropped:
+	default:
+		t.Error("a subscriber past its buffer was kept")
+	}
+	if _, ok := hub.subscribers[member]; ok {
+		t.Error("a dropped subscriber is still registered")
+	}
+	hub.unsubscribe(member)
+}
+
+func TestSequenceEventsNumbersInCommitOrder(t *testing.T) {
+	fake := useFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+		if strings.Contains(query, "WHERE seq IS NULL") {
+			// Event 12 committed before 11, so it is numbered first by the previous poll;
+			// now 11 and 13 are visible
+			return &fakeRows{columns: []string{"event_id", "audience", "user_id", "event_type", "payload"}, values: [][]driver.Value{
+				{int64(11), AudienceUser, int64(3), RealtimeNotification, "{}"},
+				{int64(13), AudienceAdmins, int64(0), RealtimeBookPending, "{}"},
+			}}, nil
+		}
+		return nil, nil
+	})
+
+	events, err := sequenceEvents(40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].EventID != 41 || events[1].EventID != 42 {
+		t.Fatalf("events = %+v, want seq 41 and 42", events)
+	}
+	numbered := fake.Find("UPDATE realtime_event SET seq = ?")
+	if len(numbered) != 2 || numbered[0].Args[0] != int64(41) || numbered[0].Args[1] != int64(11) {
+		t.Errorf("numbered %+v, want event 11 as seq 41 first", numbered)
+	}
+}
+
+func TestPurgeRealtimeEventsKeepsResumeWindow(t *testing.T) {
+	fake := useFakeDB(t, nil)
+	if _, err := PurgeRealtimeEvents(); err != nil {
+		t.Fatal(err)
+	}
+	purged := fake.Find("DELETE FROM realtime_event WHERE created_at < ?")
+	if len(purged) != 1 {
+		t.Fatal("events were not purged")
+	}
+	cutoff := purged[0].Args[0].(time.Time)
+	if age := time.Since(cutoff); age < realtimeRetention || age > realtimeRetention+time.Minute {
+		t.Errorf("purged events older than %v, want %v", age, realtimeRetention)
+	}
+}
+
+func TestStreamEventsResumesFromLastEventID(t *testing.T) {
+	previous := realtimeHub
+	realtimeHub = &RealtimeHub{subscribers: map[*realtimeSubscriber]struct{}{}, lastID: 5}
+	t.Cleanup(func() { realtimeHub = previous })
+
+	fake := useFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+		if rows, ok := userRows(query, args, map[int64]string{3: "member"}); ok {
+			return rows, nil
+		}
+		switch {
+		case strings.Contains(query, "WHERE seq > ?"):
+			// Seq 6 was dispatched after the stream subscribed, so the hub delivers it instead
+			return &fakeRows{columns: []string{"seq", "audience", "user_id", "event_type", "payload"}, values: [][]driver.Value{
+				{int64(4), AudienceUser, int64(3), RealtimeNotification, `{"n":4}`},
+				{int64(5), AudienceUser, int64(3), RealtimeBorrowStatusChanged, `{"n":5}`},
+				{int64(6), AudienceUser, int64(3), RealtimeNotification, `{"n":6}`},
+			}}, nil
+		}
+		return nil, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "/api/events?user_id=3", nil).WithContext(ctx)
+	req.Header.Set("Last-Event-ID", "3")
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		streamEvents(rec, req)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+
+	body := rec.Body.String()
+	if !strings.Contains(body, "id: 4\nevent: notification\n") || !strings.Contains(body, "id: 5\nevent: borrow.status_changed\n") {
+		t.Errorf("stream did not replay the missed events:\n%s", body)
+	}
+	if strings.Contains(body, "id: 6") {
+		t.Errorf("stream replayed an event past the hub position:\n%s", body)
+	}
+	replay := fake.Find("WHERE seq > ?")
+	if len(replay) != 1 || replay[0].Args[0] != int64(3) {
+		t.Errorf("replay queries %+v, want one from seq 3", replay)
+	}
+}
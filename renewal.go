@@ -0,0 +1,165 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============ LOAN RENEWALS ============
+
+var (
+	ErrRenewalNotAllowed   = errors.New("only borrows on loan can be renewed")
+	ErrRenewalLimitReached = errors.New("renewal limit reached")
+	ErrTitleOnHold         = errors.New("another member has a hold on this title")
+	ErrRenewalOverdue      = errors.New("overdue loans cannot be renewed, return the book instead")
+)
+
+// RenewalResult describes a successful renewal.
+type RenewalResult struct {
+	BorrowID     int       `json:"borrow_id"`
+	PreviousDue  time.Time `json:"previous_due_date"`
+	DueDate      time.Time `json:"due_date"`
+	RenewalCount int       `json:"renewal_count"`
+	MaxRenewals  int       `json:"max_renewals"`
+}
+
+// hasWaitingHoldsTx reports whether anyone other than userID is waiting for the book.
+func hasWaitingHoldsTx(tx *sql.Tx, bookID, userID int) (bool, error) {
+	var count int
+	err := tx.QueryRow(`
+		SELECT COUNT(*) FROM book_hold
+		WHERE book_id = ? AND user_id <> ? AND status = 'waiting'
+	`, bookID, userID).Scan(&count)
+	return count > 0, err
+}
+
+// RenewBorrow extends the due date of a borrow on loan according to its loan policy.
+func RenewBorrow(borrowID, changedBy int) (*RenewalResult, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var userID, bookID, locationID, renewalCount, categoryID int
+	var status, memberTier string
+	var dueDate time.Time
+	var overdue bool
+	err = tx.QueryRow(`
+		SELECT br.user_id, br.book_id, COALESCE(br.location_id, 0), br.renewal_count, br.status, br.due_date,
+		       br.overdue_since IS NOT NULL OR br.due_date < NOW(),
+		       COALESCE(bk.category_id, 0), COALESCE(u.member_tier, 'standard')
+		FROM borrow br
+		JOIN book bk ON br.book_id = bk.book_id
+		JOIN user u ON br.user_id = u.user_id
+		WHERE br.borrow_id = ?
+		FOR UPDATE
+	`, borrowID).Scan(&userID, &bookID, &locationID, &renewalCount, &status, &dueDate, &overdue, &categoryID, &memberTier)
+	if err == sql.ErrNoRows {
+		return nil, ErrBorrowNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if status != BorrowStatusOnLoan {
+		return nil, ErrRenewalNotAllowed
+	}
+	// The fine accrued so far belongs to the current due date, so a late loan has to come back first
+	if overdue {
+		return nil, ErrRenewalOverdue
+	}
+
+	policy, err := ResolveLoanPolicy(categoryID, locationID, memberTier)
+	if err != nil {
+		return nil, err
+	}
+	if renewalCount >= policy.MaxRenewals {
+		return nil, ErrRenewalLimitReached
+	}
+
+	onHold, err := hasWaitingHoldsTx(tx, bookID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if onHold {
+		return nil, ErrTitleOnHold
+	}
+
+	period := policy.RenewalPeriodDays
+	if period == 0 {
+		period = policy.LoanPeriodDays
+	}
+	newDueDate, err := computeDueDate(dueDate, period, locationID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("UPDATE borrow SET due_date = ?, renewal_count = renewal_count + 1 WHERE borrow_id = ?", newDueDate, borrowID)
+	if err != nil {
+		return nil, err
+	}
+
+	note := fmt.Sprintf("renewed until %s", newDueDate.Format("2006-01-02"))
+	if err := recordBorrowStatusTx(tx, borrowID, status, status, changedBy, note); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &RenewalResult{
+		BorrowID:     borrowID,
+		PreviousDue:  dueDate,
+		DueDate:      newDueDate,
+		RenewalCount: renewalCount + 1,
+		MaxRenewals:  policy.MaxRenewals,
+	}, nil
+}
+
+func renewBorrow(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	borrowID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid borrow ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		ChangedBy int `json:"changed_by"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	result, err := RenewBorrow(borrowID, req.ChangedBy)
+	switch {
+	case errors.Is(err, ErrBorrowNotFound):
+		http.Error(w, "Borrow not found", http.StatusNotFound)
+		return
+	case errors.Is(err, ErrRenewalNotAllowed), errors.Is(err, ErrRenewalLimitReached), errors.Is(err, ErrTitleOnHold),
+		errors.Is(err, ErrRenewalOverdue):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "Failed to renew borrow", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Borrow renewed successfully",
+		"renewal": result,
+	})
+}
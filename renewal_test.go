@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// renewalBorrow describes the loan of book 7 to member 5 that RenewBorrow finds, under a policy
+// allowing two renewals of seven days.
+type renewalBorrow struct {
+	status   string
+	renewals int64
+	overdue  bool
+	waiting  int64
+}
+
+func (b renewalBorrow) respond(due time.Time) fakeResponder {
+	return func(query string, args []driver.Value) (*fakeRows, error) {
+		switch {
+		case strings.Contains(query, "FROM borrow br JOIN book bk"):
+			return fakeRow(int64(5), int64(7), int64(0), b.renewals, b.status, due, b.overdue, int64(2), "standard"), nil
+		case strings.Contains(query, "FROM loan_policy"):
+			return fakeRow(int64(1), "Standard", nil, nil, nil, int64(21), int64(3), int64(2), int64(7), 1000.0, 20000.0), nil
+		case strings.Contains(query, "FROM book_hold WHERE book_id = ? AND user_id <> ?"):
+			return fakeRow(b.waiting), nil
+		}
+		return nil, nil
+	}
+}
+
+func TestRenewBorrowExtendsTheDueDate(t *testing.T) {
+	due := time.Date(2026, 3, 20, 0, 0, 0, 0, time.UTC)
+	fake := useFakeDB(t, renewalBorrow{status: BorrowStatusOnLoan, renewals: 1}.respond(due))
+
+	result, err := RenewBorrow(9, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := due.AddDate(0, 0, 7); !result.DueDate.Equal(want) {
+		t.Errorf("DueDate = %v, want %v", result.DueDate, want)
+	}
+	if result.RenewalCount != 2 || result.MaxRenewals != 2 {
+		t.Errorf("renewals = %d of %d, want 2 of 2", result.RenewalCount, result.MaxRenewals)
+	}
+	if len(fake.Find("UPDATE borrow SET due_date = ?, renewal_count = renewal_count + 1")) != 1 {
+		t.Error("the borrow's due date was not updated")
+	}
+	if fake.Index("COMMIT") < 0 {
+		t.Error("the renewal was not committed")
+	}
+}
+
+func TestRenewBorrowRefusals(t *testing.T) {
+	due := time.Date(2026, 3, 20, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		borrow renewalBorrow
+		want   error
+	}{
+		{"not on loan", renewalBorrow{status: BorrowStatusRequested}, ErrRenewalNotAllowed},
+		{"overdue", renewalBorrow{status: BorrowStatusOnLoan, overdue: true}, ErrRenewalOverdue},
+		{"limit reached", renewalBorrow{status: BorrowStatusOnLoan, renewals: 2}, ErrRenewalLimitReached},
+		{"held by another member", renewalBorrow{status: BorrowStatusOnLoan, waiting: 1}, ErrTitleOnHold},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t, tt.borrow.respond(due))
+
+			if _, err := RenewBorrow(9, 5); !errors.Is(err, tt.want) {
+				t.Fatalf("RenewBorrow = %v, want %v", err, tt.want)
+			}
+			if len(fake.Find("UPDATE borrow SET due_date")) != 0 {
+				t.Error("a refused renewal changed the due date")
+			}
+		})
+	}
+}
+
+func TestRenewBorrowUnknownBorrow(t *testing.T) {
+	useFakeDB(t, nil)
+
+	if _, err := RenewBorrow(9, 5); !errors.Is(err, ErrBorrowNotFound) {
+		t.Fatalf("RenewBorrow = %v, want %v", err, ErrBorrowNotFound)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// ============ BACKGROUND SCHEDULER ============
+
+// scheduledJob is a maintenance task run periodically in the background.
+// Run returns how many records it touched so the scheduler can log useful activity only.
+type scheduledJob struct {
+	Name     string
+	Interval time.Duration
+	Run      func() (int, error)
+}
+
+var scheduledJobs = []scheduledJob{
+	{"expire holds", 15 * time.Minute, ExpireHolds},
+	{"flag overdue borrows", time.Hour, FlagOverdueBorrows},
+	{"send due reminders", time.Hour, func() (int, error) { return SendDueReminders(reminderChannel) }},
+	{"accrue fines", time.Hour, AccrueFines},
+	{"expire pickup appointments", 5 * time.Minute, ExpirePickupAppointments},
+	{"purge real-time events", time.Hour, PurgeRealtimeEvents},
+	{"deliver notifications", time.Minute, DeliverPendingNotifications},
+	{"deliver webhooks", 30 * time.Second, DeliverWebhooks},
+}
+
+// startScheduler runs every job once at startup and then on its own interval.
+func startScheduler(jobs []scheduledJob) {
+	for _, job := range jobs {
+		go runScheduledJob(job)
+	}
+}
+
+func runScheduledJob(job scheduledJob) {
+	ticker := time.NewTicker(job.Interval)
+	defer ticker.Stop()
+	for {
+		count, err := job.Run()
+		if err != nil {
+			log.Printf("Scheduled job %q failed: %v", job.Name, err)
+		} else if count > 0 {
+			log.Printf("Scheduled job %q processed %d records", job.Name, count)
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,550 @@
+package main
+
+import "fmt"
+
+// ============ SCHEMA MIGRATIONS ============
+
+// schemaStatements are executed on every startup, so each one must be idempotent.
+var schemaStatements = []string{
+	`CREATE TABLE IF NOT EXISTS borrow_status_history (
+		history_id INT AUTO_INCREMENT PRIMARY KEY,
+		borrow_id INT NOT NULL,
+		from_status VARCHAR(32) NULL,
+		to_status VARCHAR(32) NOT NULL,
+		changed_by INT NULL,
+		note VARCHAR(255) NULL,
+		created_at DATETIME NOT NULL,
+		INDEX idx_borrow_status_history_borrow (borrow_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS loan_policy (
+		policy_id INT AUTO_INCREMENT PRIMARY KEY,
+		name VARCHAR(100) NOT NULL,
+		category_id INT NULL,
+		location_id INT NULL,
+		member_tier VARCHAR(32) NULL,
+		loan_period_days INT NOT NULL,
+		max_active_loans INT NOT NULL,
+		max_renewals INT NOT NULL DEFAULT 0,
+		renewal_period_days INT NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS book_hold (
+		hold_id INT AUTO_INCREMENT PRIMARY KEY,
+		book_id INT NOT NULL,
+		user_id INT NOT NULL,
+		status VARCHAR(32) NOT NULL DEFAULT 'waiting',
+		created_at DATETIME NOT NULL,
+		INDEX idx_book_hold_book_status (book_id, status)
+	)`,
+	`CREATE TABLE IF NOT EXISTS borrow_reminder (
+		reminder_id INT AUTO_INCREMENT PRIMARY KEY,
+		borrow_id INT NOT NULL,
+		kind VARCHAR(32) NOT NULL,
+		due_date DATETIME NOT NULL,
+		sent_at DATETIME NOT NULL,
+		UNIQUE KEY uq_borrow_reminder (borrow_id, kind, due_date)
+	)`,
+	`CREATE TABLE IF NOT EXISTS fine (
+		fine_id INT AUTO_INCREMENT PRIMARY KEY,
+		borrow_id INT NOT NULL,
+		user_id INT NOT NULL,
+		days_overdue INT NOT NULL,
+		amount DECIMAL(12,2) NOT NULL,
+		status VARCHAR(32) NOT NULL,
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL,
+		UNIQUE KEY uq_fine_borrow (borrow_id),
+		INDEX idx_fine_user_status (user_id, status)
+	)`,
+	`CREATE TABLE IF NOT EXISTS pricing_rule (
+		rule_id INT AUTO_INCREMENT PRIMARY KEY,
+		kind VARCHAR(32) NOT NULL,
+		category_id INT NULL,
+		delivery_type VARCHAR(32) NULL,
+		amount DECIMAL(12,2) NOT NULL DEFAULT 0,
+		rate DECIMAL(6,4) NOT NULL DEFAULT 0,
+		active BOOLEAN NOT NULL DEFAULT TRUE
+	)`,
+	`CREATE TABLE IF NOT EXISTS borrow_line_item (
+		line_id INT AUTO_INCREMENT PRIMARY KEY,
+		borrow_id INT NOT NULL,
+		code VARCHAR(32) NOT NULL,
+		description VARCHAR(255) NOT NULL,
+		book_id INT NULL,
+		quantity INT NOT NULL DEFAULT 1,
+		unit_price DECIMAL(12,2) NOT NULL,
+		amount DECIMAL(12,2) NOT NULL,
+		INDEX idx_borrow_line_item_borrow (borrow_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS cart_item (
+		cart_item_id INT AUTO_INCREMENT PRIMARY KEY,
+		user_id INT NOT NULL,
+		book_id INT NOT NULL,
+		location_id INT NULL,
+		added_at DATETIME NOT NULL,
+		UNIQUE KEY uq_cart_item_user_book (user_id, book_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS borrow_order (
+		order_id INT AUTO_INCREMENT PRIMARY KEY,
+		user_id INT NOT NULL,
+		status VARCHAR(32) NOT NULL,
+		delivery_type VARCHAR(32) NOT NULL,
+		location_id INT NULL,
+		delivery_address VARCHAR(500) NULL,
+		subtotal DECIMAL(12,2) NOT NULL,
+		tax DECIMAL(12,2) NOT NULL,
+		total DECIMAL(12,2) NOT NULL,
+		created_at DATETIME NOT NULL,
+		INDEX idx_borrow_order_user (user_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS order_line_item (
+		line_id INT AUTO_INCREMENT PRIMARY KEY,
+		order_id INT NOT NULL,
+		code VARCHAR(32) NOT NULL,
+		description VARCHAR(255) NOT NULL,
+		book_id INT NULL,
+		quantity INT NOT NULL DEFAULT 1,
+		unit_price DECIMAL(12,2) NOT NULL,
+		amount DECIMAL(12,2) NOT NULL,
+		INDEX idx_order_line_item_order (order_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS order_status_history (
+		history_id INT AUTO_INCREMENT PRIMARY KEY,
+		order_id INT NOT NULL,
+		from_status VARCHAR(32) NULL,
+		to_status VARCHAR(32) NOT NULL,
+		changed_by INT NULL,
+		note VARCHAR(255) NULL,
+		created_at DATETIME NOT NULL,
+		INDEX idx_order_status_history_order (order_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS payment (
+		payment_id INT AUTO_INCREMENT PRIMARY KEY,
+		order_id INT NULL,
+		borrow_id INT NULL,
+		provider VARCHAR(32) NOT NULL,
+		provider_ref VARCHAR(128) NOT NULL,
+		amount DECIMAL(12,2) NOT NULL,
+		refunded_amount DECIMAL(12,2) NOT NULL DEFAULT 0,
+		currency VARCHAR(3) NOT NULL,
+		status VARCHAR(32) NOT NULL,
+		created_at DATETIME NOT NULL,
+		UNIQUE KEY uq_payment_provider_ref (provider, provider_ref),
+		INDEX idx_payment_order (order_id),
+		INDEX idx_payment_borrow (borrow_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS ledger_txn (
+		txn_id INT AUTO_INCREMENT PRIMARY KEY,
+		kind VARCHAR(32) NOT NULL,
+		user_id INT NOT NULL,
+		reference_type VARCHAR(32) NOT NULL,
+		reference_id INT NULL,
+		description VARCHAR(255) NULL,
+		created_at DATETIME NOT NULL,
+		INDEX idx_ledger_txn_user (user_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS ledger_entry (
+		entry_id INT AUTO_INCREMENT PRIMARY KEY,
+		txn_id INT NOT NULL,
+		account VARCHAR(32) NOT NULL,
+		user_id INT NULL,
+		amount DECIMAL(12,2) NOT NULL,
+		INDEX idx_ledger_entry_txn (txn_id),
+		INDEX idx_ledger_entry_user_account (user_id, account)
+	)`,
+	`CREATE TABLE IF NOT EXISTS voucher (
+		voucher_id INT AUTO_INCREMENT PRIMARY KEY,
+		code VARCHAR(64) NOT NULL,
+		description VARCHAR(255) NULL,
+		discount_type VARCHAR(16) NOT NULL,
+		value DECIMAL(12,2) NOT NULL,
+		min_spend DECIMAL(12,2) NOT NULL DEFAULT 0,
+		category_id INT NULL,
+		location_id INT NULL,
+		new_members_only BOOLEAN NOT NULL DEFAULT FALSE,
+		max_uses INT NOT NULL DEFAULT 0,
+		max_uses_per_user INT NOT NULL DEFAULT 0,
+		valid_from DATETIME NULL,
+		valid_until DATETIME NULL,
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		UNIQUE KEY uq_voucher_code (code)
+	)`,
+	`CREATE TABLE IF NOT EXISTS voucher_redemption (
+		redemption_id INT AUTO_INCREMENT PRIMARY KEY,
+		voucher_id INT NOT NULL,
+		user_id INT NOT NULL,
+		order_id INT NULL,
+		borrow_id INT NULL,
+		amount DECIMAL(12,2) NOT NULL,
+		created_at DATETIME NOT NULL,
+		INDEX idx_voucher_redemption_voucher_user (voucher_id, user_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS invoice_sequence (
+		series VARCHAR(32) PRIMARY KEY,
+		last_number INT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS invoice (
+		invoice_id INT AUTO_INCREMENT PRIMARY KEY,
+		invoice_number VARCHAR(32) NOT NULL UNIQUE,
+		kind VARCHAR(32) NOT NULL,
+		status VARCHAR(32) NOT NULL,
+		order_id INT NULL,
+		borrow_id INT NULL,
+		user_id INT NOT NULL,
+		related_invoice_id INT NULL,
+		subtotal DECIMAL(12,2) NOT NULL,
+		tax DECIMAL(12,2) NOT NULL,
+		total DECIMAL(12,2) NOT NULL,
+		issued_at DATETIME NOT NULL,
+		INDEX idx_invoice_order (order_id),
+		INDEX idx_invoice_borrow (borrow_id),
+		INDEX idx_invoice_user (user_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS invoice_line (
+		line_id INT AUTO_INCREMENT PRIMARY KEY,
+		invoice_id INT NOT NULL,
+		code VARCHAR(32) NOT NULL,
+		description VARCHAR(255) NOT NULL,
+		quantity INT NOT NULL,
+		unit_price DECIMAL(12,2) NOT NULL,
+		amount DECIMAL(12,2) NOT NULL,
+		INDEX idx_invoice_line_invoice (invoice_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS shipment (
+		shipment_id INT AUTO_INCREMENT PRIMARY KEY,
+		borrow_id INT NOT NULL,
+		courier VARCHAR(32) NOT NULL,
+		tracking_number VARCHAR(64) NOT NULL UNIQUE,
+		address TEXT,
+		status VARCHAR(32) NOT NULL,
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL,
+		INDEX idx_shipment_borrow (borrow_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS shipment_event (
+		event_id INT AUTO_INCREMENT PRIMARY KEY,
+		shipment_id INT NOT NULL,
+		status VARCHAR(32) NOT NULL,
+		location VARCHAR(255) NULL,
+		note TEXT,
+		created_at DATETIME NOT NULL,
+		INDEX idx_shipment_event_shipment (shipment_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS delivery_fee_tier (
+		tier_id INT AUTO_INCREMENT PRIMARY KEY,
+		location_id INT NULL,
+		service VARCHAR(32) NOT NULL,
+		max_distance_km DECIMAL(8,2) NOT NULL,
+		base_fee DECIMAL(12,2) NOT NULL,
+		per_km_fee DECIMAL(12,2) NOT NULL DEFAULT 0,
+		active BOOLEAN NOT NULL DEFAULT TRUE
+	)`,
+	`CREATE TABLE IF NOT EXISTS location_hours (
+		location_id INT NOT NULL,
+		weekday TINYINT NOT NULL,
+		open_time CHAR(5) NOT NULL,
+		close_time CHAR(5) NOT NULL,
+		PRIMARY KEY (location_id, weekday)
+	)`,
+	`CREATE TABLE IF NOT EXISTS pickup_appointment (
+		appointment_id INT AUTO_INCREMENT PRIMARY KEY,
+		location_id INT NOT NULL,
+		user_id INT NOT NULL,
+		order_id INT NULL,
+		slot_start DATETIME NOT NULL,
+		slot_end DATETIME NOT NULL,
+		status VARCHAR(32) NOT NULL,
+		expires_at DATETIME NULL,
+		created_at DATETIME NOT NULL,
+		INDEX idx_pickup_appointment_slot (location_id, slot_start),
+		INDEX idx_pickup_appointment_order (order_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS location_holiday (
+		holiday_id INT AUTO_INCREMENT PRIMARY KEY,
+		location_id INT NULL,
+		holiday_date DATE NOT NULL,
+		name VARCHAR(255) NOT NULL,
+		UNIQUE KEY uniq_location_holiday (location_id, holiday_date),
+		INDEX idx_location_holiday_date (holiday_date)
+	)`,
+	`CREATE TABLE IF NOT EXISTS geocode_address (
+		pattern VARCHAR(255) PRIMARY KEY,
+		latitude DECIMAL(9,6) NOT NULL,
+		longitude DECIMAL(9,6) NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS location_transfer (
+		transfer_id INT AUTO_INCREMENT PRIMARY KEY,
+		book_id INT NOT NULL,
+		from_location_id INT NOT NULL,
+		to_location_id INT NOT NULL,
+		status VARCHAR(32) NOT NULL,
+		reason VARCHAR(32) NOT NULL,
+		hold_id INT NULL,
+		borrow_id INT NULL,
+		requested_by INT NULL,
+		dispatched_by INT NULL,
+		received_by INT NULL,
+		created_at DATETIME NOT NULL,
+		dispatched_at DATETIME NULL,
+		received_at DATETIME NULL,
+		cancelled_at DATETIME NULL,
+		INDEX idx_transfer_from (from_location_id, status),
+		INDEX idx_transfer_to (to_location_id, status),
+		INDEX idx_transfer_hold (hold_id),
+		INDEX idx_transfer_borrow (borrow_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS book_copy (
+		copy_id INT AUTO_INCREMENT PRIMARY KEY,
+		book_id INT NOT NULL,
+		location_id INT NOT NULL,
+		barcode VARCHAR(64) NULL UNIQUE,
+		status VARCHAR(32) NOT NULL,
+		created_at DATETIME NOT NULL,
+		lost_at DATETIME NULL,
+		INDEX idx_book_copy_location (location_id, book_id, status)
+	)`,
+	`CREATE TABLE IF NOT EXISTS inventory_audit (
+		audit_id INT AUTO_INCREMENT PRIMARY KEY,
+		location_id INT NOT NULL,
+		status VARCHAR(32) NOT NULL,
+		started_by INT NOT NULL,
+		started_at DATETIME NOT NULL,
+		submitted_at DATETIME NULL,
+		closed_at DATETIME NULL,
+		INDEX idx_inventory_audit_location (location_id, status)
+	)`,
+	`CREATE TABLE IF NOT EXISTS inventory_scan (
+		scan_id INT AUTO_INCREMENT PRIMARY KEY,
+		audit_id INT NOT NULL,
+		barcode VARCHAR(64) NOT NULL,
+		copy_id INT NULL,
+		scanned_by INT NULL,
+		scanned_at DATETIME NOT NULL,
+		UNIQUE KEY uniq_inventory_scan (audit_id, barcode)
+	)`,
+	`CREATE TABLE IF NOT EXISTS inventory_discrepancy (
+		discrepancy_id INT AUTO_INCREMENT PRIMARY KEY,
+		audit_id INT NOT NULL,
+		kind VARCHAR(32) NOT NULL,
+		barcode VARCHAR(64) NOT NULL,
+		copy_id INT NULL,
+		book_id INT NULL,
+		recorded_location_id INT NULL,
+		resolution VARCHAR(32) NOT NULL,
+		resolved_book_id INT NULL,
+		resolved_by INT NULL,
+		resolved_at DATETIME NULL,
+		note TEXT NULL,
+		INDEX idx_inventory_discrepancy_audit (audit_id)
+	)`,
+	// notification predates the migrations; this only creates it on fresh databases.
+	`CREATE TABLE IF NOT EXISTS notification (
+		notification_id INT AUTO_INCREMENT PRIMARY KEY,
+		user_id INT NOT NULL,
+		book_id INT NULL,
+		message TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		INDEX idx_notification_user (user_id, created_at)
+	)`,
+	`CREATE TABLE IF NOT EXISTS notification_preference (
+		user_id INT NOT NULL,
+		event VARCHAR(64) NOT NULL,
+		enabled BOOLEAN NOT NULL,
+		PRIMARY KEY (user_id, event)
+	)`,
+	`CREATE TABLE IF NOT EXISTS realtime_event (
+		event_id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		audience VARCHAR(16) NOT NULL,
+		user_id INT NULL,
+		event_type VARCHAR(64) NOT NULL,
+		payload TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		seq BIGINT NULL,
+		UNIQUE KEY uq_realtime_event_seq (seq),
+		INDEX idx_realtime_event_created (created_at)
+	)`,
+	`CREATE TABLE IF NOT EXISTS notification_channel_preference (
+		user_id INT NOT NULL,
+		channel VARCHAR(16) NOT NULL,
+		enabled BOOLEAN NOT NULL,
+		PRIMARY KEY (user_id, channel)
+	)`,
+	`CREATE TABLE IF NOT EXISTS push_subscription (
+		subscription_id INT AUTO_INCREMENT PRIMARY KEY,
+		user_id INT NOT NULL,
+		endpoint VARCHAR(512) NOT NULL,
+		created_at DATETIME NOT NULL,
+		UNIQUE KEY uq_push_subscription_endpoint (endpoint),
+		INDEX idx_push_subscription_user (user_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS notification_delivery (
+		delivery_id INT AUTO_INCREMENT PRIMARY KEY,
+		notification_id INT NOT NULL,
+		user_id INT NOT NULL,
+		channel VARCHAR(16) NOT NULL,
+		recipient VARCHAR(512) NOT NULL,
+		language VARCHAR(8) NOT NULL,
+		subject VARCHAR(255) NOT NULL,
+		body TEXT NOT NULL,
+		link VARCHAR(255) NULL,
+		status VARCHAR(16) NOT NULL,
+		attempts INT NOT NULL DEFAULT 0,
+		next_attempt_at DATETIME NOT NULL,
+		last_error TEXT NULL,
+		created_at DATETIME NOT NULL,
+		sent_at DATETIME NULL,
+		INDEX idx_notification_delivery_due (status, next_attempt_at),
+		INDEX idx_notification_delivery_notification (notification_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS webhook_endpoint (
+		endpoint_id INT AUTO_INCREMENT PRIMARY KEY,
+		url VARCHAR(512) NOT NULL,
+		description VARCHAR(255) NULL,
+		events VARCHAR(512) NOT NULL,
+		secret VARCHAR(128) NOT NULL,
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		created_by INT NULL,
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS webhook_delivery (
+		delivery_id INT AUTO_INCREMENT PRIMARY KEY,
+		endpoint_id INT NOT NULL,
+		event_id VARCHAR(64) NOT NULL,
+		event_type VARCHAR(64) NOT NULL,
+		payload TEXT NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		attempts INT NOT NULL DEFAULT 0,
+		next_attempt_at DATETIME NOT NULL,
+		last_status_code INT NULL,
+		last_error TEXT NULL,
+		created_at DATETIME NOT NULL,
+		delivered_at DATETIME NULL,
+		INDEX idx_webhook_delivery_due (status, next_attempt_at),
+		INDEX idx_webhook_delivery_endpoint (endpoint_id, status)
+	)`,
+	`CREATE TABLE IF NOT EXISTS book_moderation (
+		moderation_id INT AUTO_INCREMENT PRIMARY KEY,
+		book_id INT NOT NULL,
+		actor_id INT NULL,
+		action VARCHAR(16) NOT NULL,
+		from_status VARCHAR(16) NULL,
+		to_status VARCHAR(16) NOT NULL,
+		reason VARCHAR(64) NULL,
+		comment TEXT NULL,
+		field_notes TEXT NULL,
+		created_at DATETIME NOT NULL,
+		INDEX idx_book_moderation_book (book_id, created_at)
+	)`,
+}
+
+// columnAddition describes a column that is added to an existing table when missing.
+type columnAddition struct {
+	Table      string
+	Column     string
+	Definition string
+}
+
+var columnAdditions = []columnAddition{
+	{"borrow", "approved_at", "DATETIME NULL"},
+	{"borrow", "dispatched_at", "DATETIME NULL"},
+	{"borrow", "ready_for_pickup_at", "DATETIME NULL"},
+	{"borrow", "on_loan_at", "DATETIME NULL"},
+	{"borrow", "rejected_at", "DATETIME NULL"},
+	{"borrow", "cancelled_at", "DATETIME NULL"},
+	{"borrow", "lost_at", "DATETIME NULL"},
+	{"borrow", "location_id", "INT NULL"},
+	{"borrow", "renewal_count", "INT NOT NULL DEFAULT 0"},
+	{"book_hold", "location_id", "INT NULL"},
+	{"book_hold", "ready_at", "DATETIME NULL"},
+	{"book_hold", "pickup_deadline", "DATETIME NULL"},
+	{"book_hold", "closed_at", "DATETIME NULL"},
+	{"borrow", "overdue_since", "DATETIME NULL"},
+	{"borrow", "order_id", "INT NULL"},
+	{"borrow", "deposit_amount", "DECIMAL(12,2) NOT NULL DEFAULT 0"},
+	// NULL marks borrows created before payments existed; they are not held back from approval.
+	{"borrow", "payment_status", "VARCHAR(32) NULL"},
+	{"book", "submitted_at", "DATETIME NULL"},
+	{"book", "claimed_by", "INT NULL"},
+	{"book", "claim_expires_at", "DATETIME NULL"},
+	{"borrow_order", "payment_status", "VARCHAR(32) NOT NULL DEFAULT 'unpaid'"},
+	// Commit order of a real-time event, assigned by the dispatcher once the event is visible.
+	{"realtime_event", "seq", "BIGINT NULL"},
+	// The part of a fine already taken out of the borrow's deposit.
+	{"fine", "paid_amount", "DECIMAL(12,2) NOT NULL DEFAULT 0"},
+	// Set when the checkout a voucher was used on is rejected or cancelled, giving the use back.
+	{"voucher_redemption", "released_at", "DATETIME NULL"},
+	// Refunds set aside while the provider is being called.
+	{"payment", "refund_reserved", "DECIMAL(12,2) NOT NULL DEFAULT 0"},
+	{"location", "latitude", "DECIMAL(9,6) NULL"},
+	{"location", "longitude", "DECIMAL(9,6) NULL"},
+	// NULL means the location delivers as far as its fee tiers reach.
+	{"location", "delivery_radius_km", "DECIMAL(8,2) NULL"},
+	{"location", "pickup_slot_capacity", "INT NOT NULL DEFAULT 5"},
+	{"location", "phone", "VARCHAR(32) NULL"},
+	{"location", "email", "VARCHAR(255) NULL"},
+	{"location", "archived_at", "DATETIME NULL"},
+	{"loan_policy", "fine_per_day", "DECIMAL(12,2) NOT NULL DEFAULT 1000"},
+	{"loan_policy", "fine_cap", "DECIMAL(12,2) NOT NULL DEFAULT 50000"},
+	{"notification", "event", "VARCHAR(64) NULL"},
+	{"notification", "link", "VARCHAR(255) NULL"},
+	{"notification", "read_at", "DATETIME NULL"},
+	{"user", "member_tier", "VARCHAR(32) NOT NULL DEFAULT 'standard'"},
+	{"user", "latitude", "DECIMAL(9,6) NULL"},
+	{"user", "longitude", "DECIMAL(9,6) NULL"},
+	{"user", "language", "VARCHAR(8) NOT NULL DEFAULT 'id'"},
+}
+
+// dataMigrations run after the schema is in place to rewrite legacy values.
+var dataMigrations = []string{
+	// Borrows were historically created as 'active' or 'pending' and shown as 'borrowed'.
+	"UPDATE borrow SET status = 'requested' WHERE status = 'pending'",
+	"UPDATE borrow SET status = 'on_loan' WHERE status IN ('active', 'borrowed')",
+	// The old frontend also used 'approved' for a book that was out. Borrows approved through the
+	// lifecycle have approved_at stamped, so only legacy rows lack it.
+	"UPDATE borrow SET status = 'on_loan', on_loan_at = COALESCE(on_loan_at, borrow_date) WHERE status = 'approved' AND approved_at IS NULL",
+	// Offline geocodes for the seeded branch addresses; patterns are lower-case address fragments.
+	`INSERT IGNORE INTO geocode_address (pattern, latitude, longitude) VALUES
+		('soekarno hatta no.713', -6.943000, 107.635000),
+		('kebon jati', -6.914700, 107.609800),
+		('cihampelas', -6.899600, 107.606700)`,
+	`UPDATE location l
+		JOIN geocode_address g ON LOWER(l.address) LIKE CONCAT('%', g.pattern, '%')
+		SET l.latitude = g.latitude, l.longitude = g.longitude
+		WHERE l.latitude IS NULL AND l.longitude IS NULL`,
+	// Books pending before the moderation queue existed start aging from the migration.
+	"UPDATE book SET submitted_at = NOW() WHERE status = 'pending' AND submitted_at IS NULL",
+}
+
+// migrateSchema brings the database up to date with the tables and columns the server needs.
+func migrateSchema() error {
+	for _, stmt := range schemaStatements {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("schema statement failed: %w", err)
+		}
+	}
+
+	for _, col := range columnAdditions {
+		var count int
+		err := db.QueryRow(`
+			SELECT COUNT(*) FROM information_schema.COLUMNS
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?
+		`, col.Table, col.Column).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+		_, err = db.Exec(fmt.Sprintf("ALTER TABLE `%s` ADD COLUMN `%s` %s", col.Table, col.Column, col.Definition))
+		if err != nil {
+			return fmt.Errorf("adding %s.%s failed: %w", col.Table, col.Column, err)
+		}
+	}
+
+	for _, stmt := range dataMigrations {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("data migration failed: %w", err)
+		}
+	}
+	return nil
+}
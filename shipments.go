@@ -0,0 +1,382 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============ SHIPMENTS ============
+
+const (
+	ShipmentStatusPacked           = "packed"
+	ShipmentStatusShipped          = "shipped"
+	ShipmentStatusOutForDelivery   = "out_for_delivery"
+	ShipmentStatusDelivered        = "delivered"
+	ShipmentStatusReturnedToSender = "returned_to_sender"
+)
+
+var (
+	ErrShipmentNotFound          = errors.New("shipment not found")
+	ErrShipmentExists            = errors.New("borrow already has an open shipment")
+	ErrNotDeliveryBorrow         = errors.New("only approved delivery borrows can be shipped")
+	ErrMissingDeliveryAddress    = errors.New("delivery borrows need a delivery address")
+	ErrInvalidShipmentTransition = errors.New("invalid shipment status transition")
+)
+
+// shipmentTransitions lists, for every status, the statuses a shipment may move to next.
+var shipmentTransitions = map[string][]string{
+	ShipmentStatusPacked:         {ShipmentStatusShipped},
+	ShipmentStatusShipped:        {ShipmentStatusOutForDelivery, ShipmentStatusDelivered, ShipmentStatusReturnedToSender},
+	ShipmentStatusOutForDelivery: {ShipmentStatusDelivered, ShipmentStatusReturnedToSender},
+}
+
+type ShipmentEvent struct {
+	EventID    int       `json:"event_id"`
+	ShipmentID int       `json:"shipment_id"`
+	Status     string    `json:"status"`
+	Location   string    `json:"location"`
+	Note       string    `json:"note"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type Shipment struct {
+	ShipmentID     int             `json:"shipment_id"`
+	BorrowID       int             `json:"borrow_id"`
+	Courier        string          `json:"courier"`
+	TrackingNumber string          `json:"tracking_number"`
+	TrackingURL    string          `json:"tracking_url,omitempty"`
+	Address        string          `json:"address"`
+	Status         string          `json:"status"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+	Events         []ShipmentEvent `json:"events"`
+}
+
+func canTransitionShipment(from, to string) bool {
+	for _, next := range shipmentTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+func recordShipmentEventTx(tx *sql.Tx, shipmentID int, status, location, note string) error {
+	_, err := tx.Exec(`
+		INSERT INTO shipment_event (shipment_id, status, location, note, created_at)
+		VALUES (?, ?, ?, ?, NOW())
+	`, shipmentID, status, location, note)
+	return err
+}
+
+// CreateShipment books a courier for an approved delivery borrow and records it as packed.
+func CreateShipment(borrowID int) (*Shipment, error) {
+	var status, deliveryType, address string
+	var userID int
+	err := db.QueryRow(`
+		SELECT status, COALESCE(delivery_type, ''), COALESCE(delivery_address, ''), user_id
+		FROM borrow WHERE borrow_id = ?
+	`, borrowID).Scan(&status, &deliveryType, &address, &userID)
+	if err == sql.ErrNoRows {
+		return nil, ErrBorrowNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deliveryType != "delivery" || status != BorrowStatusApproved {
+		return nil, ErrNotDeliveryBorrow
+	}
+	if strings.TrimSpace(address) == "" {
+		return nil, ErrMissingDeliveryAddress
+	}
+
+	open, err := openShipmentID(borrowID)
+	if err != nil {
+		return nil, err
+	}
+	if open != 0 {
+		return nil, ErrShipmentExists
+	}
+
+	recipient := ""
+	if user, err := GetUserByID(userID); err == nil && user != nil {
+		recipient = user.Name
+	}
+	trackingNumber, err := courierProvider.CreateShipment(ShipmentRequest{BorrowID: borrowID, Recipient: recipient, Address: address})
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO shipment (borrow_id, courier, tracking_number, address, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, NOW(), NOW())
+	`, borrowID, courierProvider.Name(), trackingNumber, address, ShipmentStatusPacked)
+	if err != nil {
+		return nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	if err := recordShipmentEventTx(tx, int(id), ShipmentStatusPacked, "", "Parcel packed"); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return GetShipmentByID(int(id))
+}
+
+// UpdateShipmentStatus records a tracking event. Shipping a parcel dispatches the borrow
+// and delivering it puts the borrow on loan.
+func UpdateShipmentStatus(shipmentID int, to, location, note string, changedBy int) (*Shipment, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var from string
+	var borrowID int
+	err = tx.QueryRow("SELECT status, borrow_id FROM shipment WHERE shipment_id = ? FOR UPDATE", shipmentID).Scan(&from, &borrowID)
+	if err == sql.ErrNoRows {
+		return nil, ErrShipmentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !canTransitionShipment(from, to) {
+		return nil, fmt.Errorf("%w: %s -> %s", ErrInvalidShipmentTransition, from, to)
+	}
+
+	if _, err := tx.Exec("UPDATE shipment SET status = ?, updated_at = NOW() WHERE shipment_id = ?", to, shipmentID); err != nil {
+		return nil, err
+	}
+	if err := recordShipmentEventTx(tx, shipmentID, to, location, note); err != nil {
+		return nil, err
+	}
+
+	var borrowStatus string
+	if err := tx.QueryRow("SELECT status FROM borrow WHERE borrow_id = ?", borrowID).Scan(&borrowStatus); err != nil {
+		return nil, err
+	}
+	switch {
+	case to == ShipmentStatusShipped && borrowStatus == BorrowStatusApproved:
+		_, err = transitionBorrowTx(tx, borrowID, BorrowStatusDispatched, changedBy, "Shipped by courier")
+	case to == ShipmentStatusDelivered && borrowStatus == BorrowStatusDispatched:
+		_, err = transitionBorrowTx(tx, borrowID, BorrowStatusOnLoan, changedBy, "Delivered by courier")
+	case to == ShipmentStatusReturnedToSender && borrowStatus == BorrowStatusDispatched:
+		_, err = transitionBorrowTx(tx, borrowID, BorrowStatusApproved, changedBy, "Returned to sender by courier")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return GetShipmentByID(shipmentID)
+}
+
+// openShipmentID returns the borrow's shipment that is still under way, or 0.
+func openShipmentID(borrowID int) (int, error) {
+	var shipmentID int
+	err := db.QueryRow(`
+		SELECT shipment_id FROM shipment
+		WHERE borrow_id = ? AND status NOT IN (?, ?)
+		ORDER BY shipment_id DESC LIMIT 1
+	`, borrowID, ShipmentStatusDelivered, ShipmentStatusReturnedToSender).Scan(&shipmentID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return shipmentID, err
+}
+
+func GetShipmentByID(shipmentID int) (*Shipment, error) {
+	var s Shipment
+	err := db.QueryRow(`
+		SELECT shipment_id, borrow_id, courier, tracking_number, address, status, created_at, updated_at
+		FROM shipment WHERE shipment_id = ?
+	`, shipmentID).Scan(&s.ShipmentID, &s.BorrowID, &s.Courier, &s.TrackingNumber, &s.Address, &s.Status, &s.CreatedAt, &s.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.Courier == courierProvider.Name() {
+		s.TrackingURL = courierProvider.TrackingURL(s.TrackingNumber)
+	}
+
+	rows, err := db.Query(`
+		SELECT event_id, shipment_id, status, COALESCE(location, ''), COALESCE(note, ''), created_at
+		FROM shipment_event WHERE shipment_id = ?
+		ORDER BY created_at, event_id
+	`, shipmentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	s.Events = []ShipmentEvent{}
+	for rows.Next() {
+		var e ShipmentEvent
+		if err := rows.Scan(&e.EventID, &e.ShipmentID, &e.Status, &e.Location, &e.Note, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		s.Events = append(s.Events, e)
+	}
+	return &s, nil
+}
+
+// GetBorrowShipment returns the latest shipment of a borrow, or nil if it was never shipped.
+func GetBorrowShipment(borrowID int) (*Shipment, error) {
+	var shipmentID int
+	err := db.QueryRow("SELECT shipment_id FROM shipment WHERE borrow_id = ? ORDER BY shipment_id DESC LIMIT 1", borrowID).
+		Scan(&shipmentID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return GetShipmentByID(shipmentID)
+}
+
+// ============ SHIPMENT HANDLERS ============
+
+func writeShipmentError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, ErrShipmentNotFound), errors.Is(err, ErrBorrowNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrShipmentExists), errors.Is(err, ErrNotDeliveryBorrow), errors.Is(err, ErrMissingDeliveryAddress),
+		errors.Is(err, ErrInvalidShipmentTransition), errors.Is(err, ErrInvalidTransition):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, fallback, http.StatusInternalServerError)
+	}
+}
+
+func createShipment(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	borrowID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid borrow ID", http.StatusBadRequest)
+		return
+	}
+
+	shipment, err := CreateShipment(borrowID)
+	if err != nil {
+		writeShipmentError(w, err, "Failed to create shipment")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(shipment)
+}
+
+// getBorrowShipment is polled by the borrowed book page to show delivery progress.
+// Only the borrower and admins see the delivery address and tracking details.
+func getBorrowShipment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	borrowID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid borrow ID", http.StatusBadRequest)
+		return
+	}
+	if !requireBorrowerOrAdmin(w, r, borrowID) {
+		return
+	}
+
+	shipment, err := GetBorrowShipment(borrowID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if shipment == nil {
+		http.Error(w, "Shipment not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shipment)
+}
+
+func getShipment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	shipmentID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid shipment ID", http.StatusBadRequest)
+		return
+	}
+	if requireUser(w, r) == 0 {
+		return
+	}
+
+	shipment, err := GetShipmentByID(shipmentID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if shipment == nil {
+		http.Error(w, "Shipment not found", http.StatusNotFound)
+		return
+	}
+	if !requireBorrowerOrAdmin(w, r, shipment.BorrowID) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shipment)
+}
+
+func addShipmentEvent(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	shipmentID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid shipment ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Status   string `json:"status"`
+		Location string `json:"location"`
+		Note     string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Status == "" {
+		http.Error(w, "Status is required", http.StatusBadRequest)
+		return
+	}
+
+	shipment, err := UpdateShipmentStatus(shipmentID, req.Status, req.Location, req.Note, actingUserID(r))
+	if err != nil {
+		writeShipmentError(w, err, "Failed to update shipment")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shipment)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// recordingCourier remembers the shipments it was asked to book.
+type recordingCourier struct {
+	requests []ShipmentRequest
+}
+
+func (c *recordingCourier) Name() string { return "recording" }
+
+func (c *recordingCourier) CreateShipment(req ShipmentRequest) (string, error) {
+	c.requests = append(c.requests, req)
+	return "REC1", nil
+}
+
+func (c *recordingCourier) TrackingURL(string) string { return "" }
+
+func useRecordingCourier(t *testing.T) *recordingCourier {
+	t.Helper()
+	courier := &recordingCourier{}
+	previous := courierProvider
+	courierProvider = courier
+	t.Cleanup(func() { courierProvider = previous })
+	return courier
+}
+
+// newBorrowResponder answers the lookups createBorrowTx makes for member 5 borrowing book 7.
+func newBorrowResponder(query string, args []driver.Value) (*fakeRows, error) {
+	switch {
+	case strings.Contains(query, "FROM book WHERE book_id = ? FOR UPDATE"):
+		return fakeRow(int64(7)), nil
+	case strings.Contains(query, "FROM borrow br LEFT JOIN book bk"):
+		return fakeRow(int64(5), int64(7), "Title", int64(5)), nil
+	case strings.Contains(query, "SELECT user_id, book_id FROM borrow WHERE borrow_id"):
+		return fakeRow(int64(5), int64(7)), nil
+	case strings.Contains(query, "SELECT user_id, book_id, COALESCE(location_id, 0), status"):
+		return fakeRow(int64(5), int64(7), int64(0), BorrowStatusRequested, "delivery"), nil
+	}
+	return nil, nil
+}
+
+func TestCreateBorrowStoresTheDeliveryAddress(t *testing.T) {
+	fake := useFakeDB(t, newBorrowResponder)
+
+	now := time.Now()
+	if _, err := CreateBorrow(5, 7, 0, now, now.AddDate(0, 0, 14), "delivery", "Jl. Merdeka 1", &Quote{}); err != nil {
+		t.Fatal(err)
+	}
+
+	inserts := fake.Find("INSERT INTO borrow (", "delivery_address")
+	if len(inserts) != 1 {
+		t.Fatalf("got %d borrow inserts storing an address, want 1", len(inserts))
+	}
+	found := false
+	for _, arg := range inserts[0].Args {
+		if arg == "Jl. Merdeka 1" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("borrow insert args %v do not carry the delivery address", inserts[0].Args)
+	}
+}
+
+func TestCreateBorrowRefusesDeliveryWithoutAddress(t *testing.T) {
+	fake := useFakeDB(t, newBorrowResponder)
+
+	now := time.Now()
+	_, err := CreateBorrow(5, 7, 0, now, now.AddDate(0, 0, 14), "delivery", "  ", &Quote{})
+	if !errors.Is(err, ErrMissingDeliveryAddress) {
+		t.Fatalf("CreateBorrow = %v, want %v", err, ErrMissingDeliveryAddress)
+	}
+	if len(fake.Find("INSERT INTO borrow (")) != 0 {
+		t.Error("a delivery borrow without an address was inserted")
+	}
+}
+
+func TestCreateBorrowHandlerRejectsDeliveryWithoutAddress(t *testing.T) {
+	fake := useFakeDB(t, nil)
+
+	body := `{"user_id": 5, "book_id": 7, "delivery_type": "delivery"}`
+	rec := httptest.NewRecorder()
+	createBorrow(rec, httptest.NewRequest(http.MethodPost, "/borrows", strings.NewReader(body)))
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if len(fake.Statements()) != 0 {
+		t.Errorf("ran %d statements before rejecting the request", len(fake.Statements()))
+	}
+}
+
+func TestCreateShipmentNeedsAnAddress(t *testing.T) {
+	courier := useRecordingCourier(t)
+	useFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+		if strings.Contains(query, "COALESCE(delivery_address, ''), user_id FROM borrow") {
+			return fakeRow(BorrowStatusApproved, "delivery", "", int64(5)), nil
+		}
+		return nil, nil
+	})
+
+	_, err := CreateShipment(9)
+	if !errors.Is(err, ErrMissingDeliveryAddress) {
+		t.Fatalf("CreateShipment = %v, want %v", err, ErrMissingDeliveryAddress)
+	}
+	if len(courier.requests) != 0 {
+		t.Errorf("booked %d courier shipments to an empty address", len(courier.requests))
+	}
+}
+
+// shipmentResponder answers lookups of shipment 4, which delivers borrow 9 of member 5.
+func shipmentResponder(query string, args []driver.Value) (*fakeRows, error) {
+	if rows, ok := userRows(query, args, map[int64]string{5: "member", 6: "member", 1: "admin"}); ok {
+		return rows, nil
+	}
+	now := time.Now()
+	switch {
+	case strings.Contains(query, "FROM borrow WHERE borrow_id = ?") && strings.Contains(query, "renewal_count"):
+		return fakeRow(int64(9), int64(5), int64(7), now, now, nil, BorrowStatusApproved, "delivery", int64(0), "",
+			"Jl. Merdeka 1", 40000.0, int64(0), int64(0), PayablePaid), nil
+	case strings.Contains(query, "SELECT shipment_id FROM shipment WHERE borrow_id"):
+		return fakeRow(int64(4)), nil
+	case strings.Contains(query, "FROM shipment WHERE shipment_id"):
+		return fakeRow(int64(4), int64(9), "local", "LM1", "Jl. Merdeka 1", ShipmentStatusShipped, now, now), nil
+	}
+	return nil, nil
+}
+
+func TestShipmentsAreVisibleToTheirBorrowerAndAdmins(t *testing.T) {
+	useFakeDB(t, shipmentResponder)
+	router := mux.NewRouter()
+	router.HandleFunc("/api/borrows/{id}/shipment", getBorrowShipment).Methods("GET")
+	router.HandleFunc("/api/shipments/{id}", getShipment).Methods("GET")
+
+	tests := []struct {
+		path, caller string
+		want         int
+	}{
+		{"/api/borrows/9/shipment", "", http.StatusUnauthorized},
+		{"/api/borrows/9/shipment", "5", http.StatusOK},
+		{"/api/borrows/9/shipment", "1", http.StatusOK},
+		{"/api/borrows/9/shipment", "6", http.StatusForbidden},
+		{"/api/shipments/4", "", http.StatusUnauthorized},
+		{"/api/shipments/4", "5", http.StatusOK},
+		{"/api/shipments/4", "1", http.StatusOK},
+		{"/api/shipments/4", "6", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		if tt.caller != "" {
+			req.Header.Set("X-User-ID", tt.caller)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("GET %s as %q = %d, want %d", tt.path, tt.caller, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestCanTransitionShipment(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{ShipmentStatusPacked, ShipmentStatusShipped, true},
+		{ShipmentStatusPacked, ShipmentStatusDelivered, false},
+		{ShipmentStatusShipped, ShipmentStatusOutForDelivery, true},
+		{ShipmentStatusShipped, ShipmentStatusDelivered, true},
+		{ShipmentStatusOutForDelivery, ShipmentStatusReturnedToSender, true},
+		{ShipmentStatusOutForDelivery, ShipmentStatusShipped, false},
+		{ShipmentStatusDelivered, ShipmentStatusReturnedToSender, false},
+		{ShipmentStatusReturnedToSender, ShipmentStatusShipped, false},
+	}
+	for _, tt := range tests {
+		if got := canTransitionShipment(tt.from, tt.to); got != tt.want {
+			t.Errorf("canTransitionShipment(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+// deliveryBorrowResponder answers CreateShipment for borrow 9 of member 5, with the given
+// status and delivery type and an open shipment when open is set.
+func deliveryBorrowResponder(status, deliveryType string, open bool) fakeResponder {
+	return func(query string, args []driver.Value) (*fakeRows, error) {
+		if rows, ok := userRows(query, args, map[int64]string{5: "member"}); ok {
+			return rows, nil
+		}
+		switch {
+		case strings.Contains(query, "COALESCE(delivery_address, ''), user_id FROM borrow"):
+			return fakeRow(status, deliveryType, "Jl. Merdeka 1", int64(5)), nil
+		case strings.Contains(query, "WHERE borrow_id = ? AND status NOT IN"):
+			if open {
+				return fakeRow(int64(4)), nil
+			}
+		case strings.Contains(query, "FROM shipment WHERE shipment_id"):
+			return fakeRow(args[0], int64(9), "recording", "REC1", "Jl. Merdeka 1", ShipmentStatusPacked, time.Now(), time.Now()), nil
+		}
+		return nil, nil
+	}
+}
+
+func TestCreateShipmentBooksTheCourier(t *testing.T) {
+	courier := useRecordingCourier(t)
+	fake := useFakeDB(t, deliveryBorrowResponder(BorrowStatusApproved, "delivery", false))
+
+	shipment, err := CreateShipment(9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(courier.requests) != 1 || courier.requests[0].Address != "Jl. Merdeka 1" || courier.requests[0].Recipient != "Member" {
+		t.Errorf("courier requests = %+v, want one to the member's delivery address", courier.requests)
+	}
+	if shipment.TrackingNumber != "REC1" || shipment.Status != ShipmentStatusPacked {
+		t.Errorf("shipment = %+v", shipment)
+	}
+	if len(fake.Find("INSERT INTO shipment_event")) != 1 {
+		t.Error("the packed event was not recorded")
+	}
+}
+
+func TestCreateShipmentRefusals(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       string
+		deliveryType string
+		open         bool
+		want         error
+	}{
+		{"pickup borrow", BorrowStatusApproved, "pickup", false, ErrNotDeliveryBorrow},
+		{"not approved", BorrowStatusRequested, "delivery", false, ErrNotDeliveryBorrow},
+		{"already shipping", BorrowStatusApproved, "delivery", true, ErrShipmentExists},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			courier := useRecordingCourier(t)
+			useFakeDB(t, deliveryBorrowResponder(tt.status, tt.deliveryType, tt.open))
+
+			if _, err := CreateShipment(9); !errors.Is(err, tt.want) {
+				t.Fatalf("CreateShipment = %v, want %v", err, tt.want)
+			}
+			if len(courier.requests) != 0 {
+				t.Error("a refused shipment was booked with the courier")
+			}
+		})
+	}
+}
+
+func TestUpdateShipmentStatusRefusesSkippedSteps(t *testing.T) {
+	fake := useFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+		if strings.Contains(query, "SELECT status, borrow_id FROM shipment") {
+			return fakeRow(ShipmentStatusPacked, int64(9)), nil
+		}
+		return nil, nil
+	})
+
+	_, err := UpdateShipmentStatus(4, ShipmentStatusDelivered, "", "", 1)
+	if !errors.Is(err, ErrInvalidShipmentTransition) {
+		t.Fatalf("UpdateShipmentStatus = %v, want %v", err, ErrInvalidShipmentTransition)
+	}
+	if len(fake.Find("UPDATE shipment SET status")) != 0 {
+		t.Error("the refused status was stored")
+	}
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============ INTER-LOCATION TRANSFERS ============
+
+// A transfer moves one copy of a book, i.e. one unit of book_location stock, between branches.
+// The stock only moves when the receiving branch confirms arrival, so the total number of
+// copies stays the same while the copy is on the road.
+const (
+	TransferStatusRequested = "requested"
+	TransferStatusInTransit = "in_transit"
+	TransferStatusReceived  = "received"
+	TransferStatusCancelled = "cancelled"
+)
+
+const (
+	TransferReasonManual = "manual"
+	TransferReasonHold   = "hold"
+	TransferReasonPickup = "pickup"
+)
+
+var (
+	ErrTransferNotFound     = errors.New("transfer not found")
+	ErrTransferInvalidState = errors.New("transfer cannot change from its current status")
+	ErrTransferNoStock      = errors.New("the sending location has no copy of this book")
+	ErrTransferSameLocation = errors.New("a transfer needs two different locations")
+	ErrTransferPending      = errors.New("the copy is still being transferred to the pickup location")
+)
+
+// openTransferStatuses are the statuses of transfers whose copy has not arrived yet.
+var openTransferStatuses = []string{TransferStatusRequested, TransferStatusInTransit}
+
+type Transfer struct {
+	TransferID       int        `json:"transfer_id"`
+	BookID           int        `json:"book_id"`
+	BookTitle        string     `json:"book_title"`
+	FromLocationID   int        `json:"from_location_id"`
+	FromLocationName string     `json:"from_location_name"`
+	ToLocationID     int        `json:"to_location_id"`
+	ToLocationName   string     `json:"to_location_name"`
+	Status           string     `json:"status"`
+	Reason           string     `json:"reason"`
+	HoldID           *int       `json:"hold_id"`
+	BorrowID         *int       `json:"borrow_id"`
+	RequestedBy      *int       `json:"requested_by"`
+	DispatchedBy     *int       `json:"dispatched_by"`
+	ReceivedBy       *int       `json:"received_by"`
+	CreatedAt        time.Time  `json:"created_at"`
+	DispatchedAt     *time.Time `json:"dispatched_at"`
+	ReceivedAt       *time.Time `json:"received_at"`
+}
+
+// shelfCopiesAtTx returns the copies of a book on a branch's shelf, net of loans and outgoing transfers.
+func shelfCopiesAtTx(tx *sql.Tx, bookID, locationID int) (int, error) {
+	onShelf, args := shelfCopiesSQL()
+	var copies int
+	err := tx.QueryRow("SELECT COALESCE(SUM("+onShelf+"), 0) FROM book_location bl WHERE bl.book_id = ? AND bl.location_id = ?",
+		append(args, bookID, locationID)...).Scan(&copies)
+	return copies, err
+}
+
+// transferSourceTx picks the location other than exclude with the most copies of a book on its shelf, or 0.
+func transferSourceTx(tx *sql.Tx, bookID, exclude int) (int, error) {
+	onShelf, args := shelfCopiesSQL()
+	var locationID int
+	err := tx.QueryRow(`
+		SELECT bl.location_id FROM book_location bl
+		JOIN location l ON l.location_id = bl.location_id
+		WHERE bl.book_id = ? AND bl.location_id <> ? AND l.archived_at IS NULL AND `+onShelf+` > 0
+		ORDER BY `+onShelf+` DESC, bl.location_id LIMIT 1
+	`, append(append([]interface{}{bookID, exclude}, args...), args...)...).Scan(&locationID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return locationID, err
+}
+
+func requestTransferTx(tx *sql.Tx, bookID, fromLocationID, toLocationID int, reason string, holdID, borrowID, requestedBy int) (int, error) {
+	if fromLocationID == toLocationID {
+		return 0, ErrTransferSameLocation
+	}
+	onShelf, err := shelfCopiesAtTx(tx, bookID, fromLocationID)
+	if err != nil {
+		return 0, err
+	}
+	if onShelf <= 0 {
+		return 0, ErrTransferNoStock
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO location_transfer (book_id, from_location_id, to_location_id, status, reason, hold_id, borrow_id, requested_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, NOW())
+	`, bookID, fromLocationID, toLocationID, TransferStatusRequested, reason,
+		nullableID(holdID), nullableID(borrowID), nullableID(requestedBy))
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// RequestTransfer asks one branch to send a copy of a book to another.
+func RequestTransfer(bookID, fromLocationID, toLocationID, requestedBy int) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	transferID, err := requestTransferTx(tx, bookID, fromLocationID, toLocationID, TransferReasonManual, 0, 0, requestedBy)
+	if err != nil {
+		return 0, err
+	}
+	return transferID, tx.Commit()
+}
+
+// transferForHoldTx sends a copy freed at locationID to the oldest waiting hold that wants it
+// somewhere else. It is used when no hold can collect the copy where it is. It returns the
+// transfer ID, or 0 when no hold is waiting elsewhere.
+func transferForHoldTx(tx *sql.Tx, bookID, locationID int) (int, error) {
+	if locationID == 0 {
+		return 0, nil
+	}
+
+	var holdID, holdLocationID int
+	err := tx.QueryRow(`
+		SELECT h.hold_id, h.location_id FROM book_hold h
+		WHERE h.book_id = ? AND h.status = 'waiting' AND h.location_id IS NOT NULL AND h.location_id <> ?
+		  AND NOT EXISTS (
+		      SELECT 1 FROM location_transfer t
+		      WHERE t.hold_id = h.hold_id AND t.status IN ('requested', 'in_transit')
+		  )
+		ORDER BY h.created_at, h.hold_id
+		LIMIT 1
+		FOR UPDATE
+	`, bookID, locationID).Scan(&holdID, &holdLocationID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	transferID, err := requestTransferTx(tx, bookID, locationID, holdLocationID, TransferReasonHold, holdID, 0, 0)
+	if errors.Is(err, ErrTransferNoStock) {
+		return 0, nil
+	}
+	return transferID, err
+}
+
+// transferForPickupTx requests a transfer when a pickup borrow is placed at a branch that has
+// no copy left on its shelf for it.
+func transferForPickupTx(tx *sql.Tx, borrowID, bookID, locationID int) error {
+	if locationID == 0 {
+		return nil
+	}
+
+	var hasStockRows bool
+	err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM book_location WHERE book_id = ?)", bookID).Scan(&hasStockRows)
+	if err != nil || !hasStockRows {
+		return err
+	}
+
+	placeholders, args := sqlInList(activeBorrowStatuses)
+	var onShelf int
+	err = tx.QueryRow(`
+		SELECT
+			COALESCE((SELECT SUM(stock) FROM book_location WHERE book_id = ? AND location_id = ?), 0)
+			+ (SELECT COUNT(*) FROM location_transfer WHERE book_id = ? AND to_location_id = ? AND status IN ('requested', 'in_transit'))
+			- (SELECT COUNT(*) FROM borrow WHERE book_id = ? AND location_id = ? AND borrow_id <> ? AND status IN (`+placeholders+`))
+	`, append([]interface{}{bookID, locationID, bookID, locationID, bookID, locationID, borrowID}, args...)...).Scan(&onShelf)
+	if err != nil || onShelf > 0 {
+		return err
+	}
+
+	source, err := transferSourceTx(tx, bookID, locationID)
+	if err != nil || source == 0 {
+		return err
+	}
+	_, err = requestTransferTx(tx, bookID, source, locationID, TransferReasonPickup, 0, borrowID, 0)
+	return err
+}
+
+// checkBorrowTransferTx fails while a copy for the borrow is still on its way to the pickup location.
+func checkBorrowTransferTx(tx *sql.Tx, borrowID int) error {
+	var open int
+	err := tx.QueryRow("SELECT COUNT(*) FROM location_transfer WHERE borrow_id = ? AND status IN ('requested', 'in_transit')", borrowID).
+		Scan(&open)
+	if err != nil {
+		return err
+	}
+	if open > 0 {
+		return ErrTransferPending
+	}
+	return nil
+}
+
+// cancelRequestedTransfersTx withdraws transfers for a hold or borrow that no longer needs the copy.
+// Copies already on the road keep going and join the stock of the receiving branch.
+func cancelRequestedTransfersTx(tx *sql.Tx, column string, id int) error {
+	_, err := tx.Exec(fmt.Sprintf("UPDATE location_transfer SET status = ?, cancelled_at = NOW() WHERE %s = ? AND status = ?", column),
+		TransferStatusCancelled, id, TransferStatusRequested)
+	return err
+}
+
+// DispatchTransfer records the sending branch handing the copy over for transport.
+func DispatchTransfer(transferID, staffID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	transfer, err := lockTransferTx(tx, transferID)
+	if err != nil {
+		return err
+	}
+	if transfer.Status != TransferStatusRequested {
+		return fmt.Errorf("%w: %s", ErrTransferInvalidState, transfer.Status)
+	}
+	onShelf, err := shelfCopiesAtTx(tx, transfer.BookID, transfer.FromLocationID)
+	if err != nil {
+		return err
+	}
+	// The transfer being dispatched is itself counted as leaving the shelf
+	if onShelf < 0 {
+		return ErrTransferNoStock
+	}
+
+	_, err = tx.Exec("UPDATE location_transfer SET status = ?, dispatched_by = ?, dispatched_at = NOW() WHERE transfer_id = ?",
+		TransferStatusInTransit, nullableID(staffID), transferID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ReceiveTransfer records the copy arriving, moves the stock and readies the hold it was sent for.
+func ReceiveTransfer(transferID, staffID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	transfer, err := lockTransferTx(tx, transferID)
+	if err != nil {
+		return err
+	}
+	if transfer.Status != TransferStatusInTransit {
+		return fmt.Errorf("%w: %s", ErrTransferInvalidState, transfer.Status)
+	}
+
+	if err := moveCopyStockTx(tx, transfer.BookID, transfer.FromLocationID, transfer.ToLocationID); err != nil {
+		return err
+	}
+	if err := relocateAnyCopyTx(tx, transfer.BookID, transfer.FromLocationID, transfer.ToLocationID); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE location_transfer SET status = ?, received_by = ?, received_at = NOW() WHERE transfer_id = ?",
+		TransferStatusReceived, nullableID(staffID), transferID)
+	if err != nil {
+		return err
+	}
+
+	if transfer.HoldID != nil {
+		var holdStatus string
+		err := tx.QueryRow("SELECT status FROM book_hold WHERE hold_id = ? FOR UPDATE", *transfer.HoldID).Scan(&holdStatus)
+		if err != nil {
+			return err
+		}
+		if holdStatus == HoldStatusWaiting {
+			_, err = tx.Exec("UPDATE book_hold SET status = ?, ready_at = NOW(), pickup_deadline = ? WHERE hold_id = ?",
+				HoldStatusReady, time.Now().Add(holdPickupWindow), *transfer.HoldID)
+			if err == nil {
+				err = notifyHoldReadyTx(tx, *transfer.HoldID)
+			}
+		} else {
+			_, err = assignNextHoldTx(tx, transfer.BookID, transfer.ToLocationID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// CancelTransfer withdraws a transfer that has not left the sending branch yet.
+func CancelTransfer(transferID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	transfer, err := lockTransferTx(tx, transferID)
+	if err != nil {
+		return err
+	}
+	if transfer.Status != TransferStatusRequested {
+		return fmt.Errorf("%w: %s", ErrTransferInvalidState, transfer.Status)
+	}
+	if err := cancelRequestedTransfersTx(tx, "transfer_id", transferID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const transferSelect = `
+	SELECT t.transfer_id, t.book_id, COALESCE(b.title, ''), t.from_location_id, COALESCE(lf.location_name, ''),
+	       t.to_location_id, COALESCE(lt.location_name, ''), t.status, t.reason, t.hold_id, t.borrow_id,
+	       t.requested_by, t.dispatched_by, t.received_by, t.created_at, t.dispatched_at, t.received_at
+	FROM location_transfer t
+	LEFT JOIN book b ON b.book_id = t.book_id
+	LEFT JOIN location lf ON lf.location_id = t.from_location_id
+	LEFT JOIN location lt ON lt.location_id = t.to_location_id
+`
+
+func scanTransfer(scanner interface{ Scan(...interface{}) error }) (*Transfer, error) {
+	var t Transfer
+	var holdID, borrowID, requestedBy, dispatchedBy, receivedBy sql.NullInt64
+	var dispatchedAt, receivedAt sql.NullTime
+	err := scanner.Scan(&t.TransferID, &t.BookID, &t.BookTitle, &t.FromLocationID, &t.FromLocationName,
+		&t.ToLocationID, &t.ToLocationName, &t.Status, &t.Reason, &holdID, &borrowID,
+		&requestedBy, &dispatchedBy, &receivedBy, &t.CreatedAt, &dispatchedAt, &receivedAt)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range []struct {
+		value  sql.NullInt64
+		target **int
+	}{{holdID, &t.HoldID}, {borrowID, &t.BorrowID}, {requestedBy, &t.RequestedBy}, {dispatchedBy, &t.DispatchedBy}, {receivedBy, &t.ReceivedBy}} {
+		if field.value.Valid {
+			id := int(field.value.Int64)
+			*field.target = &id
+		}
+	}
+	if dispatchedAt.Valid {
+		t.DispatchedAt = &dispatchedAt.Time
+	}
+	if receivedAt.Valid {
+		t.ReceivedAt = &receivedAt.Time
+	}
+	return &t, nil
+}
+
+func lockTransferTx(tx *sql.Tx, transferID int) (*Transfer, error) {
+	transfer, err := scanTransfer(tx.QueryRow(transferSelect+" WHERE t.transfer_id = ? FOR UPDATE", transferID))
+	if err == sql.ErrNoRows {
+		return nil, ErrTransferNotFound
+	}
+	return transfer, err
+}
+
+func GetTransfer(transferID int) (*Transfer, error) {
+	transfer, err := scanTransfer(db.QueryRow(transferSelect+" WHERE t.transfer_id = ?", transferID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return transfer, err
+}
+
+// GetLocationTransfers lists a location's transfers, newest first. direction is "inbound",
+// "outbound" or empty for both; openOnly drops received and cancelled transfers.
+func GetLocationTransfers(locationID int, direction string, openOnly bool) ([]Transfer, error) {
+	where := " WHERE (t.from_location_id = ? OR t.to_location_id = ?)"
+	args := []interface{}{locationID, locationID}
+	switch direction {
+	case "inbound":
+		where = " WHERE t.to_location_id = ?"
+		args = args[:1]
+	case "outbound":
+		where = " WHERE t.from_location_id = ?"
+		args = args[:1]
+	}
+	if openOnly {
+		placeholders, statusArgs := sqlInList(openTransferStatuses)
+		where += " AND t.status IN (" + placeholders + ")"
+		args = append(args, statusArgs...)
+	}
+
+	rows, err := db.Query(transferSelect+where+" ORDER BY t.created_at DESC, t.transfer_id DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transfers := []Transfer{}
+	for rows.Next() {
+		transfer, err := scanTransfer(rows)
+		if err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, *transfer)
+	}
+	return transfers, nil
+}
+
+// ============ TRANSFER HANDLERS ============
+
+func writeTransferError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, ErrTransferNotFound):
+		http.Error(w, "Transfer not found", http.StatusNotFound)
+	case errors.Is(err, ErrTransferSameLocation):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrTransferInvalidState), errors.Is(err, ErrTransferNoStock):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, fallback, http.StatusInternalServerError)
+	}
+}
+
+// loadTransfer reads the {id} path variable and the transfer it names, writing an error if either fails.
+func loadTransfer(w http.ResponseWriter, r *http.Request) *Transfer {
+	transferID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid transfer ID", http.StatusBadRequest)
+		return nil
+	}
+	transfer, err := GetTransfer(transferID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return nil
+	}
+	if transfer == nil {
+		http.Error(w, "Transfer not found", http.StatusNotFound)
+		return nil
+	}
+	return transfer
+}
+
+// createTransfer lets the staff of the receiving branch ask another branch for a copy.
+func createTransfer(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		BookID         int `json:"book_id"`
+		FromLocationID int `json:"from_location_id"`
+		ToLocationID   int `json:"to_location_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.BookID == 0 || req.FromLocationID == 0 || req.ToLocationID == 0 {
+		http.Error(w, "book_id, from_location_id and to_location_id are required", http.StatusBadRequest)
+		return
+	}
+	if !requireLocationManager(w, r, req.ToLocationID) {
+		return
+	}
+
+	transferID, err := RequestTransfer(req.BookID, req.FromLocationID, req.ToLocationID, actingUserID(r))
+	if err != nil {
+		writeTransferError(w, err, "Failed to request transfer")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"message":     "Transfer requested successfully",
+		"transfer_id": transferID,
+	})
+}
+
+func getTransfer(w http.ResponseWriter, r *http.Request) {
+	transfer := loadTransfer(w, r)
+	if transfer == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transfer)
+}
+
+// dispatchTransfer is confirmed by the staff of the sending branch.
+func dispatchTransfer(w http.ResponseWriter, r *http.Request) {
+	transfer := loadTransfer(w, r)
+	if transfer == nil || !requireLocationManager(w, r, transfer.FromLocationID) {
+		return
+	}
+
+	if err := DispatchTransfer(transfer.TransferID, actingUserID(r)); err != nil {
+		writeTransferError(w, err, "Failed to dispatch transfer")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Transfer dispatched",
+	})
+}
+
+// receiveTransfer is confirmed by the staff of the receiving branch.
+func receiveTransfer(w http.ResponseWriter, r *http.Request) {
+	transfer := loadTransfer(w, r)
+	if transfer == nil || !requireLocationManager(w, r, transfer.ToLocationID) {
+		return
+	}
+
+	if err := ReceiveTransfer(transfer.TransferID, actingUserID(r)); err != nil {
+		writeTransferError(w, err, "Failed to receive transfer")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Transfer received",
+	})
+}
+
+// cancelTransfer may be done by the staff of the receiving branch before the copy is dispatched.
+func cancelTransfer(w http.ResponseWriter, r *http.Request) {
+	transfer := loadTransfer(w, r)
+	if transfer == nil || !requireLocationManager(w, r, transfer.ToLocationID) {
+		return
+	}
+
+	if err := CancelTransfer(transfer.TransferID); err != nil {
+		writeTransferError(w, err, "Failed to cancel transfer")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Transfer cancelled",
+	})
+}
+
+// getLocationTransfers lists a branch's transfers; ?direction=inbound|outbound and ?open=true filter them.
+func getLocationTransfers(w http.ResponseWriter, r *http.Request) {
+	locationID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid location ID", http.StatusBadRequest)
+		return
+	}
+	if !requireLocationManager(w, r, locationID) {
+		return
+	}
+
+	direction := r.URL.Query().Get("direction")
+	if direction != "" && direction != "inbound" && direction != "outbound" {
+		http.Error(w, "direction must be inbound or outbound", http.StatusBadRequest)
+		return
+	}
+
+	transfers, err := GetLocationTransfers(locationID, direction, r.URL.Query().Get("open") == "true")
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transfers)
+}
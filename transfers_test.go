@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// transferRow is transfer 6 of book 7 from location 1 to location 2 as lockTransferTx reads it.
+func transferRow(status string, holdID interface{}) *fakeRows {
+	return fakeRow(int64(6), int64(7), "Title", int64(1), "North", int64(2), "South", status, TransferReasonHold,
+		holdID, nil, nil, nil, nil, time.Now(), nil, nil)
+}
+
+// shelfResponder answers shelfCopiesAtTx with the given number of copies.
+func shelfResponder(copies int64) fakeResponder {
+	return func(query string, args []driver.Value) (*fakeRows, error) {
+		if strings.Contains(query, "FROM book_location bl WHERE bl.book_id = ? AND bl.location_id = ?") {
+			return fakeRow(copies), nil
+		}
+		return nil, nil
+	}
+}
+
+func TestRequestTransferRefusals(t *testing.T) {
+	fake := useFakeDB(t, shelfResponder(0))
+	if _, err := RequestTransfer(7, 1, 1, 3); !errors.Is(err, ErrTransferSameLocation) {
+		t.Errorf("transfer to the same location = %v, want %v", err, ErrTransferSameLocation)
+	}
+	if _, err := RequestTransfer(7, 1, 2, 3); !errors.Is(err, ErrTransferNoStock) {
+		t.Errorf("transfer without stock = %v, want %v", err, ErrTransferNoStock)
+	}
+	if len(fake.Find("INSERT INTO location_transfer")) != 0 {
+		t.Error("a refused transfer was requested")
+	}
+}
+
+func TestRequestTransfer(t *testing.T) {
+	fake := useFakeDB(t, shelfResponder(1))
+
+	if _, err := RequestTransfer(7, 1, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	inserts := fake.Find("INSERT INTO location_transfer")
+	if len(inserts) != 1 || inserts[0].Args[3] != TransferStatusRequested || inserts[0].Args[4] != TransferReasonManual {
+		t.Errorf("inserts = %+v, want one requested manual transfer", inserts)
+	}
+}
+
+func TestTransferStateChecks(t *testing.T) {
+	tests := []struct {
+		name   string
+		status string
+		act    func() error
+	}{
+		{"dispatch in transit", TransferStatusInTransit, func() error { return DispatchTransfer(6, 1) }},
+		{"receive before dispatch", TransferStatusRequested, func() error { return ReceiveTransfer(6, 1) }},
+		{"receive twice", TransferStatusReceived, func() error { return ReceiveTransfer(6, 1) }},
+		{"cancel in transit", TransferStatusInTransit, func() error { return CancelTransfer(6) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+				if strings.Contains(query, "FROM location_transfer t") {
+					return transferRow(tt.status, nil), nil
+				}
+				return nil, nil
+			})
+			if err := tt.act(); !errors.Is(err, ErrTransferInvalidState) {
+				t.Fatalf("got %v, want %v", err, ErrTransferInvalidState)
+			}
+			if len(fake.Find("UPDATE location_transfer")) != 0 || len(fake.Find("UPDATE book_location")) != 0 {
+				t.Error("a refused change was written")
+			}
+		})
+	}
+
+	useFakeDB(t, nil)
+	if err := DispatchTransfer(6, 1); !errors.Is(err, ErrTransferNotFound) {
+		t.Errorf("dispatching an unknown transfer = %v, want %v", err, ErrTransferNotFound)
+	}
+}
+
+func TestReceiveTransferMovesStockAndReadiesTheHold(t *testing.T) {
+	fake := useFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+		switch {
+		case strings.Contains(query, "FROM location_transfer t"):
+			return transferRow(TransferStatusInTransit, int64(11)), nil
+		case strings.Contains(query, "SELECT status FROM book_hold WHERE hold_id = ? FOR UPDATE"):
+			return fakeRow(HoldStatusWaiting), nil
+		case strings.Contains(query, "FROM book_hold h LEFT JOIN book b"):
+			return fakeRow(int64(5), int64(7), "Title", time.Now()), nil
+		}
+		return nil, nil
+	})
+
+	if err := ReceiveTransfer(6, 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.Find("UPDATE book_location SET stock = stock - 1")) != 1 || len(fake.Find("UPDATE book_location SET stock = stock + 1")) != 1 {
+		t.Error("the copy's stock did not move between the locations")
+	}
+	ready := fake.Find("UPDATE book_hold SET status = ?, ready_at = NOW()")
+	if len(ready) != 1 || ready[0].Args[0] != HoldStatusReady || ready[0].Args[2] != int64(11) {
+		t.Errorf("hold updates = %+v, want hold 11 ready", ready)
+	}
+	if fake.Index("COMMIT") < 0 {
+		t.Error("the receipt was not committed")
+	}
+}
+
+func TestCheckBorrowTransfer(t *testing.T) {
+	for open, want := range map[int64]error{0: nil, 1: ErrTransferPending} {
+		useFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+			return fakeRow(open), nil
+		})
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkBorrowTransferTx(tx, 9); !errors.Is(err, want) {
+			t.Errorf("with %d open transfers = %v, want %v", open, err, want)
+		}
+		tx.Rollback()
+	}
+}
+
+func TestPickupWithoutShelfCopyRequestsATransfer(t *testing.T) {
+	fake := useFakeDB(t, func(query string, args []driver.Value) (*fakeRows, error) {
+		switch {
+		case strings.Contains(query, "SELECT EXISTS(SELECT 1 FROM book_location"):
+			return fakeRow(true), nil
+		case strings.Contains(query, "SELECT bl.location_id FROM book_location bl"):
+			return fakeRow(int64(1)), nil
+		case strings.Contains(query, "FROM book_location bl WHERE bl.book_id = ? AND bl.location_id = ?"):
+			return fakeRow(int64(2)), nil
+		case strings.Contains(query, "SELECT COALESCE((SELECT SUM(stock)"):
+			return fakeRow(int64(0)), nil
+		}
+		return nil, nil
+	})
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	if err := transferForPickupTx(tx, 9, 7, 2); err != nil {
+		t.Fatal(err)
+	}
+	inserts := fake.Find("INSERT INTO location_transfer")
+	if len(inserts) != 1 {
+		t.Fatalf("got %d transfers, want 1", len(inserts))
+	}
+	args := inserts[0].Args
+	if args[1] != int64(1) || args[2] != int64(2) || args[4] != TransferReasonPickup || args[6] != int64(9) {
+		t.Errorf("transfer args = %v, want a pickup transfer from 1 to 2 for borrow 9", args)
+	}
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============ VOUCHERS ============
+
+const (
+	VoucherPercentage = "percentage"
+	VoucherFixed      = "fixed"
+)
+
+// PricingDiscount is the quote line code of a voucher discount.
+const PricingDiscount = "discount"
+
+var ErrVoucherInvalid = errors.New("voucher cannot be used")
+
+// Voucher is a promo code. Zero limits mean unlimited; nil restrictions apply everywhere.
+type Voucher struct {
+	VoucherID      int        `json:"voucher_id"`
+	Code           string     `json:"code"`
+	Description    string     `json:"description"`
+	DiscountType   string     `json:"discount_type"`
+	Value          float64    `json:"value"`
+	MinSpend       float64    `json:"min_spend"`
+	CategoryID     *int       `json:"category_id"`
+	LocationID     *int       `json:"location_id"`
+	NewMembersOnly bool       `json:"new_members_only"`
+	MaxUses        int        `json:"max_uses"`
+	MaxUsesPerUser int        `json:"max_uses_per_user"`
+	ValidFrom      *time.Time `json:"valid_from"`
+	ValidUntil     *time.Time `json:"valid_until"`
+	Active         bool       `json:"active"`
+	TimesRedeemed  int        `json:"times_redeemed"`
+}
+
+type VoucherRedemption struct {
+	RedemptionID int        `json:"redemption_id"`
+	VoucherID    int        `json:"voucher_id"`
+	UserID       int        `json:"user_id"`
+	OrderID      *int       `json:"order_id"`
+	BorrowID     *int       `json:"borrow_id"`
+	Amount       float64    `json:"amount"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ReleasedAt   *time.Time `json:"released_at"`
+}
+
+const voucherSelect = `
+	SELECT v.voucher_id, v.code, COALESCE(v.description, ''), v.discount_type, v.value, v.min_spend, v.category_id,
+	       v.location_id, v.new_members_only, v.max_uses, v.max_uses_per_user, v.valid_from, v.valid_until, v.active,
+	       (SELECT COUNT(*) FROM voucher_redemption r WHERE r.voucher_id = v.voucher_id AND r.released_at IS NULL)
+	FROM voucher v`
+
+func scanVoucher(scanner interface{ Scan(...interface{}) error }) (*Voucher, error) {
+	var v Voucher
+	var categoryID, locationID sql.NullInt64
+	var validFrom, validUntil sql.NullTime
+	err := scanner.Scan(&v.VoucherID, &v.Code, &v.Description, &v.DiscountType, &v.Value, &v.MinSpend, &categoryID,
+		&locationID, &v.NewMembersOnly, &v.MaxUses, &v.MaxUsesPerUser, &validFrom, &validUntil, &v.Active, &v.TimesRedeemed)
+	if err != nil {
+		return nil, err
+	}
+	if categoryID.Valid {
+		id := int(categoryID.Int64)
+		v.CategoryID = &id
+	}
+	if locationID.Valid {
+		id := int(locationID.Int64)
+		v.LocationID = &id
+	}
+	if validFrom.Valid {
+		v.ValidFrom = &validFrom.Time
+	}
+	if validUntil.Valid {
+		v.ValidUntil = &validUntil.Time
+	}
+	return &v, nil
+}
+
+func GetVouchers() ([]Voucher, error) {
+	rows, err := db.Query(voucherSelect + " ORDER BY v.voucher_id DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	vouchers := []Voucher{}
+	for rows.Next() {
+		v, err := scanVoucher(rows)
+		if err != nil {
+			return nil, err
+		}
+		vouchers = append(vouchers, *v)
+	}
+	return vouchers, nil
+}
+
+func GetVoucherByCode(code string) (*Voucher, error) {
+	v, err := scanVoucher(db.QueryRow(voucherSelect+" WHERE v.code = ?", strings.ToUpper(code)))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return v, err
+}
+
+func CreateVoucher(v Voucher) (int, error) {
+	result, err := db.Exec(`
+		INSERT INTO voucher (code, description, discount_type, value, min_spend, category_id, location_id,
+		                     new_members_only, max_uses, max_uses_per_user, valid_from, valid_until, active)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, strings.ToUpper(v.Code), v.Description, v.DiscountType, v.Value, v.MinSpend, v.CategoryID, v.LocationID,
+		v.NewMembersOnly, v.MaxUses, v.MaxUsesPerUser, v.ValidFrom, v.ValidUntil, v.Active)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+func VoucherExists(voucherID int) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM voucher WHERE voucher_id = ?", voucherID).Scan(&count)
+	return count > 0, err
+}
+
+func UpdateVoucher(v Voucher) error {
+	_, err := db.Exec(`
+		UPDATE voucher SET code = ?, description = ?, discount_type = ?, value = ?, min_spend = ?, category_id = ?,
+		       location_id = ?, new_members_only = ?, max_uses = ?, max_uses_per_user = ?, valid_from = ?,
+		       valid_until = ?, active = ?
+		WHERE voucher_id = ?
+	`, strings.ToUpper(v.Code), v.Description, v.DiscountType, v.Value, v.MinSpend, v.CategoryID, v.LocationID,
+		v.NewMembersOnly, v.MaxUses, v.MaxUsesPerUser, v.ValidFrom, v.ValidUntil, v.Active, v.VoucherID)
+	return err
+}
+
+func DeleteVoucher(voucherID int) error {
+	_, err := db.Exec("DELETE FROM voucher WHERE voucher_id = ?", voucherID)
+	return err
+}
+
+func GetVoucherRedemptions(voucherID int) ([]VoucherRedemption, error) {
+	rows, err := db.Query(`
+		SELECT redemption_id, voucher_id, user_id, order_id, borrow_id, amount, created_at, released_at
+		FROM voucher_redemption WHERE voucher_id = ? ORDER BY created_at DESC
+	`, voucherID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	redemptions := []VoucherRedemption{}
+	for rows.Next() {
+		var r VoucherRedemption
+		var orderID, borrowID sql.NullInt64
+		var releasedAt sql.NullTime
+		if err := rows.Scan(&r.RedemptionID, &r.VoucherID, &r.UserID, &orderID, &borrowID, &r.Amount, &r.CreatedAt, &releasedAt); err != nil {
+			return nil, err
+		}
+		if releasedAt.Valid {
+			r.ReleasedAt = &releasedAt.Time
+		}
+		if orderID.Valid {
+			id := int(orderID.Int64)
+			r.OrderID = &id
+		}
+		if borrowID.Valid {
+			id := int(borrowID.Int64)
+			r.BorrowID = &id
+		}
+		redemptions = append(redemptions, r)
+	}
+	return redemptions, nil
+}
+
+// voucherUsesByUser counts the member's redemptions of a voucher that still stand.
+func voucherUsesByUser(q interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}, voucherID, userID int) (int, error) {
+	var count int
+	err := q.QueryRow("SELECT COUNT(*) FROM voucher_redemption WHERE voucher_id = ? AND user_id = ? AND released_at IS NULL", voucherID, userID).Scan(&count)
+	return count, err
+}
+
+// checkVoucher verifies everything about a voucher that does not depend on the basket.
+func checkVoucher(v *Voucher, userID, locationID int, now time.Time) error {
+	switch {
+	case !v.Active:
+		return fmt.Errorf("%w: voucher is not active", ErrVoucherInvalid)
+	case v.ValidFrom != nil && now.Before(*v.ValidFrom):
+		return fmt.Errorf("%w: voucher is not valid yet", ErrVoucherInvalid)
+	case v.ValidUntil != nil && now.After(*v.ValidUntil):
+		return fmt.Errorf("%w: voucher has expired", ErrVoucherInvalid)
+	case v.LocationID != nil && *v.LocationID != locationID:
+		return fmt.Errorf("%w: voucher is not valid at this location", ErrVoucherInvalid)
+	case v.MaxUses > 0 && v.TimesRedeemed >= v.MaxUses:
+		return fmt.Errorf("%w: voucher has been fully redeemed", ErrVoucherInvalid)
+	}
+
+	if userID == 0 && (v.NewMembersOnly || v.MaxUsesPerUser > 0) {
+		return fmt.Errorf("%w: log in to use this voucher", ErrVoucherInvalid)
+	}
+	if v.MaxUsesPerUser > 0 {
+		used, err := voucherUsesByUser(db, v.VoucherID, userID)
+		if err != nil {
+			return err
+		}
+		if used >= v.MaxUsesPerUser {
+			return fmt.Errorf("%w: you have already used this voucher", ErrVoucherInvalid)
+		}
+	}
+	if v.NewMembersOnly {
+		var borrows int
+		if err := db.QueryRow("SELECT COUNT(*) FROM borrow WHERE user_id = ?", userID).Scan(&borrows); err != nil {
+			return err
+		}
+		if borrows > 0 {
+			return fmt.Errorf("%w: voucher is for new members only", ErrVoucherInvalid)
+		}
+	}
+	return nil
+}
+
+// applyVoucher adds the discount line of the requested voucher to a quote holding its rental lines.
+// bookCategories maps the quoted books to their categories for category-restricted vouchers.
+func applyVoucher(quote *Quote, req QuoteRequest, bookCategories map[int]int) error {
+	v, err := GetVoucherByCode(req.VoucherCode)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return fmt.Errorf("%w: unknown voucher code", ErrVoucherInvalid)
+	}
+	if err := checkVoucher(v, req.UserID, req.LocationID, time.Now()); err != nil {
+		return err
+	}
+
+	var eligible float64
+	rentals := map[int]float64{}
+	for _, line := range quote.Lines {
+		if line.Code != PricingRentalFee {
+			continue
+		}
+		if v.CategoryID != nil && bookCategories[*line.BookID] != *v.CategoryID {
+			continue
+		}
+		eligible += line.Amount
+		rentals[*line.BookID] += line.Amount
+	}
+	if eligible == 0 {
+		return fmt.Errorf("%w: no books in this checkout qualify", ErrVoucherInvalid)
+	}
+	if eligible < v.MinSpend {
+		return fmt.Errorf("%w: minimum spend is Rp %.0f", ErrVoucherInvalid, v.MinSpend)
+	}
+
+	discount := v.Value
+	if v.DiscountType == VoucherPercentage {
+		discount = roundRupiah(eligible * v.Value / 100)
+	}
+	discount = math.Min(discount, eligible)
+
+	quote.Lines = append(quote.Lines, QuoteLine{
+		Code:        PricingDiscount,
+		Description: "Voucher " + v.Code,
+		Quantity:    1,
+		UnitPrice:   -discount,
+		Amount:      -discount,
+	})
+	quote.Discount = discount
+	quote.DiscountedRentals = rentals
+	quote.VoucherCode = v.Code
+	quote.VoucherID = v.VoucherID
+	return nil
+}
+
+// redeemVoucherTx records the use of the quote's voucher, re-checking the usage limits
+// under a row lock so concurrent checkouts cannot exceed them.
+func redeemVoucherTx(tx *sql.Tx, quote *Quote, userID, orderID, borrowID int) error {
+	if quote.VoucherID == 0 {
+		return nil
+	}
+
+	var maxUses, maxUsesPerUser int
+	err := tx.QueryRow("SELECT max_uses, max_uses_per_user FROM voucher WHERE voucher_id = ? FOR UPDATE", quote.VoucherID).
+		Scan(&maxUses, &maxUsesPerUser)
+	if err != nil {
+		return err
+	}
+
+	if maxUses > 0 {
+		var used int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM voucher_redemption WHERE voucher_id = ? AND released_at IS NULL", quote.VoucherID).Scan(&used); err != nil {
+			return err
+		}
+		if used >= maxUses {
+			return fmt.Errorf("%w: voucher has been fully redeemed", ErrVoucherInvalid)
+		}
+	}
+	if maxUsesPerUser > 0 {
+		used, err := voucherUsesByUser(tx, quote.VoucherID, userID)
+		if err != nil {
+			return err
+		}
+		if used >= maxUsesPerUser {
+			return fmt.Errorf("%w: you have already used this voucher", ErrVoucherInvalid)
+		}
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO voucher_redemption (voucher_id, user_id, order_id, borrow_id, amount, created_at)
+		VALUES (?, ?, ?, ?, ?, NOW())
+	`, quote.VoucherID, userID, nullableID(orderID), nullableID(borrowID), quote.Discount)
+	return err
+}
+
+// releaseVoucherRedemptionTx gives back the voucher use of a borrow or order that was rejected
+// or cancelled, so it counts against neither the voucher's nor the member's limit.
+func releaseVoucherRedemptionTx(tx *sql.Tx, column string, id int) error {
+	_, err := tx.Exec(fmt.Sprintf("UPDATE voucher_redemption SET released_at = NOW() WHERE %s = ? AND released_at IS NULL", column), id)
+	return err
+}
+
+// ============ VOUCHER HANDLERS ============
+
+// validateVoucher returns an error message for an unusable voucher definition, or an empty string.
+func validateVoucher(v Voucher) string {
+	if strings.TrimSpace(v.Code) == "" {
+		return "Voucher code is required"
+	}
+	if v.DiscountType != VoucherPercentage && v.DiscountType != VoucherFixed {
+		return "Discount type must be percentage or fixed"
+	}
+	if v.Value <= 0 || (v.DiscountType == VoucherPercentage && v.Value > 100) {
+		return "Discount value must be positive and at most 100 percent"
+	}
+	if v.MinSpend < 0 || v.MaxUses < 0 || v.MaxUsesPerUser < 0 {
+		return "Limits cannot be negative"
+	}
+	if v.ValidFrom != nil && v.ValidUntil != nil && v.ValidUntil.Before(*v.ValidFrom) {
+		return "Validity window ends before it starts"
+	}
+	return ""
+}
+
+func getVouchers(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	vouchers, err := GetVouchers()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(vouchers)
+}
+
+func createVoucher(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var v Voucher
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if msg := validateVoucher(v); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	existing, err := GetVoucherByCode(v.Code)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if existing != nil {
+		http.Error(w, "Voucher code already exists", http.StatusConflict)
+		return
+	}
+
+	voucherID, err := CreateVoucher(v)
+	if err != nil {
+		http.Error(w, "Failed to create voucher", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"message":    "Voucher created successfully",
+		"voucher_id": voucherID,
+	})
+}
+
+func updateVoucher(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	voucherID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid voucher ID", http.StatusBadRequest)
+		return
+	}
+
+	var v Voucher
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	v.VoucherID = voucherID
+	if msg := validateVoucher(v); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	found, err := VoucherExists(voucherID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Voucher not found", http.StatusNotFound)
+		return
+	}
+
+	if err := UpdateVoucher(v); err != nil {
+		http.Error(w, "Failed to update voucher", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Voucher updated successfully",
+	})
+}
+
+func deleteVoucher(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	voucherID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid voucher ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := DeleteVoucher(voucherID); err != nil {
+		http.Error(w, "Failed to delete voucher", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Voucher deleted successfully",
+	})
+}
+
+func getVoucherRedemptions(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	voucherID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid voucher ID", http.StatusBadRequest)
+		return
+	}
+
+	redemptions, err := GetVoucherRedemptions(voucherID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(redemptions)
+}
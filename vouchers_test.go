@@ -0,0 +1,174 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckVoucher(t *testing.T) {
+	now := time.Date(2026, 6, 15, 12, 0, 0, 0, time.UTC)
+	yesterday, tomorrow := now.AddDate(0, 0, -1), now.AddDate(0, 0, 1)
+	branch := 2
+
+	tests := []struct {
+		name    string
+		voucher Voucher
+		wantErr bool
+	}{
+		{"usable", Voucher{Active: true, ValidFrom: &yesterday, ValidUntil: &tomorrow}, false},
+		{"inactive", Voucher{Active: false}, true},
+		{"not valid yet", Voucher{Active: true, ValidFrom: &tomorrow}, true},
+		{"expired", Voucher{Active: true, ValidUntil: &yesterday}, true},
+		{"other location", Voucher{Active: true, LocationID: &branch}, true},
+		{"fully redeemed", Voucher{Active: true, MaxUses: 3, TimesRedeemed: 3}, true},
+		{"uses left", Voucher{Active: true, MaxUses: 3, TimesRedeemed: 2}, false},
+	}
+	for _, tt := range tests {
+		err := checkVoucher(&tt.voucher, 5, 1, now)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkVoucher = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if err != nil && !errors.Is(err, ErrVoucherInvalid) {
+			t.Errorf("%s: checkVoucher = %v, want %v", tt.name, err, ErrVoucherInvalid)
+		}
+	}
+}
+
+// redemptionResponder answers redeemVoucherTx's queries for a voucher with the given limits
+// that has been used used times in total and userUses times by the member.
+func redemptionResponder(maxUses, maxUsesPerUser, used, userUses int64) fakeResponder {
+	return func(query string, args []driver.Value) (*fakeRows, error) {
+		switch {
+		case strings.Contains(query, "FROM voucher WHERE voucher_id = ? FOR UPDATE"):
+			return fakeRow(maxUses, maxUsesPerUser), nil
+		case strings.Contains(query, "FROM voucher_redemption WHERE voucher_id = ? AND user_id = ?"):
+			return fakeRow(userUses), nil
+		case strings.Contains(query, "FROM voucher_redemption WHERE voucher_id = ?"):
+			return fakeRow(used), nil
+		}
+		return nil, nil
+	}
+}
+
+func redeem(t *testing.T) error {
+	t.Helper()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	return redeemVoucherTx(tx, &Quote{VoucherID: 4, Discount: 5000}, 5, 0, 9)
+}
+
+func TestRedeemVoucherLimits(t *testing.T) {
+	tests := []struct {
+		name                                   string
+		maxUses, maxUsesPerUser, used, perUser int64
+		wantErr                                bool
+	}{
+		{"unlimited", 0, 0, 40, 3, false},
+		{"under the total limit", 10, 0, 9, 0, false},
+		{"total limit reached", 10, 0, 10, 0, true},
+		{"under the member limit", 0, 2, 5, 1, false},
+		{"member limit reached", 0, 1, 5, 1, true},
+	}
+	for _, tt := range tests {
+		fake := useFakeDB(t, redemptionResponder(tt.maxUses, tt.maxUsesPerUser, tt.used, tt.perUser))
+		err := redeem(t)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: redeemVoucherTx = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if err != nil && !errors.Is(err, ErrVoucherInvalid) {
+			t.Errorf("%s: redeemVoucherTx = %v, want %v", tt.name, err, ErrVoucherInvalid)
+		}
+		if inserted := len(fake.Find("INSERT INTO voucher_redemption")) > 0; inserted == tt.wantErr {
+			t.Errorf("%s: redemption inserted = %v", tt.name, inserted)
+		}
+	}
+}
+
+func TestRedeemVoucherIgnoresReleasedUses(t *testing.T) {
+	fake := useFakeDB(t, redemptionResponder(1, 1, 0, 0))
+	if err := redeem(t); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range fake.Find("SELECT COUNT(*) FROM voucher_redemption") {
+		if !strings.Contains(s.Query, "released_at IS NULL") {
+			t.Errorf("usage count includes released redemptions: %s", s.Query)
+		}
+	}
+}
+
+func TestReleaseVoucherRedemption(t *testing.T) {
+	fake := useFakeDB(t, nil)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := releaseVoucherRedemptionTx(tx, "borrow_id", 9); err != nil {
+		t.Fatal(err)
+	}
+	released := fake.Find("UPDATE voucher_redemption SET released_at = NOW() WHERE borrow_id = ?")
+	if len(released) != 1 || released[0].Args[0] != int64(9) {
+		t.Errorf("release statements = %v", released)
+	}
+}
+
+// orderResponder answers syncOrderStatusTx for order 4, currently requested, whose borrows
+// are in the given statuses.
+func orderResponder(statuses ...string) fakeResponder {
+	return func(query string, args []driver.Value) (*fakeRows, error) {
+		switch {
+		case strings.Contains(query, "SELECT order_id FROM borrow WHERE borrow_id"):
+			return fakeRow(int64(4)), nil
+		case strings.Contains(query, "SELECT status FROM borrow_order"):
+			return fakeRow(BorrowStatusRequested), nil
+		case strings.Contains(query, "SELECT status FROM borrow WHERE order_id"):
+			rows := &fakeRows{columns: []string{"status"}}
+			for _, status := range statuses {
+				rows.values = append(rows.values, []driver.Value{status})
+			}
+			return rows, nil
+		}
+		return nil, nil
+	}
+}
+
+func syncOrder(t *testing.T) {
+	t.Helper()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := syncOrderStatusTx(tx, 9, 1, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCancelledOrderReleasesItsVoucher(t *testing.T) {
+	fake := useFakeDB(t, orderResponder(BorrowStatusCancelled, BorrowStatusCancelled))
+	syncOrder(t)
+	released := fake.Find("UPDATE voucher_redemption SET released_at = NOW() WHERE order_id = ?")
+	if len(released) != 1 || released[0].Args[0] != int64(4) {
+		t.Errorf("release statements = %v, want one for order 4", released)
+	}
+
+	fake = useFakeDB(t, orderResponder(BorrowStatusRejected, BorrowStatusCancelled))
+	syncOrder(t)
+	if len(fake.Find("UPDATE voucher_redemption")) != 1 {
+		t.Error("an order that ended rejected and cancelled kept its voucher")
+	}
+}
+
+func TestPartlyCancelledOrderKeepsItsVoucher(t *testing.T) {
+	fake := useFakeDB(t, orderResponder(BorrowStatusCancelled, BorrowStatusApproved))
+	syncOrder(t)
+	if len(fake.Find("UPDATE voucher_redemption")) != 0 {
+		t.Error("an order with a borrow still going released its voucher")
+	}
+}
@@ -0,0 +1,744 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ============ OUTGOING WEBHOOKS ============
+
+// Events are queued in webhook_delivery inside the transaction that causes them, one row per
+// subscribed endpoint, and sent by the scheduler. Each request is signed with the endpoint's
+// secret; failures are retried with exponential backoff until they land in the dead-letter
+// list, from where an admin can replay them.
+const (
+	WebhookBookUploaded      = "book.uploaded"
+	WebhookBookStatusChanged = "book.status_changed"
+	WebhookBorrowCreated     = "borrow.created"
+	WebhookBorrowReturned    = "borrow.returned"
+	WebhookReviewCreated     = "review.created"
+)
+
+// webhookEvents lists every event an endpoint can subscribe to.
+var webhookEvents = []string{
+	WebhookBookUploaded,
+	WebhookBookStatusChanged,
+	WebhookBorrowCreated,
+	WebhookBorrowReturned,
+	WebhookReviewCreated,
+}
+
+const (
+	WebhookPending   = "pending"
+	WebhookDelivered = "delivered"
+	// WebhookDead marks deliveries that ran out of attempts; they stay until replayed.
+	WebhookDead = "dead"
+)
+
+const (
+	maxWebhookAttempts = 8
+	webhookBaseBackoff = 30 * time.Second
+	webhookMaxBackoff  = 6 * time.Hour
+	webhookBatch       = 100
+	webhookTimeout     = 10 * time.Second
+	// webhookResponseLimit is how much of a failed response body is kept for debugging.
+	webhookResponseLimit = 512
+)
+
+var (
+	ErrWebhookNotFound         = errors.New("webhook not found")
+	ErrWebhookDeliveryNotFound = errors.New("webhook delivery not found")
+	ErrInvalidWebhook          = errors.New("invalid webhook")
+	ErrDeliveryPending         = errors.New("delivery is still pending")
+)
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+type WebhookEndpoint struct {
+	EndpointID  int        `json:"endpoint_id"`
+	URL         string     `json:"url"`
+	Description string     `json:"description"`
+	Events      []string   `json:"events"`
+	Active      bool       `json:"active"`
+	Secret      string     `json:"secret,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   *time.Time `json:"updated_at"`
+}
+
+type WebhookDelivery struct {
+	DeliveryID     int             `json:"delivery_id"`
+	EndpointID     int             `json:"endpoint_id"`
+	EventID        string          `json:"event_id"`
+	EventType      string          `json:"event_type"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at"`
+	LastStatusCode *int            `json:"last_status_code"`
+	LastError      string          `json:"last_error,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at"`
+}
+
+func knownWebhookEvent(event string) bool {
+	for _, e := range webhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// signWebhook returns the signature header for a payload sent at the given time. Receivers
+// recompute the hex HMAC-SHA256 of "<t>.<body>" with their secret and compare it to v1.
+func signWebhook(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(payload)
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// queueWebhookEvent records an event for every active endpoint subscribed to it.
+func queueWebhookEvent(ex execer, eventType string, data interface{}) error {
+	rows, err := ex.Query("SELECT endpoint_id, events FROM webhook_endpoint WHERE active = TRUE")
+	if err != nil {
+		return err
+	}
+	var endpointIDs []int
+	for rows.Next() {
+		var id int
+		var events string
+		if err := rows.Scan(&id, &events); err != nil {
+			rows.Close()
+			return err
+		}
+		for _, e := range strings.Split(events, ",") {
+			if e == eventType {
+				endpointIDs = append(endpointIDs, id)
+				break
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(endpointIDs) == 0 {
+		return nil
+	}
+
+	suffix, err := randomHex(12)
+	if err != nil {
+		return err
+	}
+	eventID := "evt_" + suffix
+	payload, err := json.Marshal(map[string]interface{}{
+		"id":         eventID,
+		"type":       eventType,
+		"created_at": time.Now().UTC().Format(time.RFC3339),
+		"data":       data,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, endpointID := range endpointIDs {
+		_, err := ex.Exec(`
+			INSERT INTO webhook_delivery (endpoint_id, event_id, event_type, payload, status, attempts, next_attempt_at, created_at)
+			VALUES (?, ?, ?, ?, ?, 0, NOW(), NOW())
+		`, endpointID, eventID, eventType, string(payload), WebhookPending)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queueBorrowWebhookTx sends a borrow event with the borrow's current details.
+func queueBorrowWebhookTx(tx *sql.Tx, borrowID int, eventType string) error {
+	var userID, bookID, locationID int
+	var status, deliveryType string
+	err := tx.QueryRow(`
+		SELECT user_id, book_id, COALESCE(location_id, 0), status, COALESCE(delivery_type, '')
+		FROM borrow WHERE borrow_id = ?
+	`, borrowID).Scan(&userID, &bookID, &locationID, &status, &deliveryType)
+	if err != nil {
+		return err
+	}
+	return queueWebhookEvent(tx, eventType, map[string]interface{}{
+		"borrow_id":     borrowID,
+		"user_id":       userID,
+		"book_id":       bookID,
+		"location_id":   locationID,
+		"status":        status,
+		"delivery_type": deliveryType,
+	})
+}
+
+// queueWebhookEventLogged queues an event outside a transaction; a failure only loses the
+// webhook, so it is logged rather than failing the request that caused it.
+func queueWebhookEventLogged(eventType string, data interface{}) {
+	if err := queueWebhookEvent(db, eventType, data); err != nil {
+		log.Printf("Error queueing %s webhook: %v", eventType, err)
+	}
+}
+
+// DeliverWebhooks sends the deliveries that are due and schedules retries for failures.
+func DeliverWebhooks() (int, error) {
+	rows, err := db.Query(`
+		SELECT d.delivery_id, d.event_id, d.event_type, d.payload, d.attempts, e.url, e.secret
+		FROM webhook_delivery d JOIN webhook_endpoint e ON e.endpoint_id = d.endpoint_id
+		WHERE d.status = ? AND d.next_attempt_at <= NOW() AND e.active = TRUE
+		ORDER BY d.next_attempt_at LIMIT ?
+	`, WebhookPending, webhookBatch)
+	if err != nil {
+		return 0, err
+	}
+
+	type dueDelivery struct {
+		id        int
+		eventID   string
+		eventType string
+		payload   []byte
+		attempts  int
+		url       string
+		secret    string
+	}
+	var due []dueDelivery
+	for rows.Next() {
+		var d dueDelivery
+		if err := rows.Scan(&d.id, &d.eventID, &d.eventType, &d.payload, &d.attempts, &d.url, &d.secret); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	for _, d := range due {
+		statusCode, sendErr := sendWebhook(d.url, d.secret, d.id, d.eventID, d.eventType, d.payload)
+		attempts := d.attempts + 1
+
+		if sendErr == nil {
+			_, err := db.Exec(`
+				UPDATE webhook_delivery SET status = ?, attempts = ?, last_status_code = ?, last_error = NULL, delivered_at = NOW()
+				WHERE delivery_id = ?
+			`, WebhookDelivered, attempts, statusCode, d.id)
+			if err != nil {
+				return delivered, err
+			}
+			delivered++
+			continue
+		}
+
+		status := WebhookPending
+		if attempts >= maxWebhookAttempts {
+			status = WebhookDead
+		}
+		_, err := db.Exec(`
+			UPDATE webhook_delivery SET status = ?, attempts = ?, last_status_code = ?, last_error = ?,
+			       next_attempt_at = DATE_ADD(NOW(), INTERVAL ? SECOND)
+			WHERE delivery_id = ?
+		`, status, attempts, nullableID(statusCode), sendErr.Error(),
+			int(retryBackoff(attempts, webhookBaseBackoff, webhookMaxBackoff).Seconds()), d.id)
+		if err != nil {
+			return delivered, err
+		}
+	}
+	return delivered, nil
+}
+
+// sendWebhook posts one signed delivery; any non-2xx response counts as a failure.
+func sendWebhook(endpointURL, secret string, deliveryID int, eventID, eventType string, payload []byte) (int, error) {
+	req, err := http.NewRequest("POST", endpointURL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "LibMatch-Webhooks/1.0")
+	req.Header.Set("X-LibMatch-Event", eventType)
+	req.Header.Set("X-LibMatch-Event-ID", eventID)
+	req.Header.Set("X-LibMatch-Delivery", strconv.Itoa(deliveryID))
+	req.Header.Set("X-LibMatch-Signature", signWebhook(secret, time.Now().Unix(), payload))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, webhookResponseLimit))
+		return resp.StatusCode, fmt.Errorf("endpoint returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp.StatusCode, nil
+}
+
+// ============ WEBHOOK ENDPOINTS ============
+
+const webhookEndpointColumns = `endpoint_id, url, COALESCE(description, ''), events, active, created_at, updated_at`
+
+func scanWebhookEndpoint(scanner interface{ Scan(...interface{}) error }) (*WebhookEndpoint, error) {
+	var e WebhookEndpoint
+	var events string
+	var updatedAt sql.NullTime
+	if err := scanner.Scan(&e.EndpointID, &e.URL, &e.Description, &events, &e.Active, &e.CreatedAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	e.Events = strings.Split(events, ",")
+	if updatedAt.Valid {
+		e.UpdatedAt = &updatedAt.Time
+	}
+	return &e, nil
+}
+
+func GetWebhookEndpoints() ([]WebhookEndpoint, error) {
+	rows, err := db.Query("SELECT " + webhookEndpointColumns + " FROM webhook_endpoint ORDER BY endpoint_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	endpoints := []WebhookEndpoint{}
+	for rows.Next() {
+		e, err := scanWebhookEndpoint(rows)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, *e)
+	}
+	return endpoints, rows.Err()
+}
+
+func GetWebhookEndpoint(endpointID int) (*WebhookEndpoint, error) {
+	e, err := scanWebhookEndpoint(db.QueryRow("SELECT "+webhookEndpointColumns+" FROM webhook_endpoint WHERE endpoint_id = ?", endpointID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return e, err
+}
+
+func validateWebhook(endpointURL string, events []string) error {
+	u, err := url.Parse(endpointURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: url must be an http or https URL", ErrInvalidWebhook)
+	}
+	if len(events) == 0 {
+		return fmt.Errorf("%w: subscribe to at least one event", ErrInvalidWebhook)
+	}
+	for _, event := range events {
+		if !knownWebhookEvent(event) {
+			return fmt.Errorf("%w: unknown event %s", ErrInvalidWebhook, event)
+		}
+	}
+	return nil
+}
+
+// CreateWebhookEndpoint registers an endpoint and returns it with its signing secret, which
+// is only ever shown here.
+func CreateWebhookEndpoint(endpointURL, description string, events []string, createdBy int) (*WebhookEndpoint, error) {
+	if err := validateWebhook(endpointURL, events); err != nil {
+		return nil, err
+	}
+	suffix, err := randomHex(24)
+	if err != nil {
+		return nil, err
+	}
+	secret := "whsec_" + suffix
+
+	result, err := db.Exec(`
+		INSERT INTO webhook_endpoint (url, description, events, secret, active, created_by, created_at)
+		VALUES (?, ?, ?, ?, TRUE, ?, NOW())
+	`, endpointURL, description, strings.Join(events, ","), secret, nullableID(createdBy))
+	if err != nil {
+		return nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint, err := GetWebhookEndpoint(int(id))
+	if err != nil {
+		return nil, err
+	}
+	endpoint.Secret = secret
+	return endpoint, nil
+}
+
+func UpdateWebhookEndpoint(endpointID int, endpointURL, description string, events []string, active bool) error {
+	if err := validateWebhook(endpointURL, events); err != nil {
+		return err
+	}
+	result, err := db.Exec(`
+		UPDATE webhook_endpoint SET url = ?, description = ?, events = ?, active = ?, updated_at = NOW()
+		WHERE endpoint_id = ?
+	`, endpointURL, description, strings.Join(events, ","), active, endpointID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		if e, err := GetWebhookEndpoint(endpointID); err != nil {
+			return err
+		} else if e == nil {
+			return ErrWebhookNotFound
+		}
+	}
+	return nil
+}
+
+// DeleteWebhookEndpoint removes an endpoint together with its delivery history.
+func DeleteWebhookEndpoint(endpointID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM webhook_endpoint WHERE endpoint_id = ?", endpointID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrWebhookNotFound
+	}
+	if _, err := tx.Exec("DELETE FROM webhook_delivery WHERE endpoint_id = ?", endpointID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ============ WEBHOOK DELIVERIES ============
+
+const webhookDeliveryColumns = `delivery_id, endpoint_id, event_id, event_type, payload, status, attempts,
+	next_attempt_at, last_status_code, COALESCE(last_error, ''), created_at, delivered_at`
+
+func scanWebhookDelivery(scanner interface{ Scan(...interface{}) error }) (*WebhookDelivery, error) {
+	var d WebhookDelivery
+	var payload string
+	var nextAttemptAt, deliveredAt sql.NullTime
+	var statusCode sql.NullInt64
+	err := scanner.Scan(&d.DeliveryID, &d.EndpointID, &d.EventID, &d.EventType, &payload, &d.Status, &d.Attempts,
+		&nextAttemptAt, &statusCode, &d.LastError, &d.CreatedAt, &deliveredAt)
+	if err != nil {
+		return nil, err
+	}
+	d.Payload = json.RawMessage(payload)
+	if nextAttemptAt.Valid && d.Status == WebhookPending {
+		d.NextAttemptAt = &nextAttemptAt.Time
+	}
+	if statusCode.Valid {
+		code := int(statusCode.Int64)
+		d.LastStatusCode = &code
+	}
+	if deliveredAt.Valid {
+		d.DeliveredAt = &deliveredAt.Time
+	}
+	return &d, nil
+}
+
+// GetWebhookDeliveries lists deliveries newest first, optionally for one endpoint or status.
+func GetWebhookDeliveries(endpointID int, status string, limit int) ([]WebhookDelivery, error) {
+	query := "SELECT " + webhookDeliveryColumns + " FROM webhook_delivery WHERE 1 = 1"
+	var args []interface{}
+	if endpointID != 0 {
+		query += " AND endpoint_id = ?"
+		args = append(args, endpointID)
+	}
+	if status != "" {
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY delivery_id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, *d)
+	}
+	return deliveries, rows.Err()
+}
+
+// ReplayWebhookDelivery queues a dead or delivered delivery to be sent again with fresh attempts.
+func ReplayWebhookDelivery(deliveryID int) error {
+	var status string
+	err := db.QueryRow("SELECT status FROM webhook_delivery WHERE delivery_id = ?", deliveryID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return ErrWebhookDeliveryNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if status == WebhookPending {
+		return ErrDeliveryPending
+	}
+
+	_, err = db.Exec(`
+		UPDATE webhook_delivery SET status = ?, attempts = 0, next_attempt_at = NOW(), delivered_at = NULL
+		WHERE delivery_id = ?
+	`, WebhookPending, deliveryID)
+	return err
+}
+
+// ReplayDeadWebhooks queues every dead delivery of an endpoint again and returns how many.
+func ReplayDeadWebhooks(endpointID int) (int, error) {
+	result, err := db.Exec(`
+		UPDATE webhook_delivery SET status = ?, attempts = 0, next_attempt_at = NOW()
+		WHERE endpoint_id = ? AND status = ?
+	`, WebhookPending, endpointID, WebhookDead)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// ============ WEBHOOK HANDLERS ============
+
+// webhookPageSize caps how many deliveries one request returns.
+const webhookPageSize = 100
+
+func writeWebhookError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, ErrWebhookNotFound), errors.Is(err, ErrWebhookDeliveryNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrInvalidWebhook):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrDeliveryPending):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, fallback, http.StatusInternalServerError)
+	}
+}
+
+type webhookRequest struct {
+	URL         string   `json:"url"`
+	Description string   `json:"description"`
+	Events      []string `json:"events"`
+	Active      *bool    `json:"active"`
+}
+
+func getWebhooks(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	endpoints, err := GetWebhookEndpoints()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"endpoints": endpoints,
+		"events":    webhookEvents,
+	})
+}
+
+func createWebhook(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var req webhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	endpoint, err := CreateWebhookEndpoint(req.URL, req.Description, req.Events, actingUserID(r))
+	if err != nil {
+		writeWebhookError(w, err, "Failed to create webhook")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(endpoint)
+}
+
+func updateWebhook(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	endpointID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+
+	var req webhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	active := true
+	if req.Active != nil {
+		active = *req.Active
+	}
+
+	if err := UpdateWebhookEndpoint(endpointID, req.URL, req.Description, req.Events, active); err != nil {
+		writeWebhookError(w, err, "Failed to update webhook")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Webhook updated",
+	})
+}
+
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	endpointID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := DeleteWebhookEndpoint(endpointID); err != nil {
+		writeWebhookError(w, err, "Failed to delete webhook")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Webhook deleted",
+	})
+}
+
+// getWebhookDeliveries lists the deliveries of one endpoint, filtered by ?status=.
+func getWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	endpointID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+
+	deliveries, err := GetWebhookDeliveries(endpointID, r.URL.Query().Get("status"), webhookPageSize)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// getDeadWebhooks is the dead-letter list across all endpoints.
+func getDeadWebhooks(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	deliveries, err := GetWebhookDeliveries(0, WebhookDead, webhookPageSize)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+func replayWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	deliveryID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid delivery ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := ReplayWebhookDelivery(deliveryID); err != nil {
+		writeWebhookError(w, err, "Failed to replay delivery")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Delivery queued for replay",
+	})
+}
+
+// replayDeadWebhooks requeues every dead delivery of an endpoint, e.g. after it was fixed.
+func replayDeadWebhooks(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	endpointID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+
+	endpoint, err := GetWebhookEndpoint(endpointID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if endpoint == nil {
+		writeWebhookError(w, ErrWebhookNotFound, "")
+		return
+	}
+
+	replayed, err := ReplayDeadWebhooks(endpointID)
+	if err != nil {
+		http.Error(w, "Failed to replay deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"message":  fmt.Sprintf("%d deliveries queued for replay", replayed),
+		"replayed": replayed,
+	})
+}
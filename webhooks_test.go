@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestSignWebhook(t *testing.T) {
+	payload := []byte(`{"event":"borrow.approved"}`)
+	got := signWebhook("s3cret", 1700000000, payload)
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte("1700000000." + string(payload)))
+	want := "t=1700000000,v1=" + hex.EncodeToString(mac.Sum(nil))
+	if got != want {
+		t.Errorf("signWebhook = %q, want %q", got, want)
+	}
+}
+
+func TestSignWebhookDependsOnInputs(t *testing.T) {
+	payload := []byte(`{"event":"borrow.approved"}`)
+	base := signWebhook("s3cret", 1700000000, payload)
+	if !strings.HasPrefix(base, "t=1700000000,v1=") {
+		t.Errorf("signature header = %q", base)
+	}
+	for name, other := range map[string]string{
+		"secret":    signWebhook("other", 1700000000, payload),
+		"timestamp": signWebhook("s3cret", 1700000001, payload),
+		"payload":   signWebhook("s3cret", 1700000000, []byte(`{"event":"borrow.rejected"}`)),
+	} {
+		if other[strings.Index(other, "v1="):] == base[strings.Index(base, "v1="):] {
+			t.Errorf("changing the %s did not change the signature", name)
+		}
+	}
+}